@@ -194,6 +194,15 @@ type CommandLineArguments struct {
 	ShipToPostalCode            string `arg:"shipToPostalCode"`
 	DestinationCountryCode      string `arg:"destinationCountryCode"`
 	OrderDate                   string `arg:"orderDate"`
+	ExportFormat                string `arg:"exportFormat"`
+	Columns                     string `arg:"columns"`
+	Period                      string `arg:"period"`
+	Statements                  bool   `arg:"statements"`
+	Disbursements               bool   `arg:"disbursements"`
+	Profiles                    string `arg:"profiles"`
+	Concurrency                 int    `arg:"concurrency"`
+	Rates                       string `arg:"rates"`
+	Confirmations               int    `arg:"confirmations"`
 }
 
 var defaultSettings = &ConfigSettings{
@@ -0,0 +1,64 @@
+package blockchyp
+
+import (
+	"sync"
+)
+
+// clientState holds per-client settings for features that aren't part of
+// the generated Client struct. It's keyed by the client's address, so
+// settings made through one *Client don't follow copies of the struct.
+type clientState struct {
+	refresher     *RouteRefresher
+	ledger        *Ledger
+	signatureSink SignatureSink
+}
+
+func (s clientState) empty() bool {
+	return s.refresher == nil && s.ledger == nil && s.signatureSink == nil
+}
+
+var (
+	clientStates     = make(map[*Client]clientState)
+	clientStatesLock sync.RWMutex
+)
+
+// Close stops any background workers started by the client and forgets
+// its ledger and signature sink. The ledger itself is left open.
+func (client *Client) Close() error {
+	previous := client.updateState(func(s *clientState) {
+		*s = clientState{}
+	})
+	if previous.refresher != nil {
+		return previous.refresher.Close()
+	}
+
+	return nil
+}
+
+// state returns the client's settings.
+func (client *Client) state() clientState {
+	clientStatesLock.RLock()
+	defer clientStatesLock.RUnlock()
+
+	return clientStates[client]
+}
+
+// updateState changes the client's settings under the lock and returns the
+// settings it replaced. A client left with no settings is forgotten, so the
+// table doesn't keep it alive.
+func (client *Client) updateState(update func(s *clientState)) clientState {
+	clientStatesLock.Lock()
+	defer clientStatesLock.Unlock()
+
+	previous := clientStates[client]
+	s := previous
+	update(&s)
+
+	if s.empty() {
+		delete(clientStates, client)
+	} else {
+		clientStates[client] = s
+	}
+
+	return previous
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -18,6 +19,15 @@ import (
 	"github.com/sirupsen/logrus"
 
 	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cryptopay"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/dedupe"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/export"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/flow"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/migrate"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/settlement"
 )
 
 var validSignatureFormats = []string{
@@ -25,6 +35,7 @@ var validSignatureFormats = []string{
 	"jpeg",
 	"jpg",
 	"png",
+	"svg",
 }
 
 /*
@@ -227,6 +238,15 @@ func parseArgs() blockchyp.CommandLineArguments {
 	flag.StringVar(&args.ShipToPostalCode, "shipToPostalCode", "", "postal code for shipping destination")
 	flag.StringVar(&args.DestinationCountryCode, "destinationCountryCode", "", "three character country code for shipping destination")
 	flag.StringVar(&args.OrderDate, "orderDate", "", "order date (format: YYYY-MM-DD)")
+	flag.StringVar(&args.ExportFormat, "exportFormat", "csv", "file format for exports and reports (csv, jsonl, parquet, html)")
+	flag.StringVar(&args.Columns, "columns", "", "comma separated export columns, as field or name=field")
+	flag.StringVar(&args.Period, "period", "daily", "reporting period for settlement reports (daily, monthly)")
+	flag.BoolVar(&args.Statements, "statements", false, "ties settlement reports to merchant statement deposits")
+	flag.BoolVar(&args.Disbursements, "disbursements", false, "adds partner statement disbursements to settlement reports")
+	flag.StringVar(&args.Profiles, "profiles", "", "comma separated profiles in blockchyp.json to combine into one settlement report")
+	flag.IntVar(&args.Concurrency, "concurrency", migrate.DefaultConcurrency, "number of token migration enrollments to run at once")
+	flag.StringVar(&args.Rates, "rates", "", "CSV file of exchange rates used to add alternate prices to a charge")
+	flag.IntVar(&args.Confirmations, "confirmations", 0, "network confirmations a crypto payment needs, overriding the default for its currency")
 
 	flag.Parse()
 
@@ -315,6 +335,31 @@ func resolveClient(args blockchyp.CommandLineArguments) (*blockchyp.Client, erro
 	return &client, nil
 }
 
+// vectorSignatureArgs handles svg signatures, which terminals can't
+// produce. The terminal is asked for a png instead, which the client's
+// signature sink traces and writes to the requested file.
+func vectorSignatureArgs(client *blockchyp.Client, args blockchyp.CommandLineArguments) blockchyp.CommandLineArguments {
+	if !strings.EqualFold(args.SigFormat, blockchyp.SignatureFormatSVG) && !strings.EqualFold(filepath.Ext(args.SigFile), ".svg") {
+		return args
+	}
+	if args.SigFile == "" {
+		fatalErrorf("-%s is required for svg signatures", "sigFile")
+	}
+
+	path := args.SigFile
+	client.SetSignatureSink(blockchyp.ConvertingSignatureSink{
+		Format: blockchyp.SignatureFormatSVG,
+		Sink: blockchyp.SignatureSinkFunc(func(sig blockchyp.Signature) error {
+			return ioutil.WriteFile(path, sig.Data, 0600)
+		}),
+	})
+
+	args.SigFile = ""
+	args.SigFormat = blockchyp.SignatureFormatPNG
+
+	return args
+}
+
 func processCommand(args blockchyp.CommandLineArguments) {
 
 	client, err := resolveClient(args)
@@ -323,6 +368,8 @@ func processCommand(args blockchyp.CommandLineArguments) {
 		handleFatalError(err)
 	}
 
+	args = vectorSignatureArgs(client, args)
+
 	cmd := args.Command
 
 	if cmd == "" {
@@ -472,6 +519,8 @@ func processCommand(args blockchyp.CommandLineArguments) {
 		updateCustomer(client, args)
 	case "tx-status":
 		processTransactionStatus(client, args)
+	case "watch-crypto":
+		processWatchCrypto(client, args)
 	case "cash-discount":
 		processCashDiscount(client, args)
 	case "batch-history":
@@ -480,6 +529,20 @@ func processCommand(args blockchyp.CommandLineArguments) {
 		processBatchDetails(client, args)
 	case "tx-history":
 		processTransactionHistory(client, args)
+	case "tx-export":
+		processTransactionExport(client, args)
+	case "settlement-report":
+		processSettlementReport(client, args)
+	case "migrate-tokens":
+		processMigrateTokens(client, args)
+	case "encrypt-migration":
+		processEncryptMigration(args)
+	case "find-duplicate-customers":
+		processFindDuplicateCustomers(client, args)
+	case "merge-customers":
+		processMergeCustomers(client, args)
+	case "run-flow":
+		processRunFlow(client, args)
 	case "merchant-profile":
 		processMerchantProfile(client, args)
 	case "update-merchant":
@@ -931,6 +994,300 @@ func processBatchDetails(client *blockchyp.Client, args blockchyp.CommandLineArg
 
 }
 
+func processTransactionExport(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	columns, err := export.ParseColumns(args.Columns)
+	if err != nil {
+		handleFatalError(err)
+	}
+
+	opts := export.Options{
+		Format:  export.Format(args.ExportFormat),
+		Columns: columns,
+		Filter: blockchyp.TransactionHistoryRequest{
+			MaxResults:   args.MaxResults,
+			BatchID:      args.BatchID,
+			TerminalName: args.TerminalName,
+			Test:         args.Test,
+			Query:        args.Query,
+		},
+		Prefetch: true,
+	}
+
+	if args.StartDate != "" {
+		parsedDate, err := parseTimestamp(args.StartDate)
+		if err != nil {
+			handleFatalError(err)
+		}
+		opts.Filter.StartDate = parsedDate
+	}
+	if args.EndDate != "" {
+		parsedDate, err := parseTimestamp(args.EndDate)
+		if err != nil {
+			handleFatalError(err)
+		}
+		opts.Filter.EndDate = parsedDate
+	}
+
+	// Without an output file the export streams to stdout and can't be
+	// resumed. Errors go to stderr so they don't corrupt the output.
+	if args.OutputFile == "" {
+		if _, err := export.Write(context.Background(), client, os.Stdout, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			handleFatal()
+		}
+		return
+	}
+
+	res, err := export.WriteFile(context.Background(), client, args.OutputFile, opts)
+	if err != nil {
+		fmt.Printf("export interrupted after %d rows, rerun to resume: %v\n", res.Rows, err)
+		handleFatal()
+	}
+
+	content, err := json.Marshal(res)
+	if err != nil {
+		handleFatalError(err)
+	}
+	fmt.Println(string(content))
+
+}
+
+func processSettlementReport(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	opts := settlement.Options{
+		Period:        settlement.Period(args.Period),
+		Test:          args.Test,
+		Statements:    args.Statements,
+		Disbursements: args.Disbursements,
+	}
+
+	if args.StartDate != "" {
+		parsedDate, err := parseTimestamp(args.StartDate)
+		if err != nil {
+			handleError(&args, err)
+		}
+		opts.StartDate = parsedDate
+	}
+	if args.EndDate != "" {
+		parsedDate, err := parseTimestamp(args.EndDate)
+		if err != nil {
+			handleError(&args, err)
+		}
+		opts.EndDate = parsedDate
+	}
+
+	// Each profile holds one merchant's credentials, so a report covering
+	// several merchants is built per profile and combined.
+	clients := []*blockchyp.Client{client}
+	if args.Profiles != "" {
+		clients = nil
+		for _, profile := range strings.Split(args.Profiles, ",") {
+			profileArgs := args
+			profileArgs.Profile = strings.TrimSpace(profile)
+			loadConfig(profileArgs)
+
+			c, err := resolveClient(profileArgs)
+			if err != nil {
+				handleFatalError(err)
+			}
+			clients = append(clients, c)
+		}
+	}
+
+	reports := make([]*settlement.Report, 0, len(clients))
+	for _, c := range clients {
+		r, err := settlement.Build(context.Background(), c, opts)
+		if err != nil {
+			handleError(&args, err)
+		}
+		reports = append(reports, r)
+	}
+
+	report := settlement.Combine(reports...)
+
+	out := os.Stdout
+	if args.OutputFile != "" {
+		f, err := os.Create(args.OutputFile)
+		if err != nil {
+			handleFatalError(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var err error
+	switch args.ExportFormat {
+	case "csv":
+		err = report.WriteCSV(out)
+	case "html":
+		err = report.WriteHTML(out)
+	default:
+		fatalErrorf("unsupported report format: %s", args.ExportFormat)
+	}
+	if err != nil {
+		handleFatalError(err)
+	}
+
+}
+
+func processMigrateTokens(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	if args.LogRequests {
+		fatalError("-logRequests would log card numbers and can't be used with migrate-tokens")
+	}
+	if args.File == "" || args.OutputFile == "" {
+		fatalError("-file and -out are required")
+	}
+
+	key, err := migrate.ParseKey(os.Getenv(migrate.KeyEnv))
+	if err != nil {
+		fatalErrorf("%s: %v", migrate.KeyEnv, err)
+	}
+
+	f, err := os.Open(args.File)
+	if err != nil {
+		handleFatalError(err)
+	}
+	plaintext, err := migrate.Decrypt(f, key)
+	f.Close()
+	if err != nil {
+		handleFatalError(err)
+	}
+
+	cards, err := migrate.ReadCards(plaintext)
+	if err != nil {
+		handleFatalError(err)
+	}
+
+	res, err := migrate.Run(context.Background(), client, cards, args.OutputFile, migrate.Options{
+		Test:        args.Test,
+		Concurrency: args.Concurrency,
+		Progress: func(r migrate.Result) {
+			fmt.Fprintf(os.Stderr, "\r%d enrolled, %d failed, %d of %d remaining", r.Enrolled, r.Failed, r.Total-r.Skipped-r.Enrolled-r.Failed, r.Total)
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Printf("migration interrupted, rerun to resume: %v\n", err)
+		handleFatal()
+	}
+
+	content, err := json.Marshal(res)
+	if err != nil {
+		handleFatalError(err)
+	}
+	fmt.Println(string(content))
+
+}
+
+func processEncryptMigration(args blockchyp.CommandLineArguments) {
+
+	if args.File == "" || args.OutputFile == "" {
+		fatalError("-file and -out are required")
+	}
+
+	key, err := migrate.ParseKey(os.Getenv(migrate.KeyEnv))
+	if err != nil {
+		fatalErrorf("%s: %v", migrate.KeyEnv, err)
+	}
+
+	plaintext, err := ioutil.ReadFile(args.File)
+	if err != nil {
+		handleFatalError(err)
+	}
+	if _, err := migrate.ReadCards(plaintext); err != nil {
+		handleFatalError(err)
+	}
+
+	f, err := os.OpenFile(args.OutputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		handleFatalError(err)
+	}
+	if err := migrate.Encrypt(f, plaintext, key); err != nil {
+		f.Close()
+		handleFatalError(err)
+	}
+	if err := f.Close(); err != nil {
+		handleFatalError(err)
+	}
+
+}
+
+func processFindDuplicateCustomers(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	validateRequired(args.Query, "query")
+	if args.OutputFile == "" {
+		fatalError("-out is required")
+	}
+
+	queries := make([]string, 0)
+	for _, q := range strings.Split(args.Query, ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			queries = append(queries, q)
+		}
+	}
+
+	customers, err := dedupe.Collect(context.Background(), client, args.Test, queries)
+	if err != nil {
+		handleError(&args, err)
+	}
+
+	plan := dedupe.Find(customers, dedupe.Options{Test: args.Test})
+	if err := dedupe.WritePlanFile(args.OutputFile, plan); err != nil {
+		handleFatalError(err)
+	}
+
+	if err := plan.WriteText(os.Stdout); err != nil {
+		handleFatalError(err)
+	}
+
+}
+
+func processRunFlow(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	validateRequired(args.File, "file")
+	validateRequired(args.TerminalName, "terminal")
+
+	script, err := flow.LoadScript(args.File)
+	if err != nil {
+		handleFatalError(err)
+	}
+
+	res, err := flow.Run(context.Background(), client, script, flow.Options{
+		TerminalName: args.TerminalName,
+		Test:         args.Test,
+	})
+
+	// The transcript records how far a failed run got.
+	dumpResponse(&args, res)
+	if err != nil {
+		handleFatal()
+	}
+
+}
+
+func processMergeCustomers(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+
+	validateRequired(args.File, "file")
+
+	plan, err := dedupe.ReadPlanFile(args.File)
+	if err != nil {
+		handleFatalError(err)
+	}
+	if plan.Test != args.Test {
+		fatalError("merge plan was made against a different gateway; match the -test flag")
+	}
+
+	res, err := dedupe.Apply(context.Background(), client, plan)
+	if err != nil {
+		handleError(&args, err)
+	}
+
+	dumpResponse(&args, res)
+
+}
+
 func processTransactionHistory(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
 
 	request := &blockchyp.TransactionHistoryRequest{}
@@ -1317,6 +1674,49 @@ func processBalance(client *blockchyp.Client, args blockchyp.CommandLineArgument
 
 }
 
+// cryptoPollInterval is how often watch-crypto checks a payment.
+const cryptoPollInterval = 15 * time.Second
+
+func processWatchCrypto(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
+	if args.TransactionID == "" && args.TransactionRef == "" {
+		fatalErrorf("-tx or -txRef are required")
+	}
+
+	res, err := client.TransactionStatus(blockchyp.TransactionStatusRequest{
+		TransactionID:  args.TransactionID,
+		TransactionRef: args.TransactionRef,
+		Test:           args.Test,
+	})
+	if err != nil {
+		handleError(&args, err)
+	}
+
+	watcher := cryptopay.NewWatcher(client)
+	if args.Confirmations > 0 {
+		watcher.Thresholds = map[string]int{
+			strings.ToUpper(res.Cryptocurrency) + "/" + strings.ToUpper(res.CryptoNetwork): args.Confirmations,
+		}
+	}
+	watcher.OnEvent = func(e cryptopay.Event) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			handleFatalError(err)
+		}
+		fmt.Println(string(b))
+	}
+
+	if _, err := watcher.Watch(res); err != nil {
+		handleFatalError(err)
+	}
+
+	for len(watcher.Pending()) > 0 {
+		time.Sleep(cryptoPollInterval)
+		if err := watcher.Poll(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
 func processCashDiscount(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
 
 	request := &blockchyp.CashDiscountRequest{}
@@ -1438,57 +1838,55 @@ func assembleDisplayTransaction(args blockchyp.CommandLineArguments) *blockchyp.
 		line := &blockchyp.TransactionDisplayItem{}
 		line.Description = desc
 
-		if len(ids) >= (idx - 1) {
+		if len(ids) > idx {
 			line.ID = ids[idx]
 		}
 
-		if len(qtys) >= (idx - 1) {
+		if len(qtys) > idx {
 			line.Quantity, _ = strconv.ParseFloat(qtys[idx], 64)
 		}
 
-		if len(prices) >= (idx - 1) {
+		if len(prices) > idx {
 			line.Price = prices[idx]
 		}
 
-		if len(extendeds) >= (idx - 1) {
+		if len(extendeds) > idx {
 			line.Extended = extendeds[idx]
 		}
 
-		if len(discounts) >= (idx - 1) {
-
-			discountLines := make([]*blockchyp.TransactionDisplayDiscount, 0)
-			discountLine := blockchyp.TransactionDisplayDiscount{}
+		discountLine := blockchyp.TransactionDisplayDiscount{}
+		if len(discounts) > idx {
 			discountLine.Description = discounts[idx]
-			if len(discountAmounts) >= (idx - 1) {
-				discountLine.Amount = discountAmounts[idx]
-			}
-
-			discountLines = append(discountLines, &discountLine)
-			line.Discounts = discountLines
+		}
+		if len(discountAmounts) > idx {
+			discountLine.Amount = discountAmounts[idx]
+		}
+		if discountLine.Description != "" || discountLine.Amount != "" {
+			line.Discounts = []*blockchyp.TransactionDisplayDiscount{&discountLine}
 		}
 
 		// Add CEDP line item fields:
-		if len(taxAmounts) >= (idx + 1) {
+		if len(taxAmounts) > idx {
 			line.TaxAmount = taxAmounts[idx]
 		}
 
-		if len(taxRates) >= (idx + 1) {
+		if len(taxRates) > idx {
 			line.TaxRate = taxRates[idx]
 		}
 
-		if len(discountCodes) >= (idx + 1) {
+		if len(discountCodes) > idx {
 			line.DiscountCode = discountCodes[idx]
 		}
 
-		if len(commodityCodes) >= (idx + 1) {
+		if len(commodityCodes) > idx {
 			line.CommodityCode = commodityCodes[idx]
 		}
 
-		if len(productCodes) >= (idx + 1) {
+		if len(productCodes) > idx {
 			line.ProductCode = productCodes[idx]
 		}
 
-		if len(unitCodes) >= (idx + 1) {
+		if len(unitCodes) > idx {
 			line.UnitCode = unitCodes[idx]
 		}
 
@@ -1497,10 +1895,77 @@ func assembleDisplayTransaction(args blockchyp.CommandLineArguments) *blockchyp.
 
 	tx.Items = lines
 
+	fillDisplayTotals(tx)
+
 	return tx
 
 }
 
+// fillDisplayTotals computes any extended prices and totals left off the
+// command line, so callers only need to pass prices and quantities.
+func fillDisplayTotals(tx *blockchyp.TransactionDisplayTransaction) {
+	if len(tx.Items) == 0 {
+		return
+	}
+
+	c := &cart.Cart{}
+	for idx, line := range tx.Items {
+		price, err := money.Parse(line.Price)
+		if err != nil {
+			return
+		}
+
+		item := cart.Item{
+			ID:       line.ID,
+			Price:    price,
+			Quantity: line.Quantity,
+			TaxRate:  line.TaxRate,
+		}
+		if item.ID == "" {
+			item.ID = strconv.Itoa(idx)
+		}
+		for _, d := range line.Discounts {
+			amount, err := money.Parse(d.Amount)
+			if err != nil {
+				return
+			}
+			item.Discounts = append(item.Discounts, cart.Discount{Amount: amount})
+		}
+		if err := c.Add(item); err != nil {
+			return
+		}
+	}
+
+	for idx, computed := range c.Lines() {
+		line := tx.Items[idx]
+		if line.Extended == "" {
+			line.Extended = computed.Extended.String()
+		}
+		if line.TaxAmount == "" && line.TaxRate != "" {
+			line.TaxAmount = computed.Tax.String()
+		}
+	}
+
+	totals := c.Totals()
+	if tx.Subtotal == "" {
+		tx.Subtotal = totals.Subtotal.String()
+	}
+	if tx.Tax == "" {
+		tx.Tax = totals.Tax.String()
+	}
+	if tx.Total == "" {
+		total, err := money.Parse(tx.Subtotal)
+		if err != nil {
+			return
+		}
+		tax, err := money.Parse(tx.Tax)
+		if err != nil {
+			return
+		}
+		tx.Total = (total + tax).String()
+	}
+}
+
 func parseJSONInput(args blockchyp.CommandLineArguments, req interface{}) bool {
 
 	rawJSON := args.JSON
@@ -1920,6 +2385,28 @@ func processEnroll(client *blockchyp.Client, args blockchyp.CommandLineArguments
 	dumpResponse(&args, res)
 }
 
+// addAltPrices converts a request's amount into each currency in a rate
+// file. Rates are quoted against the request's currency.
+func addAltPrices(path string, req *blockchyp.AuthorizationRequest) {
+	f, err := os.Open(path)
+	if err != nil {
+		handleFatalError(err)
+	}
+	defer f.Close()
+
+	base := req.CurrencyCode
+	if base == "" {
+		base = currency.Default
+	}
+	rates, err := currency.ReadRates(base, f)
+	if err != nil {
+		handleFatalError(err)
+	}
+	if err := rates.FillAltPrices(req, money.RoundNearest); err != nil {
+		handleFatalError(err)
+	}
+}
+
 func processAuth(client *blockchyp.Client, args blockchyp.CommandLineArguments) {
 
 	req := &blockchyp.AuthorizationRequest{}
@@ -1985,6 +2472,7 @@ func processAuth(client *blockchyp.Client, args blockchyp.CommandLineArguments)
 			ShipFromPostalCode:         args.ShipFromPostalCode,
 			ShipToPostalCode:           args.ShipToPostalCode,
 			DestinationCountryCode:     args.DestinationCountryCode,
+			CurrencyCode:               args.CurrencyCode,
 		}
 
 		displayTx := assembleDisplayTransaction(args)
@@ -2035,6 +2523,14 @@ func processAuth(client *blockchyp.Client, args blockchyp.CommandLineArguments)
 
 		}
 
+		if args.Rates != "" {
+			addAltPrices(args.Rates, req)
+		}
+
+	}
+
+	if err := currency.ValidateRequest(req); err != nil {
+		fatalErrorf("invalid request: %v", err)
 	}
 
 	cmd := args.Command
@@ -200,6 +200,13 @@ func (client *Client) DashboardUpload(path string, request UploadMetadata, reade
 
 // GatewayRequest sends a gateway request with the default timeout.
 func (client *Client) GatewayRequest(path, method string, request, response interface{}, testTx bool, requestTimeout interface{}) error {
+	err := client.gatewayRequest(path, method, request, response, testTx, requestTimeout)
+	client.afterRequest(path, request, response, err)
+
+	return err
+}
+
+func (client *Client) gatewayRequest(path, method string, request, response interface{}, testTx bool, requestTimeout interface{}) error {
 	content, err := json.Marshal(request)
 	if err != nil {
 		return err
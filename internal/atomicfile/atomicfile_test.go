@@ -0,0 +1,37 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	name := filepath.Join(dir, "state.json")
+
+	require.NoError(t, WriteFile(name, []byte("first"), 0600))
+	require.NoError(t, WriteFile(name, []byte("second"), 0600))
+
+	content, err := os.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal("second", string(content))
+
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(entries, 1)
+}
+
+func TestWriteFileMissingDir(t *testing.T) {
+	err := WriteFile(filepath.Join(t.TempDir(), "missing", "state.json"), []byte("x"), 0600)
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+// Package netutil classifies errors from calls to the gateway.
+package netutil
+
+import (
+	"errors"
+	"net"
+)
+
+// IsNetworkError reports whether err came from the network rather than from
+// the gateway. The request may or may not have been processed, so a payment
+// that fails this way has an unknown outcome.
+func IsNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsOffline reports whether err means the gateway could not be reached, so
+// the request was never processed and can safely be replayed. Only DNS
+// failures, failed dials and timeouts count; TLS and certificate errors or
+// canceled requests won't fix themselves on replay. Every offline error is
+// also a network error.
+func IsOffline(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
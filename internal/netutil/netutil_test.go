@@ -0,0 +1,32 @@
+package netutil
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsNetworkError(&net.OpError{Op: "read", Err: errors.New("connection reset")}))
+	assert.True(IsNetworkError(&url.Error{Op: "Post", URL: "https://api.blockchyp.com", Err: x509.UnknownAuthorityError{}}))
+	assert.False(IsNetworkError(errors.New("Transaction not found")))
+	assert.False(IsNetworkError(nil))
+}
+
+func TestIsOffline(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsOffline(&net.DNSError{Err: "no such host", Name: "api.blockchyp.com"}))
+	assert.True(IsOffline(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(IsOffline(&net.OpError{Op: "read", Err: errors.New("connection reset")}))
+	assert.False(IsOffline(x509.UnknownAuthorityError{}))
+	assert.False(IsOffline(context.Canceled))
+	assert.False(IsOffline(nil))
+}
@@ -0,0 +1,494 @@
+package blockchyp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LedgerOperation identifies the money-moving call that produced a ledger
+// entry.
+type LedgerOperation string
+
+// Operations recorded in the ledger.
+const (
+	LedgerCharge       LedgerOperation = "charge"
+	LedgerPreauth      LedgerOperation = "preauth"
+	LedgerCapture      LedgerOperation = "capture"
+	LedgerVoid         LedgerOperation = "void"
+	LedgerRefund       LedgerOperation = "refund"
+	LedgerReverse      LedgerOperation = "reverse"
+	LedgerGiftActivate LedgerOperation = "gift-activate"
+)
+
+// ErrLedgerClosed is returned when writing to a closed ledger.
+var ErrLedgerClosed = errors.New("ledger closed")
+
+// LedgerEntry is a single recorded request and response.
+type LedgerEntry struct {
+	Sequence  int64           `json:"sequence"`
+	Operation LedgerOperation `json:"operation"`
+
+	// RecordedAt is the local time the response was received.
+	RecordedAt time.Time `json:"recordedAt"`
+
+	// GatewayTimestamp is the timestamp reported by the gateway, if any.
+	GatewayTimestamp string `json:"gatewayTimestamp,omitempty"`
+
+	TransactionID         string `json:"transactionId,omitempty"`
+	OriginalTransactionID string `json:"originalTransactionId,omitempty"`
+	TransactionRef        string `json:"transactionRef,omitempty"`
+	OrderRef              string `json:"orderRef,omitempty"`
+	TerminalName          string `json:"terminalName,omitempty"`
+	BatchID               string `json:"batchId,omitempty"`
+	TransactionType       string `json:"transactionType,omitempty"`
+	Test                  bool   `json:"test"`
+
+	Success             bool   `json:"success"`
+	Approved            bool   `json:"approved"`
+	ResponseDescription string `json:"responseDescription,omitempty"`
+	Error               string `json:"error,omitempty"`
+
+	CurrencyCode     string `json:"currencyCode,omitempty"`
+	RequestedAmount  string `json:"requestedAmount,omitempty"`
+	AuthorizedAmount string `json:"authorizedAmount,omitempty"`
+	MaskedPAN        string `json:"maskedPan,omitempty"`
+	PaymentType      string `json:"paymentType,omitempty"`
+
+	// Response is the full gateway response, minus any signature image.
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// LedgerQuery filters ledger entries. Zero valued fields match everything.
+type LedgerQuery struct {
+	Operations     []LedgerOperation
+	TransactionID  string
+	TransactionRef string
+	OrderRef       string
+	TerminalName   string
+	BatchID        string
+	Since          time.Time
+	Until          time.Time
+	ApprovedOnly   bool
+
+	// Related also matches follow-up entries that reference TransactionID,
+	// such as captures, voids and refunds.
+	Related bool
+
+	// Limit caps the number of entries returned, newest last.
+	Limit int
+}
+
+// Ledger is an append-only, file backed record of every money-moving
+// request made through a Client. Entries are stored one JSON document per
+// line and synced to disk before the call returns. Queries read the file
+// rather than keeping entries in memory, so a long-lived ledger doesn't
+// grow the process.
+type Ledger struct {
+	path string
+
+	lock     sync.RWMutex
+	file     *os.File
+	sequence int64
+
+	// size is the length of the file up to the last complete entry.
+	size int64
+}
+
+// OpenLedger opens or creates a ledger file.
+func OpenLedger(path string) (*Ledger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	l := &Ledger{path: path}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.file = f
+	l.size = info.Size()
+
+	return l, nil
+}
+
+// Close closes the underlying file.
+func (l *Ledger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// Append writes an entry to the ledger, assigning its sequence number.
+func (l *Ledger) Append(entry LedgerEntry) (LedgerEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return entry, ErrLedgerClosed
+	}
+
+	entry.Sequence = l.sequence + 1
+	if entry.RecordedAt.IsZero() {
+		entry.RecordedAt = time.Now()
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	content = append(content, '\n')
+
+	if _, err := l.file.Write(content); err != nil {
+		// Part of the entry may have been written. Readers stop at the last
+		// complete entry until the ledger is reopened and the tear is cut
+		// off.
+		return entry, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return entry, err
+	}
+
+	l.sequence = entry.Sequence
+	l.size += int64(len(content))
+
+	return entry, nil
+}
+
+// Entries reads the ledger from the start, yielding entries in the order
+// they were recorded. Entries appended while reading aren't included.
+func (l *Ledger) Entries() iter.Seq2[LedgerEntry, error] {
+	return func(yield func(LedgerEntry, error) bool) {
+		l.lock.RLock()
+		size := l.size
+		l.lock.RUnlock()
+
+		f, err := os.Open(l.path)
+		if err != nil {
+			yield(LedgerEntry{}, err)
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(io.LimitReader(f, size))
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			var entry LedgerEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				yield(LedgerEntry{}, fmt.Errorf("corrupt ledger entry at line %d: %w", line, err))
+				return
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			yield(LedgerEntry{}, err)
+		}
+	}
+}
+
+// Query returns entries matching q in the order they were recorded.
+func (l *Ledger) Query(q LedgerQuery) ([]LedgerEntry, error) {
+	results := make([]LedgerEntry, 0)
+	for e, err := range l.Entries() {
+		if err != nil {
+			return nil, err
+		}
+		if !q.matches(e) {
+			continue
+		}
+
+		results = append(results, e)
+		if q.Limit > 0 && len(results) > q.Limit {
+			results = results[1:]
+		}
+	}
+
+	return results, nil
+}
+
+// Transaction returns every entry for a transaction, including follow-up
+// captures, voids and refunds.
+func (l *Ledger) Transaction(transactionID string) ([]LedgerEntry, error) {
+	return l.Query(LedgerQuery{
+		TransactionID: transactionID,
+		Related:       true,
+	})
+}
+
+// Order returns every entry recorded for an order.
+func (l *Ledger) Order(orderRef string) ([]LedgerEntry, error) {
+	return l.Query(LedgerQuery{
+		OrderRef: orderRef,
+	})
+}
+
+func (q LedgerQuery) matches(e LedgerEntry) bool {
+	if len(q.Operations) > 0 {
+		found := false
+		for _, op := range q.Operations {
+			if op == e.Operation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if q.TransactionID != "" {
+		if e.TransactionID != q.TransactionID && !(q.Related && e.OriginalTransactionID == q.TransactionID) {
+			return false
+		}
+	}
+
+	switch {
+	case q.TransactionRef != "" && e.TransactionRef != q.TransactionRef:
+		return false
+	case q.OrderRef != "" && e.OrderRef != q.OrderRef:
+		return false
+	case q.TerminalName != "" && e.TerminalName != q.TerminalName:
+		return false
+	case q.BatchID != "" && e.BatchID != q.BatchID:
+		return false
+	case !q.Since.IsZero() && e.RecordedAt.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.RecordedAt.Before(q.Until):
+		return false
+	case q.ApprovedOnly && !e.Approved:
+		return false
+	}
+
+	return true
+}
+
+func (l *Ledger) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var offset int64
+	line := 0
+	for scanner.Scan() {
+		line++
+		length := int64(len(scanner.Bytes())) + 1
+		if length == 1 {
+			offset += length
+			continue
+		}
+
+		var entry LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final write is expected after a crash and is cut off
+			// so new entries start on a clean line. Anything earlier means
+			// the file is damaged.
+			if scanner.Scan() {
+				return fmt.Errorf("corrupt ledger entry at line %d: %w", line, err)
+			}
+			return os.Truncate(l.path, offset)
+		}
+
+		offset += length
+		if entry.Sequence > l.sequence {
+			l.sequence = entry.Sequence
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// The last entry is intact but its newline never made it to disk, so
+	// terminate it before anything else is appended.
+	if info, err := f.Stat(); err == nil && offset > info.Size() {
+		w, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+
+	return nil
+}
+
+// ledgerFields holds the fields common to every recorded request and
+// response, decoded by JSON name so one shape fits every message type.
+type ledgerFields struct {
+	Success             bool   `json:"success"`
+	Approved            bool   `json:"approved"`
+	ResponseDescription string `json:"responseDescription"`
+	TransactionID       string `json:"transactionId"`
+	TransactionRef      string `json:"transactionRef"`
+	TransactionType     string `json:"transactionType"`
+	OrderRef            string `json:"orderRef"`
+	TerminalName        string `json:"terminalName"`
+	BatchID             string `json:"batchId"`
+	Timestamp           string `json:"timestamp"`
+	Test                bool   `json:"test"`
+	CurrencyCode        string `json:"currencyCode"`
+	Amount              string `json:"amount"`
+	AuthorizedAmount    string `json:"authorizedAmount"`
+	MaskedPAN           string `json:"maskedPan"`
+	PaymentType         string `json:"paymentType"`
+}
+
+// ledgerOperations maps the paths of money-moving requests to the
+// operations they're recorded as.
+var ledgerOperations = map[string]LedgerOperation{
+	"/api/charge":        LedgerCharge,
+	"/api/preauth":       LedgerPreauth,
+	"/api/capture":       LedgerCapture,
+	"/api/void":          LedgerVoid,
+	"/api/refund":        LedgerRefund,
+	"/api/reverse":       LedgerReverse,
+	"/api/gift-activate": LedgerGiftActivate,
+}
+
+// SetLedger records every money-moving request made through the client,
+// and its response, in l. A nil ledger stops recording. The ledger belongs
+// to this *Client, not to copies of it, and is forgotten when the client
+// is closed.
+func (client *Client) SetLedger(l *Ledger) {
+	client.updateState(func(s *clientState) {
+		s.ledger = l
+	})
+}
+
+// recordTransaction writes a money-moving call to the client's ledger, if
+// one is configured. Ledger failures are logged rather than returned so
+// they never mask the outcome of a payment.
+func (client *Client) recordTransaction(path string, request, response interface{}, callErr error) {
+	op, ok := ledgerOperations[path]
+	if !ok {
+		return
+	}
+	l := client.state().ledger
+	if l == nil {
+		return
+	}
+
+	entry, err := newLedgerEntry(op, request, response, callErr)
+	if err == nil {
+		_, err = l.Append(entry)
+	}
+	if err != nil {
+		log.Printf("Failed to record %s in ledger: %+v", op, err)
+	}
+}
+
+func newLedgerEntry(op LedgerOperation, request, response interface{}, callErr error) (LedgerEntry, error) {
+	var req, res ledgerFields
+
+	content, err := json.Marshal(request)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if err := json.Unmarshal(content, &req); err != nil {
+		return LedgerEntry{}, err
+	}
+
+	content, err = json.Marshal(response)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if err := json.Unmarshal(content, &res); err != nil {
+		return LedgerEntry{}, err
+	}
+
+	// Signature images are large and belong in a signature store.
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err == nil {
+		delete(raw, "sigFile")
+		if stripped, err := json.Marshal(raw); err == nil {
+			content = stripped
+		}
+	}
+
+	entry := LedgerEntry{
+		Operation:           op,
+		RecordedAt:          time.Now(),
+		GatewayTimestamp:    res.Timestamp,
+		TransactionID:       res.TransactionID,
+		TransactionRef:      firstNonEmpty(res.TransactionRef, req.TransactionRef),
+		OrderRef:            req.OrderRef,
+		TerminalName:        req.TerminalName,
+		BatchID:             res.BatchID,
+		TransactionType:     res.TransactionType,
+		Test:                req.Test,
+		Success:             res.Success,
+		Approved:            res.Approved,
+		ResponseDescription: res.ResponseDescription,
+		CurrencyCode:        firstNonEmpty(res.CurrencyCode, req.CurrencyCode),
+		RequestedAmount:     req.Amount,
+		AuthorizedAmount:    res.AuthorizedAmount,
+		MaskedPAN:           res.MaskedPAN,
+		PaymentType:         res.PaymentType,
+		Response:            content,
+	}
+
+	if req.TransactionID != "" && req.TransactionID != res.TransactionID {
+		entry.OriginalTransactionID = req.TransactionID
+	}
+
+	if callErr != nil {
+		entry.Error = callErr.Error()
+	}
+
+	return entry, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,160 @@
+package blockchyp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgerQuery(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	l, err := OpenLedger(path)
+	require.NoError(t, err)
+
+	entries := []LedgerEntry{
+		{Operation: LedgerCharge, TransactionID: "TX1", OrderRef: "O1", Approved: true},
+		{Operation: LedgerRefund, TransactionID: "TX2", OriginalTransactionID: "TX1", OrderRef: "O1", Approved: true},
+		{Operation: LedgerCharge, TransactionID: "TX3", OrderRef: "O2"},
+		{Operation: LedgerGiftActivate, TransactionID: "TX4", Approved: true},
+	}
+	for _, e := range entries {
+		_, err := l.Append(e)
+		require.NoError(t, err)
+	}
+
+	related, err := l.Transaction("TX1")
+	require.NoError(t, err)
+	assert.Len(related, 2)
+
+	order, err := l.Order("O2")
+	require.NoError(t, err)
+	require.Len(t, order, 1)
+	assert.Equal("TX3", order[0].TransactionID)
+
+	approved, err := l.Query(LedgerQuery{ApprovedOnly: true, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, approved, 2)
+	assert.Equal("TX2", approved[0].TransactionID)
+	assert.Equal("TX4", approved[1].TransactionID)
+
+	require.NoError(t, l.Close())
+
+	// Entries and sequence numbers survive a reopen.
+	l, err = OpenLedger(path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	e, err := l.Append(LedgerEntry{Operation: LedgerVoid, TransactionID: "TX3"})
+	require.NoError(t, err)
+	assert.Equal(int64(5), e.Sequence)
+
+	all, err := l.Query(LedgerQuery{})
+	require.NoError(t, err)
+	assert.Len(all, 5)
+}
+
+func TestLedgerTornWrite(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	l, err := OpenLedger(path)
+	require.NoError(t, err)
+	_, err = l.Append(LedgerEntry{Operation: LedgerCharge, TransactionID: "TX1"})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"sequence":2,"operation":"ch`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = OpenLedger(path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	e, err := l.Append(LedgerEntry{Operation: LedgerCharge, TransactionID: "TX2"})
+	require.NoError(t, err)
+	assert.Equal(int64(2), e.Sequence)
+
+	all, err := l.Query(LedgerQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal("TX2", all[1].TransactionID)
+}
+
+func TestLedgerEntryFromGiftActivate(t *testing.T) {
+	assert := assert.New(t)
+
+	request := GiftActivateRequest{TerminalName: "Front", Amount: "25.00", TransactionRef: "ref1"}
+	response := GiftActivateResponse{Success: true, Approved: true, TransactionID: "TX1"}
+
+	e, err := newLedgerEntry(LedgerGiftActivate, request, &response, errors.New("late"))
+	require.NoError(t, err)
+	assert.Equal(LedgerGiftActivate, e.Operation)
+	assert.Equal("TX1", e.TransactionID)
+	assert.Equal("ref1", e.TransactionRef)
+	assert.Equal("Front", e.TerminalName)
+	assert.Equal("25.00", e.RequestedAmount)
+	assert.True(e.Approved)
+	assert.Equal("late", e.Error)
+}
+
+func TestClientRecordsMoneyMovingCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"success":true,"approved":true,"transactionId":"TX1"}`)
+	}))
+	defer srv.Close()
+
+	l, err := OpenLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	require.NoError(t, err)
+	defer l.Close()
+
+	client := NewClient(APICredentials{})
+	client.GatewayHost = srv.URL
+	client.SetLedger(l)
+	defer client.Close()
+
+	_, err = client.Charge(AuthorizationRequest{Amount: "10.00", TransactionRef: "ref1", OrderRef: "ord1"})
+	require.NoError(t, err)
+	_, err = client.Void(VoidRequest{TransactionID: "TX1"})
+	require.NoError(t, err)
+
+	// Calls that don't move money aren't recorded.
+	_, err = client.Ping(PingRequest{})
+	require.NoError(t, err)
+
+	entries, err := l.Query(LedgerQuery{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(LedgerCharge, entries[0].Operation)
+	assert.Equal("ord1", entries[0].OrderRef)
+	assert.Equal("10.00", entries[0].RequestedAmount)
+	assert.Equal(LedgerVoid, entries[1].Operation)
+
+	client.SetLedger(nil)
+	_, err = client.Charge(AuthorizationRequest{Amount: "10.00"})
+	require.NoError(t, err)
+	entries, err = l.Query(LedgerQuery{})
+	require.NoError(t, err)
+	assert.Len(entries, 2)
+}
+
+func TestUnwrapTerminalRequest(t *testing.T) {
+	request := AuthorizationRequest{TerminalName: "Front"}
+
+	assert.Equal(t, request, unwrapTerminalRequest(TerminalAuthorizationRequest{Request: request}))
+	assert.Equal(t, request, unwrapTerminalRequest(request))
+	assert.Nil(t, unwrapTerminalRequest(nil))
+}
@@ -0,0 +1,45 @@
+package blockchyp
+
+import (
+	"log"
+	"reflect"
+)
+
+// afterRequest runs once for every gateway and terminal request, whatever
+// its outcome. The generated client methods all send their requests
+// through GatewayRequest or terminalRequest, so this is where features
+// that watch every call, like signature sinks and the ledger, hook in.
+func (client *Client) afterRequest(path string, request, response interface{}, err error) {
+	request = unwrapTerminalRequest(request)
+
+	if err := client.deliverSignature(request, response); err != nil {
+		log.Printf("Failed to deliver signature: %+v", err)
+	}
+
+	client.recordTransaction(path, request, response, err)
+}
+
+// unwrapTerminalRequest returns the request inside the credentials wrapper
+// sent to terminals, such as the AuthorizationRequest in a
+// TerminalAuthorizationRequest. Other requests are returned as they are.
+func unwrapTerminalRequest(request interface{}) interface{} {
+	if !isStruct(request) {
+		return request
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(request))
+	if _, ok := v.Type().FieldByName("APICredentials"); !ok {
+		return request
+	}
+	if inner := v.FieldByName("Request"); inner.IsValid() {
+		return inner.Interface()
+	}
+
+	return request
+}
+
+// isStruct reports whether v is a struct or a non-nil pointer to one, which
+// the reflection helpers shared with the generated code require.
+func isStruct(v interface{}) bool {
+	return reflect.Indirect(reflect.ValueOf(v)).Kind() == reflect.Struct
+}
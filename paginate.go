@@ -0,0 +1,268 @@
+package blockchyp
+
+import (
+	"context"
+	"iter"
+)
+
+// DefaultPageSize is the page size used by the All* iterators when the
+// request does not set MaxResults.
+const DefaultPageSize = 100
+
+// PageOptions controls how the All* iterators page through results.
+type PageOptions struct {
+	// Prefetch requests the next page while the current one is being
+	// consumed.
+	Prefetch bool
+
+	// Overlap re-reads this many records from the end of each page when
+	// requesting the next one, so records that shift toward the front of the
+	// result set between requests are not skipped. Records seen on the
+	// previous page are never yielded twice, whatever the overlap.
+	Overlap int
+
+	// Position, if set, is kept at the result set index just past the
+	// latest record, including records skipped as duplicates. A consumer
+	// that saves it can resume with StartIndex set to the saved value.
+	Position *int
+}
+
+// page is a single page of results from a paged endpoint.
+type page[T any] struct {
+	items []T
+	total int
+	err   error
+}
+
+// pageFetcher retrieves a page of results starting at startIndex.
+type pageFetcher[T any] func(startIndex, maxResults int) page[T]
+
+// paginate yields every record from a paged endpoint, starting at start and
+// requesting pageSize records at a time. Records are identified by key for
+// de-duplication between adjacent pages; only the keys of the last two pages
+// are kept, so memory stays bounded however long the result set is.
+func paginate[T any](ctx context.Context, start, pageSize int, opts []PageOptions, fetch pageFetcher[T], key func(T) string) iter.Seq2[T, error] {
+	var opt PageOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if opt.Overlap < 0 || opt.Overlap >= pageSize {
+		opt.Overlap = 0
+	}
+
+	return func(yield func(T, error) bool) {
+		var zero T
+		var pending chan page[T]
+
+		request := func(index int) chan page[T] {
+			ch := make(chan page[T], 1)
+			if opt.Prefetch {
+				go func() { ch <- fetch(index, pageSize) }()
+			} else {
+				ch <- fetch(index, pageSize)
+			}
+			return ch
+		}
+
+		previous := map[string]bool{}
+		index := start
+		pending = request(index)
+
+		for {
+			var current page[T]
+			select {
+			case <-ctx.Done():
+				yield(zero, ctx.Err())
+				return
+			case current = <-pending:
+			}
+
+			if current.err != nil {
+				yield(zero, current.err)
+				return
+			}
+
+			next := index + len(current.items) - opt.Overlap
+			more := len(current.items) >= pageSize &&
+				(current.total <= 0 || index+len(current.items) < current.total)
+
+			if more && opt.Prefetch {
+				pending = request(next)
+			}
+
+			seen := make(map[string]bool, len(current.items))
+			for i, item := range current.items {
+				if opt.Position != nil {
+					*opt.Position = index + i + 1
+				}
+
+				k := key(item)
+				if k != "" {
+					if previous[k] || seen[k] {
+						continue
+					}
+					seen[k] = true
+				}
+
+				if err := ctx.Err(); err != nil {
+					yield(zero, err)
+					return
+				}
+
+				if !yield(item, nil) {
+					return
+				}
+			}
+
+			if !more {
+				return
+			}
+
+			previous = seen
+			index = next
+			if !opt.Prefetch {
+				pending = request(index)
+			}
+		}
+	}
+}
+
+// single yields every record from an endpoint that returns its full result
+// set in one response.
+func single[T any](ctx context.Context, fetch func() ([]T, error)) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		if err := ctx.Err(); err != nil {
+			yield(zero, err)
+			return
+		}
+
+		items, err := fetch()
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+
+		for _, item := range items {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// AllTransactions iterates over the full transaction history matching the
+// request, paging transparently. MaxResults sets the page size and
+// StartIndex the first record.
+func (client *Client) AllTransactions(ctx context.Context, request TransactionHistoryRequest, opts ...PageOptions) iter.Seq2[AuthorizationResponse, error] {
+	return paginate(ctx, request.StartIndex, request.MaxResults, opts, func(startIndex, maxResults int) page[AuthorizationResponse] {
+		request.StartIndex = startIndex
+		request.MaxResults = maxResults
+		res, err := client.TransactionHistory(request)
+		if err != nil {
+			return page[AuthorizationResponse]{err: err}
+		}
+		return page[AuthorizationResponse]{items: res.Transactions, total: res.TotalResultCount}
+	}, func(tx AuthorizationResponse) string {
+		return tx.TransactionID
+	})
+}
+
+// AllBatches iterates over the full batch history matching the request.
+func (client *Client) AllBatches(ctx context.Context, request BatchHistoryRequest, opts ...PageOptions) iter.Seq2[BatchSummary, error] {
+	return paginate(ctx, request.StartIndex, request.MaxResults, opts, func(startIndex, maxResults int) page[BatchSummary] {
+		request.StartIndex = startIndex
+		request.MaxResults = maxResults
+		res, err := client.BatchHistory(request)
+		if err != nil {
+			return page[BatchSummary]{err: err}
+		}
+		return page[BatchSummary]{items: res.Batches, total: res.TotalResultCount}
+	}, func(batch BatchSummary) string {
+		return batch.BatchID
+	})
+}
+
+// AllTCLogEntries iterates over the full terms and conditions log matching
+// the request.
+func (client *Client) AllTCLogEntries(ctx context.Context, request TermsAndConditionsLogRequest, opts ...PageOptions) iter.Seq2[TermsAndConditionsLogEntry, error] {
+	return paginate(ctx, request.StartIndex, request.MaxResults, opts, func(startIndex, maxResults int) page[TermsAndConditionsLogEntry] {
+		request.StartIndex = startIndex
+		request.MaxResults = maxResults
+		res, err := client.TCLog(request)
+		if err != nil {
+			return page[TermsAndConditionsLogEntry]{err: err}
+		}
+		return page[TermsAndConditionsLogEntry]{items: res.Results, total: res.ResultCount}
+	}, func(entry TermsAndConditionsLogEntry) string {
+		return entry.ID
+	})
+}
+
+// AllMerchants iterates over every merchant visible to the caller.
+func (client *Client) AllMerchants(ctx context.Context, request GetMerchantsRequest, opts ...PageOptions) iter.Seq2[MerchantProfileResponse, error] {
+	return paginate(ctx, request.StartIndex, request.MaxResults, opts, func(startIndex, maxResults int) page[MerchantProfileResponse] {
+		request.StartIndex = startIndex
+		request.MaxResults = maxResults
+		res, err := client.GetMerchants(request)
+		if err != nil {
+			return page[MerchantProfileResponse]{err: err}
+		}
+		return page[MerchantProfileResponse]{items: res.Merchants, total: res.ResultCount}
+	}, func(merchant MerchantProfileResponse) string {
+		return merchant.MerchantID
+	})
+}
+
+// AllCustomers iterates over the customers matching a search. The customer
+// search API returns its full result set in one response, so there is only
+// ever one request.
+func (client *Client) AllCustomers(ctx context.Context, request CustomerSearchRequest) iter.Seq2[Customer, error] {
+	return single(ctx, func() ([]Customer, error) {
+		res, err := client.CustomerSearch(request)
+		if err != nil {
+			return nil, err
+		}
+		return res.Customers, nil
+	})
+}
+
+// AllMedia iterates over the media library. The media API returns the full
+// library in one response.
+func (client *Client) AllMedia(ctx context.Context, request MediaRequest) iter.Seq2[MediaMetadata, error] {
+	return single(ctx, func() ([]MediaMetadata, error) {
+		res, err := client.Media(request)
+		if err != nil {
+			return nil, err
+		}
+		return res.Results, nil
+	})
+}
+
+// AllMerchantInvoices iterates over the merchant invoices matching the
+// request. The invoice API returns its full result set in one response.
+func (client *Client) AllMerchantInvoices(ctx context.Context, request MerchantInvoiceListRequest) iter.Seq2[MerchantInvoiceSummary, error] {
+	return single(ctx, func() ([]MerchantInvoiceSummary, error) {
+		res, err := client.MerchantInvoices(request)
+		if err != nil {
+			return nil, err
+		}
+		return res.Invoices, nil
+	})
+}
+
+// AllPartnerStatements iterates over the partner statements matching the
+// request. The statement API returns its full result set in one response.
+func (client *Client) AllPartnerStatements(ctx context.Context, request PartnerStatementListRequest) iter.Seq2[PartnerStatementSummary, error] {
+	return single(ctx, func() ([]PartnerStatementSummary, error) {
+		res, err := client.PartnerStatements(request)
+		if err != nil {
+			return nil, err
+		}
+		return res.Statements, nil
+	})
+}
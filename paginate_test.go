@@ -0,0 +1,182 @@
+package blockchyp
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePages serves fixed pages by start index and records each request.
+type fakePages struct {
+	lock      sync.Mutex
+	pages     map[int][]string
+	total     int
+	requested []int
+}
+
+func (f *fakePages) fetch(startIndex, maxResults int) page[string] {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requested = append(f.requested, startIndex)
+
+	return page[string]{items: f.pages[startIndex], total: f.total}
+}
+
+func identity(s string) string {
+	return s
+}
+
+func collect(t *testing.T, seq func(func(string, error) bool)) []string {
+	var items []string
+	for item, err := range seq {
+		require.NoError(t, err)
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func TestPaginateOverlapDedupe(t *testing.T) {
+	f := &fakePages{pages: map[int][]string{
+		0: {"A", "B", "C"},
+		2: {"C", "D", "E"},
+		4: {"E", "F"},
+	}}
+
+	items := collect(t, paginate(context.Background(), 0, 3, []PageOptions{{Overlap: 1}}, f.fetch, identity))
+
+	assert.Equal(t, []string{"A", "B", "C", "D", "E", "F"}, items)
+	assert.Equal(t, []int{0, 2, 4}, f.requested)
+}
+
+func TestPaginateStopsAtTotal(t *testing.T) {
+	f := &fakePages{
+		pages: map[int][]string{0: {"A", "B"}, 2: {"C", "D"}},
+		total: 4,
+	}
+
+	items := collect(t, paginate(context.Background(), 0, 2, nil, f.fetch, identity))
+
+	assert.Equal(t, []string{"A", "B", "C", "D"}, items)
+	assert.Equal(t, []int{0, 2}, f.requested)
+}
+
+func TestPaginatePrefetch(t *testing.T) {
+	fetched := make(chan int, 4)
+	fetch := func(startIndex, maxResults int) page[string] {
+		fetched <- startIndex
+		if startIndex == 0 {
+			return page[string]{items: []string{"A", "B"}}
+		}
+		return page[string]{items: []string{"C"}}
+	}
+
+	var items []string
+	for item, err := range paginate(context.Background(), 0, 2, []PageOptions{{Prefetch: true}}, fetch, identity) {
+		require.NoError(t, err)
+		if item == "A" {
+			// The second page is requested while the first is consumed.
+			assert.Equal(t, 0, <-fetched)
+			select {
+			case index := <-fetched:
+				assert.Equal(t, 2, index)
+			case <-time.After(time.Second):
+				t.Fatal("next page was not prefetched")
+			}
+		}
+		items = append(items, item)
+	}
+
+	assert.Equal(t, []string{"A", "B", "C"}, items)
+}
+
+func TestPaginateBreakDoesNotLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	fetch := func(startIndex, maxResults int) page[string] {
+		if startIndex > 0 {
+			<-release
+		}
+		return page[string]{items: []string{"A", "B"}}
+	}
+
+	for item := range paginate(context.Background(), 0, 2, []PageOptions{{Prefetch: true}}, fetch, identity) {
+		assert.Equal(t, "A", item)
+		break
+	}
+
+	// The prefetch still running when the consumer stopped finishes
+	// without anyone receiving its page.
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestPaginateContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := &fakePages{pages: map[int][]string{0: {"A", "B"}, 2: {"C"}}}
+
+	var items []string
+	var err error
+	for item, ierr := range paginate(ctx, 0, 2, nil, f.fetch, identity) {
+		if ierr != nil {
+			err = ierr
+			continue
+		}
+		items = append(items, item)
+		cancel()
+	}
+
+	assert.Equal(t, []string{"A"}, items)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, []int{0}, f.requested)
+}
+
+func TestPaginateFetchError(t *testing.T) {
+	fetch := func(startIndex, maxResults int) page[string] {
+		return page[string]{err: errors.New("gateway unavailable")}
+	}
+
+	var errs []error
+	for _, err := range paginate(context.Background(), 0, 2, nil, fetch, identity) {
+		errs = append(errs, err)
+	}
+
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "gateway unavailable")
+}
+
+func TestPaginatePosition(t *testing.T) {
+	// B shifts onto the second page between requests, so it is skipped
+	// there but still counts toward the position.
+	f := &fakePages{pages: map[int][]string{
+		0: {"A", "B"},
+		2: {"B", "C"},
+		4: {"D"},
+	}}
+
+	position := 0
+	var seen []string
+	var positions []int
+	for item, err := range paginate(context.Background(), 0, 2, []PageOptions{{Position: &position}}, f.fetch, identity) {
+		require.NoError(t, err)
+		seen = append(seen, item)
+		positions = append(positions, position)
+	}
+
+	assert.Equal(t, []string{"A", "B", "C", "D"}, seen)
+	assert.Equal(t, []int{1, 2, 4, 5}, positions)
+}
@@ -0,0 +1,422 @@
+// Package cart builds line item displays with totals that always add up,
+// keeps a terminal's display in sync with as few updates as possible, and
+// produces matching line items for the final authorization.
+package cart
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+var (
+	// ErrMissingID is returned when an item has no ID. IDs are how the
+	// terminal display updates and removes items.
+	ErrMissingID = errors.New("item has no ID")
+
+	// ErrDuplicateItem is returned when an item is added twice.
+	ErrDuplicateItem = errors.New("item already in cart")
+
+	// ErrUnknownItem is returned when an item isn't in the cart.
+	ErrUnknownItem = errors.New("item not in cart")
+
+	// ErrInvalidQuantity is returned for negative or non-finite quantities.
+	ErrInvalidQuantity = errors.New("invalid quantity")
+
+	// ErrInvalidTaxRate is returned when a tax rate isn't a decimal
+	// percentage.
+	ErrInvalidTaxRate = errors.New("invalid tax rate")
+)
+
+// Discount is a discount applied to an item.
+type Discount struct {
+	Description string
+	Amount      money.Amount
+}
+
+// Item is a line item in a cart.
+type Item struct {
+	ID          string
+	Description string
+	Price       money.Amount
+	Quantity    float64
+	Discounts   []Discount
+
+	// TaxRate is a percentage, such as "8.25". Blank uses the cart's rate.
+	TaxRate string
+
+	// TaxBeforeDiscount calculates tax on the full extended price rather
+	// than the discounted price.
+	TaxBeforeDiscount bool
+
+	UnitCode      string
+	CommodityCode string
+	ProductCode   string
+}
+
+// Line is an item with its computed amounts.
+type Line struct {
+	Item
+
+	// Extended is quantity times price, before discounts.
+	Extended money.Amount
+
+	// Discount is the sum of the item's discounts.
+	Discount money.Amount
+
+	// Net is the extended price less discounts.
+	Net money.Amount
+
+	// TaxRate is the rate actually applied and Tax the resulting tax.
+	TaxRate string
+	Tax     money.Amount
+}
+
+// Totals are the cart's summary amounts. Subtotal is net of discounts and
+// Total is Subtotal plus Tax.
+type Totals struct {
+	Subtotal money.Amount
+	Discount money.Amount
+	Tax      money.Amount
+	Total    money.Amount
+}
+
+// Cart is an ordered set of line items. A Cart is not safe for concurrent
+// use.
+type Cart struct {
+	// TaxRate is the default tax rate as a percentage, used by items that
+	// don't set their own.
+	TaxRate string
+
+	// Rounding resolves fractions of a cent in extended prices and tax.
+	// Defaults to rounding half a cent up.
+	Rounding money.Rounding
+
+	items []*Item
+
+	// shown is what the terminal is currently displaying, when known.
+	shown *snapshot
+}
+
+// New returns an empty cart with a default tax rate, which may be blank.
+func New(taxRate string) (*Cart, error) {
+	if err := validateRate(taxRate); err != nil {
+		return nil, err
+	}
+
+	return &Cart{TaxRate: taxRate}, nil
+}
+
+// Add appends an item to the cart.
+func (c *Cart) Add(item Item) error {
+	if err := validate(item); err != nil {
+		return err
+	}
+	if c.find(item.ID) >= 0 {
+		return fmt.Errorf("%w: %s", ErrDuplicateItem, item.ID)
+	}
+
+	item.Discounts = append([]Discount(nil), item.Discounts...)
+	c.items = append(c.items, &item)
+
+	return nil
+}
+
+// Set replaces the item with the same ID, or appends it if the cart
+// doesn't have it yet.
+func (c *Cart) Set(item Item) error {
+	if err := validate(item); err != nil {
+		return err
+	}
+
+	item.Discounts = append([]Discount(nil), item.Discounts...)
+
+	if i := c.find(item.ID); i >= 0 {
+		c.items[i] = &item
+		return nil
+	}
+	c.items = append(c.items, &item)
+
+	return nil
+}
+
+// Remove takes an item out of the cart.
+func (c *Cart) Remove(id string) error {
+	i := c.find(id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownItem, id)
+	}
+
+	c.items = append(c.items[:i], c.items[i+1:]...)
+
+	return nil
+}
+
+// SetQuantity changes an item's quantity.
+func (c *Cart) SetQuantity(id string, quantity float64) error {
+	item, err := c.get(id)
+	if err != nil {
+		return err
+	}
+	if _, err := quantityRat(quantity); err != nil {
+		return err
+	}
+
+	item.Quantity = quantity
+
+	return nil
+}
+
+// AddDiscount applies a discount to an item.
+func (c *Cart) AddDiscount(id string, discount Discount) error {
+	item, err := c.get(id)
+	if err != nil {
+		return err
+	}
+
+	item.Discounts = append(item.Discounts, discount)
+
+	return nil
+}
+
+// ClearDiscounts removes every discount from an item.
+func (c *Cart) ClearDiscounts(id string) error {
+	item, err := c.get(id)
+	if err != nil {
+		return err
+	}
+
+	item.Discounts = nil
+
+	return nil
+}
+
+// SetTaxRate changes an item's tax rate. A blank rate uses the cart's.
+func (c *Cart) SetTaxRate(id, rate string) error {
+	item, err := c.get(id)
+	if err != nil {
+		return err
+	}
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+
+	item.TaxRate = rate
+
+	return nil
+}
+
+// Item returns a copy of an item.
+func (c *Cart) Item(id string) (Item, bool) {
+	i := c.find(id)
+	if i < 0 {
+		return Item{}, false
+	}
+
+	item := *c.items[i]
+	item.Discounts = append([]Discount(nil), item.Discounts...)
+
+	return item, true
+}
+
+// Len returns the number of items in the cart.
+func (c *Cart) Len() int {
+	return len(c.items)
+}
+
+// Clear empties the cart. The terminal keeps showing the old items until
+// the next Publish.
+func (c *Cart) Clear() {
+	c.items = nil
+}
+
+// Lines returns every item with its computed amounts, in cart order.
+func (c *Cart) Lines() []Line {
+	lines := make([]Line, 0, len(c.items))
+	for _, item := range c.items {
+		lines = append(lines, c.line(*item))
+	}
+
+	return lines
+}
+
+// Totals adds up the cart. Tax is rounded per item, so Tax always equals
+// the sum of the line item tax amounts.
+func (c *Cart) Totals() Totals {
+	var t Totals
+	for _, line := range c.Lines() {
+		t.Subtotal += line.Net
+		t.Discount += line.Discount
+		t.Tax += line.Tax
+	}
+	t.Total = t.Subtotal + t.Tax
+
+	return t
+}
+
+// Display returns the full line item display for the cart.
+func (c *Cart) Display() *blockchyp.TransactionDisplayTransaction {
+	t := c.Totals()
+
+	return &blockchyp.TransactionDisplayTransaction{
+		Subtotal: t.Subtotal.String(),
+		Tax:      t.Tax.String(),
+		Total:    t.Total.String(),
+		Items:    c.LineItems(),
+	}
+}
+
+// LineItems returns the cart as display items, suitable for an
+// AuthorizationRequest's LineItems.
+func (c *Cart) LineItems() []*blockchyp.TransactionDisplayItem {
+	items := make([]*blockchyp.TransactionDisplayItem, 0, len(c.items))
+	for _, line := range c.Lines() {
+		items = append(items, displayItem(line))
+	}
+
+	return items
+}
+
+// Apply sets the amount, tax and line items of an authorization request
+// from the cart, so the charge matches what the customer saw. Carts are
+// priced in cents, so requests in currencies with a different number of
+// decimal places are refused and left as they were.
+func (c *Cart) Apply(req *blockchyp.AuthorizationRequest) error {
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		return err
+	}
+
+	t := c.Totals()
+
+	req.Amount = t.Total.String()
+	req.TaxAmount = t.Tax.String()
+	req.LineItems = c.LineItems()
+
+	return nil
+}
+
+func (c *Cart) line(item Item) Line {
+	mode := c.Rounding
+
+	// Quantities and rates are validated on the way in.
+	qty, _ := quantityRat(item.Quantity)
+
+	l := Line{
+		Item:     item,
+		Extended: item.Price.MulRat(qty, mode),
+		TaxRate:  item.TaxRate,
+	}
+	for _, d := range item.Discounts {
+		l.Discount += d.Amount
+	}
+	l.Net = l.Extended - l.Discount
+
+	if l.TaxRate == "" {
+		l.TaxRate = c.TaxRate
+	}
+	if l.TaxRate != "" {
+		taxable := l.Net
+		if item.TaxBeforeDiscount {
+			taxable = l.Extended
+		}
+		l.Tax, _ = taxable.Percent(l.TaxRate, mode)
+	}
+
+	return l
+}
+
+func (c *Cart) find(id string) int {
+	for i, item := range c.items {
+		if item.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (c *Cart) get(id string) (*Item, error) {
+	i := c.find(id)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownItem, id)
+	}
+
+	return c.items[i], nil
+}
+
+func displayItem(l Line) *blockchyp.TransactionDisplayItem {
+	item := &blockchyp.TransactionDisplayItem{
+		ID:            l.ID,
+		Description:   l.Description,
+		Price:         l.Price.String(),
+		Quantity:      l.Quantity,
+		Extended:      l.Extended.String(),
+		UnitCode:      l.UnitCode,
+		CommodityCode: l.CommodityCode,
+		ProductCode:   l.ProductCode,
+		Discounts:     make([]*blockchyp.TransactionDisplayDiscount, 0, len(l.Discounts)),
+	}
+
+	for _, d := range l.Discounts {
+		item.Discounts = append(item.Discounts, &blockchyp.TransactionDisplayDiscount{
+			Description: d.Description,
+			Amount:      d.Amount.String(),
+		})
+	}
+
+	if l.TaxRate != "" {
+		item.TaxRate = l.TaxRate
+		item.TaxAmount = l.Tax.String()
+
+		switch {
+		case len(l.Discounts) == 0:
+			item.DiscountCode = "0"
+		case l.TaxBeforeDiscount:
+			item.DiscountCode = "2"
+		default:
+			item.DiscountCode = "1"
+		}
+	}
+
+	return item
+}
+
+func validate(item Item) error {
+	if item.ID == "" {
+		return ErrMissingID
+	}
+	if _, err := quantityRat(item.Quantity); err != nil {
+		return err
+	}
+
+	return validateRate(item.TaxRate)
+}
+
+func validateRate(rate string) error {
+	if rate == "" {
+		return nil
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() < 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidTaxRate, rate)
+	}
+
+	return nil
+}
+
+// quantityRat converts a quantity to the exact decimal it prints as, so 0.1
+// means one tenth rather than the nearest binary fraction.
+func quantityRat(q float64) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(q, 'f', -1, 64))
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuantity, q)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,165 @@
+package cart
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+func TestTotals(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := New("8.25")
+	require.NoError(t, err)
+
+	require.NoError(t, c.Add(Item{ID: "1", Description: "Widget", Price: money.MustParse("1.99"), Quantity: 3}))
+	require.NoError(t, c.Add(Item{
+		ID:        "2",
+		Price:     money.MustParse("10.00"),
+		Quantity:  1,
+		Discounts: []Discount{{Description: "Sale", Amount: money.MustParse("2.00")}},
+	}))
+	require.NoError(t, c.Add(Item{
+		ID:                "3",
+		Price:             money.MustParse("10.00"),
+		Quantity:          1,
+		TaxBeforeDiscount: true,
+		Discounts:         []Discount{{Description: "Coupon", Amount: money.MustParse("2.00")}},
+	}))
+	require.NoError(t, c.Add(Item{ID: "4", Price: money.MustParse("0.10"), Quantity: 0.5, TaxRate: "0"}))
+
+	lines := c.Lines()
+	require.Len(t, lines, 4)
+	assert.Equal(money.MustParse("5.97"), lines[0].Extended)
+	assert.Equal(money.MustParse("0.49"), lines[0].Tax)
+	assert.Equal(money.MustParse("0.66"), lines[1].Tax)
+	assert.Equal(money.MustParse("0.83"), lines[2].Tax)
+	assert.Equal(money.MustParse("0.05"), lines[3].Extended)
+	assert.Equal(money.Amount(0), lines[3].Tax)
+
+	totals := c.Totals()
+	assert.Equal(money.MustParse("22.02"), totals.Subtotal)
+	assert.Equal(money.MustParse("4.00"), totals.Discount)
+	assert.Equal(money.MustParse("1.98"), totals.Tax)
+	assert.Equal(totals.Subtotal+totals.Tax, totals.Total)
+
+	items := c.LineItems()
+	assert.Equal("0", items[0].DiscountCode)
+	assert.Equal("1", items[1].DiscountCode)
+	assert.Equal("2", items[2].DiscountCode)
+}
+
+func TestItemErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New("abc")
+	assert.ErrorIs(err, ErrInvalidTaxRate)
+
+	c, err := New("")
+	require.NoError(t, err)
+
+	assert.ErrorIs(c.Add(Item{}), ErrMissingID)
+	assert.ErrorIs(c.Add(Item{ID: "1", Quantity: -1}), ErrInvalidQuantity)
+	require.NoError(t, c.Add(Item{ID: "1", Quantity: 1}))
+	assert.ErrorIs(c.Add(Item{ID: "1", Quantity: 1}), ErrDuplicateItem)
+	assert.ErrorIs(c.Remove("2"), ErrUnknownItem)
+	assert.ErrorIs(c.SetTaxRate("1", "-1"), ErrInvalidTaxRate)
+
+	// Items are copied in and out.
+	item, ok := c.Item("1")
+	require.True(t, ok)
+	item.Quantity = 5
+	item, _ = c.Item("1")
+	assert.Equal(1.0, item.Quantity)
+}
+
+func TestApply(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := New("10")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(Item{ID: "1", Price: money.MustParse("5.00"), Quantity: 2}))
+
+	req := blockchyp.AuthorizationRequest{CurrencyCode: "usd"}
+	require.NoError(t, c.Apply(&req))
+	assert.Equal("11.00", req.Amount)
+	assert.Equal("1.00", req.TaxAmount)
+	assert.Len(req.LineItems, 1)
+
+	jpy := blockchyp.AuthorizationRequest{CurrencyCode: "JPY"}
+	assert.ErrorIs(c.Apply(&jpy), currency.ErrUnsupportedScale)
+	assert.Empty(jpy.Amount)
+}
+
+type fakeDisplay struct {
+	calls []string
+	items [][]string
+	fail  bool
+}
+
+func (d *fakeDisplay) record(call string, request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error) {
+	d.calls = append(d.calls, call)
+	ids := make([]string, 0)
+	for _, item := range request.Transaction.Items {
+		ids = append(ids, item.ID)
+	}
+	d.items = append(d.items, ids)
+	if d.fail {
+		return nil, errors.New("terminal busy")
+	}
+
+	return &blockchyp.Acknowledgement{Success: true}, nil
+}
+
+func (d *fakeDisplay) NewTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error) {
+	return d.record("new", request)
+}
+
+func (d *fakeDisplay) UpdateTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error) {
+	return d.record("update", request)
+}
+
+func TestPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := New("")
+	require.NoError(t, err)
+	d := &fakeDisplay{}
+	request := blockchyp.TransactionDisplayRequest{TerminalName: "Front"}
+
+	require.NoError(t, c.Add(Item{ID: "1", Price: money.MustParse("1.00"), Quantity: 1}))
+	require.NoError(t, c.Publish(d, request))
+
+	// Appended items are sent on their own.
+	require.NoError(t, c.Add(Item{ID: "2", Price: money.MustParse("2.00"), Quantity: 1}))
+	require.NoError(t, c.Publish(d, request))
+
+	// Nothing changed, so nothing is sent.
+	require.NoError(t, c.Publish(d, request))
+
+	// Changing a shown item redraws the whole display.
+	require.NoError(t, c.SetQuantity("1", 2))
+	require.NoError(t, c.Publish(d, request))
+
+	assert.Equal([]string{"new", "update", "new"}, d.calls)
+	assert.Equal([][]string{{"1"}, {"2"}, {"1", "2"}}, d.items)
+
+	// After a failure the next publish starts over.
+	d.fail = true
+	require.NoError(t, c.Add(Item{ID: "3", Price: money.MustParse("3.00"), Quantity: 1}))
+	assert.Error(c.Publish(d, request))
+	d.fail = false
+	require.NoError(t, c.Publish(d, request))
+	assert.Equal([]string{"new", "update", "new", "update", "new"}, d.calls)
+
+	c.Reset()
+	tx, reset := c.Changes()
+	assert.True(reset)
+	assert.Len(tx.Items, 3)
+}
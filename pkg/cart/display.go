@@ -0,0 +1,140 @@
+package cart
+
+import (
+	"errors"
+	"reflect"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// Display is the part of the BlockChyp client used to drive a terminal's
+// line item display. It is satisfied by *blockchyp.Client.
+type Display interface {
+	NewTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error)
+	UpdateTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error)
+}
+
+// snapshot records what was last sent to the terminal.
+type snapshot struct {
+	ids      []string
+	items    map[string]*blockchyp.TransactionDisplayItem
+	subtotal string
+	tax      string
+	total    string
+}
+
+// Changes returns the display request needed to bring the terminal in line
+// with the cart. When reset is false, the transaction only holds the items
+// added since the last Publish and should be sent with
+// UpdateTransactionDisplay. When reset is true, it holds the whole cart and
+// should be sent with NewTransactionDisplay; that happens the first time,
+// after Reset, and whenever items already shown were changed, removed or
+// reordered. UpdateTransactionDisplay appends items, combining them with
+// shown items of the same description, so it can't change an item in
+// place. A nil transaction means the terminal is already up to date.
+func (c *Cart) Changes() (tx *blockchyp.TransactionDisplayTransaction, reset bool) {
+	full := c.Display()
+
+	prev := c.shown
+	if prev == nil || !sameOrder(prev.ids, full.Items) {
+		return full, true
+	}
+
+	shown := len(prev.ids)
+	for _, item := range full.Items[:shown] {
+		if !reflect.DeepEqual(prev.items[item.ID], item) {
+			return full, true
+		}
+	}
+
+	added := full.Items[shown:]
+	if len(added) == 0 {
+		if full.Subtotal == prev.subtotal && full.Tax == prev.tax && full.Total == prev.total {
+			return nil, false
+		}
+
+		// Totals can't change without an item changing, but if they do,
+		// start over rather than send an update with nothing in it.
+		return full, true
+	}
+
+	full.Items = added
+
+	return full, false
+}
+
+// Publish sends whatever changed to the terminal named in the request,
+// using UpdateTransactionDisplay for added items and NewTransactionDisplay
+// for resets. The request's Transaction is replaced.
+func (c *Cart) Publish(d Display, request blockchyp.TransactionDisplayRequest) error {
+	tx, reset := c.Changes()
+	if tx == nil {
+		return nil
+	}
+
+	request.Transaction = tx
+
+	var ack *blockchyp.Acknowledgement
+	var err error
+	if reset {
+		ack, err = d.NewTransactionDisplay(request)
+	} else {
+		ack, err = d.UpdateTransactionDisplay(request)
+	}
+	if err != nil {
+		// The terminal may or may not have applied the request, so start
+		// from scratch next time.
+		c.shown = nil
+		return err
+	}
+	if !ack.Success {
+		c.shown = nil
+		return errors.New(ack.ResponseDescription)
+	}
+
+	c.markShown()
+
+	return nil
+}
+
+// Reset forgets what the terminal is showing, so the next Publish sends
+// the whole cart. Call it after the display has been cleared, such as when
+// a transaction completes or ClearTerminal is called.
+func (c *Cart) Reset() {
+	c.shown = nil
+}
+
+// markShown records the cart as displayed.
+func (c *Cart) markShown() {
+	full := c.Display()
+
+	s := &snapshot{
+		ids:      make([]string, 0, len(full.Items)),
+		items:    make(map[string]*blockchyp.TransactionDisplayItem, len(full.Items)),
+		subtotal: full.Subtotal,
+		tax:      full.Tax,
+		total:    full.Total,
+	}
+	for _, item := range full.Items {
+		s.ids = append(s.ids, item.ID)
+		s.items[item.ID] = item
+	}
+
+	c.shown = s
+}
+
+// sameOrder reports whether the items start with the previously shown IDs
+// in the same order. New items may follow.
+func sameOrder(shown []string, items []*blockchyp.TransactionDisplayItem) bool {
+	if len(items) < len(shown) {
+		return false
+	}
+
+	for i, id := range shown {
+		if items[i].ID != id {
+			return false
+		}
+	}
+
+	return true
+}
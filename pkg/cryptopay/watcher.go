@@ -0,0 +1,478 @@
+// Package cryptopay follows cryptocurrency payments from the moment a
+// charge returns until the payment is confirmed on its network, found to be
+// short, or expires unpaid. Confirmation happens long after the charge
+// itself, so a Watcher polls the transaction status API and reports each
+// change as an event.
+package cryptopay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// DefaultExpiry is how long a payment request waits for the customer to
+// send funds.
+const DefaultExpiry = 15 * time.Minute
+
+// DefaultConfirmations is the threshold for currencies not in the
+// thresholds table.
+const DefaultConfirmations = 6
+
+// DefaultThresholds gives the confirmations a level one payment needs,
+// keyed by cryptocurrency. Level two payments settle off chain and are
+// confirmed as soon as they're received.
+var DefaultThresholds = map[string]int{
+	"BTC":  6,
+	"BCH":  6,
+	"LTC":  6,
+	"DOGE": 6,
+	"ETH":  12,
+	"USDC": 12,
+	"USDT": 12,
+	"DAI":  12,
+}
+
+// ErrNotCrypto is returned when asked to watch a transaction that isn't a
+// cryptocurrency payment.
+var ErrNotCrypto = errors.New("not a cryptocurrency transaction")
+
+// Gateway is the subset of *blockchyp.Client used to follow payments.
+type Gateway interface {
+	TransactionStatus(request blockchyp.TransactionStatusRequest) (*blockchyp.AuthorizationResponse, error)
+}
+
+// State is where a payment is in its lifecycle.
+type State string
+
+// Payment states. Confirmed, Underpaid and Expired are final.
+const (
+	StatePending   State = "pending"
+	StateSeen      State = "seen"
+	StateConfirmed State = "confirmed"
+	StateUnderpaid State = "underpaid"
+	StateExpired   State = "expired"
+)
+
+// Final reports whether a payment in this state is no longer watched.
+func (s State) Final() bool {
+	return s == StateConfirmed || s == StateUnderpaid || s == StateExpired
+}
+
+// EventType identifies a payment event.
+type EventType string
+
+// Payment events.
+const (
+	// EventSeen is sent when the customer's transaction reaches the network.
+	EventSeen EventType = "seen"
+
+	// EventConfirmation is sent each time the confirmation count rises
+	// without reaching the threshold.
+	EventConfirmation EventType = "confirmation"
+
+	EventConfirmed EventType = "confirmed"
+	EventUnderpaid EventType = "underpaid"
+	EventExpired   EventType = "expired"
+)
+
+// Event reports a change to a payment.
+type Event struct {
+	Type EventType `json:"type"`
+	At   time.Time `json:"at"`
+
+	// Payment is the payment after the event.
+	Payment Payment `json:"payment"`
+}
+
+// Payment is a cryptocurrency payment being watched.
+type Payment struct {
+	TransactionID  string `json:"transactionId"`
+	TransactionRef string `json:"transactionRef,omitempty"`
+	Test           bool   `json:"test"`
+
+	Cryptocurrency string `json:"cryptocurrency"`
+	Network        string `json:"network"`
+
+	// RequestedAmount and AuthorizedAmount are in the transaction's
+	// currency; CryptoAmount is what was sent on the network.
+	RequestedAmount  string `json:"requestedAmount"`
+	AuthorizedAmount string `json:"authorizedAmount,omitempty"`
+	CryptoAmount     string `json:"cryptoAmount,omitempty"`
+
+	CryptoTransactionID string `json:"cryptoTransactionId,omitempty"`
+	CryptoBlock         string `json:"cryptoBlock,omitempty"`
+	CryptoStatus        string `json:"cryptoStatus,omitempty"`
+
+	State         State `json:"state"`
+	Confirmations int   `json:"confirmations"`
+	Required      int   `json:"required"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Watcher polls pending cryptocurrency payments and reports their progress.
+type Watcher struct {
+	Gateway Gateway
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	// Expiry is how long a payment can go unpaid before it expires.
+	// Defaults to DefaultExpiry. Once the customer's transaction has been
+	// seen on the network it's watched until it confirms.
+	Expiry time.Duration
+
+	// Thresholds overrides DefaultThresholds. Keys are a cryptocurrency,
+	// such as BTC, or a cryptocurrency and network, such as BTC/L2.
+	Thresholds map[string]int
+
+	// Confirmations extracts the confirmation count from a status
+	// response, reporting false if the response doesn't carry one. The
+	// default reads counts such as "3 confirmations" from CryptoStatus.
+	// When no count is available, the gateway's Confirmed flag is taken to
+	// mean the threshold has been met.
+	Confirmations func(res *blockchyp.AuthorizationResponse) (int, bool)
+
+	// UnderpaidTolerance is how far short of the requested amount a
+	// payment can be and still count as paid in full, to allow for
+	// exchange rate rounding.
+	UnderpaidTolerance money.Amount
+
+	// OnEvent is called for each event, in order, from the goroutine
+	// calling Watch or Poll. The watcher isn't locked meanwhile, so it can
+	// call Pending, but it mustn't call Poll.
+	OnEvent func(Event)
+
+	lock     sync.Mutex
+	payments map[string]*Payment
+
+	// pollLock serializes Poll, which releases lock while it waits on the
+	// gateway, so a payment's events are delivered in order.
+	pollLock sync.Mutex
+}
+
+// NewWatcher returns a Watcher backed by the given gateway.
+func NewWatcher(gateway Gateway) *Watcher {
+	return &Watcher{
+		Gateway: gateway,
+		Now:     time.Now,
+		Expiry:  DefaultExpiry,
+	}
+}
+
+// Watch starts watching the payment a crypto charge returned. The response
+// is evaluated at once, so a payment already confirmed produces its events
+// immediately and isn't watched.
+func (w *Watcher) Watch(res *blockchyp.AuthorizationResponse) (Payment, error) {
+	if res == nil || res.Cryptocurrency == "" {
+		return Payment{}, ErrNotCrypto
+	}
+	if res.TransactionID == "" && res.TransactionRef == "" {
+		return Payment{}, errors.New("transaction id or ref required")
+	}
+
+	w.lock.Lock()
+
+	now := w.now()
+	expiry := w.Expiry
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+
+	p := &Payment{
+		TransactionID:   res.TransactionID,
+		TransactionRef:  res.TransactionRef,
+		Test:            res.Test,
+		Cryptocurrency:  strings.ToUpper(res.Cryptocurrency),
+		Network:         strings.ToUpper(res.CryptoNetwork),
+		RequestedAmount: res.RequestedAmount,
+		State:           StatePending,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(expiry),
+	}
+	p.Required = w.required(p)
+
+	events := w.update(p, res)
+	payment := *p
+	w.lock.Unlock()
+
+	// The payment isn't polled until its first events are out, so they
+	// can't be overtaken.
+	w.deliver(events)
+	if !payment.State.Final() {
+		w.lock.Lock()
+		if w.payments == nil {
+			w.payments = make(map[string]*Payment)
+		}
+		w.payments[key(p)] = p
+		w.lock.Unlock()
+	}
+
+	return payment, nil
+}
+
+// Pending returns the payments still being watched, oldest first.
+func (w *Watcher) Pending() []Payment {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pending := make([]Payment, 0, len(w.payments))
+	for _, p := range w.payments {
+		pending = append(pending, *p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].CreatedAt.Equal(pending[j].CreatedAt) {
+			return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+		}
+		return key(&pending[i]) < key(&pending[j])
+	})
+
+	return pending
+}
+
+// Poll checks every pending payment once. Payments that reach a final state
+// stop being watched. Gateway errors are returned together and the
+// payments they affect are checked again on the next poll. Polls run one at
+// a time; the watcher isn't locked while they wait on the gateway.
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.pollLock.Lock()
+	defer w.pollLock.Unlock()
+
+	w.lock.Lock()
+	keys := make([]string, 0, len(w.payments))
+	requests := make(map[string]blockchyp.TransactionStatusRequest, len(w.payments))
+	for k, p := range w.payments {
+		keys = append(keys, k)
+		requests[k] = blockchyp.TransactionStatusRequest{
+			Test:           p.Test,
+			TransactionID:  p.TransactionID,
+			TransactionRef: p.TransactionRef,
+		}
+	}
+	w.lock.Unlock()
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := w.Gateway.TransactionStatus(requests[k])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+			continue
+		}
+
+		w.lock.Lock()
+		var events []Event
+		if p, ok := w.payments[k]; ok {
+			events = w.update(p, res)
+			if p.State.Final() {
+				delete(w.payments, k)
+			}
+		}
+		w.lock.Unlock()
+
+		w.deliver(events)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Run calls Poll every interval until the context is canceled. Errors are
+// logged and the loop carries on.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("crypto payment poll failed: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// update applies a status response to a payment and returns an event for
+// each change. The lock must be held.
+func (w *Watcher) update(p *Payment, res *blockchyp.AuthorizationResponse) []Event {
+	now := w.now()
+	p.UpdatedAt = now
+	events := make([]Event, 0)
+
+	if res.TransactionID != "" {
+		p.TransactionID = res.TransactionID
+	}
+	if res.RequestedAmount != "" {
+		p.RequestedAmount = res.RequestedAmount
+	}
+	p.AuthorizedAmount = res.AuthorizedAmount
+	p.CryptoAmount = res.CryptoAuthorizedAmount
+	p.CryptoTransactionID = res.CryptoTransactionID
+	p.CryptoBlock = res.CryptoBlock
+	p.CryptoStatus = res.CryptoStatus
+
+	received := res.CryptoTransactionID != "" || res.Approved
+	if !received {
+		if statusIs(res, "expired") || !now.Before(p.ExpiresAt) {
+			p.State = StateExpired
+			events = append(events, newEvent(p, EventExpired))
+		}
+		return events
+	}
+
+	if p.State == StatePending {
+		p.State = StateSeen
+		events = append(events, newEvent(p, EventSeen))
+	}
+
+	if w.underpaid(res) {
+		p.State = StateUnderpaid
+		events = append(events, newEvent(p, EventUnderpaid))
+		return events
+	}
+
+	n, ok := w.confirmations(res)
+	if !ok && res.Confirmed {
+		n = max(p.Required, p.Confirmations)
+	}
+
+	if n >= p.Required {
+		p.Confirmations = n
+		p.State = StateConfirmed
+		events = append(events, newEvent(p, EventConfirmed))
+		return events
+	}
+	if n > p.Confirmations {
+		p.Confirmations = n
+		events = append(events, newEvent(p, EventConfirmation))
+	}
+
+	return events
+}
+
+// underpaid reports whether less arrived than was asked for. Amounts are
+// only compared once the payment is approved, since the authorized amount
+// isn't known before then.
+func (w *Watcher) underpaid(res *blockchyp.AuthorizationResponse) bool {
+	if statusIs(res, "underpaid") || res.PartialAuth {
+		return true
+	}
+	if !res.Approved || res.RequestedAmount == "" || res.AuthorizedAmount == "" {
+		return false
+	}
+
+	requested, err := money.Parse(res.RequestedAmount)
+	if err != nil {
+		return false
+	}
+	authorized, err := money.Parse(res.AuthorizedAmount)
+	if err != nil {
+		return false
+	}
+
+	return requested-authorized > w.UnderpaidTolerance
+}
+
+func (w *Watcher) required(p *Payment) int {
+	thresholds := w.Thresholds
+	if thresholds == nil {
+		thresholds = DefaultThresholds
+	}
+
+	if n, ok := thresholds[p.Cryptocurrency+"/"+p.Network]; ok {
+		return n
+	}
+	if p.Network == "L2" {
+		return 0
+	}
+	if n, ok := thresholds[p.Cryptocurrency]; ok {
+		return n
+	}
+
+	return DefaultConfirmations
+}
+
+func (w *Watcher) confirmations(res *blockchyp.AuthorizationResponse) (int, bool) {
+	if w.Confirmations != nil {
+		return w.Confirmations(res)
+	}
+
+	return StatusConfirmations(res)
+}
+
+var confirmationCount = regexp.MustCompile(`(?i)(\d+)(?:\s*/\s*\d+)?\s*confirmation`)
+
+// StatusConfirmations reads a confirmation count such as "3 confirmations"
+// or "3/6 confirmations" from a response's CryptoStatus.
+func StatusConfirmations(res *blockchyp.AuthorizationResponse) (int, bool) {
+	m := confirmationCount.FindStringSubmatch(res.CryptoStatus)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func newEvent(p *Payment, event EventType) Event {
+	return Event{
+		Type:    event,
+		At:      p.UpdatedAt,
+		Payment: *p,
+	}
+}
+
+// deliver passes events to OnEvent. It's called without the lock.
+func (w *Watcher) deliver(events []Event) {
+	if w.OnEvent == nil {
+		return
+	}
+
+	for _, e := range events {
+		w.OnEvent(e)
+	}
+}
+
+func (w *Watcher) now() time.Time {
+	if w.Now == nil {
+		return time.Now()
+	}
+
+	return w.Now()
+}
+
+func statusIs(res *blockchyp.AuthorizationResponse, word string) bool {
+	return strings.Contains(strings.ToLower(res.CryptoStatus), word) ||
+		strings.EqualFold(res.Status, word)
+}
+
+func key(p *Payment) string {
+	if p.TransactionID != "" {
+		return p.TransactionID
+	}
+
+	return "ref:" + p.TransactionRef
+}
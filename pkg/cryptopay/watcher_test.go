@@ -0,0 +1,268 @@
+package cryptopay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// fakeGateway answers status requests with queued responses, repeating the
+// last one once the queue runs out.
+type fakeGateway struct {
+	responses map[string][]*blockchyp.AuthorizationResponse
+	err       error
+}
+
+func (g *fakeGateway) TransactionStatus(request blockchyp.TransactionStatusRequest) (*blockchyp.AuthorizationResponse, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	queue := g.responses[request.TransactionID]
+	res := queue[0]
+	if len(queue) > 1 {
+		g.responses[request.TransactionID] = queue[1:]
+	}
+
+	return res, nil
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newWatcher(g Gateway) (*Watcher, *clock, *[]EventType) {
+	c := &clock{now: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)}
+	events := make([]EventType, 0)
+
+	w := NewWatcher(g)
+	w.Now = c.Now
+	w.OnEvent = func(e Event) { events = append(events, e.Type) }
+
+	return w, c, &events
+}
+
+func charge(id, currency, network string) *blockchyp.AuthorizationResponse {
+	return &blockchyp.AuthorizationResponse{
+		TransactionID:   id,
+		Cryptocurrency:  currency,
+		CryptoNetwork:   network,
+		RequestedAmount: "25.00",
+	}
+}
+
+func received(id, status string) *blockchyp.AuthorizationResponse {
+	res := charge(id, "BTC", "L1")
+	res.Approved = true
+	res.AuthorizedAmount = "25.00"
+	res.CryptoTransactionID = "0xabc"
+	res.CryptoStatus = status
+
+	return res
+}
+
+func TestWatchUntilConfirmed(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{responses: map[string][]*blockchyp.AuthorizationResponse{
+		"TX1": {
+			charge("TX1", "BTC", "L1"),
+			received("TX1", "2 confirmations"),
+			received("TX1", "4/6 confirmations"),
+			received("TX1", "6 confirmations"),
+		},
+	}}
+	w, _, events := newWatcher(g)
+
+	p, err := w.Watch(charge("TX1", "btc", "l1"))
+	require.NoError(t, err)
+	assert.Equal(StatePending, p.State)
+	assert.Equal(6, p.Required)
+	assert.Equal("BTC", p.Cryptocurrency)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.Poll(context.Background()))
+		require.Len(t, w.Pending(), 1)
+	}
+	assert.Equal(StateSeen, w.Pending()[0].State)
+	assert.Equal(4, w.Pending()[0].Confirmations)
+
+	require.NoError(t, w.Poll(context.Background()))
+	assert.Empty(w.Pending())
+	assert.Equal([]EventType{EventSeen, EventConfirmation, EventConfirmation, EventConfirmed}, *events)
+}
+
+func TestWatchExpires(t *testing.T) {
+	g := &fakeGateway{responses: map[string][]*blockchyp.AuthorizationResponse{
+		"TX1": {charge("TX1", "ETH", "")},
+	}}
+	w, c, events := newWatcher(g)
+
+	p, err := w.Watch(charge("TX1", "ETH", ""))
+	require.NoError(t, err)
+	assert.Equal(t, 12, p.Required)
+
+	require.NoError(t, w.Poll(context.Background()))
+	require.Len(t, w.Pending(), 1)
+
+	c.now = c.now.Add(DefaultExpiry)
+	require.NoError(t, w.Poll(context.Background()))
+	assert.Empty(t, w.Pending())
+	assert.Equal(t, []EventType{EventExpired}, *events)
+}
+
+func TestWatchSeenPaymentOutlivesExpiry(t *testing.T) {
+	g := &fakeGateway{responses: map[string][]*blockchyp.AuthorizationResponse{
+		"TX1": {received("TX1", "1 confirmation")},
+	}}
+	w, c, _ := newWatcher(g)
+
+	_, err := w.Watch(charge("TX1", "BTC", "L1"))
+	require.NoError(t, err)
+
+	c.now = c.now.Add(2 * DefaultExpiry)
+	require.NoError(t, w.Poll(context.Background()))
+	require.Len(t, w.Pending(), 1)
+	assert.Equal(t, StateSeen, w.Pending()[0].State)
+}
+
+func TestWatchUnderpaid(t *testing.T) {
+	assert := assert.New(t)
+
+	short := received("TX1", "")
+	short.AuthorizedAmount = "24.90"
+
+	w, _, events := newWatcher(&fakeGateway{})
+	p, err := w.Watch(short)
+	require.NoError(t, err)
+	assert.Equal(StateUnderpaid, p.State)
+	assert.Equal([]EventType{EventSeen, EventUnderpaid}, *events)
+	assert.Empty(w.Pending())
+
+	// Within the tolerance the payment counts as paid.
+	w, _, _ = newWatcher(&fakeGateway{})
+	w.UnderpaidTolerance = money.MustParse("0.10")
+	short.Confirmed = true
+	p, err = w.Watch(short)
+	require.NoError(t, err)
+	assert.Equal(StateConfirmed, p.State)
+}
+
+func TestWatchLayerTwoConfirmsOnReceipt(t *testing.T) {
+	res := received("TX1", "")
+	res.CryptoNetwork = "L2"
+
+	w, _, events := newWatcher(&fakeGateway{})
+	p, err := w.Watch(res)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, p.Required)
+	assert.Equal(t, StateConfirmed, p.State)
+	assert.Equal(t, []EventType{EventSeen, EventConfirmed}, *events)
+}
+
+func TestWatchThresholdOverrides(t *testing.T) {
+	w, _, _ := newWatcher(&fakeGateway{})
+	w.Thresholds = map[string]int{"BTC": 2, "BTC/L2": 1}
+
+	p, err := w.Watch(charge("TX1", "BTC", "L1"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.Required)
+
+	p, err = w.Watch(charge("TX2", "BTC", "L2"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.Required)
+
+	p, err = w.Watch(charge("TX3", "XMR", ""))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfirmations, p.Required)
+}
+
+func TestWatchRejectsOtherTransactions(t *testing.T) {
+	w, _, _ := newWatcher(&fakeGateway{})
+
+	_, err := w.Watch(&blockchyp.AuthorizationResponse{TransactionID: "TX1"})
+	assert.True(t, errors.Is(err, ErrNotCrypto))
+
+	_, err = w.Watch(&blockchyp.AuthorizationResponse{Cryptocurrency: "BTC"})
+	assert.Error(t, err)
+}
+
+func TestPollErrorKeepsPayment(t *testing.T) {
+	g := &fakeGateway{}
+	w, _, _ := newWatcher(g)
+
+	_, err := w.Watch(charge("TX1", "BTC", "L1"))
+	require.NoError(t, err)
+
+	g.err = errors.New("gateway unavailable")
+	err = w.Poll(context.Background())
+	assert.EqualError(t, err, "TX1: gateway unavailable")
+	assert.Len(t, w.Pending(), 1)
+}
+
+func TestStatusConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	for status, want := range map[string]int{
+		"3 confirmations":          3,
+		"3/6 Confirmations":        3,
+		"pending (1 confirmation)": 1,
+	} {
+		n, ok := StatusConfirmations(&blockchyp.AuthorizationResponse{CryptoStatus: status})
+		assert.True(ok, status)
+		assert.Equal(want, n, status)
+	}
+
+	_, ok := StatusConfirmations(&blockchyp.AuthorizationResponse{CryptoStatus: "pending"})
+	assert.False(ok)
+}
+
+// blockingGateway waits for release before answering.
+type blockingGateway struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingGateway) TransactionStatus(request blockchyp.TransactionStatusRequest) (*blockchyp.AuthorizationResponse, error) {
+	close(g.started)
+	<-g.release
+
+	return received(request.TransactionID, "6 confirmations"), nil
+}
+
+func TestPollDoesNotLockWhileWaiting(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &blockingGateway{started: make(chan struct{}), release: make(chan struct{})}
+	w, _, _ := newWatcher(g)
+
+	var pending []int
+	w.OnEvent = func(e Event) { pending = append(pending, len(w.Pending())) }
+
+	_, err := w.Watch(charge("TX1", "BTC", "L1"))
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() { done <- w.Poll(context.Background()) }()
+	<-g.started
+
+	// The watcher can be checked on while the gateway is slow.
+	assert.Len(w.Pending(), 1)
+
+	close(g.release)
+	require.NoError(t, <-done)
+	assert.Equal([]int{0, 0}, pending)
+	assert.Empty(w.Pending())
+}
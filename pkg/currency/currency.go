@@ -0,0 +1,247 @@
+// Package currency describes the currencies a transaction can be priced in:
+// the ISO 4217 table with minor units, symbols and cash rounding
+// increments, validation of the currency fields on a request, alternate
+// prices converted from a merchant supplied rate table, and locale aware
+// formatting for displays and receipts.
+package currency
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// Default is the currency assumed when a request doesn't name one.
+const Default = "USD"
+
+var (
+	// ErrUnknownCurrency is returned for codes not in the currency table.
+	ErrUnknownCurrency = errors.New("unknown currency")
+
+	// ErrInvalidAmount is returned for amounts that aren't decimal numbers.
+	ErrInvalidAmount = errors.New("invalid amount")
+
+	// ErrPrecision is returned for amounts with more decimal places than the
+	// currency allows, such as cents on a yen amount.
+	ErrPrecision = errors.New("amount has too many decimal places")
+
+	// ErrUnsupportedScale is returned by RequireCents for currencies that
+	// don't have two decimal places.
+	ErrUnsupportedScale = errors.New("currency does not have two decimal places")
+)
+
+// Currency is an ISO 4217 currency, or a cryptocurrency that can be used
+// in alternate prices.
+type Currency struct {
+	Code    string
+	Numeric string
+	Name    string
+
+	// MinorUnits is the number of decimal places, such as 2 for dollars, 0
+	// for yen and 3 for dinars.
+	MinorUnits int
+
+	// Symbol is unambiguous, such as CA$. NarrowSymbol is how the currency
+	// is written at home, such as $. Currencies without a well known
+	// symbol use their code for both.
+	Symbol       string
+	NarrowSymbol string
+
+	// CashIncrement is the smallest cash amount in minor units, such as 5
+	// for Swiss francs. It's 1 for currencies whose smallest coin is the
+	// minor unit.
+	CashIncrement int64
+
+	Crypto bool
+}
+
+// Lookup finds a currency by its alphabetic code, case insensitive.
+func Lookup(code string) (Currency, bool) {
+	c, ok := currencies[strings.ToUpper(strings.TrimSpace(code))]
+
+	return c, ok
+}
+
+// MustLookup is Lookup for codes known to be valid, such as constants.
+func MustLookup(code string) Currency {
+	c, ok := Lookup(code)
+	if !ok {
+		panic(fmt.Sprintf("currency: unknown code %q", code))
+	}
+
+	return c
+}
+
+// All returns every currency, sorted by code.
+func All() []Currency {
+	all := make([]Currency, 0, len(currencies))
+	for _, c := range currencies {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Code < all[j].Code
+	})
+
+	return all
+}
+
+// Validate checks a currency code a transaction can be priced in. Blank
+// codes are valid and mean Default; cryptocurrencies are not valid here.
+func Validate(code string) error {
+	if strings.TrimSpace(code) == "" {
+		return nil
+	}
+
+	c, ok := Lookup(code)
+	if !ok || c.Crypto {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+	}
+
+	return nil
+}
+
+// RequireCents checks a currency code for packages that keep amounts as
+// money.Amount, which always has two decimal places. Blank codes mean
+// Default. Yen, dinars and other currencies with a different number of
+// decimal places return ErrUnsupportedScale rather than being mis-scaled.
+func RequireCents(code string) error {
+	if err := Validate(code); err != nil {
+		return err
+	}
+	if strings.TrimSpace(code) == "" {
+		code = Default
+	}
+
+	if c := MustLookup(code); c.MinorUnits != 2 {
+		return fmt.Errorf("%w: %s has %d", ErrUnsupportedScale, c.Code, c.MinorUnits)
+	}
+
+	return nil
+}
+
+// Rat parses a decimal amount exactly, checking it has no more decimal
+// places than the currency allows. Trailing zeros are ignored, so 100.00
+// is a valid yen amount and 100.50 isn't.
+func (c Currency) Rat(amount string) (*big.Rat, error) {
+	s := strings.TrimSpace(amount)
+	if s == "" || strings.ContainsAny(s, "eE/") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAmount, amount)
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAmount, amount)
+	}
+
+	scaled := new(big.Rat).Mul(r, c.unit())
+	if !scaled.IsInt() {
+		return nil, fmt.Errorf("%w: %q in %s", ErrPrecision, amount, c.Code)
+	}
+
+	return r, nil
+}
+
+// Parse returns an amount in minor units.
+func (c Currency) Parse(amount string) (int64, error) {
+	r, err := c.Rat(amount)
+	if err != nil {
+		return 0, err
+	}
+
+	minor := new(big.Rat).Mul(r, c.unit()).Num()
+	if !minor.IsInt64() {
+		return 0, fmt.Errorf("%w: %q is out of range", ErrInvalidAmount, amount)
+	}
+
+	return minor.Int64(), nil
+}
+
+// String formats an amount in minor units the way the gateway expects it,
+// with exactly MinorUnits decimal places and no symbol.
+func (c Currency) String(minor int64) string {
+	return new(big.Rat).Quo(big.NewRat(minor, 1), c.unit()).FloatString(c.MinorUnits)
+}
+
+// Round rounds an exact amount to the currency's minor unit and formats it
+// for the gateway.
+func (c Currency) Round(amount *big.Rat, mode money.Rounding) string {
+	minor := money.RoundInt(new(big.Rat).Mul(amount, c.unit()), mode)
+
+	return new(big.Rat).SetFrac(minor, c.unit().Num()).FloatString(c.MinorUnits)
+}
+
+// CashRound rounds an amount in minor units to the currency's cash
+// increment, as when a Swiss franc total is paid in coins.
+func (c Currency) CashRound(minor int64, mode money.Rounding) int64 {
+	if c.CashIncrement <= 1 {
+		return minor
+	}
+
+	return money.RoundInt(big.NewRat(minor, c.CashIncrement), mode).Int64() * c.CashIncrement
+}
+
+// unit is the number of minor units in a major unit.
+func (c Currency) unit() *big.Rat {
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(c.MinorUnits)), nil))
+}
+
+// ValidateRequest checks a request's currency code, that its amounts suit
+// the currency's minor units, and that any alternate prices are in known
+// currencies and well formed.
+func ValidateRequest(req *blockchyp.AuthorizationRequest) error {
+	if err := Validate(req.CurrencyCode); err != nil {
+		return err
+	}
+
+	code := req.CurrencyCode
+	if strings.TrimSpace(code) == "" {
+		code = Default
+	}
+	c, _ := Lookup(code)
+
+	var errs []error
+	amounts := []struct {
+		name  string
+		value string
+	}{
+		{"amount", req.Amount},
+		{"tipAmount", req.TipAmount},
+		{"taxAmount", req.TaxAmount},
+		{"healthcareTotal", req.HealthcareTotal},
+		{"ebtTotal", req.EBTTotal},
+		{"shippingAmount", req.ShippingAmount},
+		{"dutyAmount", req.DutyAmount},
+		{"totalDiscountAmount", req.TotalDiscountAmount},
+	}
+	for _, a := range amounts {
+		if a.value == "" {
+			continue
+		}
+		if _, err := c.Rat(a.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.name, err))
+		}
+	}
+
+	codes := make([]string, 0, len(req.AltPrices))
+	for alt := range req.AltPrices {
+		codes = append(codes, alt)
+	}
+	sort.Strings(codes)
+	for _, alt := range codes {
+		ac, ok := Lookup(alt)
+		if !ok {
+			errs = append(errs, fmt.Errorf("altPrices: %w: %q", ErrUnknownCurrency, alt))
+			continue
+		}
+		if _, err := ac.Rat(req.AltPrices[alt]); err != nil {
+			errs = append(errs, fmt.Errorf("altPrices %s: %w", alt, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
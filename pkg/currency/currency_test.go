@@ -0,0 +1,42 @@
+package currency
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireCents(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(RequireCents(""))
+	assert.NoError(RequireCents("usd"))
+	assert.NoError(RequireCents("EUR"))
+
+	for _, code := range []string{"JPY", "KWD", "CLP"} {
+		err := RequireCents(code)
+		assert.True(errors.Is(err, ErrUnsupportedScale), code)
+	}
+
+	assert.True(errors.Is(RequireCents("XYZ"), ErrUnknownCurrency))
+	assert.True(errors.Is(RequireCents("BTC"), ErrUnknownCurrency))
+}
+
+func TestParseScale(t *testing.T) {
+	assert := assert.New(t)
+
+	minor, err := MustLookup("JPY").Parse("1000")
+	require.NoError(t, err)
+	assert.Equal(int64(1000), minor)
+	assert.Equal("1000", MustLookup("JPY").String(minor))
+
+	minor, err = MustLookup("KWD").Parse("1.234")
+	require.NoError(t, err)
+	assert.Equal(int64(1234), minor)
+	assert.Equal("1.234", MustLookup("KWD").String(minor))
+
+	_, err = MustLookup("JPY").Parse("100.50")
+	assert.True(errors.Is(err, ErrPrecision))
+}
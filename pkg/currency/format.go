@@ -0,0 +1,185 @@
+package currency
+
+import (
+	"strings"
+)
+
+// DefaultLocale is used for locales that aren't in the locale table.
+const DefaultLocale = "en-US"
+
+// Locale describes how a region writes amounts of money. Spaces are
+// ordinary spaces rather than the non-breaking ones typographers use, so
+// output prints cleanly on receipt printers.
+type Locale struct {
+	Tag string
+
+	// Currency is the region's own currency, shown with its narrow symbol.
+	// Other currencies are shown with their unambiguous symbol.
+	Currency string
+
+	Decimal string
+	Group   string
+
+	// SymbolAfter writes the symbol after the number, and SymbolSpace puts
+	// a space between them.
+	SymbolAfter bool
+	SymbolSpace bool
+
+	// IndianGrouping groups digits above the thousands in pairs, as in
+	// 12,34,567.00.
+	IndianGrouping bool
+}
+
+var locales = map[string]Locale{
+	"en-US": {Tag: "en-US", Currency: "USD", Decimal: ".", Group: ","},
+	"en-CA": {Tag: "en-CA", Currency: "CAD", Decimal: ".", Group: ","},
+	"fr-CA": {Tag: "fr-CA", Currency: "CAD", Decimal: ",", Group: " ", SymbolAfter: true, SymbolSpace: true},
+	"en-GB": {Tag: "en-GB", Currency: "GBP", Decimal: ".", Group: ","},
+	"en-IE": {Tag: "en-IE", Currency: "EUR", Decimal: ".", Group: ","},
+	"en-AU": {Tag: "en-AU", Currency: "AUD", Decimal: ".", Group: ","},
+	"en-NZ": {Tag: "en-NZ", Currency: "NZD", Decimal: ".", Group: ","},
+	"en-IN": {Tag: "en-IN", Currency: "INR", Decimal: ".", Group: ",", IndianGrouping: true},
+	"es-US": {Tag: "es-US", Currency: "USD", Decimal: ".", Group: ","},
+	"es-MX": {Tag: "es-MX", Currency: "MXN", Decimal: ".", Group: ","},
+	"es-ES": {Tag: "es-ES", Currency: "EUR", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"fr-FR": {Tag: "fr-FR", Currency: "EUR", Decimal: ",", Group: " ", SymbolAfter: true, SymbolSpace: true},
+	"de-DE": {Tag: "de-DE", Currency: "EUR", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"de-CH": {Tag: "de-CH", Currency: "CHF", Decimal: ".", Group: "'", SymbolSpace: true},
+	"it-IT": {Tag: "it-IT", Currency: "EUR", Decimal: ",", Group: ".", SymbolAfter: true, SymbolSpace: true},
+	"nl-NL": {Tag: "nl-NL", Currency: "EUR", Decimal: ",", Group: ".", SymbolSpace: true},
+	"pt-BR": {Tag: "pt-BR", Currency: "BRL", Decimal: ",", Group: ".", SymbolSpace: true},
+	"pt-PT": {Tag: "pt-PT", Currency: "EUR", Decimal: ",", Group: " ", SymbolAfter: true, SymbolSpace: true},
+	"ja-JP": {Tag: "ja-JP", Currency: "JPY", Decimal: ".", Group: ","},
+	"zh-CN": {Tag: "zh-CN", Currency: "CNY", Decimal: ".", Group: ","},
+	"ko-KR": {Tag: "ko-KR", Currency: "KRW", Decimal: ".", Group: ","},
+}
+
+// LookupLocale finds a locale by its language tag, such as fr-CA. Tags
+// are matched case insensitively and with either a dash or underscore. A
+// tag with an unknown region falls back to the language's home region, and
+// anything else to DefaultLocale.
+func LookupLocale(tag string) Locale {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	lang, region, _ := strings.Cut(tag, "-")
+	lang, region = strings.ToLower(lang), strings.ToUpper(region)
+
+	if l, ok := locales[lang+"-"+region]; ok {
+		return l
+	}
+
+	// Otherwise the region where the language is from.
+	fallbacks := map[string]string{
+		"en": "en-US",
+		"es": "es-ES",
+		"fr": "fr-FR",
+		"de": "de-DE",
+		"pt": "pt-PT",
+		"it": "it-IT",
+		"nl": "nl-NL",
+		"ja": "ja-JP",
+		"zh": "zh-CN",
+		"ko": "ko-KR",
+	}
+	if l, ok := locales[fallbacks[lang]]; ok {
+		return l
+	}
+
+	return locales[DefaultLocale]
+}
+
+// Format writes an amount for people to read, such as $1,234.50 or
+// 1.234,50 €, with the currency's decimal places. The amount is a decimal
+// string as used by the gateway; amounts that don't parse are returned
+// unchanged with the currency code after them, so a receipt still prints.
+func Format(amount, code, locale string) string {
+	return format(amount, code, locale, false)
+}
+
+// FormatCode is Format with the currency code in place of the symbol, such
+// as USD 1,234.50, for printers that can only print ASCII.
+func FormatCode(amount, code, locale string) string {
+	return format(amount, code, locale, true)
+}
+
+func format(amount, code, locale string, byCode bool) string {
+	if strings.TrimSpace(code) == "" {
+		code = Default
+	}
+	c, ok := Lookup(code)
+	if !ok {
+		return amount + " " + code
+	}
+
+	r, err := c.Rat(amount)
+	if err != nil {
+		return amount + " " + c.Code
+	}
+
+	l := LookupLocale(locale)
+	symbol := c.Symbol
+	switch {
+	case byCode:
+		symbol = c.Code
+	case c.Code == l.Currency:
+		symbol = c.NarrowSymbol
+	}
+
+	return l.format(r.FloatString(c.MinorUnits), symbol, symbol == c.Code)
+}
+
+// format lays out a fixed point decimal string with a currency symbol.
+// Codes are always set apart from the number by a space.
+func (l Locale) format(s, symbol string, isCode bool) string {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+
+	var b strings.Builder
+	if negative {
+		b.WriteString("-")
+	}
+
+	sep := ""
+	if l.SymbolSpace || isCode {
+		sep = " "
+	}
+
+	if !l.SymbolAfter {
+		b.WriteString(symbol)
+		b.WriteString(sep)
+	}
+	b.WriteString(group(whole, l))
+	if frac != "" {
+		b.WriteString(l.Decimal)
+		b.WriteString(frac)
+	}
+	if l.SymbolAfter {
+		b.WriteString(sep)
+		b.WriteString(symbol)
+	}
+
+	return b.String()
+}
+
+// group inserts group separators into a string of digits.
+func group(digits string, l Locale) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	head, tail := digits[:len(digits)-3], digits[len(digits)-3:]
+	size := 3
+	if l.IndianGrouping {
+		size = 2
+	}
+
+	parts := []string{tail}
+	for len(head) > size {
+		parts = append([]string{head[len(head)-size:]}, parts...)
+		head = head[:len(head)-size]
+	}
+	parts = append([]string{head}, parts...)
+
+	return strings.Join(parts, l.Group)
+}
@@ -0,0 +1,212 @@
+package currency
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// ErrNoRate is returned when a conversion needs a currency missing from
+// the rate table.
+var ErrNoRate = errors.New("no exchange rate")
+
+// Rates is an exchange rate table quoted against a base currency: each
+// rate is how much of a currency one unit of the base buys.
+type Rates struct {
+	Base  string
+	rates map[string]*big.Rat
+}
+
+// NewRates builds a rate table from decimal rates keyed by currency code.
+func NewRates(base string, rates map[string]string) (*Rates, error) {
+	b, ok := Lookup(base)
+	if !ok {
+		return nil, fmt.Errorf("%w: base %q", ErrUnknownCurrency, base)
+	}
+
+	t := &Rates{Base: b.Code, rates: make(map[string]*big.Rat)}
+	for code, rate := range rates {
+		if err := t.Set(code, rate); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// ReadRates reads a rate table from CSV rows of currency code and rate,
+// such as "EUR,0.9214". A header row and lines starting with # are
+// skipped.
+func ReadRates(base string, r io.Reader) (*Rates, error) {
+	t, err := NewRates(base, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("rate table line %d: expected currency and rate", line(cr))
+		}
+		if _, ok := new(big.Rat).SetString(strings.TrimSpace(record[1])); !ok && first {
+			// A header row.
+			continue
+		}
+		if err := t.Set(record[0], record[1]); err != nil {
+			return nil, fmt.Errorf("rate table line %d: %w", line(cr), err)
+		}
+	}
+
+	return t, nil
+}
+
+// Set adds or replaces a rate.
+func (t *Rates) Set(code, rate string) error {
+	c, ok := Lookup(code)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+	}
+
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+	if !ok || r.Sign() <= 0 {
+		return fmt.Errorf("invalid rate %q for %s", rate, c.Code)
+	}
+	t.rates[c.Code] = r
+
+	return nil
+}
+
+// Rate returns how much of one currency a unit of another buys, crossing
+// through the base currency if need be.
+func (t *Rates) Rate(from, to string) (*big.Rat, error) {
+	f, err := t.rate(from)
+	if err != nil {
+		return nil, err
+	}
+	r, err := t.rate(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Quo(r, f), nil
+}
+
+func (t *Rates) rate(code string) (*big.Rat, error) {
+	c, ok := Lookup(code)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+	}
+	if c.Code == t.Base {
+		return big.NewRat(1, 1), nil
+	}
+
+	r, ok := t.rates[c.Code]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoRate, c.Code)
+	}
+
+	return new(big.Rat).Set(r), nil
+}
+
+// Codes returns the currencies in the table other than the base, sorted.
+func (t *Rates) Codes() []string {
+	codes := make([]string, 0, len(t.rates))
+	for code := range t.rates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	return codes
+}
+
+// Convert converts an amount between currencies, rounding to the target
+// currency's minor unit.
+func (t *Rates) Convert(amount, from, to string, mode money.Rounding) (string, error) {
+	src, ok := Lookup(from)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownCurrency, from)
+	}
+	dst, ok := Lookup(to)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownCurrency, to)
+	}
+
+	a, err := src.Rat(amount)
+	if err != nil {
+		return "", err
+	}
+	rate, err := t.Rate(src.Code, dst.Code)
+	if err != nil {
+		return "", err
+	}
+
+	return dst.Round(a.Mul(a, rate), mode), nil
+}
+
+// FillAltPrices sets the request's alternate prices by converting its
+// amount into each of the given currencies, or into every currency in the
+// table when none are given. The request's own currency is skipped.
+// Existing alternate prices for other currencies are kept.
+func (t *Rates) FillAltPrices(req *blockchyp.AuthorizationRequest, mode money.Rounding, codes ...string) error {
+	from := req.CurrencyCode
+	if strings.TrimSpace(from) == "" {
+		from = Default
+	}
+	src, ok := Lookup(from)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownCurrency, from)
+	}
+
+	if len(codes) == 0 {
+		codes = append(t.Codes(), t.Base)
+	}
+
+	prices := make(map[string]string)
+	for _, code := range codes {
+		dst, ok := Lookup(code)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownCurrency, code)
+		}
+		if dst.Code == src.Code {
+			continue
+		}
+
+		price, err := t.Convert(req.Amount, src.Code, dst.Code, mode)
+		if err != nil {
+			return err
+		}
+		prices[dst.Code] = price
+	}
+
+	if req.AltPrices == nil {
+		req.AltPrices = make(map[string]string)
+	}
+	for code, price := range prices {
+		req.AltPrices[code] = price
+	}
+
+	return nil
+}
+
+func line(cr *csv.Reader) int {
+	l, _ := cr.FieldPos(0)
+
+	return l
+}
@@ -0,0 +1,205 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// ErrChanged is recorded for merges whose customers have gained or lost
+// tokens since the plan was made. Such merges are left alone; make a new
+// plan.
+var ErrChanged = errors.New("customer changed since plan was made")
+
+// Outcome is the result of applying one merge.
+type Outcome struct {
+	Survivor string `json:"survivor"`
+
+	// Relinked lists the tokens moved to the survivor, and Deleted the
+	// losers removed.
+	Relinked []string `json:"relinked"`
+	Deleted  []string `json:"deleted"`
+
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Applied is the result of applying a plan.
+type Applied struct {
+	Merged   int       `json:"merged"`
+	Skipped  int       `json:"skipped"`
+	Failed   int       `json:"failed"`
+	Outcomes []Outcome `json:"outcomes"`
+}
+
+// Apply carries out a plan. For each merge it confirms the customers still
+// look as they did when the plan was made, links every loser token to the
+// survivor before unlinking it from the loser, deletes a loser only once
+// all of its tokens have moved, and then fills in the survivor's missing
+// details. A failed merge is recorded and the rest carry on; a canceled context
+// stops the run between merges.
+func Apply(ctx context.Context, gateway Gateway, plan *Plan) (*Applied, error) {
+	applied := &Applied{
+		Outcomes: make([]Outcome, 0, len(plan.Merges)),
+	}
+
+	for _, m := range plan.Merges {
+		if err := ctx.Err(); err != nil {
+			return applied, err
+		}
+
+		out := Outcome{
+			Survivor: m.Survivor.ID,
+			Relinked: make([]string, 0),
+			Deleted:  make([]string, 0),
+		}
+
+		if m.Skip {
+			out.Skipped = true
+			applied.Skipped++
+		} else if err := apply(gateway, plan.Test, m, &out); err != nil {
+			out.Error = err.Error()
+			applied.Failed++
+		} else {
+			applied.Merged++
+		}
+
+		applied.Outcomes = append(applied.Outcomes, out)
+	}
+
+	return applied, nil
+}
+
+func apply(gateway Gateway, test bool, m Merge, out *Outcome) error {
+	// Catch edits to the plan file before anything is changed.
+	var check blockchyp.Customer
+	for name, value := range m.Updates {
+		if err := setField(&check, name, value); err != nil {
+			return err
+		}
+	}
+
+	survivor, err := load(gateway, test, m.Survivor.ID)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(tokens(*survivor), m.Survivor.Tokens) {
+		return fmt.Errorf("%w: %s", ErrChanged, m.Survivor.ID)
+	}
+
+	losers := make([]*blockchyp.Customer, 0, len(m.Losers))
+	for _, planned := range m.Losers {
+		loser, err := load(gateway, test, planned.ID)
+		if err != nil {
+			return err
+		}
+		if !slices.Equal(tokens(*loser), planned.Tokens) {
+			return fmt.Errorf("%w: %s", ErrChanged, planned.ID)
+		}
+		losers = append(losers, loser)
+	}
+
+	linked := make(map[string]bool)
+	for _, t := range m.Survivor.Tokens {
+		linked[t] = true
+	}
+
+	for _, loser := range losers {
+		for _, t := range tokens(*loser) {
+			if !linked[t] {
+				ack, err := gateway.LinkToken(blockchyp.LinkTokenRequest{
+					Test:       test,
+					Token:      t,
+					CustomerID: survivor.ID,
+				})
+				if err == nil && !ack.Success {
+					err = failed(ack.ResponseDescription)
+				}
+				if err != nil {
+					return fmt.Errorf("link token to %s: %w", survivor.ID, err)
+				}
+				linked[t] = true
+				out.Relinked = append(out.Relinked, t)
+			}
+
+			ack, err := gateway.UnlinkToken(blockchyp.UnlinkTokenRequest{
+				Test:       test,
+				Token:      t,
+				CustomerID: loser.ID,
+			})
+			if err == nil && !ack.Success {
+				err = failed(ack.ResponseDescription)
+			}
+			if err != nil {
+				return fmt.Errorf("unlink token from %s: %w", loser.ID, err)
+			}
+		}
+
+		res, err := gateway.DeleteCustomer(blockchyp.DeleteCustomerRequest{
+			Test:       test,
+			CustomerID: loser.ID,
+		})
+		if err == nil && !res.Success {
+			err = failed(res.ResponseDescription)
+		}
+		if err != nil {
+			return fmt.Errorf("delete %s: %w", loser.ID, err)
+		}
+		out.Deleted = append(out.Deleted, loser.ID)
+	}
+
+	// Filled in last, so a customer ref taken from a loser is free to reuse.
+	if len(m.Updates) > 0 {
+		updated := *survivor
+		updated.PaymentMethods = nil
+		for name, value := range m.Updates {
+			if err := setField(&updated, name, value); err != nil {
+				return err
+			}
+		}
+		res, err := gateway.UpdateCustomer(blockchyp.UpdateCustomerRequest{
+			Test:     test,
+			Customer: updated,
+		})
+		if err == nil && !res.Success {
+			err = failed(res.ResponseDescription)
+		}
+		if err != nil {
+			return fmt.Errorf("update %s: %w", survivor.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(c *blockchyp.Customer, name, value string) error {
+	switch name {
+	case "firstName":
+		c.FirstName = value
+	case "lastName":
+		c.LastName = value
+	case "companyName":
+		c.CompanyName = value
+	case "emailAddress":
+		c.EmailAddress = value
+	case "smsNumber":
+		c.SmsNumber = value
+	case "customerRef":
+		c.CustomerRef = value
+	default:
+		return fmt.Errorf("unknown customer field %q in plan", name)
+	}
+
+	return nil
+}
+
+func failed(description string) error {
+	if description == "" {
+		description = "request failed"
+	}
+
+	return errors.New(description)
+}
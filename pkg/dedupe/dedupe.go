@@ -0,0 +1,474 @@
+// Package dedupe finds customer records that likely belong to the same
+// person, such as those created at different lanes by enrolling a card with
+// customer data, and merges them. Finding duplicates produces a plan that
+// can be written to a file and reviewed before anything is changed; applying
+// a plan moves the duplicates' payment tokens to the surviving record and
+// deletes the duplicates.
+package dedupe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// DefaultMinScore is the lowest match score proposed as a merge when none
+// is configured. It's high enough that matching names alone don't qualify.
+const DefaultMinScore = 0.8
+
+// DefaultFuzzyThreshold is the lowest name similarity treated as a fuzzy
+// match when none is configured.
+const DefaultFuzzyThreshold = 0.9
+
+// Gateway is the subset of *blockchyp.Client used to find and merge
+// duplicates.
+type Gateway interface {
+	CustomerSearch(request blockchyp.CustomerSearchRequest) (*blockchyp.CustomerSearchResponse, error)
+	Customer(request blockchyp.CustomerRequest) (*blockchyp.CustomerResponse, error)
+	UpdateCustomer(request blockchyp.UpdateCustomerRequest) (*blockchyp.CustomerResponse, error)
+	LinkToken(request blockchyp.LinkTokenRequest) (*blockchyp.Acknowledgement, error)
+	UnlinkToken(request blockchyp.UnlinkTokenRequest) (*blockchyp.Acknowledgement, error)
+	DeleteCustomer(request blockchyp.DeleteCustomerRequest) (*blockchyp.DeleteCustomerResponse, error)
+}
+
+// Reason is why two customers are thought to be the same person.
+type Reason string
+
+// Match reasons.
+const (
+	ReasonEmail     Reason = "email"
+	ReasonSMS       Reason = "sms"
+	ReasonToken     Reason = "token"
+	ReasonName      Reason = "name"
+	ReasonFuzzyName Reason = "fuzzy_name"
+)
+
+// weights is how much each reason contributes to a match score. Evidence
+// is combined as independent probabilities, so two weak reasons together
+// can qualify where neither would alone.
+var weights = map[Reason]float64{
+	ReasonEmail:     0.95,
+	ReasonToken:     0.95,
+	ReasonSMS:       0.85,
+	ReasonName:      0.5,
+	ReasonFuzzyName: 0.35,
+}
+
+// Options configures duplicate detection.
+type Options struct {
+	Test bool
+
+	// MinScore is the lowest score proposed as a merge, from 0 to 1.
+	// Defaults to DefaultMinScore.
+	MinScore float64
+
+	// FuzzyThreshold is the lowest Jaro-Winkler similarity between two
+	// names that counts as a fuzzy match. Defaults to
+	// DefaultFuzzyThreshold.
+	FuzzyThreshold float64
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (o Options) withDefaults() Options {
+	if o.MinScore <= 0 {
+		o.MinScore = DefaultMinScore
+	}
+	if o.FuzzyThreshold <= 0 {
+		o.FuzzyThreshold = DefaultFuzzyThreshold
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+
+	return o
+}
+
+// Collect loads the customers matching each search query, along with
+// their payment methods, which search results don't reliably include.
+func Collect(ctx context.Context, gateway Gateway, test bool, queries []string) ([]blockchyp.Customer, error) {
+	seen := make(map[string]bool)
+	customers := make([]blockchyp.Customer, 0)
+
+	for _, query := range queries {
+		res, err := gateway.CustomerSearch(blockchyp.CustomerSearchRequest{
+			Test:  test,
+			Query: query,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("customer search %q: %w", query, err)
+		}
+		if !res.Success {
+			return nil, fmt.Errorf("customer search %q: %s", query, res.ResponseDescription)
+		}
+
+		for _, c := range res.Customers {
+			if seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			full, err := load(gateway, test, c.ID)
+			if err != nil {
+				return nil, err
+			}
+			customers = append(customers, *full)
+		}
+	}
+
+	return customers, nil
+}
+
+// Find groups likely duplicates and proposes a merge for each group. Every
+// duplicate in a group matches the surviving record directly; customers
+// only linked through another duplicate aren't merged on that alone. Two
+// duplicates with different email addresses are only grouped if they also
+// match each other.
+func Find(customers []blockchyp.Customer, opts Options) *Plan {
+	opts = opts.withDefaults()
+
+	plan := &Plan{
+		GeneratedAt: opts.Now(),
+		Test:        opts.Test,
+		MinScore:    opts.MinScore,
+		Merges:      make([]Merge, 0),
+	}
+
+	f := &finder{
+		keys:    make([]key, len(customers)),
+		matches: make(map[[2]int]Match),
+	}
+	for i, c := range customers {
+		f.keys[i] = newKey(c)
+	}
+
+	// Candidates are tried as survivors in the order newMerge picks them.
+	order := make([]int, len(customers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ra, rb := newRecord(customers[order[a]]), newRecord(customers[order[b]])
+		if ca, cb := ra.completeness(), rb.completeness(); ca != cb {
+			return ca > cb
+		}
+		return ra.ID < rb.ID
+	})
+
+	for i := range customers {
+		for j := i + 1; j < len(customers); j++ {
+			m, ok := compare(f.keys[i], f.keys[j], opts)
+			if !ok || m.Score < opts.MinScore {
+				continue
+			}
+			m.A, m.B = customers[i].ID, customers[j].ID
+			f.matches[[2]int{i, j}] = m
+		}
+	}
+
+	for _, members := range f.groups(order) {
+		group := make([]blockchyp.Customer, 0, len(members))
+		in := make(map[int]bool, len(members))
+		for _, i := range members {
+			group = append(group, customers[i])
+			in[i] = true
+		}
+
+		merge := newMerge(group)
+		for pair, m := range f.matches {
+			if in[pair[0]] && in[pair[1]] {
+				merge.Matches = append(merge.Matches, m)
+			}
+		}
+		sort.Slice(merge.Matches, func(i, j int) bool {
+			if merge.Matches[i].A != merge.Matches[j].A {
+				return merge.Matches[i].A < merge.Matches[j].A
+			}
+			return merge.Matches[i].B < merge.Matches[j].B
+		})
+		plan.Merges = append(plan.Merges, merge)
+	}
+
+	sort.Slice(plan.Merges, func(i, j int) bool {
+		return plan.Merges[i].Survivor.ID < plan.Merges[j].Survivor.ID
+	})
+
+	return plan
+}
+
+// finder holds pairwise matches between customers, by index.
+type finder struct {
+	keys []key
+
+	// matches holds qualifying matches keyed by index pair, lowest first.
+	matches map[[2]int]Match
+}
+
+func (f *finder) matched(i, j int) bool {
+	if i > j {
+		i, j = j, i
+	}
+	_, ok := f.matches[[2]int{i, j}]
+
+	return ok
+}
+
+// groups splits customers, given best survivor first, into merge groups.
+// Each connected set of matches is taken in turn: its best survivor keeps
+// the customers that match it directly and don't conflict with the group,
+// and whatever is left over is grouped again.
+func (f *finder) groups(members []int) [][]int {
+	result := make([][]int, 0)
+
+	for _, component := range f.components(members) {
+		if len(component) < 2 {
+			continue
+		}
+
+		survivor := component[0]
+		group := []int{survivor}
+		rest := make([]int, 0)
+		for _, i := range component[1:] {
+			if f.matched(survivor, i) && !f.conflicts(group, i) {
+				group = append(group, i)
+			} else {
+				rest = append(rest, i)
+			}
+		}
+
+		if len(group) > 1 {
+			result = append(result, group)
+		}
+		result = append(result, f.groups(rest)...)
+	}
+
+	return result
+}
+
+// conflicts reports whether a customer has a different email address from
+// someone already in the group that it doesn't match directly.
+func (f *finder) conflicts(group []int, i int) bool {
+	email := f.keys[i].email
+	if email == "" {
+		return false
+	}
+
+	for _, g := range group {
+		other := f.keys[g].email
+		if other != "" && other != email && !f.matched(g, i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// components returns the connected sets of matches among members, each in
+// the order members were given.
+func (f *finder) components(members []int) [][]int {
+	parent := make(map[int]int, len(members))
+	for _, i := range members {
+		parent[i] = i
+	}
+	root := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	for a, i := range members {
+		for _, j := range members[a+1:] {
+			if f.matched(i, j) {
+				parent[root(i)] = root(j)
+			}
+		}
+	}
+
+	index := make(map[int]int)
+	components := make([][]int, 0)
+	for _, i := range members {
+		r := root(i)
+		c, ok := index[r]
+		if !ok {
+			c = len(components)
+			index[r] = c
+			components = append(components, nil)
+		}
+		components[c] = append(components[c], i)
+	}
+
+	return components
+}
+
+// key holds a customer's normalized identifiers.
+type key struct {
+	email  string
+	sms    string
+	name   string
+	tokens map[string]bool
+}
+
+func newKey(c blockchyp.Customer) key {
+	k := key{
+		email:  strings.ToLower(strings.TrimSpace(c.EmailAddress)),
+		sms:    normalizePhone(c.SmsNumber),
+		name:   normalizeName(c.FirstName + " " + c.LastName),
+		tokens: make(map[string]bool),
+	}
+	if k.name == "" {
+		k.name = normalizeName(c.CompanyName)
+	}
+	for _, pm := range c.PaymentMethods {
+		k.tokens[pm.Token] = true
+	}
+
+	return k
+}
+
+// compare scores the evidence that two customers are the same person.
+func compare(a, b key, opts Options) (Match, bool) {
+	m := Match{Reasons: make([]Reason, 0)}
+
+	if a.email != "" && a.email == b.email {
+		m.Reasons = append(m.Reasons, ReasonEmail)
+	}
+	if a.sms != "" && a.sms == b.sms {
+		m.Reasons = append(m.Reasons, ReasonSMS)
+	}
+	for t := range a.tokens {
+		if b.tokens[t] {
+			m.Reasons = append(m.Reasons, ReasonToken)
+			break
+		}
+	}
+	if a.name != "" && b.name != "" {
+		if a.name == b.name {
+			m.Reasons = append(m.Reasons, ReasonName)
+		} else if jaroWinkler(a.name, b.name) >= opts.FuzzyThreshold {
+			m.Reasons = append(m.Reasons, ReasonFuzzyName)
+		}
+	}
+
+	if len(m.Reasons) == 0 {
+		return m, false
+	}
+
+	doubt := 1.0
+	for _, r := range m.Reasons {
+		doubt *= 1 - weights[r]
+	}
+	m.Score = 1 - doubt
+
+	// Different email addresses suggest different people, such as family
+	// members sharing a card.
+	if a.email != "" && b.email != "" && a.email != b.email {
+		m.Score /= 2
+	}
+
+	return m, true
+}
+
+func normalizePhone(s string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+
+	// Drop the North American country code so 1-555-... matches 555-...
+	if len(digits) == 11 && digits[0] == '1' {
+		digits = digits[1:]
+	}
+
+	return digits
+}
+
+func normalizeName(s string) string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return strings.Join(fields, " ")
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of two strings, from 0
+// for nothing in common to 1 for identical.
+func jaroWinkler(a, b string) float64 {
+	s, t := []rune(a), []rune(b)
+	if len(s) == 0 || len(t) == 0 {
+		return 0
+	}
+
+	window := max(len(s), len(t))/2 - 1
+	window = max(window, 0)
+
+	sMatched := make([]bool, len(s))
+	tMatched := make([]bool, len(t))
+	matches := 0
+	for i := range s {
+		lo, hi := max(0, i-window), min(len(t), i+window+1)
+		for j := lo; j < hi; j++ {
+			if tMatched[j] || s[i] != t[j] {
+				continue
+			}
+			sMatched[i], tMatched[j] = true, true
+			matches++
+			break
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range s {
+		if !sMatched[i] {
+			continue
+		}
+		for !tMatched[j] {
+			j++
+		}
+		if s[i] != t[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(s)) + m/float64(len(t)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(s), len(t)) && s[prefix] == t[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+func load(gateway Gateway, test bool, id string) (*blockchyp.Customer, error) {
+	res, err := gateway.Customer(blockchyp.CustomerRequest{
+		Test:       test,
+		CustomerID: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("customer %s: %w", id, err)
+	}
+	if !res.Success || res.Customer == nil {
+		return nil, fmt.Errorf("customer %s: %s", id, res.ResponseDescription)
+	}
+
+	return res.Customer, nil
+}
@@ -0,0 +1,169 @@
+package dedupe
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+func customer(id, first, last, email, sms string, tokens ...string) blockchyp.Customer {
+	c := blockchyp.Customer{
+		ID:           id,
+		FirstName:    first,
+		LastName:     last,
+		EmailAddress: email,
+		SmsNumber:    sms,
+	}
+	for _, t := range tokens {
+		c.PaymentMethods = append(c.PaymentMethods, blockchyp.CustomerToken{Token: t, MaskedPAN: "****" + t})
+	}
+
+	return c
+}
+
+func ids(records []Record) []string {
+	result := make([]string, 0, len(records))
+	for _, r := range records {
+		result = append(result, r.ID)
+	}
+
+	return result
+}
+
+func TestFindByEmail(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Gavin", "Belson", "gavin@hooli.com", "", "T1"),
+		customer("C2", "", "", "Gavin@Hooli.com ", "555-123-4567"),
+		customer("C3", "Richard", "Hendricks", "richard@piedpiper.com", ""),
+	}, Options{})
+
+	require.Len(t, plan.Merges, 1)
+	m := plan.Merges[0]
+	assert.Equal("C1", m.Survivor.ID)
+	assert.Equal([]string{"C2"}, ids(m.Losers))
+	assert.Equal("555-123-4567", m.Updates["smsNumber"])
+	require.Len(t, m.Matches, 1)
+	assert.Contains(m.Matches[0].Reasons, ReasonEmail)
+}
+
+func TestFindPhoneNormalized(t *testing.T) {
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Dinesh", "Chugtai", "", "1 (555) 123-4567", "T1"),
+		customer("C2", "Dinesh", "Chugtai", "", "555.123.4567"),
+	}, Options{})
+
+	require.Len(t, plan.Merges, 1)
+	assert.Equal(t, []string{"C2"}, ids(plan.Merges[0].Losers))
+}
+
+func TestFindNamesAloneDontMerge(t *testing.T) {
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Jared", "Dunn", "", ""),
+		customer("C2", "Jared", "Dunn", "", ""),
+	}, Options{})
+
+	assert.Empty(t, plan.Merges)
+}
+
+func TestFindRequiresDirectMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	// C1 and C2 share a card, C2 and C3 share an email address, but
+	// nothing links C1 and C3.
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Erlich", "Bachman", "", "", "T1", "T2"),
+		customer("C2", "", "", "erlich@aviato.com", "", "T1"),
+		customer("C3", "", "", "erlich@aviato.com", ""),
+	}, Options{})
+
+	require.Len(t, plan.Merges, 1)
+	m := plan.Merges[0]
+	assert.Equal("C1", m.Survivor.ID)
+	assert.Equal([]string{"C2"}, ids(m.Losers))
+	for _, match := range m.Matches {
+		assert.NotEqual("C3", match.B)
+	}
+}
+
+func TestFindConflictingEmails(t *testing.T) {
+	assert := assert.New(t)
+
+	// A shared family phone and card: both spouses match the account
+	// holder, but have different email addresses and nothing else in
+	// common with each other.
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Monica", "Hall", "", "555-000-1111", "T1"),
+		customer("C2", "", "", "monica@raviga.com", "555-000-1111", "T1"),
+		customer("C3", "", "", "laurie@raviga.com", "555-000-1111"),
+	}, Options{})
+
+	require.Len(t, plan.Merges, 1)
+	assert.Equal("C1", plan.Merges[0].Survivor.ID)
+	assert.Equal([]string{"C2"}, ids(plan.Merges[0].Losers))
+}
+
+func TestFindLeftoversGroupedAgain(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Bertram", "Gilfoyle", "", "", "T1", "T2"),
+		customer("C2", "Bertram", "", "gilfoyle@piedpiper.com", "", "T1"),
+		customer("C3", "Nelson", "Bighetti", "bighead@hooli.com", "", "T3"),
+		customer("C4", "", "", "bighead@hooli.com", "555-222-3333", "T1"),
+	}, Options{})
+
+	// C4 shares a card with C1 and C2, but its email conflicts with C2's.
+	// It still matches C3 by email, so they're merged separately.
+	require.Len(t, plan.Merges, 2)
+	assert.Equal("C1", plan.Merges[0].Survivor.ID)
+	assert.Equal([]string{"C2"}, ids(plan.Merges[0].Losers))
+	assert.Equal("C3", plan.Merges[1].Survivor.ID)
+	assert.Equal([]string{"C4"}, ids(plan.Merges[1].Losers))
+}
+
+func TestFuzzyNameNeedsMoreEvidence(t *testing.T) {
+	assert := assert.New(t)
+
+	customers := []blockchyp.Customer{
+		customer("C1", "Jonathan", "Smith", "", "555-444-5555", "T1"),
+		customer("C2", "Jonathon", "Smith", "", ""),
+	}
+	assert.Empty(Find(customers, Options{}).Merges)
+
+	customers[1].SmsNumber = "555-444-5555"
+	plan := Find(customers, Options{})
+	require.Len(t, plan.Merges, 1)
+	assert.Contains(plan.Merges[0].Matches[0].Reasons, ReasonFuzzyName)
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	plan := Find([]blockchyp.Customer{
+		customer("C1", "Gavin", "Belson", "gavin@hooli.com", "", "T1"),
+		customer("C2", "", "", "gavin@hooli.com", ""),
+	}, Options{Now: func() time.Time { return now }})
+
+	var buf bytes.Buffer
+	require.NoError(t, WritePlan(&buf, plan))
+
+	read, err := ReadPlan(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, plan.Merges[0].Survivor, read.Merges[0].Survivor)
+	assert.True(t, read.GeneratedAt.Equal(now))
+}
+
+func TestJaroWinkler(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(1.0, jaroWinkler("martha", "martha"))
+	assert.InDelta(0.961, jaroWinkler("martha", "marhta"), 0.001)
+	assert.InDelta(0.813, jaroWinkler("dixon", "dicksonx"), 0.001)
+	assert.Equal(0.0, jaroWinkler("", "abc"))
+}
@@ -0,0 +1,275 @@
+package dedupe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// Plan is a set of proposed merges. It's meant to be written out with
+// WritePlan, reviewed, edited if need be, and read back for Apply. Merges
+// can be dropped from the file, or marked Skip, to leave them alone.
+type Plan struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Test        bool      `json:"test"`
+	MinScore    float64   `json:"minScore"`
+	Merges      []Merge   `json:"merges"`
+}
+
+// Merge folds one or more duplicate customers into a survivor.
+type Merge struct {
+	// Skip leaves the merge out when the plan is applied.
+	Skip bool `json:"skip,omitempty"`
+
+	Survivor Record   `json:"survivor"`
+	Losers   []Record `json:"losers"`
+
+	// Updates fills fields the survivor is missing from the losers, keyed
+	// by field name.
+	Updates map[string]string `json:"updates,omitempty"`
+
+	// Matches is the evidence for the merge.
+	Matches []Match `json:"matches"`
+}
+
+// Record is a customer as it was when the plan was made. Apply checks
+// that the customer's tokens haven't changed since.
+type Record struct {
+	ID           string   `json:"id"`
+	CustomerRef  string   `json:"customerRef,omitempty"`
+	FirstName    string   `json:"firstName,omitempty"`
+	LastName     string   `json:"lastName,omitempty"`
+	CompanyName  string   `json:"companyName,omitempty"`
+	EmailAddress string   `json:"emailAddress,omitempty"`
+	SmsNumber    string   `json:"smsNumber,omitempty"`
+	Tokens       []string `json:"tokens"`
+	MaskedPANs   []string `json:"maskedPans,omitempty"`
+}
+
+// Match is the evidence linking two customers.
+type Match struct {
+	A       string   `json:"a"`
+	B       string   `json:"b"`
+	Score   float64  `json:"score"`
+	Reasons []Reason `json:"reasons"`
+}
+
+func newRecord(c blockchyp.Customer) Record {
+	r := Record{
+		ID:           c.ID,
+		CustomerRef:  c.CustomerRef,
+		FirstName:    c.FirstName,
+		LastName:     c.LastName,
+		CompanyName:  c.CompanyName,
+		EmailAddress: c.EmailAddress,
+		SmsNumber:    c.SmsNumber,
+		Tokens:       tokens(c),
+		MaskedPANs:   make([]string, 0, len(c.PaymentMethods)),
+	}
+	for _, pm := range c.PaymentMethods {
+		r.MaskedPANs = append(r.MaskedPANs, pm.MaskedPAN)
+	}
+
+	return r
+}
+
+// completeness ranks how useful a record is to keep.
+func (r Record) completeness() int {
+	n := len(r.Tokens) * 10
+	if r.CustomerRef != "" {
+		n += 5
+	}
+	for _, v := range r.fields() {
+		if v.value != "" {
+			n++
+		}
+	}
+
+	return n
+}
+
+type field struct {
+	name  string
+	value string
+}
+
+func (r Record) fields() []field {
+	return []field{
+		{"firstName", r.FirstName},
+		{"lastName", r.LastName},
+		{"companyName", r.CompanyName},
+		{"emailAddress", r.EmailAddress},
+		{"smsNumber", r.SmsNumber},
+		{"customerRef", r.CustomerRef},
+	}
+}
+
+// newMerge picks the survivor of a group: the record with the most tokens,
+// then the one with a customer ref, then the most complete, with ties
+// broken by ID so plans are repeatable.
+func newMerge(group []blockchyp.Customer) Merge {
+	records := make([]Record, 0, len(group))
+	for _, c := range group {
+		records = append(records, newRecord(c))
+	}
+	sort.Slice(records, func(i, j int) bool {
+		ci, cj := records[i].completeness(), records[j].completeness()
+		if ci != cj {
+			return ci > cj
+		}
+		return records[i].ID < records[j].ID
+	})
+
+	m := Merge{
+		Survivor: records[0],
+		Losers:   records[1:],
+		Updates:  make(map[string]string),
+		Matches:  make([]Match, 0),
+	}
+
+	for i, f := range m.Survivor.fields() {
+		if f.value != "" {
+			continue
+		}
+		for _, loser := range m.Losers {
+			if v := loser.fields()[i].value; v != "" {
+				m.Updates[f.name] = v
+				break
+			}
+		}
+	}
+
+	return m
+}
+
+// WritePlan writes a plan as indented JSON.
+func WritePlan(w io.Writer, plan *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(plan)
+}
+
+// WritePlanFile writes a plan to a file.
+func WritePlanFile(path string, plan *Plan) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WritePlan(f, plan); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadPlan reads a plan written by WritePlan.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, fmt.Errorf("invalid merge plan: %w", err)
+	}
+
+	for i, m := range plan.Merges {
+		if m.Survivor.ID == "" {
+			return nil, fmt.Errorf("invalid merge plan: merge %d has no survivor", i+1)
+		}
+		for _, loser := range m.Losers {
+			if loser.ID == "" || loser.ID == m.Survivor.ID {
+				return nil, fmt.Errorf("invalid merge plan: merge %d has an invalid loser", i+1)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// ReadPlanFile reads a plan from a file.
+func ReadPlanFile(path string) (*Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadPlan(f)
+}
+
+// WriteText writes a summary of the plan for review.
+func (p *Plan) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Customer merge plan generated %s\n", p.GeneratedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(tw, "Merges:\t%d\n", len(p.Merges))
+
+	for i, m := range p.Merges {
+		title := fmt.Sprintf("Merge %d", i+1)
+		if m.Skip {
+			title += " (skipped)"
+		}
+		fmt.Fprintf(tw, "\n%s\n%s\n", title, strings.Repeat("-", len(title)))
+		fmt.Fprintln(tw, "\tID\tName\tEmail\tSMS\tCards")
+		describe(tw, "keep", m.Survivor)
+		for _, loser := range m.Losers {
+			describe(tw, "merge", loser)
+		}
+		for _, match := range m.Matches {
+			reasons := make([]string, 0, len(match.Reasons))
+			for _, r := range match.Reasons {
+				reasons = append(reasons, string(r))
+			}
+			fmt.Fprintf(tw, "match\t%s = %s\t%.2f\t%s\t\t\n", match.A, match.B, match.Score, strings.Join(reasons, ", "))
+		}
+		names := make([]string, 0, len(m.Updates))
+		for name := range m.Updates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(tw, "update\t%s\t%s\t\t\t\n", name, m.Updates[name])
+		}
+	}
+
+	return tw.Flush()
+}
+
+func describe(w io.Writer, role string, r Record) {
+	name := strings.TrimSpace(r.FirstName + " " + r.LastName)
+	if name == "" {
+		name = r.CompanyName
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+		role,
+		r.ID,
+		dash(name),
+		dash(r.EmailAddress),
+		dash(r.SmsNumber),
+		dash(strings.Join(r.MaskedPANs, ", ")),
+	)
+}
+
+func tokens(c blockchyp.Customer) []string {
+	tokens := make([]string, 0, len(c.PaymentMethods))
+	for _, pm := range c.PaymentMethods {
+		tokens = append(tokens, pm.Token)
+	}
+	sort.Strings(tokens)
+
+	return tokens
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
@@ -0,0 +1,131 @@
+// Package ebt splits an order between an EBT card and other tenders. Items
+// are classified by SNAP eligibility to work out the EBTTotal, the card's
+// balance is checked, food benefits are charged for the eligible part, and
+// the rest goes to EBT cash benefits or any other tender. Legs run in a
+// tender.Session, so abandoning the order voids every one of them.
+package ebt
+
+import (
+	"math/big"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// Item is a SKU level line item.
+type Item struct {
+	SKU         string
+	Description string
+
+	// Amount is the item's total net of discounts, before tax.
+	Amount money.Amount
+	Tax    money.Amount
+}
+
+// ItemsFromCart converts a cart's lines, using each item's ProductCode as
+// its SKU, or its ID if it has no product code.
+func ItemsFromCart(c *cart.Cart) []Item {
+	lines := c.Lines()
+
+	items := make([]Item, 0, len(lines))
+	for _, line := range lines {
+		sku := line.ProductCode
+		if sku == "" {
+			sku = line.ID
+		}
+
+		items = append(items, Item{
+			SKU:         sku,
+			Description: line.Description,
+			Amount:      line.Net,
+			Tax:         line.Tax,
+		})
+	}
+
+	return items
+}
+
+// ClassifiedItem is an item with its SNAP eligibility.
+type ClassifiedItem struct {
+	Item
+	Eligible bool
+}
+
+// Basket is a classified set of items.
+type Basket struct {
+	Items []ClassifiedItem
+
+	// Total is the whole basket including tax.
+	Total money.Amount
+
+	// EBTTotal is the eligible items before tax, which is what food
+	// benefits can pay for, and EligibleTax the tax on those items. Food
+	// bought with benefits is exempt from sales tax, so EligibleTax is
+	// waived in proportion to how much of EBTTotal the card covers.
+	EBTTotal    money.Amount
+	EligibleTax money.Amount
+
+	// Ineligible is everything else, with its tax.
+	Ineligible money.Amount
+}
+
+// Classify looks up each item on the eligibility list.
+func Classify(list *List, items []Item) *Basket {
+	b := &Basket{
+		Items: make([]ClassifiedItem, 0, len(items)),
+	}
+
+	for _, item := range items {
+		eligible := list.Eligible(item.SKU)
+		b.Items = append(b.Items, ClassifiedItem{Item: item, Eligible: eligible})
+		b.Total += item.Amount + item.Tax
+
+		if eligible {
+			b.EBTTotal += item.Amount
+			b.EligibleTax += item.Tax
+		} else {
+			b.Ineligible += item.Amount + item.Tax
+		}
+	}
+
+	return b
+}
+
+// Eligible reports whether anything in the basket can be paid for with
+// food benefits.
+func (b *Basket) Eligible() bool {
+	return b.EBTTotal > 0
+}
+
+// Exempt is the tax waived when food benefits pay part of EBTTotal.
+func (b *Basket) Exempt(paid money.Amount) money.Amount {
+	if b.EBTTotal <= 0 || paid <= 0 {
+		return 0
+	}
+	if paid >= b.EBTTotal {
+		return b.EligibleTax
+	}
+
+	share := big.NewRat(paid.Cents(), b.EBTTotal.Cents())
+
+	return b.EligibleTax.MulRat(share, money.RoundNearest)
+}
+
+// Due is the order total once food benefits have paid part of EBTTotal.
+func (b *Basket) Due(paid money.Amount) money.Amount {
+	return b.Total - b.Exempt(paid)
+}
+
+// Apply prepares a request for an EBT card to pay for the eligible items
+// with food benefits. If nothing in the basket is eligible the request is
+// left alone.
+func (b *Basket) Apply(req *blockchyp.AuthorizationRequest) {
+	if !b.Eligible() {
+		return
+	}
+
+	req.CardType = blockchyp.CardTypeEBT
+	req.Amount = b.EBTTotal.String()
+	req.EBTTotal = b.EBTTotal.String()
+}
@@ -0,0 +1,220 @@
+package ebt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/tender"
+)
+
+var (
+	// ErrNothingEligible is returned when food benefits are charged for a
+	// basket whose eligible items are already paid for.
+	ErrNothingEligible = errors.New("no SNAP eligible amount left to charge")
+
+	// ErrFoodFirst is returned when food benefits are charged after other
+	// tenders. The tax they waive could leave the order overpaid.
+	ErrFoodFirst = errors.New("food benefits must be charged before other tenders")
+
+	// ErrNoBalance is returned when the card's balance check came back
+	// empty.
+	ErrNoBalance = errors.New("EBT card has no balance")
+)
+
+// Gateway is the subset of *blockchyp.Client used for EBT checkouts.
+type Gateway interface {
+	tender.Gateway
+	Balance(request blockchyp.BalanceRequest) (*blockchyp.BalanceResponse, error)
+}
+
+// Checkout collects payment for a basket with an EBT card and whatever
+// other tenders cover the rest. It is safe for concurrent use, though legs
+// run one at a time.
+type Checkout struct {
+	gateway Gateway
+	basket  *Basket
+	opts    tender.Options
+	session *tender.Session
+
+	lock sync.Mutex
+
+	// food is what food benefits have paid.
+	food money.Amount
+
+	// balance is the card's last known balance, if checked.
+	balance *money.Amount
+}
+
+// NewCheckout starts collecting payment for a basket. The order total
+// starts as the whole basket with tax, and drops as food benefits make
+// items tax exempt.
+func NewCheckout(gateway Gateway, basket *Basket, opts tender.Options) (*Checkout, error) {
+	session, err := tender.New(gateway, basket.Total, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkout{
+		gateway: gateway,
+		basket:  basket,
+		opts:    opts,
+		session: session,
+	}, nil
+}
+
+// Balance checks the EBT card's balance. The request's CardType, Test and,
+// if blank, TerminalName are filled in. The balance caps later food
+// benefit charges, so a card that can't cover the whole EBTTotal is
+// charged what it has rather than declined.
+func (c *Checkout) Balance(req blockchyp.BalanceRequest) (money.Amount, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	req.CardType = blockchyp.CardTypeEBT
+	req.Test = c.opts.Test
+	if req.TerminalName == "" {
+		req.TerminalName = c.opts.TerminalName
+	}
+
+	res, err := c.gateway.Balance(req)
+	if err != nil {
+		return 0, err
+	}
+	if !res.Success {
+		return 0, fmt.Errorf("balance check failed: %s", res.ResponseDescription)
+	}
+
+	balance, err := money.Parse(res.RemainingBalance)
+	if err != nil {
+		return 0, fmt.Errorf("invalid balance %q: %w", res.RemainingBalance, err)
+	}
+	c.balance = &balance
+
+	return balance, nil
+}
+
+// ChargeFood charges food benefits for the eligible items not yet paid
+// for, capped at the card's balance if it was checked. It has to run before
+// any other tender. An approval, even a partial one, makes the covered
+// items tax exempt and lowers the order total to match. Declines are
+// returned as legs, as with tender.Session.
+func (c *Checkout) ChargeFood(req blockchyp.AuthorizationRequest) (*tender.Leg, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	amount := c.basket.EBTTotal - c.food
+	if amount <= 0 {
+		return nil, ErrNothingEligible
+	}
+	if c.session.Paid() > c.food {
+		return nil, ErrFoodFirst
+	}
+	if c.balance != nil {
+		if *c.balance <= 0 {
+			return nil, ErrNoBalance
+		}
+		amount = min(amount, *c.balance)
+	}
+
+	req.EBTTotal = amount.String()
+	leg, err := c.session.Run(tender.Tender{
+		Kind:    tender.EBT,
+		Amount:  amount,
+		Request: req,
+	})
+	if err != nil || leg.Status != tender.Approved {
+		return leg, err
+	}
+
+	c.food += leg.Paid
+	c.updateBalance(leg)
+	if err := c.session.SetTotal(c.basket.Due(c.food)); err != nil {
+		return leg, err
+	}
+
+	return leg, nil
+}
+
+// ChargeCash charges EBT cash benefits for the rest of the order. Cash
+// benefits can pay for anything, so the remaining balance is requested
+// with no part of it marked as food.
+func (c *Checkout) ChargeCash(req blockchyp.AuthorizationRequest) (*tender.Leg, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	req.EBTTotal = money.Amount(0).String()
+	leg, err := c.session.Run(tender.Tender{
+		Kind:    tender.EBT,
+		Request: req,
+	})
+	if err == nil && leg.Status == tender.Approved {
+		c.updateBalance(leg)
+	}
+
+	return leg, err
+}
+
+// Run applies another tender, such as a credit card or cash, to the rest
+// of the order. EBT cards should be charged with ChargeFood or ChargeCash
+// instead, so tax exemptions are kept track of.
+func (c *Checkout) Run(t tender.Tender) (*tender.Leg, error) {
+	if t.Kind == tender.EBT {
+		return nil, errors.New("use ChargeFood or ChargeCash for EBT tenders")
+	}
+
+	return c.session.Run(t)
+}
+
+// FoodPaid is what food benefits have paid.
+func (c *Checkout) FoodPaid() money.Amount {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.food
+}
+
+// Total is the order total after any tax exemption.
+func (c *Checkout) Total() money.Amount {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.basket.Due(c.food)
+}
+
+// Remaining is what's left to collect.
+func (c *Checkout) Remaining() money.Amount {
+	return c.session.Remaining()
+}
+
+// Complete reports whether the order is paid in full.
+func (c *Checkout) Complete() bool {
+	return c.session.Complete()
+}
+
+// Legs returns a copy of every leg run so far, in order.
+func (c *Checkout) Legs() []tender.Leg {
+	return c.session.Legs()
+}
+
+// Abandon voids every approved leg, newest first, including the EBT legs,
+// and reports the cash to hand back. Nothing more can be charged
+// afterwards.
+func (c *Checkout) Abandon() (*tender.Abandoned, error) {
+	return c.session.Abandon()
+}
+
+// updateBalance records the balance an EBT approval reports.
+func (c *Checkout) updateBalance(leg *tender.Leg) {
+	if leg.RemainingBalance == "" {
+		return
+	}
+
+	balance, err := money.Parse(leg.RemainingBalance)
+	if err != nil {
+		return
+	}
+	c.balance = &balance
+}
@@ -0,0 +1,197 @@
+package ebt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/tender"
+)
+
+// fakeGateway approves EBT charges up to the card's balance and other
+// charges in full.
+type fakeGateway struct {
+	balance money.Amount
+	charges []blockchyp.AuthorizationRequest
+	voids   int
+}
+
+func (g *fakeGateway) Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.charges = append(g.charges, request)
+
+	amount := money.MustParse(request.Amount)
+	res := &blockchyp.AuthorizationResponse{
+		Approved:      true,
+		TransactionID: "TX-" + request.TransactionRef,
+	}
+	if request.CardType == blockchyp.CardTypeEBT {
+		amount = min(amount, g.balance)
+		g.balance -= amount
+		res.RemainingBalance = g.balance.String()
+	}
+	res.AuthorizedAmount = amount.String()
+
+	return res, nil
+}
+
+func (g *fakeGateway) Void(request blockchyp.VoidRequest) (*blockchyp.VoidResponse, error) {
+	g.voids++
+
+	return &blockchyp.VoidResponse{Success: true, Approved: true}, nil
+}
+
+func (g *fakeGateway) Reverse(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	return &blockchyp.AuthorizationResponse{Success: true}, nil
+}
+
+func (g *fakeGateway) Balance(request blockchyp.BalanceRequest) (*blockchyp.BalanceResponse, error) {
+	return &blockchyp.BalanceResponse{Success: true, RemainingBalance: g.balance.String()}, nil
+}
+
+func testList(t *testing.T) *List {
+	list, err := ReadList(strings.NewReader("sku,eligible\n# dairy\nMILK\nBREAD,yes\nSOAP,no\n"))
+	require.NoError(t, err)
+
+	return list
+}
+
+// testBasket has 7.00 of eligible items with 0.35 tax and 5.50 of
+// ineligible items with tax.
+func testBasket(t *testing.T) *Basket {
+	return Classify(testList(t), []Item{
+		{SKU: "MILK", Amount: money.MustParse("4.00"), Tax: money.MustParse("0.20")},
+		{SKU: "BREAD", Amount: money.MustParse("3.00"), Tax: money.MustParse("0.15")},
+		{SKU: "SOAP", Amount: money.MustParse("5.00"), Tax: money.MustParse("0.50")},
+	})
+}
+
+func TestReadList(t *testing.T) {
+	assert := assert.New(t)
+
+	list := testList(t)
+	assert.Equal(3, list.Len())
+	assert.True(list.Eligible("MILK"))
+	assert.True(list.Eligible("BREAD"))
+	assert.False(list.Eligible("SOAP"))
+	assert.False(list.Eligible("UNLISTED"))
+
+	_, err := ReadList(strings.NewReader("MILK,maybe\n"))
+	assert.True(errors.Is(err, ErrInvalidList))
+
+	_, err = ReadList(strings.NewReader(",yes\n"))
+	assert.True(errors.Is(err, ErrInvalidList))
+}
+
+func TestClassify(t *testing.T) {
+	assert := assert.New(t)
+
+	b := testBasket(t)
+	assert.Equal("12.85", b.Total.String())
+	assert.Equal("7.00", b.EBTTotal.String())
+	assert.Equal("0.35", b.EligibleTax.String())
+	assert.Equal("5.50", b.Ineligible.String())
+	assert.True(b.Items[0].Eligible)
+	assert.False(b.Items[2].Eligible)
+
+	assert.Equal("0.25", b.Exempt(money.MustParse("5.00")).String())
+	assert.Equal("0.35", b.Exempt(money.MustParse("7.00")).String())
+	assert.Equal("12.50", b.Due(money.MustParse("7.00")).String())
+
+	req := blockchyp.AuthorizationRequest{}
+	b.Apply(&req)
+	assert.Equal(blockchyp.CardTypeEBT, req.CardType)
+	assert.Equal("7.00", req.Amount)
+	assert.Equal("7.00", req.EBTTotal)
+}
+
+func TestItemsFromCart(t *testing.T) {
+	c, err := cart.New("5")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(cart.Item{ID: "1", ProductCode: "MILK", Price: money.MustParse("4.00"), Quantity: 1}))
+	require.NoError(t, c.Add(cart.Item{ID: "SOAP", Price: money.MustParse("5.00"), Quantity: 1}))
+
+	items := ItemsFromCart(c)
+	require.Len(t, items, 2)
+	assert.Equal(t, "MILK", items[0].SKU)
+	assert.Equal(t, "0.20", items[0].Tax.String())
+	assert.Equal(t, "SOAP", items[1].SKU)
+}
+
+func TestCheckoutPartialFood(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{balance: money.MustParse("5.00")}
+	c, err := NewCheckout(g, testBasket(t), tender.Options{OrderRef: "ORD1", TerminalName: "Front"})
+	require.NoError(t, err)
+
+	balance, err := c.Balance(blockchyp.BalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal("5.00", balance.String())
+
+	leg, err := c.ChargeFood(blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.Equal(tender.Approved, leg.Status)
+	assert.Equal("5.00", g.charges[0].Amount)
+	assert.Equal("5.00", g.charges[0].EBTTotal)
+	assert.Equal(blockchyp.CardTypeEBT, g.charges[0].CardType)
+
+	// 5.00 of the 7.00 eligible waives 0.25 of the 0.35 tax.
+	assert.Equal("5.00", c.FoodPaid().String())
+	assert.Equal("12.60", c.Total().String())
+	assert.Equal("7.60", c.Remaining().String())
+
+	_, err = c.ChargeFood(blockchyp.AuthorizationRequest{})
+	assert.True(errors.Is(err, ErrNoBalance))
+
+	_, err = c.Run(tender.Tender{Kind: tender.EBT})
+	assert.Error(err)
+
+	_, err = c.Run(tender.Tender{Kind: tender.Credit})
+	require.NoError(t, err)
+	assert.True(c.Complete())
+	assert.Len(c.Legs(), 2)
+}
+
+func TestCheckoutFoodThenCashBenefits(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{balance: money.MustParse("50.00")}
+	c, err := NewCheckout(g, testBasket(t), tender.Options{OrderRef: "ORD1"})
+	require.NoError(t, err)
+
+	_, err = c.ChargeFood(blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.Equal("12.50", c.Total().String())
+
+	_, err = c.ChargeFood(blockchyp.AuthorizationRequest{})
+	assert.True(errors.Is(err, ErrNothingEligible))
+
+	leg, err := c.ChargeCash(blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.Equal("5.50", leg.Paid.String())
+	assert.Equal("0.00", g.charges[1].EBTTotal)
+	assert.True(c.Complete())
+
+	abandoned, err := c.Abandon()
+	require.NoError(t, err)
+	assert.Len(abandoned.Voided, 2)
+	assert.Equal(2, g.voids)
+}
+
+func TestCheckoutFoodFirst(t *testing.T) {
+	g := &fakeGateway{balance: money.MustParse("50.00")}
+	c, err := NewCheckout(g, testBasket(t), tender.Options{OrderRef: "ORD1"})
+	require.NoError(t, err)
+
+	_, err = c.Run(tender.Tender{Kind: tender.Cash, Amount: money.MustParse("1.00")})
+	require.NoError(t, err)
+
+	_, err = c.ChargeFood(blockchyp.AuthorizationRequest{})
+	assert.True(t, errors.Is(err, ErrFoodFirst))
+}
@@ -0,0 +1,97 @@
+package ebt
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrInvalidList is returned when an eligibility list can't be parsed.
+var ErrInvalidList = errors.New("invalid SNAP eligibility list")
+
+// List is a set of SNAP eligible SKUs, usually exported from the point of
+// sale system's item file.
+type List struct {
+	eligible map[string]bool
+}
+
+// LoadList reads an eligibility list file. See ReadList for the format.
+func LoadList(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadList(f)
+}
+
+// ReadList reads an eligibility list in CSV form, one SKU per line:
+//
+//	sku[,eligible]
+//
+// Eligible is yes or no, true or false; SKUs listed without it are
+// eligible. Lines starting with # are comments, and a header line starting
+// with "sku" is skipped.
+func ReadList(r io.Reader) (*List, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	l := &List{eligible: make(map[string]bool)}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidList, err)
+		}
+
+		sku := strings.TrimSpace(record[0])
+		if line == 1 && strings.EqualFold(sku, "sku") {
+			continue
+		}
+		if sku == "" {
+			return nil, fmt.Errorf("%w: line %d: missing sku", ErrInvalidList, line)
+		}
+
+		eligible := true
+		if len(record) > 1 {
+			switch strings.ToLower(strings.TrimSpace(record[1])) {
+			case "yes", "y", "true", "1", "snap", "":
+			case "no", "n", "false", "0":
+				eligible = false
+			default:
+				return nil, fmt.Errorf("%w: line %d: invalid eligibility %q", ErrInvalidList, line, record[1])
+			}
+		}
+
+		l.eligible[sku] = eligible
+	}
+
+	return l, nil
+}
+
+// Add marks a SKU eligible or not.
+func (l *List) Add(sku string, eligible bool) {
+	if l.eligible == nil {
+		l.eligible = make(map[string]bool)
+	}
+
+	l.eligible[sku] = eligible
+}
+
+// Eligible reports whether a SKU can be paid for with SNAP benefits. SKUs
+// that aren't on the list are not.
+func (l *List) Eligible(sku string) bool {
+	return l.eligible[sku]
+}
+
+// Len returns the number of SKUs on the list.
+func (l *List) Len() int {
+	return len(l.eligible)
+}
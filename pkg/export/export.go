@@ -0,0 +1,522 @@
+// Package export streams transaction history out of the gateway into CSV,
+// JSON Lines or Parquet files.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"iter"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/internal/atomicfile"
+)
+
+// Format is an export file format.
+type Format string
+
+// Supported export formats.
+const (
+	FormatCSV     Format = "csv"
+	FormatJSONL   Format = "jsonl"
+	FormatParquet Format = "parquet"
+)
+
+// DefaultRowGroupSize is the number of rows buffered between checkpoints and
+// written per Parquet row group.
+const DefaultRowGroupSize = 10000
+
+// ErrCheckpointMismatch is returned when an export is resumed with options
+// that differ from the ones it was started with.
+var ErrCheckpointMismatch = errors.New("checkpoint does not match export options")
+
+// Column maps an output column to a transaction field.
+type Column struct {
+	// Name is the column header.
+	Name string `json:"name"`
+
+	// Field is the JSON name of an AuthorizationResponse field. Nested
+	// fields use dots, for example receiptSuggestions.aid.
+	Field string `json:"field"`
+}
+
+// DefaultColumns is the column set used when none is configured. Card data
+// is exported in its masked form only.
+var DefaultColumns = []Column{
+	{Name: "transactionId", Field: "transactionId"},
+	{Name: "transactionRef", Field: "transactionRef"},
+	{Name: "timestamp", Field: "timestamp"},
+	{Name: "batchId", Field: "batchId"},
+	{Name: "transactionType", Field: "transactionType"},
+	{Name: "approved", Field: "approved"},
+	{Name: "responseDescription", Field: "responseDescription"},
+	{Name: "authCode", Field: "authCode"},
+	{Name: "currencyCode", Field: "currencyCode"},
+	{Name: "requestedAmount", Field: "requestedAmount"},
+	{Name: "authorizedAmount", Field: "authorizedAmount"},
+	{Name: "tipAmount", Field: "tipAmount"},
+	{Name: "taxAmount", Field: "taxAmount"},
+	{Name: "paymentType", Field: "paymentType"},
+	{Name: "entryMethod", Field: "entryMethod"},
+	{Name: "maskedPan", Field: "maskedPan"},
+	{Name: "cardHolder", Field: "cardHolder"},
+	{Name: "test", Field: "test"},
+}
+
+// ParseColumns parses a comma separated column list. Each entry is either a
+// field name or name=field.
+func ParseColumns(spec string) ([]Column, error) {
+	if strings.TrimSpace(spec) == "" {
+		return DefaultColumns, nil
+	}
+
+	columns := make([]Column, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, field, found := strings.Cut(part, "=")
+		if !found {
+			field = name
+		}
+		name = strings.TrimSpace(name)
+		field = strings.TrimSpace(field)
+		if name == "" || field == "" {
+			return nil, fmt.Errorf("invalid column: %s", part)
+		}
+
+		columns = append(columns, Column{Name: name, Field: field})
+	}
+
+	return columns, nil
+}
+
+// Source provides transaction history. *blockchyp.Client satisfies it.
+type Source interface {
+	AllTransactions(ctx context.Context, request blockchyp.TransactionHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.AuthorizationResponse, error]
+}
+
+// Options configures an export.
+type Options struct {
+	Format  Format
+	Columns []Column
+
+	// Filter selects the transactions to export. StartDate, EndDate,
+	// BatchID and TerminalName are the usual filters. MaxResults sets the
+	// page size.
+	Filter blockchyp.TransactionHistoryRequest
+
+	// RowGroupSize is the number of rows between checkpoints and per Parquet
+	// row group. It bounds memory use for Parquet exports.
+	RowGroupSize int
+
+	// Prefetch requests the next page of history while the current one is
+	// written.
+	Prefetch bool
+}
+
+// Result summarizes an export.
+type Result struct {
+	Rows    int  `json:"rows"`
+	Resumed bool `json:"resumed"`
+}
+
+// checkpoint records export progress so an interrupted file export can pick
+// up where it left off.
+type checkpoint struct {
+	Format    Format                              `json:"format"`
+	Columns   []Column                            `json:"columns"`
+	Filter    blockchyp.TransactionHistoryRequest `json:"filter"`
+	Rows      int                                 `json:"rows"`
+	Index     int                                 `json:"index"`
+	Offset    int64                               `json:"offset"`
+	RowGroups []parquetRowGroup                   `json:"rowGroups,omitempty"`
+}
+
+// rowWriter writes rows in a specific format.
+type rowWriter interface {
+	WriteRow(row []string) error
+	Flush() error
+	Close() error
+}
+
+// Write streams every matching transaction to w. Streaming exports cannot be
+// resumed; use WriteFile for that.
+func Write(ctx context.Context, source Source, w io.Writer, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+
+	cw := &countingWriter{w: w}
+	rw, err := newRowWriter(cw, opts, nil, true)
+	if err != nil {
+		return Result{}, err
+	}
+
+	rows := 0
+	for tx, err := range source.AllTransactions(ctx, opts.Filter, blockchyp.PageOptions{Prefetch: opts.Prefetch}) {
+		if err != nil {
+			return Result{Rows: rows}, err
+		}
+
+		row, err := extractRow(tx, opts.Columns)
+		if err != nil {
+			return Result{Rows: rows}, err
+		}
+		if err := rw.WriteRow(row); err != nil {
+			return Result{Rows: rows}, err
+		}
+
+		rows++
+		if rows%opts.RowGroupSize == 0 {
+			if err := rw.Flush(); err != nil {
+				return Result{Rows: rows}, err
+			}
+		}
+	}
+
+	return Result{Rows: rows}, rw.Close()
+}
+
+// WriteFile exports every matching transaction to a file. Progress is
+// checkpointed next to the file every RowGroupSize rows; if a checkpoint
+// exists the export resumes from it. The checkpoint is removed once the
+// export completes.
+func WriteFile(ctx context.Context, source Source, path string, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+	cpPath := path + ".checkpoint"
+
+	cp, err := readCheckpoint(cpPath)
+	if err != nil {
+		return Result{}, err
+	}
+
+	resumed := cp != nil
+	if resumed {
+		if cp.Format != opts.Format || !reflect.DeepEqual(cp.Columns, opts.Columns) || !sameFilter(cp.Filter, opts.Filter) {
+			return Result{}, ErrCheckpointMismatch
+		}
+	} else {
+		// Pin the end of the range so new transactions cannot shift
+		// records between pages if the export is resumed later.
+		filter := opts.Filter
+		if filter.EndDate.IsZero() {
+			filter.EndDate = time.Now().UTC()
+		}
+		cp = &checkpoint{
+			Format:  opts.Format,
+			Columns: opts.Columns,
+			Filter:  filter,
+			Index:   filter.StartIndex,
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	// Discard anything written after the last checkpoint.
+	if err := f.Truncate(cp.Offset); err != nil {
+		return Result{}, err
+	}
+	if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+		return Result{}, err
+	}
+
+	cw := &countingWriter{w: f, offset: cp.Offset}
+	rw, err := newRowWriter(cw, opts, cp.RowGroups, !resumed)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Resume from the gateway's position rather than the row count, which
+	// falls behind it whenever duplicate records are skipped between pages.
+	index := cp.Index
+	filter := cp.Filter
+	filter.StartIndex = index
+
+	save := func() error {
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		cp.Offset = cw.offset
+		cp.Index = index
+		if pw, ok := rw.(*parquetWriter); ok {
+			cp.RowGroups = pw.rowGroups
+		}
+		return writeCheckpoint(cpPath, cp)
+	}
+
+	// Record the header before any rows so a resume never writes it twice.
+	if !resumed {
+		if err := save(); err != nil {
+			return Result{}, err
+		}
+	}
+
+	for tx, err := range source.AllTransactions(ctx, filter, blockchyp.PageOptions{Prefetch: opts.Prefetch, Position: &index}) {
+		if err != nil {
+			return Result{Rows: cp.Rows, Resumed: resumed}, err
+		}
+
+		row, err := extractRow(tx, opts.Columns)
+		if err != nil {
+			return Result{Rows: cp.Rows, Resumed: resumed}, err
+		}
+		if err := rw.WriteRow(row); err != nil {
+			return Result{Rows: cp.Rows, Resumed: resumed}, err
+		}
+
+		cp.Rows++
+		if cp.Rows%opts.RowGroupSize == 0 {
+			if err := save(); err != nil {
+				return Result{Rows: cp.Rows, Resumed: resumed}, err
+			}
+		}
+	}
+
+	if err := rw.Close(); err != nil {
+		return Result{Rows: cp.Rows, Resumed: resumed}, err
+	}
+	if err := f.Sync(); err != nil {
+		return Result{Rows: cp.Rows, Resumed: resumed}, err
+	}
+
+	if err := os.Remove(cpPath); err != nil && !os.IsNotExist(err) {
+		return Result{Rows: cp.Rows, Resumed: resumed}, err
+	}
+
+	return Result{Rows: cp.Rows, Resumed: resumed}, nil
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.Format == "" {
+		opts.Format = FormatCSV
+	}
+	if len(opts.Columns) == 0 {
+		opts.Columns = DefaultColumns
+	}
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = DefaultRowGroupSize
+	}
+
+	return opts
+}
+
+func newRowWriter(w *countingWriter, opts Options, rowGroups []parquetRowGroup, header bool) (rowWriter, error) {
+	names := make([]string, len(opts.Columns))
+	for i, c := range opts.Columns {
+		names[i] = c.Name
+	}
+
+	switch opts.Format {
+	case FormatCSV:
+		cw := &csvWriter{bw: bufio.NewWriter(w)}
+		cw.w = csv.NewWriter(cw.bw)
+		if header {
+			if err := cw.w.Write(names); err != nil {
+				return nil, err
+			}
+		}
+		return cw, nil
+	case FormatJSONL:
+		return &jsonlWriter{bw: bufio.NewWriter(w), names: names}, nil
+	case FormatParquet:
+		return newParquetWriter(w, names, rowGroups)
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", opts.Format)
+	}
+}
+
+type csvWriter struct {
+	bw *bufio.Writer
+	w  *csv.Writer
+}
+
+func (c *csvWriter) WriteRow(row []string) error {
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+
+	return c.bw.Flush()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
+
+type jsonlWriter struct {
+	bw    *bufio.Writer
+	names []string
+}
+
+func (j *jsonlWriter) WriteRow(row []string) error {
+	// Build the object by hand to keep the configured column order.
+	j.bw.WriteByte('{')
+	for i, name := range j.names {
+		if i > 0 {
+			j.bw.WriteByte(',')
+		}
+		k, _ := json.Marshal(name)
+		v, _ := json.Marshal(row[i])
+		j.bw.Write(k)
+		j.bw.WriteByte(':')
+		j.bw.Write(v)
+	}
+	j.bw.WriteByte('}')
+
+	return j.bw.WriteByte('\n')
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.bw.Flush()
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.Flush()
+}
+
+// extractRow renders the configured columns of a transaction as strings.
+func extractRow(tx blockchyp.AuthorizationResponse, columns []Column) ([]string, error) {
+	content, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		row[i] = render(lookup(fields, c.Field))
+	}
+
+	return row, nil
+}
+
+func lookup(fields map[string]interface{}, path string) interface{} {
+	var value interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+
+	return value
+}
+
+func render(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(content)
+	}
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint %s: %w", path, err)
+	}
+
+	return cp, nil
+}
+
+// sameFilter reports whether a resumed export asked for the same
+// transactions as the checkpointed one. The end date pinned when the export
+// started and the start index it advances are not part of the comparison.
+func sameFilter(checkpointed, requested blockchyp.TransactionHistoryRequest) bool {
+	if requested.EndDate.IsZero() {
+		requested.EndDate = checkpointed.EndDate
+	}
+	requested.StartIndex = checkpointed.StartIndex
+
+	// Compare the encoded form, which is what the checkpoint holds, so time
+	// zones and monotonic clock readings don't cause false mismatches.
+	a, err := json.Marshal(normalizeFilter(checkpointed))
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(normalizeFilter(requested))
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(a, b)
+}
+
+func normalizeFilter(filter blockchyp.TransactionHistoryRequest) blockchyp.TransactionHistoryRequest {
+	filter.StartDate = filter.StartDate.UTC()
+	filter.EndDate = filter.EndDate.UTC()
+
+	return filter
+}
+
+func writeCheckpoint(path string, cp *checkpoint) error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, content, 0600)
+}
+
+// countingWriter tracks the file offset of everything written through it.
+type countingWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.offset += int64(n)
+
+	return n, err
+}
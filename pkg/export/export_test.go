@@ -0,0 +1,190 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// fakeSource serves a fixed transaction history, skipping records the way
+// the client skips duplicates that shift between pages.
+type fakeSource struct {
+	txs    []blockchyp.AuthorizationResponse
+	skip   map[int]bool
+	failAt int
+	starts []int
+}
+
+func newFakeSource(n int) *fakeSource {
+	f := &fakeSource{skip: map[int]bool{}}
+	for i := 0; i < n; i++ {
+		f.txs = append(f.txs, blockchyp.AuthorizationResponse{
+			TransactionID:    fmt.Sprintf("TX%d", i),
+			Approved:         true,
+			AuthorizedAmount: "1.00",
+		})
+	}
+
+	return f
+}
+
+func (f *fakeSource) AllTransactions(ctx context.Context, request blockchyp.TransactionHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.AuthorizationResponse, error] {
+	var position *int
+	if len(opts) > 0 {
+		position = opts[0].Position
+	}
+
+	return func(yield func(blockchyp.AuthorizationResponse, error) bool) {
+		f.starts = append(f.starts, request.StartIndex)
+		for i := request.StartIndex; i < len(f.txs); i++ {
+			if f.failAt > 0 && i == f.failAt {
+				yield(blockchyp.AuthorizationResponse{}, errInterrupted)
+				return
+			}
+			if position != nil {
+				*position = i + 1
+			}
+			if f.skip[i] {
+				continue
+			}
+			if !yield(f.txs[i], nil) {
+				return
+			}
+		}
+	}
+}
+
+func readIDs(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	require.NotEmpty(t, records)
+
+	ids := make([]string, 0, len(records)-1)
+	for _, r := range records[1:] {
+		ids = append(ids, r[0])
+	}
+
+	return ids
+}
+
+func TestParseColumns(t *testing.T) {
+	assert := assert.New(t)
+
+	columns, err := ParseColumns("transactionId, aid=receiptSuggestions.aid")
+	require.NoError(t, err)
+	assert.Equal([]Column{
+		{Name: "transactionId", Field: "transactionId"},
+		{Name: "aid", Field: "receiptSuggestions.aid"},
+	}, columns)
+
+	columns, err = ParseColumns(" ")
+	require.NoError(t, err)
+	assert.Equal(DefaultColumns, columns)
+
+	_, err = ParseColumns("name=")
+	assert.Error(err)
+}
+
+func TestWriteJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	res, err := Write(context.Background(), newFakeSource(2), &buf, Options{
+		Format:  FormatJSONL,
+		Columns: []Column{{Name: "id", Field: "transactionId"}, {Name: "approved", Field: "approved"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, res.Rows)
+	assert.Equal(t, "{\"id\":\"TX0\",\"approved\":\"true\"}\n{\"id\":\"TX1\",\"approved\":\"true\"}\n", buf.String())
+}
+
+func TestWriteFileResumesFromGatewayPosition(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "history.csv")
+
+	// Record 3 is skipped as a duplicate, so after six rows the gateway is
+	// at index seven.
+	source := newFakeSource(10)
+	source.skip[3] = true
+	source.failAt = 7
+	opts := Options{RowGroupSize: 2}
+
+	_, err := WriteFile(context.Background(), source, path, opts)
+	require.ErrorIs(t, err, errInterrupted)
+
+	_, err = os.Stat(path + ".checkpoint")
+	require.NoError(t, err)
+
+	source.failAt = 0
+	res, err := WriteFile(context.Background(), source, path, opts)
+	require.NoError(t, err)
+	assert.True(res.Resumed)
+	assert.Equal(9, res.Rows)
+	assert.Equal([]int{0, 7}, source.starts)
+
+	assert.Equal([]string{"TX0", "TX1", "TX2", "TX4", "TX5", "TX6", "TX7", "TX8", "TX9"}, readIDs(t, path))
+
+	_, err = os.Stat(path + ".checkpoint")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestWriteFileCheckpointMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.csv")
+
+	source := newFakeSource(4)
+	source.failAt = 3
+	_, err := WriteFile(context.Background(), source, path, Options{RowGroupSize: 1})
+	require.ErrorIs(t, err, errInterrupted)
+
+	_, err = WriteFile(context.Background(), source, path, Options{Format: FormatJSONL, RowGroupSize: 1})
+	assert.ErrorIs(t, err, ErrCheckpointMismatch)
+}
+
+func TestWriteFileFilterMismatch(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "history.csv")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	source := newFakeSource(4)
+	source.failAt = 3
+	opts := Options{RowGroupSize: 1, Filter: blockchyp.TransactionHistoryRequest{StartDate: start, BatchID: "B1"}}
+	_, err := WriteFile(context.Background(), source, path, opts)
+	require.ErrorIs(t, err, errInterrupted)
+
+	changed := opts
+	changed.Filter.BatchID = "B2"
+	_, err = WriteFile(context.Background(), source, path, changed)
+	assert.ErrorIs(err, ErrCheckpointMismatch)
+
+	changed = opts
+	changed.Filter.EndDate = start.Add(time.Hour)
+	_, err = WriteFile(context.Background(), source, path, changed)
+	assert.ErrorIs(err, ErrCheckpointMismatch)
+
+	// The same start date in another zone, with the end date left to the
+	// pinned one, resumes the export.
+	source.failAt = 0
+	same := opts
+	same.Filter.StartDate = start.In(time.FixedZone("EST", -5*60*60))
+	res, err := WriteFile(context.Background(), source, path, same)
+	require.NoError(t, err)
+	assert.True(res.Resumed)
+	assert.Equal(4, res.Rows)
+}
@@ -0,0 +1,281 @@
+package export
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// This file contains a deliberately small Parquet writer: every column is a
+// required UTF-8 byte array, written with PLAIN encoding, no compression and
+// one data page per column per row group. That is all a flat export needs,
+// and it keeps the SDK free of a heavyweight Parquet dependency.
+
+const parquetMagic = "PAR1"
+
+// Parquet enum values from parquet.thrift.
+const (
+	parquetTypeByteArray      = 6
+	parquetRepetitionRequired = 0
+	parquetConvertedUTF8      = 0
+	parquetEncodingPlain      = 0
+	parquetEncodingRLE        = 3
+	parquetCodecUncompressed  = 0
+	parquetPageData           = 0
+)
+
+// parquetColumnChunk locates one column's data within a row group.
+type parquetColumnChunk struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// parquetRowGroup records a written row group so a resumed export can
+// rebuild the footer without re-reading the file.
+type parquetRowGroup struct {
+	Rows    int64                `json:"rows"`
+	Columns []parquetColumnChunk `json:"columns"`
+}
+
+// parquetWriter buffers a row group of values in memory and writes it out
+// on flush. Memory use is bounded by the row group size.
+type parquetWriter struct {
+	w         *countingWriter
+	columns   []string
+	values    [][]string
+	rowGroups []parquetRowGroup
+}
+
+func newParquetWriter(w *countingWriter, columns []string, rowGroups []parquetRowGroup) (*parquetWriter, error) {
+	p := &parquetWriter{
+		w:         w,
+		columns:   columns,
+		values:    make([][]string, len(columns)),
+		rowGroups: rowGroups,
+	}
+
+	if w.offset == 0 {
+		if _, err := io.WriteString(w, parquetMagic); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *parquetWriter) WriteRow(row []string) error {
+	for i, v := range row {
+		p.values[i] = append(p.values[i], v)
+	}
+
+	return nil
+}
+
+// Flush writes buffered rows as a new row group.
+func (p *parquetWriter) Flush() error {
+	rows := 0
+	if len(p.values) > 0 {
+		rows = len(p.values[0])
+	}
+	if rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{
+		Rows:    int64(rows),
+		Columns: make([]parquetColumnChunk, len(p.columns)),
+	}
+
+	for i := range p.columns {
+		data := make([]byte, 0)
+		for _, v := range p.values[i] {
+			data = binary.LittleEndian.AppendUint32(data, uint32(len(v)))
+			data = append(data, v...)
+		}
+
+		header := &thriftWriter{}
+		header.fieldI32(1, parquetPageData)
+		header.fieldI32(2, int32(len(data)))
+		header.fieldI32(3, int32(len(data)))
+		header.fieldStructBegin(5)
+		header.fieldI32(1, int32(rows))
+		header.fieldI32(2, parquetEncodingPlain)
+		header.fieldI32(3, parquetEncodingRLE)
+		header.fieldI32(4, parquetEncodingRLE)
+		header.structEnd()
+		header.structEnd()
+
+		offset := p.w.offset
+		if _, err := p.w.Write(header.buf); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(data); err != nil {
+			return err
+		}
+
+		group.Columns[i] = parquetColumnChunk{
+			Offset: offset,
+			Size:   p.w.offset - offset,
+		}
+		p.values[i] = p.values[i][:0]
+	}
+
+	p.rowGroups = append(p.rowGroups, group)
+
+	return nil
+}
+
+// Close flushes any buffered rows and writes the file footer.
+func (p *parquetWriter) Close() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+
+	var rows int64
+	for _, g := range p.rowGroups {
+		rows += g.Rows
+	}
+
+	meta := &thriftWriter{}
+	meta.fieldI32(1, 1)
+
+	meta.fieldListBegin(2, thriftStruct, len(p.columns)+1)
+	meta.structBegin()
+	meta.fieldBinary(4, "schema")
+	meta.fieldI32(5, int32(len(p.columns)))
+	meta.structEnd()
+	for _, name := range p.columns {
+		meta.structBegin()
+		meta.fieldI32(1, parquetTypeByteArray)
+		meta.fieldI32(3, parquetRepetitionRequired)
+		meta.fieldBinary(4, name)
+		meta.fieldI32(6, parquetConvertedUTF8)
+		meta.structEnd()
+	}
+
+	meta.fieldI64(3, rows)
+
+	meta.fieldListBegin(4, thriftStruct, len(p.rowGroups))
+	for _, g := range p.rowGroups {
+		var total int64
+		for _, c := range g.Columns {
+			total += c.Size
+		}
+
+		meta.structBegin()
+		meta.fieldListBegin(1, thriftStruct, len(g.Columns))
+		for i, c := range g.Columns {
+			meta.structBegin()
+			meta.fieldI64(2, c.Offset)
+			meta.fieldStructBegin(3)
+			meta.fieldI32(1, parquetTypeByteArray)
+			meta.fieldListBegin(2, thriftI32, 1)
+			meta.varint(zigzag(parquetEncodingPlain))
+			meta.fieldListBegin(3, thriftBinary, 1)
+			meta.binary(p.columns[i])
+			meta.fieldI32(4, parquetCodecUncompressed)
+			meta.fieldI64(5, g.Rows)
+			meta.fieldI64(6, c.Size)
+			meta.fieldI64(7, c.Size)
+			meta.fieldI64(9, c.Offset)
+			meta.structEnd()
+			meta.structEnd()
+		}
+		meta.fieldI64(2, total)
+		meta.fieldI64(3, g.Rows)
+		meta.structEnd()
+	}
+
+	meta.fieldBinary(6, "blockchyp-go")
+	meta.structEnd()
+
+	footer := binary.LittleEndian.AppendUint32(meta.buf, uint32(len(meta.buf)))
+	footer = append(footer, parquetMagic...)
+
+	_, err := p.w.Write(footer)
+
+	return err
+}
+
+// Thrift compact protocol type ids.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the handful of thrift compact protocol constructs
+// used by Parquet metadata.
+type thriftWriter struct {
+	buf    []byte
+	last   int16
+	nested []int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	delta := id - t.last
+	if delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) fieldBinary(id int16, v string) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(v)
+}
+
+func (t *thriftWriter) fieldStructBegin(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.structBegin()
+}
+
+func (t *thriftWriter) fieldListBegin(id int16, elem byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) structBegin() {
+	t.nested = append(t.nested, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.nested); n > 0 {
+		t.last = t.nested[n-1]
+		t.nested = t.nested[:n-1]
+	}
+}
+
+func (t *thriftWriter) binary(v string) {
+	t.varint(uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf = binary.AppendUvarint(t.buf, v)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
@@ -0,0 +1,195 @@
+package export
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// thriftReader decodes thrift compact protocol structs into maps keyed by
+// field id, which is enough to check the metadata the writer produces.
+type thriftReader struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	require.Less(r.t, r.pos, len(r.buf), "thrift data ends early")
+	b := r.buf[r.pos]
+	r.pos++
+
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	require.Greater(r.t, n, 0, "invalid varint")
+	r.pos += n
+
+	return v
+}
+
+func (r *thriftReader) int() int64 {
+	v := r.uvarint()
+
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+
+	var last int16
+	for {
+		b := r.byte()
+		if b == 0 {
+			return fields
+		}
+
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(r.int())
+		}
+		last = id
+		fields[id] = r.readValue(b & 0x0f)
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case thriftI32, thriftI64:
+		return r.int()
+	case thriftBinary:
+		n := int(r.uvarint())
+		require.LessOrEqual(r.t, r.pos+n, len(r.buf), "thrift data ends early")
+		v := string(r.buf[r.pos : r.pos+n])
+		r.pos += n
+		return v
+	case thriftList:
+		b := r.byte()
+		size := int(b >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i] = r.readValue(b & 0x0f)
+		}
+		return items
+	case thriftStruct:
+		return r.readStruct()
+	}
+
+	r.t.Fatalf("unsupported thrift type %d", typ)
+
+	return nil
+}
+
+// readParquet checks the file layout and returns the column names and rows.
+func readParquet(t *testing.T, path string) ([]string, [][]string) {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	require.Greater(t, len(content), 12)
+	require.Equal(t, parquetMagic, string(content[:4]))
+	require.Equal(t, parquetMagic, string(content[len(content)-4:]))
+
+	size := int(binary.LittleEndian.Uint32(content[len(content)-8:]))
+	start := len(content) - 8 - size
+	require.Greater(t, start, 4)
+
+	footer := &thriftReader{t: t, buf: content[start : len(content)-8]}
+	meta := footer.readStruct()
+	require.Equal(t, len(footer.buf), footer.pos, "trailing footer bytes")
+	require.Equal(t, int64(1), meta[1])
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	require.Equal(t, int64(len(schema)-1), root[5])
+
+	columns := make([]string, 0, len(schema)-1)
+	for _, s := range schema[1:] {
+		element := s.(map[int16]interface{})
+		require.Equal(t, int64(parquetTypeByteArray), element[1])
+		columns = append(columns, element[4].(string))
+	}
+
+	rows := make([][]string, 0)
+	var total int64
+	for _, g := range meta[4].([]interface{}) {
+		group := g.(map[int16]interface{})
+		count := int(group[3].(int64))
+		total += int64(count)
+
+		values := make([][]string, len(columns))
+		for i, c := range group[1].([]interface{}) {
+			chunk := c.(map[int16]interface{})[3].(map[int16]interface{})
+			require.Equal(t, []interface{}{columns[i]}, chunk[3])
+			require.Equal(t, int64(count), chunk[5])
+
+			page := &thriftReader{t: t, buf: content, pos: int(chunk[9].(int64))}
+			header := page.readStruct()
+			require.Equal(t, int64(count), header[5].(map[int16]interface{})[1])
+
+			data := content[page.pos : page.pos+int(header[3].(int64))]
+			for len(data) > 0 {
+				n := int(binary.LittleEndian.Uint32(data))
+				values[i] = append(values[i], string(data[4:4+n]))
+				data = data[4+n:]
+			}
+			require.Len(t, values[i], count)
+		}
+
+		for r := 0; r < count; r++ {
+			row := make([]string, len(columns))
+			for i := range columns {
+				row[i] = values[i][r]
+			}
+			rows = append(rows, row)
+		}
+	}
+	require.Equal(t, total, meta[3])
+
+	return columns, rows
+}
+
+func TestWriteFileParquet(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "history.parquet")
+
+	// The export is interrupted after the first row group and resumed, so
+	// the footer has to cover row groups from both runs.
+	source := newFakeSource(5)
+	source.failAt = 3
+	opts := Options{
+		Format:       FormatParquet,
+		Columns:      []Column{{Name: "id", Field: "transactionId"}, {Name: "approved", Field: "approved"}},
+		RowGroupSize: 2,
+	}
+
+	_, err := WriteFile(context.Background(), source, path, opts)
+	require.ErrorIs(t, err, errInterrupted)
+
+	source.failAt = 0
+	res, err := WriteFile(context.Background(), source, path, opts)
+	require.NoError(t, err)
+	assert.True(res.Resumed)
+	assert.Equal(5, res.Rows)
+
+	columns, rows := readParquet(t, path)
+	assert.Equal([]string{"id", "approved"}, columns)
+	assert.Equal([][]string{
+		{"TX0", "true"},
+		{"TX1", "true"},
+		{"TX2", "true"},
+		{"TX3", "true"},
+		{"TX4", "true"},
+	}, rows)
+}
@@ -0,0 +1,289 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// timeout is a scripted answer the fake terminal times out on.
+const timeout = "<timeout>"
+
+// fakeGateway answers prompts from scripted queues and records every
+// message shown.
+type fakeGateway struct {
+	booleans []bool
+	texts    []string
+	terms    []*blockchyp.TermsAndConditionsResponse
+	err      error
+
+	messages []string
+	termsReq []blockchyp.TermsAndConditionsRequest
+}
+
+func (g *fakeGateway) Message(request blockchyp.MessageRequest) (*blockchyp.Acknowledgement, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	g.messages = append(g.messages, request.Message)
+
+	return &blockchyp.Acknowledgement{Success: true}, nil
+}
+
+func (g *fakeGateway) BooleanPrompt(request blockchyp.BooleanPromptRequest) (*blockchyp.BooleanPromptResponse, error) {
+	answer := g.booleans[0]
+	g.booleans = g.booleans[1:]
+
+	return &blockchyp.BooleanPromptResponse{Success: true, Response: answer}, nil
+}
+
+func (g *fakeGateway) TextPrompt(request blockchyp.TextPromptRequest) (*blockchyp.TextPromptResponse, error) {
+	answer := g.texts[0]
+	g.texts = g.texts[1:]
+	if answer == timeout {
+		return &blockchyp.TextPromptResponse{ResponseDescription: blockchyp.ResponseTimedOut}, nil
+	}
+
+	return &blockchyp.TextPromptResponse{Success: true, Response: answer}, nil
+}
+
+func (g *fakeGateway) TermsAndConditions(request blockchyp.TermsAndConditionsRequest) (*blockchyp.TermsAndConditionsResponse, error) {
+	g.termsReq = append(g.termsReq, request)
+	res := g.terms[0]
+	g.terms = g.terms[1:]
+
+	return res, nil
+}
+
+func (g *fakeGateway) CaptureSignature(request blockchyp.CaptureSignatureRequest) (*blockchyp.CaptureSignatureResponse, error) {
+	return &blockchyp.CaptureSignatureResponse{Success: true, SigFile: "ff00"}, nil
+}
+
+const checkIn = `
+name: check-in
+timeout: 60
+vars:
+  name: friend
+steps:
+  - id: greet
+    type: message
+    text: "Welcome, {{.name}}"
+    next: ask
+  - id: ask
+    type: boolean
+    text: Join our mailing list?
+    yes: Sure
+    no: No thanks
+    branches:
+      - equals: "yes"
+        next: email
+    next: bye
+  - id: email
+    type: text
+    prompt: email
+    save: email
+    validate:
+      required: true
+    invalidText: That doesn't look right
+    retries: 1
+    onInvalid: bye
+    onTimeout: bye
+    next: terms
+  - id: terms
+    type: terms
+    name: "Terms for {{.email}}"
+    content: Be nice.
+    save: agreed
+    branches:
+      - equals: "no"
+        next: bye
+    next: sign
+  - id: sign
+    type: signature
+    save: signature
+    next: bye
+  - id: bye
+    type: message
+    text: "Thanks, {{.name}}"
+`
+
+func parse(t *testing.T, script string) *Script {
+	s, err := ParseScript([]byte(script))
+	require.NoError(t, err)
+
+	return s
+}
+
+func steps(tr *Transcript) []string {
+	ids := make([]string, 0, len(tr.Entries))
+	for _, e := range tr.Entries {
+		ids = append(ids, e.Step)
+	}
+
+	return ids
+}
+
+func TestRunCompleted(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{
+		booleans: []bool{true},
+		texts:    []string{"not-an-email", " ann@example.com "},
+		terms:    []*blockchyp.TermsAndConditionsResponse{{Success: true, TransactionID: "TC1", SigFile: "abcd"}},
+	}
+	tr, err := Run(context.Background(), g, parse(t, checkIn), Options{
+		TerminalName: "Front",
+		Vars:         map[string]string{"name": "Ann"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(Completed, tr.Status)
+	assert.Equal("check-in", tr.Script)
+	assert.Equal([]string{"greet", "ask", "email", "email", "terms", "sign", "bye"}, steps(tr))
+	assert.Equal([]string{"Welcome, Ann", "That doesn't look right", "Thanks, Ann"}, g.messages)
+
+	invalid := tr.Entries[2]
+	assert.True(invalid.Invalid)
+	assert.Equal("not an email address", invalid.Error)
+	assert.Equal(2, tr.Entries[3].Attempt)
+
+	require.Len(t, g.termsReq, 1)
+	assert.Equal("Terms for ann@example.com", g.termsReq[0].TCName)
+	assert.Equal(60, g.termsReq[0].Timeout)
+	assert.Equal("TC1", tr.Entries[4].TransactionID)
+	assert.Equal(blockchyp.SignatureFormat(blockchyp.SignatureFormatPNG), tr.Entries[4].SigFormat)
+
+	assert.Equal("ann@example.com", tr.Vars["email"])
+	assert.Equal("true", tr.Vars["agreed"])
+	assert.Equal("ff00", tr.Vars["signature"])
+}
+
+func TestRunBranches(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, err := Run(context.Background(), &fakeGateway{booleans: []bool{false}}, parse(t, checkIn), Options{})
+	require.NoError(t, err)
+	assert.Equal([]string{"greet", "ask", "bye"}, steps(tr))
+	assert.Equal("Thanks, friend", tr.Entries[2].Text)
+
+	g := &fakeGateway{
+		booleans: []bool{true},
+		texts:    []string{"ann@example.com"},
+		terms:    []*blockchyp.TermsAndConditionsResponse{{ResponseDescription: "Declined"}},
+	}
+	tr, err = Run(context.Background(), g, parse(t, checkIn), Options{})
+	require.NoError(t, err)
+	assert.Equal([]string{"greet", "ask", "email", "terms", "bye"}, steps(tr))
+	assert.Equal("false", tr.Vars["agreed"])
+}
+
+func TestRunTimeoutAndInvalidHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	tr, err := Run(context.Background(), &fakeGateway{booleans: []bool{true}, texts: []string{timeout}}, parse(t, checkIn), Options{})
+	require.NoError(t, err)
+	assert.Equal(Completed, tr.Status)
+	assert.Equal([]string{"greet", "ask", "email", "bye"}, steps(tr))
+	assert.True(tr.Entries[2].TimedOut)
+
+	tr, err = Run(context.Background(), &fakeGateway{booleans: []bool{true}, texts: []string{"", "nope"}}, parse(t, checkIn), Options{})
+	require.NoError(t, err)
+	assert.Equal([]string{"greet", "ask", "email", "email", "bye"}, steps(tr))
+	assert.Equal("answer required", tr.Entries[2].Error)
+	_, saved := tr.Vars["email"]
+	assert.False(saved)
+}
+
+func TestRunUnhandledTimeout(t *testing.T) {
+	s := parse(t, `
+steps:
+  - id: phone
+    type: text
+    prompt: phone
+`)
+
+	tr, err := Run(context.Background(), &fakeGateway{texts: []string{timeout}}, s, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, TimedOut, tr.Status)
+}
+
+func TestRunGatewayFailure(t *testing.T) {
+	g := &fakeGateway{err: errors.New("terminal offline")}
+
+	tr, err := Run(context.Background(), g, parse(t, checkIn), Options{})
+	assert.EqualError(t, err, "step greet: terminal offline")
+	assert.Equal(t, Failed, tr.Status)
+	assert.Equal(t, "step greet: terminal offline", tr.Error)
+}
+
+func TestRunStepLimit(t *testing.T) {
+	s := parse(t, `
+steps:
+  - id: a
+    type: message
+    text: ping
+    next: b
+  - id: b
+    type: message
+    text: pong
+    next: a
+`)
+
+	tr, err := Run(context.Background(), &fakeGateway{}, s, Options{MaxSteps: 5})
+	assert.EqualError(t, err, "stopped after 5 steps at b")
+	assert.Equal(t, Failed, tr.Status)
+	assert.Len(t, tr.Entries, 5)
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tr, err := Run(ctx, &fakeGateway{}, parse(t, checkIn), Options{})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, Canceled, tr.Status)
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	for name, script := range map[string]string{
+		"no steps":       `name: empty`,
+		"unknown field":  "steps:\n  - id: a\n    type: message\n    text: hi\n    nxet: b\n",
+		"duplicate id":   "steps:\n  - id: a\n    type: message\n    text: hi\n  - id: a\n    type: message\n    text: hi\n",
+		"unknown target": "steps:\n  - id: a\n    type: message\n    text: hi\n    next: b\n",
+		"unknown type":   "steps:\n  - id: a\n    type: dance\n",
+		"bad template":   "steps:\n  - id: a\n    type: message\n    text: \"{{.name\"\n",
+		"bad pattern":    "steps:\n  - id: a\n    type: text\n    prompt: email\n    validate:\n      pattern: \"[\"\n",
+		"validate type":  "steps:\n  - id: a\n    type: message\n    text: hi\n    validate:\n      required: true\n",
+	} {
+		_, err := ParseScript([]byte(script))
+		assert.True(t, errors.Is(err, ErrInvalidScript), name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	phone := &Step{Type: Text, Prompt: blockchyp.PromptTypePhone}
+	assert.Empty(validate(phone, "(555) 123-4567"))
+	assert.Equal("not a phone number", validate(phone, "call me"))
+	assert.Empty(validate(phone, ""))
+
+	s := parse(t, `
+steps:
+  - id: zip
+    type: text
+    prompt: customer-number
+    validate:
+      pattern: "[0-9]{5}"
+      maxLength: 5
+`)
+	zip := &s.Steps[0]
+	assert.Empty(validate(zip, "12345"))
+	assert.Equal("doesn't match the expected format", validate(zip, "1234a"))
+	assert.Equal("longer than 5 characters", validate(zip, "123456"))
+}
@@ -0,0 +1,559 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// DefaultRetries is how many times an invalid answer is asked for again
+// when a step doesn't say.
+const DefaultRetries = 2
+
+// DefaultMaxSteps limits how many steps a run can take, so a script that
+// branches in a loop can't hold a terminal forever.
+const DefaultMaxSteps = 100
+
+// Gateway is the subset of *blockchyp.Client used to run flows.
+type Gateway interface {
+	Message(request blockchyp.MessageRequest) (*blockchyp.Acknowledgement, error)
+	BooleanPrompt(request blockchyp.BooleanPromptRequest) (*blockchyp.BooleanPromptResponse, error)
+	TextPrompt(request blockchyp.TextPromptRequest) (*blockchyp.TextPromptResponse, error)
+	TermsAndConditions(request blockchyp.TermsAndConditionsRequest) (*blockchyp.TermsAndConditionsResponse, error)
+	CaptureSignature(request blockchyp.CaptureSignatureRequest) (*blockchyp.CaptureSignatureResponse, error)
+}
+
+// Status is how a run ended.
+type Status string
+
+// Run statuses.
+const (
+	Completed Status = "completed"
+	TimedOut  Status = "timed_out"
+	Invalid   Status = "invalid"
+	Canceled  Status = "canceled"
+	Failed    Status = "failed"
+)
+
+// Options configures a run.
+type Options struct {
+	TerminalName string
+	Test         bool
+
+	// Vars are added to the script's variables, replacing any with the
+	// same name, such as a customer's name looked up before the flow.
+	Vars map[string]string
+
+	// MaxSteps defaults to DefaultMaxSteps.
+	MaxSteps int
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Transcript records a run.
+type Transcript struct {
+	Script    string    `json:"script"`
+	Terminal  string    `json:"terminal"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+
+	// Vars are the variables at the end of the run, including every saved
+	// answer.
+	Vars    map[string]string `json:"vars"`
+	Entries []Entry           `json:"entries"`
+}
+
+// Entry is one interaction in a transcript. Re-prompts after invalid
+// answers get an entry each.
+type Entry struct {
+	Step    string    `json:"step"`
+	Type    StepType  `json:"type"`
+	At      time.Time `json:"at"`
+	Attempt int       `json:"attempt"`
+
+	// Text is what was shown, after templating.
+	Text string `json:"text,omitempty"`
+
+	Answer   string `json:"answer,omitempty"`
+	Invalid  bool   `json:"invalid,omitempty"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+
+	// TransactionID identifies an accepted terms and conditions record.
+	TransactionID string `json:"transactionId,omitempty"`
+
+	// Signature is a captured signature, hex encoded, in SigFormat.
+	Signature string                    `json:"signature,omitempty"`
+	SigFormat blockchyp.SignatureFormat `json:"sigFormat,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	// errTimeout marks a step the customer didn't answer in time.
+	errTimeout = errors.New("timed out waiting for customer")
+
+	// errInvalid marks a step whose answers were invalid on every attempt.
+	errInvalid = errors.New("answer invalid")
+)
+
+// Run runs a script on a terminal and returns its transcript. The
+// transcript is returned even when the run fails, recording how far it
+// got; the error is only set for failures of the terminal or gateway, not
+// for timeouts or invalid answers the script didn't handle, which end the
+// run with a status instead.
+func Run(ctx context.Context, gateway Gateway, script *Script, opts Options) (*Transcript, error) {
+	r := &runner{
+		gateway: gateway,
+		script:  script,
+		opts:    opts,
+		vars:    make(map[string]string),
+	}
+	for k, v := range script.Vars {
+		r.vars[k] = v
+	}
+	for k, v := range opts.Vars {
+		r.vars[k] = v
+	}
+
+	t := &Transcript{
+		Script:    script.Name,
+		Terminal:  opts.TerminalName,
+		StartedAt: r.now(),
+		Entries:   make([]Entry, 0),
+	}
+	r.transcript = t
+
+	err := r.run(ctx)
+
+	t.EndedAt = r.now()
+	t.Vars = r.vars
+	switch {
+	case err == nil:
+		t.Status = Completed
+	case errors.Is(err, errTimeout):
+		t.Status = TimedOut
+		err = nil
+	case errors.Is(err, errInvalid):
+		t.Status = Invalid
+		err = nil
+	case ctx.Err() != nil:
+		t.Status = Canceled
+		t.Error = err.Error()
+	default:
+		t.Status = Failed
+		t.Error = err.Error()
+	}
+
+	return t, err
+}
+
+type runner struct {
+	gateway    Gateway
+	script     *Script
+	opts       Options
+	vars       map[string]string
+	transcript *Transcript
+}
+
+func (r *runner) run(ctx context.Context) error {
+	if r.script.steps == nil {
+		if err := r.script.compile(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidScript, err)
+		}
+	}
+
+	limit := r.opts.MaxSteps
+	if limit <= 0 {
+		limit = DefaultMaxSteps
+	}
+
+	id := r.script.Start
+	for n := 0; id != ""; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if n == limit {
+			return fmt.Errorf("stopped after %d steps at %s", limit, id)
+		}
+
+		step := r.script.steps[id]
+		answer, err := r.step(ctx, step)
+		switch {
+		case errors.Is(err, errTimeout) && step.OnTimeout != "":
+			id = step.OnTimeout
+		case errors.Is(err, errInvalid) && step.OnInvalid != "":
+			id = step.OnInvalid
+		case err != nil:
+			return fmt.Errorf("step %s: %w", step.ID, err)
+		default:
+			id = next(step, answer)
+		}
+	}
+
+	return nil
+}
+
+// step runs a step, asking again after invalid answers, and saves the
+// answer.
+func (r *runner) step(ctx context.Context, step *Step) (string, error) {
+	retries := DefaultRetries
+	if step.Retries != nil {
+		retries = *step.Retries
+	}
+
+	for attempt := 1; ; attempt++ {
+		entry := Entry{
+			Step:    step.ID,
+			Type:    step.Type,
+			At:      r.now(),
+			Attempt: attempt,
+		}
+
+		err := r.interact(step, &entry)
+		if errors.Is(err, errTimeout) {
+			entry.TimedOut = true
+		} else if err != nil {
+			entry.Error = err.Error()
+		}
+
+		if err == nil && step.Type == Text {
+			if problem := validate(step, entry.Answer); problem != "" {
+				entry.Invalid = true
+				entry.Error = problem
+				err = errInvalid
+			}
+		}
+		r.transcript.Entries = append(r.transcript.Entries, entry)
+
+		if !errors.Is(err, errInvalid) {
+			if err == nil && step.Save != "" {
+				r.vars[step.Save] = entry.Answer
+				if step.Type == Signature {
+					r.vars[step.Save] = entry.Signature
+				}
+			}
+			return entry.Answer, err
+		}
+
+		if attempt > retries {
+			return "", err
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			return "", cerr
+		}
+		if step.InvalidText != "" {
+			if err := r.message(step.InvalidText); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// interact performs a step's terminal request and records the result.
+func (r *runner) interact(step *Step, entry *Entry) error {
+	timeout := step.Timeout
+	if timeout == 0 {
+		timeout = r.script.Timeout
+	}
+
+	switch step.Type {
+	case Message:
+		text, err := r.render(step.Text)
+		if err != nil {
+			return err
+		}
+		entry.Text = text
+
+		res, err := r.gateway.Message(blockchyp.MessageRequest{
+			Test:         r.opts.Test,
+			TerminalName: r.opts.TerminalName,
+			Timeout:      timeout,
+			Message:      text,
+		})
+		if err != nil {
+			return failure(err, "")
+		}
+		if !res.Success {
+			return failure(nil, res.ResponseDescription)
+		}
+
+	case Boolean:
+		text, err := r.render(step.Text)
+		if err != nil {
+			return err
+		}
+		yes, err := r.render(step.Yes)
+		if err != nil {
+			return err
+		}
+		no, err := r.render(step.No)
+		if err != nil {
+			return err
+		}
+		entry.Text = text
+
+		res, err := r.gateway.BooleanPrompt(blockchyp.BooleanPromptRequest{
+			Test:         r.opts.Test,
+			TerminalName: r.opts.TerminalName,
+			Timeout:      timeout,
+			Prompt:       text,
+			YesCaption:   yes,
+			NoCaption:    no,
+		})
+		if err != nil {
+			return failure(err, "")
+		}
+		if !res.Success {
+			return failure(nil, res.ResponseDescription)
+		}
+		entry.Answer = strconv.FormatBool(res.Response)
+
+	case Text:
+		entry.Text = string(step.Prompt)
+
+		res, err := r.gateway.TextPrompt(blockchyp.TextPromptRequest{
+			Test:         r.opts.Test,
+			TerminalName: r.opts.TerminalName,
+			Timeout:      timeout,
+			PromptType:   step.Prompt,
+		})
+		if err != nil {
+			return failure(err, "")
+		}
+		if !res.Success {
+			return failure(nil, res.ResponseDescription)
+		}
+		entry.Answer = strings.TrimSpace(res.Response)
+
+	case Terms:
+		name, err := r.render(step.Name)
+		if err != nil {
+			return err
+		}
+		content, err := r.render(step.Content)
+		if err != nil {
+			return err
+		}
+		entry.Text = firstNonEmpty(name, step.Alias)
+
+		format := sigFormat(step)
+		res, err := r.gateway.TermsAndConditions(blockchyp.TermsAndConditionsRequest{
+			Test:         r.opts.Test,
+			TerminalName: r.opts.TerminalName,
+			Timeout:      timeout,
+			TCAlias:      step.Alias,
+			TCName:       name,
+			TCContent:    content,
+			SigRequired:  step.SigRequired,
+			SigFormat:    format,
+			SigWidth:     step.SigWidth,
+		})
+		if err != nil {
+			return failure(err, "")
+		}
+		entry.TransactionID = res.TransactionID
+		if !res.Success {
+			if declined(res) {
+				entry.Answer = "false"
+				return nil
+			}
+
+			return failure(nil, res.ResponseDescription)
+		}
+		entry.Answer = "true"
+		if res.SigFile != "" {
+			entry.Signature = res.SigFile
+			entry.SigFormat = format
+		}
+
+	case Signature:
+		format := sigFormat(step)
+		res, err := r.gateway.CaptureSignature(blockchyp.CaptureSignatureRequest{
+			Test:         r.opts.Test,
+			TerminalName: r.opts.TerminalName,
+			Timeout:      timeout,
+			SigFormat:    format,
+			SigWidth:     step.SigWidth,
+		})
+		if err != nil {
+			return failure(err, "")
+		}
+		if !res.Success {
+			return failure(nil, res.ResponseDescription)
+		}
+		entry.Signature = res.SigFile
+		entry.SigFormat = format
+	}
+
+	return nil
+}
+
+// message shows a templated message outside of a step, such as after an
+// invalid answer.
+func (r *runner) message(text string) error {
+	text, err := r.render(text)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.gateway.Message(blockchyp.MessageRequest{
+		Test:         r.opts.Test,
+		TerminalName: r.opts.TerminalName,
+		Message:      text,
+	})
+	if err != nil {
+		return failure(err, "")
+	}
+	if !res.Success {
+		return failure(nil, res.ResponseDescription)
+	}
+
+	return nil
+}
+
+func (r *runner) render(text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	t, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, r.vars); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func (r *runner) now() time.Time {
+	if r.opts.Now == nil {
+		return time.Now()
+	}
+
+	return r.opts.Now()
+}
+
+// failure turns a failed terminal request into an error, recognizing
+// timeouts.
+func failure(err error, description string) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errTimeout
+	}
+	if err != nil {
+		return err
+	}
+
+	if description == blockchyp.ResponseTimedOut || strings.Contains(strings.ToLower(description), "timed out") {
+		return errTimeout
+	}
+	if description == "" {
+		description = "request failed"
+	}
+
+	return errors.New(description)
+}
+
+// declined reports whether the customer turned down the terms, as opposed
+// to the request failing.
+func declined(res *blockchyp.TermsAndConditionsResponse) bool {
+	if res.Error != "" {
+		return false
+	}
+
+	description := strings.ToLower(res.ResponseDescription)
+	for _, word := range []string{"declin", "disagree", "not accepted", "rejected"} {
+		if strings.Contains(description, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// next picks the step after an answer.
+func next(step *Step, answer string) string {
+	for _, b := range step.Branches {
+		if b.match(step, answer) {
+			return b.Next
+		}
+	}
+
+	return step.Next
+}
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phonePattern = regexp.MustCompile(`^\+?[0-9 ().-]{7,}$`)
+)
+
+// validate returns why a text answer is invalid, or "" if it's fine.
+func validate(step *Step, answer string) string {
+	v := step.Validate
+	if v == nil {
+		v = &Validation{}
+	}
+
+	if answer == "" {
+		if v.Required {
+			return "answer required"
+		}
+		return ""
+	}
+
+	if n := utf8.RuneCountInString(answer); v.MinLength > 0 && n < v.MinLength {
+		return fmt.Sprintf("shorter than %d characters", v.MinLength)
+	} else if v.MaxLength > 0 && n > v.MaxLength {
+		return fmt.Sprintf("longer than %d characters", v.MaxLength)
+	}
+
+	switch {
+	case v.pattern != nil:
+		if !v.pattern.MatchString(answer) {
+			return "doesn't match the expected format"
+		}
+	case step.Prompt == blockchyp.PromptTypeEmail:
+		if !emailPattern.MatchString(answer) {
+			return "not an email address"
+		}
+	case step.Prompt == blockchyp.PromptTypePhone:
+		if !phonePattern.MatchString(answer) {
+			return "not a phone number"
+		}
+	}
+
+	return ""
+}
+
+func sigFormat(step *Step) blockchyp.SignatureFormat {
+	if step.SigFormat == "" {
+		return blockchyp.SignatureFormatPNG
+	}
+
+	return step.SigFormat
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,306 @@
+// Package flow runs scripted customer interactions on a payment terminal,
+// such as a check-in kiosk that greets the customer, asks for an email
+// address, shows terms and conditions and captures a signature. Scripts
+// are written in YAML or JSON; steps can branch on the customer's answers,
+// re-prompt for invalid input, and template earlier answers into later
+// prompts. Each run produces a transcript of everything shown and
+// answered, including signatures.
+package flow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// ErrInvalidScript is returned for scripts that can't be run.
+var ErrInvalidScript = errors.New("invalid flow script")
+
+// StepType is the terminal interaction a step performs.
+type StepType string
+
+// Step types.
+const (
+	Message   StepType = "message"
+	Boolean   StepType = "boolean"
+	Text      StepType = "text"
+	Terms     StepType = "terms"
+	Signature StepType = "signature"
+)
+
+// Script is an interaction flow.
+type Script struct {
+	Name string `yaml:"name"`
+
+	// Start is the first step. Defaults to the first step listed.
+	Start string `yaml:"start"`
+
+	// Timeout is the default number of seconds a step waits for the
+	// customer.
+	Timeout int `yaml:"timeout"`
+
+	// Vars are initial variables, available to templates alongside the
+	// answers steps save. Templates that refer to a variable that hasn't
+	// been set fail the run, so give optional answers a default here.
+	Vars map[string]string `yaml:"vars"`
+
+	Steps []Step `yaml:"steps"`
+
+	steps map[string]*Step
+}
+
+// Step is one interaction with the customer.
+type Step struct {
+	ID   string   `yaml:"id"`
+	Type StepType `yaml:"type"`
+
+	// Text is the message shown, or the question asked by a boolean
+	// prompt. It's a text/template, as are captions and terms content,
+	// with the script's variables as its data: "Welcome back, {{.name}}".
+	Text string `yaml:"text"`
+
+	// Yes and No caption the buttons of a boolean prompt.
+	Yes string `yaml:"yes"`
+	No  string `yaml:"no"`
+
+	// Prompt is the kind of text a text step collects, such as email,
+	// phone or rewards-number.
+	Prompt blockchyp.PromptType `yaml:"prompt"`
+
+	// Terms steps show either a template stored on the gateway, by alias,
+	// or the name and content given here.
+	Alias       string `yaml:"alias"`
+	Name        string `yaml:"name"`
+	Content     string `yaml:"content"`
+	SigRequired bool   `yaml:"sigRequired"`
+
+	// SigFormat and SigWidth control the image returned by signature and
+	// terms steps. The format defaults to png.
+	SigFormat blockchyp.SignatureFormat `yaml:"sigFormat"`
+	SigWidth  int                       `yaml:"sigWidth"`
+
+	// Timeout overrides the script's timeout for this step.
+	Timeout int `yaml:"timeout"`
+
+	// Save names a variable to store the answer in: the text entered,
+	// "true" or "false" for boolean prompts and terms, or the hex encoded
+	// signature.
+	Save string `yaml:"save"`
+
+	// Validate checks text answers. Invalid answers show InvalidText and
+	// ask again, up to Retries more times, after which the flow moves to
+	// OnInvalid, or ends if it isn't set.
+	Validate    *Validation `yaml:"validate"`
+	InvalidText string      `yaml:"invalidText"`
+	Retries     *int        `yaml:"retries"`
+	OnInvalid   string      `yaml:"onInvalid"`
+
+	// OnTimeout is the step to go to if the customer doesn't answer in
+	// time. Without it the flow ends.
+	OnTimeout string `yaml:"onTimeout"`
+
+	// Branches are checked in order against the answer; the first match
+	// decides the next step. Otherwise the flow goes to Next, or ends if
+	// Next is blank.
+	Branches []Branch `yaml:"branches"`
+	Next     string   `yaml:"next"`
+}
+
+// Branch sends the flow to another step when an answer matches.
+type Branch struct {
+	// Equals matches an answer exactly, ignoring case. Boolean answers are
+	// "true" and "false", and also match "yes" and "no".
+	Equals *string `yaml:"equals"`
+
+	// Matches is a regular expression the answer must match.
+	Matches string `yaml:"matches"`
+
+	Next string `yaml:"next"`
+
+	pattern *regexp.Regexp
+}
+
+// Validation checks a text answer.
+type Validation struct {
+	// Pattern is a regular expression the whole answer must match.
+	Pattern string `yaml:"pattern"`
+
+	MinLength int `yaml:"minLength"`
+	MaxLength int `yaml:"maxLength"`
+
+	// Required rejects blank answers. Email and phone prompts also get a
+	// basic format check unless Pattern is set.
+	Required bool `yaml:"required"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadScript reads a script file. See ParseScript.
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseScript(data)
+}
+
+// ParseScript reads a script in YAML or JSON and checks that it can run:
+// step ids are unique, step types and fields make sense, every step
+// referred to exists, and patterns and templates compile. Unknown fields
+// are rejected, so a misspelled option isn't silently ignored.
+func ParseScript(data []byte) (*Script, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	s := &Script{}
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScript, err)
+	}
+
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScript, err)
+	}
+
+	return s, nil
+}
+
+func (s *Script) compile() error {
+	if len(s.Steps) == 0 {
+		return errors.New("no steps")
+	}
+
+	s.steps = make(map[string]*Step, len(s.Steps))
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.ID == "" {
+			return fmt.Errorf("step %d: id required", i+1)
+		}
+		if _, ok := s.steps[step.ID]; ok {
+			return fmt.Errorf("step %s: duplicate id", step.ID)
+		}
+		s.steps[step.ID] = step
+	}
+
+	if s.Start == "" {
+		s.Start = s.Steps[0].ID
+	}
+	if _, ok := s.steps[s.Start]; !ok {
+		return fmt.Errorf("start: unknown step %q", s.Start)
+	}
+
+	for i := range s.Steps {
+		if err := s.compileStep(&s.Steps[i]); err != nil {
+			return fmt.Errorf("step %s: %w", s.Steps[i].ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Script) compileStep(step *Step) error {
+	switch step.Type {
+	case Message, Boolean:
+		if step.Text == "" {
+			return errors.New("text required")
+		}
+	case Text:
+		if step.Prompt == "" {
+			return errors.New("prompt required")
+		}
+	case Terms:
+		if step.Alias == "" && step.Content == "" {
+			return errors.New("alias or content required")
+		}
+	case Signature:
+	default:
+		return fmt.Errorf("unknown type %q", step.Type)
+	}
+
+	if step.Validate != nil && step.Type != Text {
+		return errors.New("only text steps can be validated")
+	}
+	if step.Retries != nil && *step.Retries < 0 {
+		return errors.New("retries can't be negative")
+	}
+
+	for _, text := range []string{step.Text, step.Yes, step.No, step.Name, step.Content, step.InvalidText} {
+		if _, err := parseTemplate(text); err != nil {
+			return err
+		}
+	}
+
+	if v := step.Validate; v != nil && v.Pattern != "" {
+		p, err := regexp.Compile(`^(?:` + v.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("validate: %w", err)
+		}
+		v.pattern = p
+	}
+
+	targets := []string{step.Next, step.OnTimeout, step.OnInvalid}
+	for i := range step.Branches {
+		b := &step.Branches[i]
+		if b.Equals == nil && b.Matches == "" {
+			return fmt.Errorf("branch %d: equals or matches required", i+1)
+		}
+		if b.Next == "" {
+			return fmt.Errorf("branch %d: next required", i+1)
+		}
+		if b.Matches != "" {
+			p, err := regexp.Compile(b.Matches)
+			if err != nil {
+				return fmt.Errorf("branch %d: %w", i+1, err)
+			}
+			b.pattern = p
+		}
+		targets = append(targets, b.Next)
+	}
+
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		if _, ok := s.steps[target]; !ok {
+			return fmt.Errorf("unknown step %q", target)
+		}
+	}
+
+	return nil
+}
+
+// match reports whether a branch applies to an answer.
+func (b Branch) match(step *Step, answer string) bool {
+	if b.Equals != nil {
+		want := strings.ToLower(strings.TrimSpace(*b.Equals))
+		got := strings.ToLower(answer)
+		if step.Type == Boolean || step.Type == Terms {
+			switch want {
+			case "yes":
+				want = "true"
+			case "no":
+				want = "false"
+			}
+		}
+		if want != got {
+			return false
+		}
+	}
+	if b.pattern != nil && !b.pattern.MatchString(answer) {
+		return false
+	}
+
+	return true
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(text)
+}
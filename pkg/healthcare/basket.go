@@ -0,0 +1,324 @@
+// Package healthcare classifies a basket of SKUs against an IIAS
+// (Inventory Information Approval System) eligibility list and fills in
+// the HealthcareMetadata, HealthcareTotal and IIAS flags FSA and HSA cards
+// require. It also works out how to split the rest of the basket across
+// other tenders when a healthcare card only covers part of it.
+package healthcare
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// groupOrder is the order healthcare groups are reported in, and the order
+// authorized amounts are allocated to them.
+var groupOrder = []blockchyp.HealthcareType{
+	blockchyp.HealthcareTypePrescription,
+	blockchyp.HealthcareTypeVision,
+	blockchyp.HealthcareTypeClinic,
+	blockchyp.HealthcareTypeDental,
+}
+
+// Item is a SKU level line item.
+type Item struct {
+	SKU         string
+	Description string
+
+	// Amount is the item's total, net of discounts and including any tax
+	// on it.
+	Amount money.Amount
+}
+
+// ItemsFromLineItems converts display line items, using each item's
+// ProductCode as its SKU.
+func ItemsFromLineItems(lines []*blockchyp.TransactionDisplayItem) ([]Item, error) {
+	items := make([]Item, 0, len(lines))
+	for _, line := range lines {
+		if line == nil {
+			continue
+		}
+
+		amount, err := lineAmount(line)
+		if err != nil {
+			return nil, fmt.Errorf("line item %s: %w", line.ProductCode, err)
+		}
+
+		items = append(items, Item{
+			SKU:         line.ProductCode,
+			Description: line.Description,
+			Amount:      amount,
+		})
+	}
+
+	return items, nil
+}
+
+// ClassifiedItem is an item with its eligibility.
+type ClassifiedItem struct {
+	Item
+	Eligibility
+}
+
+// Basket is a classified set of items.
+type Basket struct {
+	Items []ClassifiedItem
+
+	// Total is the whole basket. HealthcareTotal is the part an FSA or
+	// HSA card can pay for, and Ineligible the rest.
+	Total           money.Amount
+	HealthcareTotal money.Amount
+	Ineligible      money.Amount
+
+	// Groups holds the amount of each healthcare type except general
+	// healthcare merchandise, which only counts toward HealthcareTotal.
+	Groups map[blockchyp.HealthcareType]money.Amount
+
+	providers map[blockchyp.HealthcareType]Eligibility
+}
+
+// Classify looks up each item on the eligibility list.
+func Classify(list *List, items []Item) *Basket {
+	b := &Basket{
+		Groups:    make(map[blockchyp.HealthcareType]money.Amount),
+		providers: make(map[blockchyp.HealthcareType]Eligibility),
+	}
+
+	for _, item := range items {
+		e := list.Lookup(item.SKU)
+		b.Items = append(b.Items, ClassifiedItem{Item: item, Eligibility: e})
+		b.Total += item.Amount
+
+		if e.Type == Ineligible {
+			b.Ineligible += item.Amount
+			continue
+		}
+
+		b.HealthcareTotal += item.Amount
+		if e.Type == blockchyp.HealthcareTypeHealthcare {
+			continue
+		}
+
+		b.Groups[e.Type] += item.Amount
+		if p := b.providers[e.Type]; p.ProviderID == "" && p.ServiceTypeCode == "" {
+			b.providers[e.Type] = e
+		}
+	}
+
+	return b
+}
+
+// Metadata returns the HealthcareMetadata for the basket. Items were
+// checked against an eligibility list, so the basket is IIAS verified.
+func (b *Basket) Metadata() *blockchyp.HealthcareMetadata {
+	return b.metadata(b.Groups)
+}
+
+func (b *Basket) metadata(groups map[blockchyp.HealthcareType]money.Amount) *blockchyp.HealthcareMetadata {
+	m := &blockchyp.HealthcareMetadata{
+		Types:        make([]blockchyp.HealthcareGroup, 0, len(groups)),
+		IIASVerified: true,
+	}
+
+	for _, t := range groupOrder {
+		amount, ok := groups[t]
+		if !ok || amount.IsZero() {
+			continue
+		}
+
+		p := b.providers[t]
+		m.Types = append(m.Types, blockchyp.HealthcareGroup{
+			Type:            t,
+			Amount:          amount.String(),
+			ProviderID:      p.ProviderID,
+			ServiceTypeCode: p.ServiceTypeCode,
+		})
+	}
+
+	return m
+}
+
+// Eligible reports whether anything in the basket can go on a healthcare
+// card.
+func (b *Basket) Eligible() bool {
+	return b.HealthcareTotal > 0
+}
+
+// Apply marks an authorization request as a healthcare transaction for the
+// whole basket. If nothing in the basket is eligible the request is left
+// alone. Baskets are priced in cents, so requests in currencies without
+// two decimal places are refused.
+func (b *Basket) Apply(req *blockchyp.AuthorizationRequest) error {
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		return err
+	}
+	if !b.Eligible() {
+		return nil
+	}
+
+	req.Amount = b.Total.String()
+	req.Healthcare = true
+	req.HealthcareTotal = b.HealthcareTotal.String()
+	req.HealthcareMetadata = b.Metadata()
+
+	return nil
+}
+
+// Split is what's left to collect after a healthcare card has paid its
+// share of a basket.
+type Split struct {
+	// Authorized is what the healthcare card covered.
+	Authorized money.Amount
+
+	// Healthcare is eligible spending the card didn't cover. It can go on
+	// another FSA or HSA card, or any other tender.
+	Healthcare money.Amount
+
+	// Other is ineligible spending, which must be paid some other way.
+	Other money.Amount
+
+	basket *Basket
+	groups map[blockchyp.HealthcareType]money.Amount
+}
+
+// Remaining is the total still to collect.
+func (s *Split) Remaining() money.Amount {
+	return s.Healthcare + s.Other
+}
+
+// Complete reports whether the basket is paid in full.
+func (s *Split) Complete() bool {
+	return s.Remaining() <= 0
+}
+
+// Apply prepares a request for a second healthcare card to pay the
+// remaining eligible amount, with healthcare groups reduced by what the
+// first card covered. Returns false if no eligible spending remains, and
+// an error for requests in currencies without two decimal places.
+func (s *Split) Apply(req *blockchyp.AuthorizationRequest) (bool, error) {
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		return false, err
+	}
+	if s.Healthcare <= 0 {
+		return false, nil
+	}
+
+	req.Amount = s.Remaining().String()
+	req.Healthcare = true
+	req.HealthcareTotal = s.Healthcare.String()
+	req.HealthcareMetadata = s.basket.metadata(s.groups)
+
+	return true, nil
+}
+
+// Guidance describes the split for the operator.
+func (s *Split) Guidance() string {
+	switch {
+	case s.Complete():
+		return "Paid in full."
+	case s.Healthcare > 0 && s.Other > 0:
+		return fmt.Sprintf("Healthcare card covered %s. Collect %s more: %s can go on another FSA/HSA card, %s must be paid with another tender.",
+			s.Authorized, s.Remaining(), s.Healthcare, s.Other)
+	case s.Healthcare > 0:
+		return fmt.Sprintf("Healthcare card covered %s. Collect %s more on another FSA/HSA card or any other tender.",
+			s.Authorized, s.Healthcare)
+	}
+
+	return fmt.Sprintf("Healthcare card covered %s. Collect the remaining %s with a non-healthcare tender.",
+		s.Authorized, s.Other)
+}
+
+// Split works out what remains after a healthcare card authorization. The
+// authorized amount is applied to prescriptions first, then vision, clinic,
+// dental and general healthcare, and only then to ineligible items, which
+// issuers don't normally approve.
+func (b *Basket) Split(res blockchyp.AuthorizationResponse) (*Split, error) {
+	if err := currency.RequireCents(res.CurrencyCode); err != nil {
+		return nil, err
+	}
+
+	authorized := money.Amount(0)
+	if res.Approved {
+		var err error
+		authorized, err = money.Parse(res.AuthorizedAmount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Split{
+		Authorized: authorized,
+		basket:     b,
+		groups:     make(map[blockchyp.HealthcareType]money.Amount, len(b.Groups)),
+	}
+
+	left := authorized
+	for _, t := range groupOrder {
+		amount := b.Groups[t]
+		covered := min(amount, left)
+		left -= covered
+		if amount-covered > 0 {
+			s.groups[t] = amount - covered
+		}
+	}
+
+	general := b.HealthcareTotal - sumGroups(b.Groups)
+	left -= min(general, left)
+
+	s.Healthcare = max(b.HealthcareTotal-authorized, 0)
+	s.Other = b.Ineligible - min(left, b.Ineligible)
+
+	return s, nil
+}
+
+func sumGroups(groups map[blockchyp.HealthcareType]money.Amount) money.Amount {
+	var total money.Amount
+	for _, amount := range groups {
+		total += amount
+	}
+
+	return total
+}
+
+// lineAmount is a display item's extended price less discounts, plus tax.
+func lineAmount(line *blockchyp.TransactionDisplayItem) (money.Amount, error) {
+	var amount money.Amount
+	if line.Extended != "" {
+		var err error
+		if amount, err = money.Parse(line.Extended); err != nil {
+			return 0, err
+		}
+	} else {
+		price, err := money.Parse(line.Price)
+		if err != nil {
+			return 0, err
+		}
+		qty, ok := new(big.Rat).SetString(strconv.FormatFloat(line.Quantity, 'f', -1, 64))
+		if !ok {
+			return 0, fmt.Errorf("invalid quantity: %v", line.Quantity)
+		}
+		amount = price.MulRat(qty, money.RoundNearest)
+	}
+
+	for _, d := range line.Discounts {
+		if d == nil {
+			continue
+		}
+		discount, err := money.Parse(d.Amount)
+		if err != nil {
+			return 0, err
+		}
+		amount -= discount
+	}
+
+	tax, err := money.Parse(line.TaxAmount)
+	if err != nil {
+		return 0, err
+	}
+
+	return amount + tax, nil
+}
@@ -0,0 +1,144 @@
+package healthcare
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+const testList = `sku,type,providerId,serviceTypeCode
+# prescriptions
+RX1, prescription
+VIS1, Vision, PROV-9, SVC
+OTC1, healthcare
+CANDY, ineligible
+`
+
+func testBasket(t *testing.T) *Basket {
+	list, err := ReadList(strings.NewReader(testList))
+	require.NoError(t, err)
+	require.Equal(t, 4, list.Len())
+
+	return Classify(list, []Item{
+		{SKU: "RX1", Amount: money.MustParse("20.00")},
+		{SKU: "VIS1", Amount: money.MustParse("30.00")},
+		{SKU: "OTC1", Amount: money.MustParse("10.00")},
+		{SKU: "CANDY", Amount: money.MustParse("3.00")},
+		{SKU: "UNLISTED", Amount: money.MustParse("2.00")},
+	})
+}
+
+func TestReadListErrors(t *testing.T) {
+	_, err := ReadList(strings.NewReader("RX1\n"))
+	assert.ErrorIs(t, err, ErrInvalidList)
+
+	_, err = ReadList(strings.NewReader("RX1,cosmetic\n"))
+	assert.ErrorIs(t, err, ErrInvalidList)
+}
+
+func TestClassifyAndApply(t *testing.T) {
+	assert := assert.New(t)
+	b := testBasket(t)
+
+	assert.Equal(money.MustParse("65.00"), b.Total)
+	assert.Equal(money.MustParse("60.00"), b.HealthcareTotal)
+	assert.Equal(money.MustParse("5.00"), b.Ineligible)
+	assert.Equal(Ineligible, b.Items[4].Type)
+
+	req := blockchyp.AuthorizationRequest{}
+	require.NoError(t, b.Apply(&req))
+	assert.True(req.Healthcare)
+	assert.Equal("65.00", req.Amount)
+	assert.Equal("60.00", req.HealthcareTotal)
+	require.NotNil(t, req.HealthcareMetadata)
+	assert.True(req.HealthcareMetadata.IIASVerified)
+	assert.Equal([]blockchyp.HealthcareGroup{
+		{Type: blockchyp.HealthcareTypePrescription, Amount: "20.00"},
+		{Type: blockchyp.HealthcareTypeVision, Amount: "30.00", ProviderID: "PROV-9", ServiceTypeCode: "SVC"},
+	}, req.HealthcareMetadata.Types)
+
+	jpy := blockchyp.AuthorizationRequest{CurrencyCode: "JPY"}
+	assert.ErrorIs(b.Apply(&jpy), currency.ErrUnsupportedScale)
+}
+
+func TestApplyIneligibleBasket(t *testing.T) {
+	b := Classify(&List{}, []Item{{SKU: "CANDY", Amount: 100}})
+
+	req := blockchyp.AuthorizationRequest{Amount: "1.00"}
+	require.NoError(t, b.Apply(&req))
+	assert.False(t, req.Healthcare)
+	assert.Nil(t, req.HealthcareMetadata)
+}
+
+func TestSplitPartialApproval(t *testing.T) {
+	assert := assert.New(t)
+	b := testBasket(t)
+
+	s, err := b.Split(blockchyp.AuthorizationResponse{Approved: true, AuthorizedAmount: "25.00"})
+	require.NoError(t, err)
+	assert.Equal(money.MustParse("35.00"), s.Healthcare)
+	assert.Equal(money.MustParse("5.00"), s.Other)
+	assert.False(s.Complete())
+	assert.Contains(s.Guidance(), "35.00 can go on another FSA/HSA card")
+
+	// Prescriptions were covered first, so only vision remains.
+	req := blockchyp.AuthorizationRequest{}
+	ok, err := s.Apply(&req)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal("40.00", req.Amount)
+	assert.Equal("35.00", req.HealthcareTotal)
+	assert.Equal([]blockchyp.HealthcareGroup{
+		{Type: blockchyp.HealthcareTypeVision, Amount: "25.00", ProviderID: "PROV-9", ServiceTypeCode: "SVC"},
+	}, req.HealthcareMetadata.Types)
+}
+
+func TestSplitFullAndDeclined(t *testing.T) {
+	assert := assert.New(t)
+	b := testBasket(t)
+
+	s, err := b.Split(blockchyp.AuthorizationResponse{Approved: true, AuthorizedAmount: "60.00"})
+	require.NoError(t, err)
+	assert.Equal(money.Amount(0), s.Healthcare)
+	assert.Equal(money.MustParse("5.00"), s.Other)
+	assert.Contains(s.Guidance(), "non-healthcare tender")
+
+	ok, err := s.Apply(&blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.False(ok)
+
+	s, err = b.Split(blockchyp.AuthorizationResponse{Approved: true, AuthorizedAmount: "65.00"})
+	require.NoError(t, err)
+	assert.True(s.Complete())
+	assert.Equal("Paid in full.", s.Guidance())
+
+	s, err = b.Split(blockchyp.AuthorizationResponse{Approved: false, AuthorizedAmount: "65.00"})
+	require.NoError(t, err)
+	assert.Equal(money.Amount(0), s.Authorized)
+	assert.Equal(b.Total, s.Remaining())
+
+	_, err = b.Split(blockchyp.AuthorizationResponse{CurrencyCode: "KWD"})
+	assert.ErrorIs(err, currency.ErrUnsupportedScale)
+}
+
+func TestItemsFromLineItems(t *testing.T) {
+	items, err := ItemsFromLineItems([]*blockchyp.TransactionDisplayItem{
+		{ProductCode: "RX1", Price: "4.00", Quantity: 2.5, TaxAmount: "0.50", Discounts: []*blockchyp.TransactionDisplayDiscount{{Amount: "1.00"}}},
+		nil,
+		{ProductCode: "OTC1", Extended: "3.00"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Item{
+		{SKU: "RX1", Amount: money.MustParse("9.50")},
+		{SKU: "OTC1", Amount: money.MustParse("3.00")},
+	}, items)
+
+	_, err = ItemsFromLineItems([]*blockchyp.TransactionDisplayItem{{ProductCode: "X", Extended: "abc"}})
+	assert.Error(t, err)
+}
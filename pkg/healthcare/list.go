@@ -0,0 +1,137 @@
+package healthcare
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// Ineligible marks a SKU that can't be paid for with an FSA or HSA card.
+const Ineligible blockchyp.HealthcareType = "ineligible"
+
+// ErrInvalidList is returned when an eligibility list can't be parsed.
+var ErrInvalidList = errors.New("invalid eligibility list")
+
+// Eligibility is the IIAS eligibility of a SKU.
+type Eligibility struct {
+	SKU string
+
+	// Type is one of the blockchyp.HealthcareType constants, or
+	// Ineligible. HealthcareTypeHealthcare covers general eligible
+	// merchandise such as over the counter medicine.
+	Type blockchyp.HealthcareType
+
+	// ProviderID and ServiceTypeCode are passed on to Mastercard and
+	// Discover for clinic and other provider services.
+	ProviderID      string
+	ServiceTypeCode string
+}
+
+// List is an IIAS eligibility list, usually exported from an approved
+// product list service.
+type List struct {
+	entries map[string]Eligibility
+}
+
+// LoadList reads an eligibility list file. See ReadList for the format.
+func LoadList(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadList(f)
+}
+
+// ReadList reads an eligibility list in CSV form, one SKU per line:
+//
+//	sku,type[,providerId,serviceTypeCode]
+//
+// The type is healthcare, prescription, vision, clinic, dental or
+// ineligible. Lines starting with # are comments, and a header line
+// starting with "sku" is skipped.
+func ReadList(r io.Reader) (*List, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	l := &List{entries: make(map[string]Eligibility)}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidList, err)
+		}
+
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "sku") {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%w: line %d: expected sku and type", ErrInvalidList, line)
+		}
+
+		e := Eligibility{
+			SKU:  strings.TrimSpace(record[0]),
+			Type: blockchyp.HealthcareType(strings.ToLower(strings.TrimSpace(record[1]))),
+		}
+		if !validType(e.Type) {
+			return nil, fmt.Errorf("%w: line %d: unknown type %q", ErrInvalidList, line, record[1])
+		}
+		if len(record) > 2 {
+			e.ProviderID = strings.TrimSpace(record[2])
+		}
+		if len(record) > 3 {
+			e.ServiceTypeCode = strings.TrimSpace(record[3])
+		}
+
+		l.entries[e.SKU] = e
+	}
+
+	return l, nil
+}
+
+// Add adds or replaces a SKU's eligibility.
+func (l *List) Add(e Eligibility) {
+	if l.entries == nil {
+		l.entries = make(map[string]Eligibility)
+	}
+
+	l.entries[e.SKU] = e
+}
+
+// Lookup returns a SKU's eligibility. SKUs that aren't on the list are
+// ineligible.
+func (l *List) Lookup(sku string) Eligibility {
+	if e, ok := l.entries[sku]; ok {
+		return e
+	}
+
+	return Eligibility{SKU: sku, Type: Ineligible}
+}
+
+// Len returns the number of SKUs on the list.
+func (l *List) Len() int {
+	return len(l.entries)
+}
+
+func validType(t blockchyp.HealthcareType) bool {
+	switch t {
+	case blockchyp.HealthcareTypeHealthcare,
+		blockchyp.HealthcareTypePrescription,
+		blockchyp.HealthcareTypeVision,
+		blockchyp.HealthcareTypeClinic,
+		blockchyp.HealthcareTypeDental,
+		Ineligible:
+		return true
+	}
+
+	return false
+}
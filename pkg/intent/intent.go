@@ -0,0 +1,179 @@
+// Package intent tracks order level payments through authorization, capture,
+// void and refund as an explicit, persistent state machine.
+package intent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// State is the lifecycle state of a payment intent.
+type State string
+
+// Payment intent states.
+const (
+	StateCreated     State = "created"
+	StateAuthorizing State = "authorizing"
+	StateAuthorized  State = "authorized"
+	StateCaptured    State = "captured"
+	StateVoided      State = "voided"
+	StateRefunded    State = "refunded"
+	StateFailed      State = "failed"
+	StateUnknown     State = "unknown"
+)
+
+// transitions lists the states each state may move to.
+var transitions = map[State][]State{
+	StateCreated:     {StateAuthorizing},
+	StateAuthorizing: {StateAuthorized, StateCaptured, StateFailed, StateUnknown},
+	StateUnknown:     {StateAuthorized, StateCaptured, StateFailed, StateVoided, StateUnknown},
+	StateAuthorized:  {StateCaptured, StateVoided},
+	StateCaptured:    {StateVoided, StateRefunded},
+	StateFailed:      {StateAuthorizing},
+}
+
+// operations lists the moves callers may ask for. The moves out of the
+// authorizing and unknown states depend on what the gateway reports, so only
+// Authorize, Cancel and Resume make them.
+var operations = map[State][]State{
+	StateCreated:    {StateAuthorizing},
+	StateFailed:     {StateAuthorizing},
+	StateAuthorized: {StateCaptured, StateVoided},
+	StateCaptured:   {StateVoided, StateRefunded},
+}
+
+// CanTransition reports whether an intent may move from one state to another.
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Terminal reports whether no further transitions are possible.
+func (s State) Terminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// ErrInvalidTransition is returned when an operation is not permitted in the
+// intent's current state.
+var ErrInvalidTransition = errors.New("invalid payment intent transition")
+
+// ErrNotFound is returned by a Store when an intent does not exist.
+var ErrNotFound = errors.New("payment intent not found")
+
+// ErrTransactionNotFound is recorded when the gateway has no record of an
+// intent's transaction, so the authorization never happened.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrCardData is returned by FileStore for intents whose request carries
+// card data, such as a keyed PAN and CVV, which must not be written to disk.
+// Use a token instead.
+var ErrCardData = errors.New("payment intent request contains card data")
+
+// ErrInvalidID is returned by FileStore for ids that can't be used as file
+// names.
+var ErrInvalidID = errors.New("invalid payment intent id")
+
+// TransitionError describes a refused state change. It matches
+// ErrInvalidTransition with errors.Is.
+type TransitionError struct {
+	ID   string
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s: %s cannot move from %s to %s", ErrInvalidTransition, e.ID, e.From, e.To)
+}
+
+// Is reports whether target is ErrInvalidTransition.
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// Transition records a single state change.
+type Transition struct {
+	From          State     `json:"from"`
+	To            State     `json:"to"`
+	Timestamp     time.Time `json:"timestamp"`
+	TransactionID string    `json:"transactionId,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+// PaymentIntent is an order level payment and its full state history.
+type PaymentIntent struct {
+	ID       string `json:"id"`
+	OrderRef string `json:"orderRef,omitempty"`
+	State    State  `json:"state"`
+
+	// Request is the authorization template. Its TransactionRef is managed
+	// by the intent so retries are idempotent at the gateway. Stores that
+	// persist intents must not write card data, so keyed sales should be
+	// tokenized first.
+	Request blockchyp.AuthorizationRequest `json:"request"`
+
+	// Attempt counts authorization attempts. Each retry after a failure
+	// uses a fresh TransactionRef.
+	Attempt        int    `json:"attempt"`
+	TransactionRef string `json:"transactionRef"`
+	TransactionID  string `json:"transactionId,omitempty"`
+
+	AuthorizedAmount string `json:"authorizedAmount,omitempty"`
+	CapturedAmount   string `json:"capturedAmount,omitempty"`
+	RefundedAmount   string `json:"refundedAmount,omitempty"`
+
+	LastError string       `json:"lastError,omitempty"`
+	History   []Transition `json:"history"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// transition moves the intent to a new state, refusing invalid moves.
+func (p *PaymentIntent) transition(to State, now time.Time, txID, reason string) error {
+	if !CanTransition(p.State, to) {
+		return &TransitionError{ID: p.ID, From: p.State, To: to}
+	}
+
+	p.History = append(p.History, Transition{
+		From:          p.State,
+		To:            to,
+		Timestamp:     now,
+		TransactionID: txID,
+		Reason:        reason,
+	})
+	p.State = to
+	p.UpdatedAt = now
+
+	return nil
+}
+
+// require returns a TransitionError unless a caller may move the intent to
+// the given state.
+func (p *PaymentIntent) require(to State) error {
+	for _, s := range operations[p.State] {
+		if s == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{ID: p.ID, From: p.State, To: to}
+}
+
+// hasCardData reports whether a request carries card data.
+func hasCardData(req blockchyp.AuthorizationRequest) bool {
+	for _, field := range []string{req.PAN, req.Track1, req.Track2, req.CVV, req.ExpMonth, req.ExpYear, req.PINBlock, req.KSN} {
+		if field != "" {
+			return true
+		}
+	}
+
+	return false
+}
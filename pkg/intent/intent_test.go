@@ -0,0 +1,279 @@
+package intent
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+var errTimeout = &net.OpError{Op: "read", Err: errors.New("i/o timeout")}
+
+// fakeGateway approves everything unless told otherwise and records the
+// transaction refs it was sent.
+type fakeGateway struct {
+	authErr     error
+	voidDecline bool
+	status      *blockchyp.AuthorizationResponse
+	statusErr   error
+	refs        []string
+}
+
+func approved(txID string) *blockchyp.AuthorizationResponse {
+	return &blockchyp.AuthorizationResponse{Success: true, Approved: true, TransactionID: txID, AuthorizedAmount: "10.00"}
+}
+
+func (g *fakeGateway) Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+	if g.authErr != nil {
+		return &blockchyp.AuthorizationResponse{}, g.authErr
+	}
+
+	return approved("CHARGE"), nil
+}
+
+func (g *fakeGateway) Preauth(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+	if g.authErr != nil {
+		return &blockchyp.AuthorizationResponse{}, g.authErr
+	}
+
+	return approved("PREAUTH"), nil
+}
+
+func (g *fakeGateway) Capture(request blockchyp.CaptureRequest) (*blockchyp.CaptureResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+
+	return &blockchyp.CaptureResponse{Success: true, Approved: true, TransactionID: "CAPTURE", AuthorizedAmount: "8.00"}, nil
+}
+
+func (g *fakeGateway) Void(request blockchyp.VoidRequest) (*blockchyp.VoidResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+	if g.voidDecline {
+		return &blockchyp.VoidResponse{Success: true, ResponseDescription: "batch closed"}, nil
+	}
+
+	return &blockchyp.VoidResponse{Success: true, Approved: true, TransactionID: "VOID"}, nil
+}
+
+func (g *fakeGateway) Reverse(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+
+	return approved("REVERSE"), nil
+}
+
+func (g *fakeGateway) Refund(request blockchyp.RefundRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+
+	return approved("REFUND"), nil
+}
+
+func (g *fakeGateway) TransactionStatus(request blockchyp.TransactionStatusRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.refs = append(g.refs, request.TransactionRef)
+	if g.statusErr != nil {
+		return nil, g.statusErr
+	}
+
+	return g.status, nil
+}
+
+func states(intent *PaymentIntent) []State {
+	result := make([]State, 0, len(intent.History))
+	for _, t := range intent.History {
+		result = append(result, t.To)
+	}
+
+	return result
+}
+
+func newTestManager(t *testing.T, gateway *fakeGateway) *Manager {
+	m := NewManager(gateway, NewMemoryStore())
+	_, err := m.Create("order-1", blockchyp.AuthorizationRequest{Amount: "10.00", OrderRef: "order-1"})
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestPreauthCaptureRefund(t *testing.T) {
+	assert := assert.New(t)
+	gateway := &fakeGateway{}
+	m := newTestManager(t, gateway)
+
+	intent, err := m.Authorize("order-1", false)
+	require.NoError(t, err)
+	assert.Equal(StateAuthorized, intent.State)
+	assert.Equal("PREAUTH", intent.TransactionID)
+
+	intent, err = m.Capture("order-1", "8.00")
+	require.NoError(t, err)
+	assert.Equal("8.00", intent.CapturedAmount)
+
+	intent, err = m.Refund("order-1", "")
+	require.NoError(t, err)
+	assert.Equal(StateRefunded, intent.State)
+	assert.True(intent.State.Terminal())
+
+	assert.Equal([]State{StateAuthorizing, StateAuthorized, StateCaptured, StateRefunded}, states(intent))
+	assert.Equal([]string{"order-1", "order-1-capture", "order-1-refund"}, gateway.refs)
+
+	stored, err := m.Get("order-1")
+	require.NoError(t, err)
+	assert.Equal(intent, stored)
+}
+
+func TestCreateIsIdempotent(t *testing.T) {
+	m := newTestManager(t, &fakeGateway{})
+	_, err := m.Authorize("order-1", true)
+	require.NoError(t, err)
+
+	intent, err := m.Create("order-1", blockchyp.AuthorizationRequest{Amount: "99.00"})
+	require.NoError(t, err)
+	assert.Equal(t, StateCaptured, intent.State)
+	assert.Equal(t, "10.00", intent.Request.Amount)
+}
+
+func TestInvalidTransitions(t *testing.T) {
+	assert := assert.New(t)
+	m := newTestManager(t, &fakeGateway{})
+
+	_, err := m.Capture("order-1", "")
+	assert.ErrorIs(err, ErrInvalidTransition)
+
+	var terr *TransitionError
+	require.ErrorAs(t, err, &terr)
+	assert.Equal(StateCreated, terr.From)
+	assert.Equal(StateCaptured, terr.To)
+
+	_, err = m.Authorize("order-1", true)
+	require.NoError(t, err)
+	_, err = m.Authorize("order-1", true)
+	assert.ErrorIs(err, ErrInvalidTransition)
+}
+
+func TestTimeoutResumedAsCharge(t *testing.T) {
+	assert := assert.New(t)
+	gateway := &fakeGateway{authErr: errTimeout}
+	m := newTestManager(t, gateway)
+
+	intent, err := m.Authorize("order-1", true)
+	assert.Error(err)
+	assert.Equal(StateUnknown, intent.State)
+
+	// An unknown outcome can't be retried, which could charge twice.
+	_, err = m.Authorize("order-1", true)
+	assert.ErrorIs(err, ErrInvalidTransition)
+
+	status := approved("CHARGE")
+	status.TransactionType = "charge"
+	gateway.status = status
+
+	resumed, err := m.ResumeAll()
+	require.NoError(t, err)
+	require.Len(t, resumed, 1)
+	assert.Equal(StateCaptured, resumed[0].State)
+	assert.Equal("CHARGE", resumed[0].TransactionID)
+}
+
+func TestResumeNotFoundAllowsRetry(t *testing.T) {
+	assert := assert.New(t)
+	gateway := &fakeGateway{authErr: errTimeout}
+	m := newTestManager(t, gateway)
+
+	_, err := m.Authorize("order-1", true)
+	require.Error(t, err)
+
+	gateway.statusErr = errors.New("Transaction Not Found")
+	intent, err := m.Resume("order-1")
+	require.NoError(t, err)
+	assert.Equal(StateFailed, intent.State)
+
+	gateway.authErr = nil
+	intent, err = m.Authorize("order-1", true)
+	require.NoError(t, err)
+	assert.Equal(StateCaptured, intent.State)
+	assert.Equal(2, intent.Attempt)
+	assert.Equal("order-1-2", intent.TransactionRef)
+}
+
+func TestResumeGatewayErrorStaysUnknown(t *testing.T) {
+	gateway := &fakeGateway{authErr: errTimeout}
+	m := newTestManager(t, gateway)
+
+	_, err := m.Authorize("order-1", false)
+	require.Error(t, err)
+
+	gateway.statusErr = errTimeout
+	intent, err := m.Resume("order-1")
+	assert.Error(t, err)
+	assert.Equal(t, StateUnknown, intent.State)
+	assert.NotEmpty(t, intent.LastError)
+}
+
+func TestCancelRefundsWhenVoidDeclined(t *testing.T) {
+	assert := assert.New(t)
+	gateway := &fakeGateway{voidDecline: true}
+	m := newTestManager(t, gateway)
+
+	_, err := m.Authorize("order-1", true)
+	require.NoError(t, err)
+
+	intent, err := m.Cancel("order-1")
+	require.NoError(t, err)
+	assert.Equal(StateRefunded, intent.State)
+	assert.Equal([]string{"order-1", "order-1-void", "order-1-refund"}, gateway.refs)
+}
+
+func TestCancelReversesUnknown(t *testing.T) {
+	m := newTestManager(t, &fakeGateway{authErr: errTimeout})
+
+	_, err := m.Authorize("order-1", true)
+	require.Error(t, err)
+
+	intent, err := m.Cancel("order-1")
+	require.NoError(t, err)
+	assert.Equal(t, StateVoided, intent.State)
+}
+
+func TestFileStore(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	intent := &PaymentIntent{ID: "order-1", State: StateCreated, Request: blockchyp.AuthorizationRequest{Token: "TOKEN"}}
+	require.NoError(t, store.Save(intent))
+
+	loaded, err := store.Load("order-1")
+	require.NoError(t, err)
+	assert.Equal("TOKEN", loaded.Request.Token)
+
+	_, err = store.Load("order-2")
+	assert.ErrorIs(err, ErrNotFound)
+
+	assert.ErrorIs(store.Save(&PaymentIntent{ID: "../order"}), ErrInvalidID)
+	assert.ErrorIs(store.Save(&PaymentIntent{ID: "order-2", Request: blockchyp.AuthorizationRequest{PAN: "4111111111111111"}}), ErrCardData)
+
+	intents, err := store.List()
+	require.NoError(t, err)
+	assert.Len(intents, 1)
+}
+
+func TestResumeOtherNotFoundStaysUnknown(t *testing.T) {
+	gateway := &fakeGateway{authErr: errTimeout}
+	m := newTestManager(t, gateway)
+
+	_, err := m.Authorize("order-1", true)
+	require.Error(t, err)
+
+	// A 404 from something other than the gateway says nothing about the
+	// transaction.
+	gateway.statusErr = errors.New("404 Not Found")
+	intent, err := m.Resume("order-1")
+	require.Error(t, err)
+	assert.Equal(t, StateUnknown, intent.State)
+}
@@ -0,0 +1,453 @@
+package intent
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/internal/netutil"
+)
+
+// Gateway is the subset of *blockchyp.Client used by payment intents.
+type Gateway interface {
+	Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+	Preauth(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+	Capture(request blockchyp.CaptureRequest) (*blockchyp.CaptureResponse, error)
+	Void(request blockchyp.VoidRequest) (*blockchyp.VoidResponse, error)
+	Reverse(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+	Refund(request blockchyp.RefundRequest) (*blockchyp.AuthorizationResponse, error)
+	TransactionStatus(request blockchyp.TransactionStatusRequest) (*blockchyp.AuthorizationResponse, error)
+}
+
+// Manager drives payment intents through the gateway and persists every
+// state change before and after each gateway call.
+type Manager struct {
+	Gateway Gateway
+	Store   Store
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewManager returns a Manager backed by the given gateway and store.
+func NewManager(gateway Gateway, store Store) *Manager {
+	return &Manager{
+		Gateway: gateway,
+		Store:   store,
+		Now:     time.Now,
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Create registers a new intent. Creating an intent that already exists
+// returns the stored intent unchanged, so callers can safely retry.
+func (m *Manager) Create(id string, request blockchyp.AuthorizationRequest) (*PaymentIntent, error) {
+	if id == "" {
+		return nil, errors.New("payment intent id required")
+	}
+
+	unlock := m.acquire(id)
+	defer unlock()
+
+	existing, err := m.Store.Load(id)
+	if err == nil {
+		return existing, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	now := m.Now()
+	intent := &PaymentIntent{
+		ID:        id,
+		OrderRef:  request.OrderRef,
+		State:     StateCreated,
+		Request:   request,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := m.Store.Save(intent); err != nil {
+		return nil, err
+	}
+
+	return intent, nil
+}
+
+// Get returns the current state of an intent.
+func (m *Manager) Get(id string) (*PaymentIntent, error) {
+	return m.Store.Load(id)
+}
+
+// Authorize runs the intent's authorization. With capture set the payment is
+// charged immediately; otherwise it is preauthorized for a later Capture.
+//
+// The authorizing state is saved before the gateway is called, so a crash
+// mid-request leaves a record Resume can reconcile.
+func (m *Manager) Authorize(id string, capture bool) (*PaymentIntent, error) {
+	unlock := m.acquire(id)
+	defer unlock()
+
+	intent, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := intent.require(StateAuthorizing); err != nil {
+		return intent, err
+	}
+
+	intent.Attempt++
+	intent.TransactionRef = transactionRef(intent.ID, intent.Attempt)
+	intent.LastError = ""
+	if err := intent.transition(StateAuthorizing, m.Now(), "", ""); err != nil {
+		return intent, err
+	}
+	if err := m.Store.Save(intent); err != nil {
+		return intent, err
+	}
+
+	request := intent.Request
+	request.TransactionRef = intent.TransactionRef
+	request.AutogeneratedRef = false
+
+	var res *blockchyp.AuthorizationResponse
+	if capture {
+		res, err = m.Gateway.Charge(request)
+	} else {
+		res, err = m.Gateway.Preauth(request)
+	}
+
+	m.applyAuthorization(intent, res, err, capture)
+
+	if saveErr := m.Store.Save(intent); saveErr != nil {
+		return intent, saveErr
+	}
+
+	return intent, err
+}
+
+// Capture captures an authorized intent. An empty amount captures the full
+// authorized amount.
+func (m *Manager) Capture(id, amount string) (*PaymentIntent, error) {
+	unlock := m.acquire(id)
+	defer unlock()
+
+	intent, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := intent.require(StateCaptured); err != nil {
+		return intent, err
+	}
+
+	res, err := m.Gateway.Capture(blockchyp.CaptureRequest{
+		Test:           intent.Request.Test,
+		TransactionRef: intent.TransactionRef + "-capture",
+		TransactionID:  intent.TransactionID,
+		Amount:         amount,
+	})
+	if err != nil {
+		return intent, m.recordError(intent, err)
+	}
+	if !res.Success || !res.Approved {
+		return intent, m.recordError(intent, responseError(res.ResponseDescription))
+	}
+
+	intent.CapturedAmount = res.AuthorizedAmount
+	if intent.CapturedAmount == "" {
+		intent.CapturedAmount = amount
+	}
+
+	return intent, m.save(intent, StateCaptured, res.TransactionID, "")
+}
+
+// Cancel unwinds an intent: authorizations are voided, captured payments are
+// voided if still in an open batch and refunded otherwise, and unknown
+// authorizations are reversed.
+func (m *Manager) Cancel(id string) (*PaymentIntent, error) {
+	unlock := m.acquire(id)
+	defer unlock()
+
+	intent, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch intent.State {
+	case StateAuthorized, StateCaptured:
+		res, err := m.Gateway.Void(blockchyp.VoidRequest{
+			Test:           intent.Request.Test,
+			TransactionRef: intent.TransactionRef + "-void",
+			TransactionID:  intent.TransactionID,
+		})
+		if err == nil && res.Success && res.Approved {
+			return intent, m.save(intent, StateVoided, res.TransactionID, "")
+		}
+		if err != nil {
+			// The void may have gone through, so refunding now could
+			// unwind the payment twice.
+			return intent, m.recordError(intent, err)
+		}
+		if intent.State == StateAuthorized {
+			return intent, m.recordError(intent, responseError(res.ResponseDescription))
+		}
+
+		// The void was declined, so the payment has most likely settled.
+		// Refund it instead.
+		return intent, m.refund(intent, "")
+	case StateUnknown, StateAuthorizing:
+		request := intent.Request
+		request.TransactionRef = intent.TransactionRef
+		res, err := m.Gateway.Reverse(request)
+		if err != nil {
+			return intent, m.recordError(intent, err)
+		}
+		if !res.Success || !res.Approved {
+			return intent, m.recordError(intent, responseError(res.ResponseDescription))
+		}
+		if intent.State == StateAuthorizing {
+			if err := intent.transition(StateUnknown, m.Now(), "", "reversed before response"); err != nil {
+				return intent, err
+			}
+		}
+		return intent, m.save(intent, StateVoided, res.TransactionID, "reversed")
+	default:
+		return intent, &TransitionError{ID: intent.ID, From: intent.State, To: StateVoided}
+	}
+}
+
+// Refund refunds a captured intent. An empty amount refunds the full
+// captured amount.
+func (m *Manager) Refund(id, amount string) (*PaymentIntent, error) {
+	unlock := m.acquire(id)
+	defer unlock()
+
+	intent, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return intent, m.refund(intent, amount)
+}
+
+// Resume reconciles an intent left in the authorizing or unknown state,
+// typically after a crash or timeout, using the gateway's transaction
+// status. Intents in any other state are returned unchanged.
+func (m *Manager) Resume(id string) (*PaymentIntent, error) {
+	unlock := m.acquire(id)
+	defer unlock()
+
+	intent, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if intent.State != StateAuthorizing && intent.State != StateUnknown {
+		return intent, nil
+	}
+
+	res, err := m.Gateway.TransactionStatus(blockchyp.TransactionStatusRequest{
+		Test:           intent.Request.Test,
+		TransactionRef: intent.TransactionRef,
+	})
+	if err == nil && !res.Success {
+		err = responseError(res.ResponseDescription)
+	}
+	if err != nil {
+		err = statusError(err)
+		if !errors.Is(err, ErrTransactionNotFound) {
+			// The authorization may still have gone through, so the intent
+			// stays unresolved rather than failing and allowing a second
+			// charge.
+			return intent, m.unresolved(intent, err)
+		}
+		intent.LastError = err.Error()
+		return intent, m.save(intent, StateFailed, "", err.Error())
+	}
+	if !res.Approved {
+		intent.LastError = res.ResponseDescription
+		return intent, m.save(intent, StateFailed, res.TransactionID, res.ResponseDescription)
+	}
+
+	intent.TransactionID = res.TransactionID
+	intent.AuthorizedAmount = res.AuthorizedAmount
+
+	switch res.TransactionType {
+	case "charge":
+		intent.CapturedAmount = res.AuthorizedAmount
+		return intent, m.save(intent, StateCaptured, res.TransactionID, "resumed")
+	case "void", "reverse":
+		if intent.State == StateAuthorizing {
+			if err := intent.transition(StateUnknown, m.Now(), "", "reversed before response"); err != nil {
+				return intent, err
+			}
+		}
+		return intent, m.save(intent, StateVoided, res.TransactionID, "resumed")
+	default:
+		return intent, m.save(intent, StateAuthorized, res.TransactionID, "resumed")
+	}
+}
+
+// ResumeAll resumes every intent left in the authorizing or unknown state and
+// returns the intents it touched. It stops at the first store error; gateway
+// errors are recorded on the intent and do not stop the scan.
+func (m *Manager) ResumeAll() ([]*PaymentIntent, error) {
+	intents, err := m.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := make([]*PaymentIntent, 0)
+	for _, intent := range intents {
+		if intent.State != StateAuthorizing && intent.State != StateUnknown {
+			continue
+		}
+
+		updated, err := m.Resume(intent.ID)
+		if updated == nil {
+			return resumed, err
+		}
+		resumed = append(resumed, updated)
+	}
+
+	return resumed, nil
+}
+
+func (m *Manager) refund(intent *PaymentIntent, amount string) error {
+	if err := intent.require(StateRefunded); err != nil {
+		return err
+	}
+
+	res, err := m.Gateway.Refund(blockchyp.RefundRequest{
+		Test:           intent.Request.Test,
+		TransactionRef: intent.TransactionRef + "-refund",
+		TransactionID:  intent.TransactionID,
+		Amount:         amount,
+	})
+	if err != nil {
+		return m.recordError(intent, err)
+	}
+	if !res.Success || !res.Approved {
+		return m.recordError(intent, responseError(res.ResponseDescription))
+	}
+
+	intent.RefundedAmount = res.AuthorizedAmount
+
+	return m.save(intent, StateRefunded, res.TransactionID, "")
+}
+
+// applyAuthorization moves an authorizing intent to the state implied by
+// the gateway response.
+func (m *Manager) applyAuthorization(intent *PaymentIntent, res *blockchyp.AuthorizationResponse, err error, capture bool) {
+	now := m.Now()
+
+	switch {
+	case netutil.IsNetworkError(err):
+		intent.LastError = err.Error()
+		intent.transition(StateUnknown, now, "", err.Error())
+	case err != nil:
+		intent.LastError = err.Error()
+		intent.transition(StateFailed, now, "", err.Error())
+	case !res.Approved:
+		intent.LastError = res.ResponseDescription
+		intent.transition(StateFailed, now, res.TransactionID, res.ResponseDescription)
+	case capture:
+		intent.TransactionID = res.TransactionID
+		intent.AuthorizedAmount = res.AuthorizedAmount
+		intent.CapturedAmount = res.AuthorizedAmount
+		intent.transition(StateCaptured, now, res.TransactionID, "")
+	default:
+		intent.TransactionID = res.TransactionID
+		intent.AuthorizedAmount = res.AuthorizedAmount
+		intent.transition(StateAuthorized, now, res.TransactionID, "")
+	}
+}
+
+func (m *Manager) save(intent *PaymentIntent, to State, txID, reason string) error {
+	if to != StateFailed {
+		intent.LastError = ""
+	}
+
+	if err := intent.transition(to, m.Now(), txID, reason); err != nil {
+		return err
+	}
+
+	return m.Store.Save(intent)
+}
+
+// unresolved records an error that leaves the outcome of an authorization
+// unknown, moving an authorizing intent to the unknown state.
+func (m *Manager) unresolved(intent *PaymentIntent, err error) error {
+	if intent.State == StateAuthorizing {
+		if terr := intent.transition(StateUnknown, m.Now(), "", err.Error()); terr != nil {
+			return terr
+		}
+	}
+
+	return m.recordError(intent, err)
+}
+
+// recordError saves a failed follow-up operation without changing state.
+func (m *Manager) recordError(intent *PaymentIntent, err error) error {
+	intent.LastError = err.Error()
+	intent.UpdatedAt = m.Now()
+
+	if saveErr := m.Store.Save(intent); saveErr != nil {
+		return saveErr
+	}
+
+	return err
+}
+
+// acquire serializes operations on a single intent.
+func (m *Manager) acquire(id string) func() {
+	m.lock.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[id] = l
+	}
+	m.lock.Unlock()
+
+	l.Lock()
+
+	return l.Unlock
+}
+
+func transactionRef(id string, attempt int) string {
+	if attempt <= 1 {
+		return id
+	}
+
+	return id + "-" + strconv.Itoa(attempt)
+}
+
+func responseError(description string) error {
+	if description == "" {
+		description = "not approved"
+	}
+
+	return errors.New(description)
+}
+
+// statusError returns ErrTransactionNotFound when a transaction status
+// lookup failed because the gateway has no record of the transaction. Only
+// the gateway's exact answer counts; anything else, such as a proxy's 404,
+// leaves the outcome unknown.
+func statusError(err error) error {
+	if strings.EqualFold(err.Error(), ErrTransactionNotFound.Error()) {
+		return ErrTransactionNotFound
+	}
+
+	return err
+}
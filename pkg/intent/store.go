@@ -0,0 +1,187 @@
+package intent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blockchyp/blockchyp-go/v2/internal/atomicfile"
+)
+
+// Store persists payment intents. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Load returns the intent with the given id or ErrNotFound.
+	Load(id string) (*PaymentIntent, error)
+
+	// Save creates or replaces an intent.
+	Save(intent *PaymentIntent) error
+
+	// List returns every stored intent.
+	List() ([]*PaymentIntent, error)
+}
+
+// MemoryStore is a Store that keeps intents in memory. It is mostly useful
+// for testing.
+type MemoryStore struct {
+	lock    sync.Mutex
+	intents map[string]PaymentIntent
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		intents: make(map[string]PaymentIntent),
+	}
+}
+
+// Load implements Store.
+func (s *MemoryStore) Load(id string) (*PaymentIntent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	intent, ok := s.intents[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return clone(&intent), nil
+}
+
+// Save implements Store.
+func (s *MemoryStore) Save(intent *PaymentIntent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.intents[intent.ID] = *clone(intent)
+
+	return nil
+}
+
+// List implements Store.
+func (s *MemoryStore) List() ([]*PaymentIntent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	intents := make([]*PaymentIntent, 0, len(s.intents))
+	for _, intent := range s.intents {
+		intent := intent
+		intents = append(intents, clone(&intent))
+	}
+
+	return intents, nil
+}
+
+// FileStore is a Store that keeps each intent in its own JSON file.
+type FileStore struct {
+	Dir string
+
+	lock sync.Mutex
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{Dir: dir}, nil
+}
+
+// path returns an intent's file. Ids are used as file names, so ones with
+// path separators or a leading dot, which List would skip, are refused.
+func (s *FileStore) path(id string) (string, error) {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	return filepath.Join(s.Dir, id+".json"), nil
+}
+
+// Load implements Store.
+func (s *FileStore) Load(id string) (*PaymentIntent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.read(path)
+}
+
+// Save implements Store. Intents whose request carries card data are
+// refused with ErrCardData.
+func (s *FileStore) Save(intent *PaymentIntent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path, err := s.path(intent.ID)
+	if err != nil {
+		return err
+	}
+	if hasCardData(intent.Request) {
+		return ErrCardData
+	}
+
+	content, err := json.MarshalIndent(intent, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, content, 0600)
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]*PaymentIntent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	intents := make([]*PaymentIntent, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		intent, err := s.read(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		intents = append(intents, intent)
+	}
+
+	return intents, nil
+}
+
+func (s *FileStore) read(path string) (*PaymentIntent, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	intent := &PaymentIntent{}
+	if err := json.Unmarshal(content, intent); err != nil {
+		return nil, err
+	}
+
+	return intent, nil
+}
+
+func clone(intent *PaymentIntent) *PaymentIntent {
+	cp := *intent
+	cp.History = append([]Transition(nil), intent.History...)
+
+	return &cp
+}
@@ -0,0 +1,36 @@
+//go:build integration
+// +build integration
+
+package itests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/blockchyp/blockchyp-go/v2/pkg/pricing"
+)
+
+func TestPricingCalculatorMatchesGateway(t *testing.T) {
+	assert := assert.New(t)
+
+	config := loadTestConfiguration(t)
+	client := config.newTestClient(t, "")
+
+	calc := pricing.New(&client, pricing.Options{Test: true})
+
+	policy, err := calc.Policy()
+	assert.NoError(err)
+	logObj(t, "Policy:", policy)
+
+	if !policy.Enabled {
+		t.Skip("cash discounting is not enabled for the test merchant")
+	}
+
+	mismatches, err := calc.Check(&client, []string{"0.01", "0.99", "1.00", "19.99", "33.33", "100.00", "1234.57"})
+	assert.NoError(err)
+
+	for _, m := range mismatches {
+		t.Error(m)
+	}
+}
@@ -0,0 +1,448 @@
+// Package level3 builds and checks the Level 2 and Level 3 commercial card
+// data carried on an AuthorizationRequest. Commercial and purchasing cards
+// qualify for lower interchange rates when a transaction includes complete,
+// consistent order data; this package reports exactly which fields kept a
+// transaction from qualifying.
+package level3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// ErrUnknownCountry is returned when a destination country isn't an ISO
+// 3166-1 code.
+var ErrUnknownCountry = errors.New("unknown country code")
+
+// Level is a commercial card data level.
+type Level int
+
+// Data levels.
+const (
+	Level1 Level = 1
+	Level2 Level = 2
+	Level3 Level = 3
+)
+
+// String returns a label such as "Level 3".
+func (l Level) String() string {
+	return "Level " + strconv.Itoa(int(l))
+}
+
+// Field limits enforced by the card networks.
+const (
+	maxPurchaseOrderNumber = 17
+	maxProductCode         = 12
+	maxCommodityCode       = 12
+	maxPostalCode          = 10
+	maxLineItems           = 998
+)
+
+// Visa rejects Level 2 tax amounts outside this range of the transaction
+// amount, expressed in basis points.
+const (
+	minTaxBasisPoints = 10
+	maxTaxBasisPoints = 2200
+)
+
+// Order is the commercial card data for a purchase.
+type Order struct {
+	PurchaseOrderNumber     string
+	SupplierReferenceNumber string
+	OrderDate               time.Time
+
+	// Cart holds the line items, discounts and tax.
+	Cart *cart.Cart
+
+	Shipping money.Amount
+	Duty     money.Amount
+
+	ShipFromPostalCode string
+	ShipToPostalCode   string
+
+	// DestinationCountry is the ship-to country as any ISO 3166-1 code.
+	// Defaults to the United States.
+	DestinationCountry string
+
+	TaxExempt bool
+}
+
+// Build fills in the amount, tax, line items and commercial card fields of
+// an authorization request from an order. Orders are priced in cents, so
+// requests in currencies without two decimal places are refused.
+func Build(order Order, req *blockchyp.AuthorizationRequest) error {
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		return err
+	}
+
+	country := Country{Numeric: "840"}
+	if order.DestinationCountry != "" {
+		var ok bool
+		country, ok = LookupCountry(order.DestinationCountry)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownCountry, order.DestinationCountry)
+		}
+	}
+
+	if order.Cart != nil {
+		if err := order.Cart.Apply(req); err != nil {
+			return err
+		}
+
+		totals := order.Cart.Totals()
+		req.Amount = (totals.Total + order.Shipping + order.Duty).String()
+		if !totals.Discount.IsZero() {
+			req.TotalDiscountAmount = totals.Discount.String()
+		}
+	}
+
+	req.PurchaseOrderNumber = order.PurchaseOrderNumber
+	req.SupplierReferenceNumber = order.SupplierReferenceNumber
+	req.ShippingAmount = order.Shipping.String()
+	req.DutyAmount = order.Duty.String()
+	req.ShipFromPostalCode = normalizePostalCode(order.ShipFromPostalCode)
+	req.ShipToPostalCode = normalizePostalCode(order.ShipToPostalCode)
+	req.DestinationCountryCode = country.Numeric
+	req.TaxExempt = order.TaxExempt
+
+	if !order.OrderDate.IsZero() {
+		date := order.OrderDate
+		req.OrderDate = &date
+	}
+
+	return nil
+}
+
+// Issue is a problem with a request's commercial card data.
+type Issue struct {
+	// Field names the request field, such as "TaxAmount" or
+	// "LineItems[2].UnitCode".
+	Field   string
+	Message string
+
+	// Costs is the level the problem keeps the transaction from
+	// qualifying for. Zero means it's advisory only.
+	Costs Level
+}
+
+// Report is the result of validating a request.
+type Report struct {
+	// Level is the best level the request qualifies for as it stands.
+	Level  Level
+	Issues []Issue
+}
+
+// Downgrades returns the issues that cost the transaction a better rate,
+// those holding it back from the next level first.
+func (r *Report) Downgrades() []Issue {
+	issues := make([]Issue, 0)
+	for level := r.Level + 1; level <= Level3; level++ {
+		for _, issue := range r.Issues {
+			if issue.Costs == level {
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	return issues
+}
+
+// WriteText writes a plain text summary of the report.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Qualifies for %s\n", r.Level)
+	if len(r.Issues) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "FIELD\tCOSTS\tPROBLEM")
+	}
+	for _, issue := range r.Issues {
+		costs := "-"
+		if issue.Costs > 0 {
+			costs = issue.Costs.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", issue.Field, costs, issue.Message)
+	}
+
+	return tw.Flush()
+}
+
+// Validate checks a request's Level 2 and Level 3 data: required fields,
+// field lengths, code tables, and that the line items add up to the
+// amount. Amounts are only checked for currencies with two decimal
+// places; anything else is reported as an issue on its own.
+func Validate(req blockchyp.AuthorizationRequest) *Report {
+	v := &validator{}
+
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		v.add("CurrencyCode", Level2, "%v", err)
+		return &Report{Level: Level1, Issues: v.issues}
+	}
+
+	amount := v.amount("Amount", req.Amount, Level2)
+	tip := v.amount("TipAmount", req.TipAmount, Level2)
+	tax := v.amount("TaxAmount", req.TaxAmount, Level2)
+
+	v.level2(req, amount-tip, tax)
+	v.level3(req, amount-tip, tax)
+
+	r := &Report{Level: Level3, Issues: v.issues}
+	for _, issue := range v.issues {
+		if issue.Costs > 0 && issue.Costs-1 < r.Level {
+			r.Level = issue.Costs - 1
+		}
+	}
+
+	return r
+}
+
+type validator struct {
+	issues []Issue
+}
+
+func (v *validator) add(field string, costs Level, format string, args ...interface{}) {
+	v.issues = append(v.issues, Issue{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+		Costs:   costs,
+	})
+}
+
+// amount parses an amount field, recording an issue if it's malformed.
+func (v *validator) amount(field, value string, costs Level) money.Amount {
+	a, err := money.Parse(value)
+	if err != nil {
+		v.add(field, costs, "%q is not a valid amount", value)
+		return 0
+	}
+	if a < 0 {
+		v.add(field, costs, "amount is negative")
+	}
+
+	return a
+}
+
+func (v *validator) level2(req blockchyp.AuthorizationRequest, amount, tax money.Amount) {
+	switch po := req.PurchaseOrderNumber; {
+	case po == "":
+		v.add("PurchaseOrderNumber", Level2, "missing")
+	case len(po) > maxPurchaseOrderNumber:
+		v.add("PurchaseOrderNumber", Level2, "longer than %d characters", maxPurchaseOrderNumber)
+	}
+
+	switch {
+	case req.TaxExempt && !tax.IsZero():
+		v.add("TaxAmount", Level2, "tax exempt transactions can't carry tax")
+	case req.TaxExempt:
+	case req.TaxAmount == "" || tax.IsZero():
+		v.add("TaxAmount", Level2, "missing; set TaxExempt if no tax applies")
+	case amount > 0:
+		bp := tax.Cents() * 10000 / amount.Cents()
+		if bp < minTaxBasisPoints || bp > maxTaxBasisPoints {
+			v.add("TaxAmount", Level2, "%s is outside 0.1%% to 22%% of the amount", tax)
+		}
+	}
+}
+
+func (v *validator) level3(req blockchyp.AuthorizationRequest, amount, tax money.Amount) {
+	v.postalCodes(req)
+
+	if len(req.SupplierReferenceNumber) > maxPurchaseOrderNumber {
+		v.add("SupplierReferenceNumber", Level3, "longer than %d characters", maxPurchaseOrderNumber)
+	}
+
+	shipping := v.amount("ShippingAmount", req.ShippingAmount, Level3)
+	duty := v.amount("DutyAmount", req.DutyAmount, Level3)
+
+	switch {
+	case len(req.LineItems) == 0:
+		v.add("LineItems", Level3, "missing")
+		return
+	case len(req.LineItems) > maxLineItems:
+		v.add("LineItems", Level3, "more than %d line items", maxLineItems)
+	}
+
+	var extended, discounts, lineTax money.Amount
+	var taxedLines int
+	for i, item := range req.LineItems {
+		if item == nil {
+			v.add(fmt.Sprintf("LineItems[%d]", i), Level3, "empty line item")
+			continue
+		}
+
+		e, d, t, taxed := v.lineItem(i, item)
+		extended += e
+		discounts += d
+		lineTax += t
+		if taxed {
+			taxedLines++
+		}
+	}
+
+	if req.TotalDiscountAmount != "" {
+		total := v.amount("TotalDiscountAmount", req.TotalDiscountAmount, Level3)
+		if !discounts.IsZero() && total != discounts {
+			v.add("TotalDiscountAmount", Level3, "%s doesn't match line item discounts of %s", total, discounts)
+		}
+		discounts = total
+	}
+
+	if taxedLines > 0 && lineTax != tax {
+		v.add("TaxAmount", Level3, "%s doesn't match line item tax of %s", tax, lineTax)
+	}
+
+	if expected := extended - discounts + tax + shipping + duty; expected != amount {
+		v.add("Amount", Level3, "%s doesn't match line items, tax, shipping and duty totalling %s", amount, expected)
+	}
+}
+
+// lineItem checks a single line item and returns its extended amount,
+// discounts and tax.
+func (v *validator) lineItem(i int, item *blockchyp.TransactionDisplayItem) (extended, discounts, tax money.Amount, taxed bool) {
+	field := func(name string) string {
+		return fmt.Sprintf("LineItems[%d].%s", i, name)
+	}
+
+	if strings.TrimSpace(item.Description) == "" {
+		v.add(field("Description"), Level3, "missing")
+	}
+
+	switch {
+	case item.ProductCode == "":
+		v.add(field("ProductCode"), Level3, "missing")
+	case len(item.ProductCode) > maxProductCode:
+		v.add(field("ProductCode"), Level3, "longer than %d characters", maxProductCode)
+	}
+
+	switch {
+	case item.CommodityCode == "":
+		v.add(field("CommodityCode"), Level3, "missing")
+	case len(item.CommodityCode) > maxCommodityCode:
+		v.add(field("CommodityCode"), Level3, "longer than %d characters", maxCommodityCode)
+	default:
+		if _, ok := ClassifyCommodityCode(item.CommodityCode); !ok {
+			v.add(field("CommodityCode"), Level3, "%q is not a UNSPSC or NIGP code", item.CommodityCode)
+		}
+	}
+
+	switch {
+	case item.UnitCode == "":
+		v.add(field("UnitCode"), Level3, "missing")
+	case ValidUnitCode(item.UnitCode):
+	case wellFormedUnitCode(item.UnitCode):
+		v.add(field("UnitCode"), 0, "%q is not a common UN/ECE unit code; check it's correct", item.UnitCode)
+	default:
+		v.add(field("UnitCode"), Level3, "%q is not a UN/ECE unit code", item.UnitCode)
+	}
+
+	price := v.amount(field("Price"), item.Price, Level3)
+	if item.Price == "" {
+		v.add(field("Price"), Level3, "missing")
+	}
+
+	qty, ok := new(big.Rat).SetString(strconv.FormatFloat(item.Quantity, 'f', -1, 64))
+	if !ok || qty.Sign() <= 0 {
+		v.add(field("Quantity"), Level3, "must be greater than zero")
+		qty = new(big.Rat)
+	}
+
+	// Fractional quantities may be rounded either way, but no further.
+	low := price.MulRat(qty, money.RoundDown)
+	high := price.MulRat(qty, money.RoundUp)
+	extended = price.MulRat(qty, money.RoundNearest)
+	if item.Extended == "" {
+		v.add(field("Extended"), Level3, "missing")
+	} else {
+		computed := extended
+		extended = v.amount(field("Extended"), item.Extended, Level3)
+		if ok && extended != low && extended != high {
+			v.add(field("Extended"), Level3, "%s doesn't match price times quantity of %s", extended, computed)
+		}
+	}
+
+	for j, d := range item.Discounts {
+		if d != nil {
+			discounts += v.amount(fmt.Sprintf("LineItems[%d].Discounts[%d].Amount", i, j), d.Amount, Level3)
+		}
+	}
+
+	switch item.DiscountCode {
+	case "":
+	case "0":
+		if !discounts.IsZero() {
+			v.add(field("DiscountCode"), Level3, "code 0 means no discount, but the item is discounted")
+		}
+	case "1", "2":
+		if discounts.IsZero() {
+			v.add(field("DiscountCode"), Level3, "code %s describes a discount, but the item isn't discounted", item.DiscountCode)
+		}
+	default:
+		v.add(field("DiscountCode"), Level3, "%q must be 0, 1 or 2", item.DiscountCode)
+	}
+
+	if item.TaxRate != "" {
+		if r, ok := new(big.Rat).SetString(item.TaxRate); !ok || r.Sign() < 0 {
+			v.add(field("TaxRate"), Level3, "%q is not a percentage", item.TaxRate)
+		}
+	}
+	if item.TaxAmount != "" {
+		tax = v.amount(field("TaxAmount"), item.TaxAmount, Level3)
+		taxed = true
+	}
+
+	return extended, discounts, tax, taxed
+}
+
+func (v *validator) postalCodes(req blockchyp.AuthorizationRequest) {
+	domestic := true
+
+	switch code := req.DestinationCountryCode; {
+	case code == "":
+		v.add("DestinationCountryCode", 0, "missing; the gateway assumes 840 (United States)")
+	default:
+		c, ok := LookupCountry(code)
+		switch {
+		case !ok:
+			v.add("DestinationCountryCode", Level3, "%q is not an ISO 3166-1 country code", code)
+		case c.Numeric != code:
+			v.add("DestinationCountryCode", Level3, "must be the numeric code %s, not %q", c.Numeric, code)
+		}
+		domestic = c.Numeric == "840"
+	}
+
+	for _, f := range []struct {
+		name  string
+		value string
+		zip   bool
+	}{
+		{"ShipFromPostalCode", req.ShipFromPostalCode, false},
+		{"ShipToPostalCode", req.ShipToPostalCode, domestic},
+	} {
+		code := normalizePostalCode(f.value)
+		switch {
+		case code == "":
+			v.add(f.name, Level3, "missing")
+		case len(code) > maxPostalCode:
+			v.add(f.name, Level3, "longer than %d characters", maxPostalCode)
+		case f.zip && (!allDigits(code) || len(code) != 5 && len(code) != 9):
+			v.add(f.name, Level3, "US ZIP codes must have 5 or 9 digits")
+		}
+	}
+}
+
+// normalizePostalCode strips the separators from a postal code, so ZIP+4
+// codes fit the gateway's nine character field.
+func normalizePostalCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
@@ -0,0 +1,167 @@
+package level3
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+func testOrder(t *testing.T) Order {
+	c, err := cart.New("8.25")
+	require.NoError(t, err)
+
+	require.NoError(t, c.Add(cart.Item{
+		ID:            "1",
+		Description:   "Copy paper",
+		Price:         money.MustParse("42.99"),
+		Quantity:      3,
+		UnitCode:      "BX",
+		CommodityCode: "14111507",
+		ProductCode:   "PAPER-500",
+		Discounts:     []cart.Discount{{Description: "Contract", Amount: money.MustParse("5.00")}},
+	}))
+	require.NoError(t, c.Add(cart.Item{
+		ID:            "2",
+		Description:   "Toner",
+		Price:         money.MustParse("89.00"),
+		Quantity:      1,
+		UnitCode:      "EA",
+		CommodityCode: "615-32",
+		ProductCode:   "TN-660",
+	}))
+
+	return Order{
+		PurchaseOrderNumber: "PO-1001",
+		OrderDate:           time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+		Cart:                c,
+		Shipping:            money.MustParse("12.50"),
+		ShipFromPostalCode:  "94303",
+		ShipToPostalCode:    "12345-6789",
+	}
+}
+
+func fields(issues []Issue) []string {
+	result := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		result = append(result, issue.Field)
+	}
+
+	return result
+}
+
+func TestBuildQualifiesForLevel3(t *testing.T) {
+	assert := assert.New(t)
+
+	req := blockchyp.AuthorizationRequest{}
+	require.NoError(t, Build(testOrder(t), &req))
+
+	assert.Equal("840", req.DestinationCountryCode)
+	assert.Equal("123456789", req.ShipToPostalCode)
+	assert.Equal("5.00", req.TotalDiscountAmount)
+	assert.Equal("12.50", req.ShippingAmount)
+	require.NotNil(t, req.OrderDate)
+
+	report := Validate(req)
+	assert.Equal(Level3, report.Level, "%v", report.Issues)
+	assert.Empty(report.Downgrades())
+}
+
+func TestValidateDowngrades(t *testing.T) {
+	assert := assert.New(t)
+
+	req := blockchyp.AuthorizationRequest{}
+	require.NoError(t, Build(testOrder(t), &req))
+	req.LineItems[1].UnitCode = "EACH"
+	req.ShipToPostalCode = "K1A0B1"
+
+	report := Validate(req)
+	assert.Equal(Level2, report.Level)
+	assert.Equal([]string{"ShipToPostalCode", "LineItems[1].UnitCode"}, fields(report.Downgrades()))
+
+	req.PurchaseOrderNumber = ""
+	report = Validate(req)
+	assert.Equal(Level1, report.Level)
+	assert.Equal("PurchaseOrderNumber", report.Downgrades()[0].Field)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf))
+	assert.Contains(buf.String(), "Qualifies for Level 1")
+}
+
+func TestValidateAmounts(t *testing.T) {
+	assert := assert.New(t)
+
+	req := blockchyp.AuthorizationRequest{}
+	require.NoError(t, Build(testOrder(t), &req))
+	req.Amount = "300.00"
+	req.LineItems[0].Extended = "130.00"
+
+	report := Validate(req)
+	assert.Equal(Level2, report.Level)
+	assert.Contains(fields(report.Issues), "Amount")
+	assert.Contains(fields(report.Issues), "LineItems[0].Extended")
+
+	req = blockchyp.AuthorizationRequest{PurchaseOrderNumber: "PO", Amount: "100.00", TaxAmount: "30.00"}
+	report = Validate(req)
+	assert.Equal(Level1, report.Level)
+	assert.Equal("TaxAmount", report.Downgrades()[0].Field)
+
+	req.TaxAmount = ""
+	req.TaxExempt = true
+	assert.NotContains(fields(Validate(req).Issues), "TaxAmount")
+}
+
+func TestValidateCurrency(t *testing.T) {
+	report := Validate(blockchyp.AuthorizationRequest{CurrencyCode: "JPY", Amount: "1000"})
+	assert.Equal(t, Level1, report.Level)
+	assert.Equal(t, []string{"CurrencyCode"}, fields(report.Issues))
+
+	req := blockchyp.AuthorizationRequest{CurrencyCode: "JPY"}
+	assert.Error(t, Build(testOrder(t), &req))
+}
+
+func TestBuildCountry(t *testing.T) {
+	order := testOrder(t)
+	order.DestinationCountry = "ca"
+
+	req := blockchyp.AuthorizationRequest{}
+	require.NoError(t, Build(order, &req))
+	assert.Equal(t, "124", req.DestinationCountryCode)
+
+	order.DestinationCountry = "XX"
+	assert.ErrorIs(t, Build(order, &req), ErrUnknownCountry)
+}
+
+func TestCodes(t *testing.T) {
+	assert := assert.New(t)
+
+	for code, want := range map[string]CommodityCodeKind{
+		"14111507":       UNSPSC,
+		"615":            NIGP,
+		"615-32":         NIGP,
+		"615-32-10":      NIGP,
+		"615-32-10-0001": NIGP,
+	} {
+		kind, ok := ClassifyCommodityCode(code)
+		assert.True(ok, code)
+		assert.Equal(want, kind, code)
+	}
+	for _, code := range []string{"", "1234", "ABC", "99111507"} {
+		_, ok := ClassifyCommodityCode(code)
+		assert.False(ok, code)
+	}
+
+	assert.True(ValidUnitCode("ea"))
+	assert.False(ValidUnitCode("EACH"))
+
+	c, ok := LookupCountry("DEU")
+	require.True(t, ok)
+	assert.Equal("276", c.Numeric)
+}
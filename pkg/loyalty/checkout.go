@@ -0,0 +1,223 @@
+package loyalty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// Gateway is the subset of *blockchyp.Client used for loyalty checkouts.
+type Gateway interface {
+	cart.Display
+	TextPrompt(request blockchyp.TextPromptRequest) (*blockchyp.TextPromptResponse, error)
+	Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+}
+
+// Options configure a Checkout.
+type Options struct {
+	TerminalName string
+	Test         bool
+
+	// Timeout is how many seconds the customer has to enter a rewards
+	// number. Zero uses the gateway's default.
+	Timeout int
+}
+
+// Checkout runs a charge with a rewards lookup in front of it.
+type Checkout struct {
+	provider Provider
+	gateway  Gateway
+	opts     Options
+}
+
+// Result is the outcome of a checkout.
+type Result struct {
+	// RewardsNumber is what the customer entered, if anything.
+	RewardsNumber string
+
+	// Reward is the reward applied, or nil if there wasn't one.
+	Reward *Reward
+
+	Response *blockchyp.AuthorizationResponse
+
+	// LoyaltyErr is why the rewards lookup or redemption failed. A loyalty
+	// service that's down or a number it doesn't know shouldn't stop the
+	// sale, so these don't fail the checkout.
+	LoyaltyErr error
+}
+
+// NewCheckout returns a checkout that looks rewards up with the given
+// provider.
+func NewCheckout(provider Provider, gateway Gateway, opts Options) *Checkout {
+	return &Checkout{
+		provider: provider,
+		gateway:  gateway,
+		opts:     opts,
+	}
+}
+
+// Prompt asks the customer for their rewards number. A blank answer or a
+// customer who doesn't answer in time returns "".
+func (c *Checkout) Prompt() (string, error) {
+	res, err := c.gateway.TextPrompt(blockchyp.TextPromptRequest{
+		TerminalName: c.opts.TerminalName,
+		Test:         c.opts.Test,
+		Timeout:      c.opts.Timeout,
+		PromptType:   blockchyp.PromptTypeRewardsNumber,
+	})
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !res.Success {
+		if timedOut(res.ResponseDescription) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("rewards prompt failed: %s", res.ResponseDescription)
+	}
+
+	return strings.TrimSpace(res.Response), nil
+}
+
+// Discount looks up the reward for a rewards number, applies it to the
+// cart and updates the terminal's display to match. If the display can't
+// be updated the reward is taken back off, so the cart is left as it was.
+func (c *Checkout) Discount(ctx context.Context, ct *cart.Cart, rewardsNumber string) (*Reward, error) {
+	reward, err := c.lookup(ctx, ct, rewardsNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.redraw(ct); err != nil {
+		Remove(ct, reward)
+		return nil, err
+	}
+
+	return reward, nil
+}
+
+// Charge charges the cart, discounts and all, and redeems the reward if the
+// charge is approved. The request's Amount, TaxAmount and LineItems come
+// from the cart, and Test and, if blank, TerminalName from the options.
+// The response is returned even if redemption fails.
+func (c *Checkout) Charge(ctx context.Context, ct *cart.Cart, reward *Reward, req blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	if err := ct.Apply(&req); err != nil {
+		return nil, err
+	}
+	req.Test = c.opts.Test
+	if req.TerminalName == "" {
+		req.TerminalName = c.opts.TerminalName
+	}
+
+	res, err := c.gateway.Charge(req)
+	if err != nil || !res.Approved || reward == nil {
+		return res, err
+	}
+
+	amount, err := money.Parse(res.AuthorizedAmount)
+	if err != nil {
+		return res, fmt.Errorf("invalid authorized amount %q: %w", res.AuthorizedAmount, err)
+	}
+
+	err = c.provider.Redeem(ctx, Redemption{
+		Reward:        reward,
+		TransactionID: res.TransactionID,
+		Amount:        amount,
+	})
+	if err != nil {
+		return res, fmt.Errorf("redeeming reward: %w", err)
+	}
+
+	return res, nil
+}
+
+// Run shows the cart, asks for a rewards number, applies the member's
+// reward and charges the discounted total. Loyalty failures are reported
+// in the result's LoyaltyErr and the sale goes ahead at full price. If the
+// charge fails or is declined the reward is taken back off the cart and the
+// display, so Run can be tried again.
+func (c *Checkout) Run(ctx context.Context, ct *cart.Cart, req blockchyp.AuthorizationRequest) (*Result, error) {
+	if err := c.publish(ct); err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+
+	number, err := c.Prompt()
+	if err != nil {
+		result.LoyaltyErr = err
+	}
+	result.RewardsNumber = number
+
+	if number != "" {
+		reward, err := c.lookup(ctx, ct, number)
+		if err != nil {
+			result.LoyaltyErr = err
+		} else if err := c.redraw(ct); err != nil {
+			Remove(ct, reward)
+			return result, err
+		} else {
+			result.Reward = reward
+		}
+	}
+
+	res, err := c.Charge(ctx, ct, result.Reward, req)
+	result.Response = res
+	if res != nil && res.Approved {
+		result.LoyaltyErr = errors.Join(result.LoyaltyErr, err)
+		return result, nil
+	}
+
+	if result.Reward != nil {
+		Remove(ct, result.Reward)
+		result.Reward = nil
+		err = errors.Join(err, c.redraw(ct))
+	}
+
+	return result, err
+}
+
+func (c *Checkout) lookup(ctx context.Context, ct *cart.Cart, rewardsNumber string) (*Reward, error) {
+	reward, err := c.provider.Lookup(ctx, rewardsNumber, OrderFromCart(ct))
+	if err != nil {
+		return nil, err
+	}
+	if reward.RewardsNumber == "" {
+		reward.RewardsNumber = rewardsNumber
+	}
+	if err := Apply(ct, reward); err != nil {
+		return nil, err
+	}
+
+	return reward, nil
+}
+
+func (c *Checkout) publish(ct *cart.Cart) error {
+	return ct.Publish(c.gateway, blockchyp.TransactionDisplayRequest{
+		TerminalName: c.opts.TerminalName,
+		Test:         c.opts.Test,
+	})
+}
+
+// redraw shows the whole cart again. Rewards discount items that are
+// already on screen, and the display can only change those by starting
+// over.
+func (c *Checkout) redraw(ct *cart.Cart) error {
+	ct.Reset()
+
+	return c.publish(ct)
+}
+
+func timedOut(description string) bool {
+	return description == blockchyp.ResponseTimedOut || strings.Contains(strings.ToLower(description), "timed out")
+}
@@ -0,0 +1,163 @@
+package loyalty
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// PointValue is what FakeProvider takes off for every 100 points.
+const PointValue = money.Amount(100)
+
+// Member is a FakeProvider member.
+type Member struct {
+	RewardsNumber string
+	Name          string
+
+	// Percent is a percentage taken off the order, such as "10".
+	Percent string
+
+	// Points are spent in blocks of 100, each worth PointValue, up to what
+	// the order comes to after the percentage off.
+	Points int
+
+	// Items are fixed discounts on particular items, by item ID.
+	Items map[string]money.Amount
+}
+
+// FakeProvider is an in-memory Provider for lanes and tests that don't
+// talk to a real loyalty service. Redeeming a reward spends its points.
+type FakeProvider struct {
+	// Err, when set, is returned by the next lookup instead of a reward.
+	Err error
+
+	lock        sync.Mutex
+	members     map[string]*Member
+	redemptions []Redemption
+	seq         int
+}
+
+// NewFakeProvider returns a provider with the given members.
+func NewFakeProvider(members ...Member) *FakeProvider {
+	p := &FakeProvider{members: make(map[string]*Member)}
+	for _, m := range members {
+		p.Add(m)
+	}
+
+	return p
+}
+
+// Add adds or replaces a member.
+func (p *FakeProvider) Add(m Member) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.members == nil {
+		p.members = make(map[string]*Member)
+	}
+
+	p.members[m.RewardsNumber] = &m
+}
+
+// Member returns a copy of a member.
+func (p *FakeProvider) Member(rewardsNumber string) (Member, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	m, ok := p.members[rewardsNumber]
+	if !ok {
+		return Member{}, false
+	}
+
+	return *m, true
+}
+
+// Redemptions returns every redemption recorded so far, in order.
+func (p *FakeProvider) Redemptions() []Redemption {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]Redemption(nil), p.redemptions...)
+}
+
+// Lookup implements Provider.
+func (p *FakeProvider) Lookup(ctx context.Context, rewardsNumber string, order Order) (*Reward, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.Err; err != nil {
+		p.Err = nil
+		return nil, err
+	}
+
+	m, ok := p.members[rewardsNumber]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMember, rewardsNumber)
+	}
+
+	p.seq++
+	r := &Reward{
+		ID:            "RWD" + strconv.Itoa(p.seq),
+		RewardsNumber: rewardsNumber,
+		Member:        m.Name,
+	}
+
+	left := order.Totals.Subtotal
+	for _, line := range order.Lines {
+		amount, ok := m.Items[line.ID]
+		if !ok {
+			continue
+		}
+		amount = min(amount, line.Net)
+		r.Discounts = append(r.Discounts, Discount{
+			ItemID:      line.ID,
+			Description: "Member price",
+			Amount:      amount,
+		})
+		left -= amount
+	}
+
+	if m.Percent != "" {
+		off, err := left.Percent(m.Percent, money.RoundDown)
+		if err != nil {
+			return nil, err
+		}
+		r.Discounts = append(r.Discounts, Discount{
+			Description: m.Percent + "% member discount",
+			Amount:      off,
+		})
+		left -= off
+	}
+
+	if blocks := min(m.Points/100, int(left/PointValue)); blocks > 0 {
+		r.Points = blocks * 100
+		r.Discounts = append(r.Discounts, Discount{
+			Description: strconv.Itoa(r.Points) + " points",
+			Amount:      PointValue * money.Amount(blocks),
+		})
+	}
+
+	return r, nil
+}
+
+// Redeem implements Provider.
+func (p *FakeProvider) Redeem(ctx context.Context, redemption Redemption) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	m, ok := p.members[redemption.Reward.RewardsNumber]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownMember, redemption.Reward.RewardsNumber)
+	}
+	if redemption.Reward.Points > m.Points {
+		return fmt.Errorf("%s has %d points, %d needed", m.RewardsNumber, m.Points, redemption.Reward.Points)
+	}
+
+	m.Points -= redemption.Reward.Points
+	p.redemptions = append(p.redemptions, redemption)
+
+	return nil
+}
@@ -0,0 +1,237 @@
+// Package loyalty adds a rewards program to checkout. The customer is asked
+// for their rewards number on the terminal, a Provider looks up the
+// discount they're entitled to, and the discount is applied to the cart so
+// the line item display and the charge that follows both reflect it. Once
+// the charge is approved the provider is told the reward was used.
+// Providers are pluggable; FakeProvider stands in for a real loyalty
+// service so every lane can be run the same way without one.
+package loyalty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// DefaultDescription describes discounts that don't have a description of
+// their own.
+const DefaultDescription = "Rewards"
+
+var (
+	// ErrUnknownMember is returned by providers for rewards numbers they
+	// don't recognize.
+	ErrUnknownMember = errors.New("unknown rewards number")
+
+	// ErrInvalidDiscount is returned for rewards with negative discounts.
+	ErrInvalidDiscount = errors.New("invalid rewards discount")
+)
+
+// Provider is a loyalty service.
+type Provider interface {
+	// Lookup returns the reward a member gets on an order. Members with
+	// nothing to redeem get a Reward with no discounts. Rewards numbers the
+	// service doesn't know return ErrUnknownMember.
+	Lookup(ctx context.Context, rewardsNumber string, order Order) (*Reward, error)
+
+	// Redeem records that a reward was used on an approved charge.
+	Redeem(ctx context.Context, redemption Redemption) error
+}
+
+// Order is the cart a reward is looked up for.
+type Order struct {
+	Lines  []cart.Line
+	Totals cart.Totals
+}
+
+// OrderFromCart returns a cart's lines and totals.
+func OrderFromCart(c *cart.Cart) Order {
+	return Order{
+		Lines:  c.Lines(),
+		Totals: c.Totals(),
+	}
+}
+
+// Reward is what a member gets on an order.
+type Reward struct {
+	// ID is the provider's reference for the reward, passed back to it on
+	// redemption.
+	ID string
+
+	RewardsNumber string
+
+	// Member is the member's name, for display.
+	Member string
+
+	// Points are the loyalty points the reward spends, if any.
+	Points int
+
+	Discounts []Discount
+
+	// Applied is the total discount Apply put on the cart. It can be less
+	// than the discounts offered, since no item is discounted below zero.
+	Applied money.Amount
+
+	// applied are the cart discounts added, by item ID, so they can be
+	// taken off again.
+	applied map[string][]cart.Discount
+}
+
+// Discount is a discount offered by a reward.
+type Discount struct {
+	// ItemID limits the discount to one item. Discounts without one apply
+	// to the whole order and are spread across its items in proportion to
+	// their net prices.
+	ItemID string
+
+	Description string
+	Amount      money.Amount
+}
+
+// Redemption is a reward used on an approved charge.
+type Redemption struct {
+	Reward        *Reward
+	TransactionID string
+
+	// Amount is what the charge approved.
+	Amount money.Amount
+}
+
+// Apply adds a reward's discounts to the cart as item discounts, so tax is
+// worked out on the discounted prices and the terminal shows each one
+// against the item it reduced. Item discounts are applied first, then
+// order discounts are spread over what's left. Nothing is applied if any
+// discount is invalid or refers to an item that isn't in the cart.
+func Apply(c *cart.Cart, r *Reward) error {
+	lines := c.Lines()
+
+	net := make(map[string]money.Amount, len(lines))
+	for _, line := range lines {
+		net[line.ID] = line.Net
+	}
+
+	for _, d := range r.Discounts {
+		if d.Amount < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidDiscount, d.Amount)
+		}
+		if _, ok := net[d.ItemID]; d.ItemID != "" && !ok {
+			return fmt.Errorf("%w: %s", cart.ErrUnknownItem, d.ItemID)
+		}
+	}
+
+	applied := make(map[string][]cart.Discount)
+	add := func(id, description string, amount money.Amount) {
+		if amount <= 0 {
+			return
+		}
+		if description == "" {
+			description = DefaultDescription
+		}
+
+		d := cart.Discount{Description: description, Amount: amount}
+
+		// The item was checked above.
+		_ = c.AddDiscount(id, d)
+		applied[id] = append(applied[id], d)
+		net[id] -= amount
+		r.Applied += amount
+	}
+
+	for _, d := range r.Discounts {
+		if d.ItemID != "" {
+			add(d.ItemID, d.Description, min(d.Amount, net[d.ItemID]))
+		}
+	}
+
+	for _, d := range r.Discounts {
+		if d.ItemID != "" {
+			continue
+		}
+		for _, share := range spread(lines, net, d.Amount) {
+			add(share.id, d.Description, share.amount)
+		}
+	}
+
+	r.applied = applied
+
+	return nil
+}
+
+// Remove takes a reward's discounts back off the cart, such as when the
+// charge is declined.
+func Remove(c *cart.Cart, r *Reward) {
+	for id, discounts := range r.applied {
+		item, ok := c.Item(id)
+		if !ok {
+			continue
+		}
+
+		for _, d := range discounts {
+			for i, have := range item.Discounts {
+				if have == d {
+					item.Discounts = append(item.Discounts[:i], item.Discounts[i+1:]...)
+					break
+				}
+			}
+		}
+
+		// The item came from the cart, so it's valid.
+		_ = c.Set(item)
+	}
+
+	r.applied = nil
+	r.Applied = 0
+}
+
+type share struct {
+	id     string
+	amount money.Amount
+}
+
+// spread divides an order discount between items in proportion to their
+// net prices. Cents left over from rounding down go to the items with the
+// largest remainders, so the shares add up exactly.
+func spread(lines []cart.Line, net map[string]money.Amount, amount money.Amount) []share {
+	var total money.Amount
+	for _, line := range lines {
+		if n := net[line.ID]; n > 0 {
+			total += n
+		}
+	}
+
+	amount = min(amount, total)
+	if amount <= 0 {
+		return nil
+	}
+
+	shares := make([]share, 0, len(lines))
+	remainders := make([]int64, 0, len(lines))
+	var given money.Amount
+	for _, line := range lines {
+		n := net[line.ID]
+		if n <= 0 {
+			continue
+		}
+
+		portion := amount.Cents() * n.Cents()
+		shares = append(shares, share{id: line.ID, amount: money.Amount(portion / total.Cents())})
+		remainders = append(remainders, portion%total.Cents())
+		given += shares[len(shares)-1].amount
+	}
+
+	order := make([]int, len(shares))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order[:amount-given] {
+		shares[i].amount++
+	}
+
+	return shares
+}
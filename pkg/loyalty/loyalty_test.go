@@ -0,0 +1,241 @@
+package loyalty
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+type fakeGateway struct {
+	rewardsNumber string
+	promptErr     string
+	decline       bool
+	displayErr    error
+
+	displays int
+	charges  []blockchyp.AuthorizationRequest
+}
+
+func (g *fakeGateway) NewTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error) {
+	if g.displayErr != nil {
+		return nil, g.displayErr
+	}
+	g.displays++
+
+	return &blockchyp.Acknowledgement{Success: true}, nil
+}
+
+func (g *fakeGateway) UpdateTransactionDisplay(request blockchyp.TransactionDisplayRequest) (*blockchyp.Acknowledgement, error) {
+	return g.NewTransactionDisplay(request)
+}
+
+func (g *fakeGateway) TextPrompt(request blockchyp.TextPromptRequest) (*blockchyp.TextPromptResponse, error) {
+	if g.promptErr != "" {
+		return &blockchyp.TextPromptResponse{ResponseDescription: g.promptErr}, nil
+	}
+
+	return &blockchyp.TextPromptResponse{Success: true, Response: g.rewardsNumber}, nil
+}
+
+func (g *fakeGateway) Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.charges = append(g.charges, request)
+	if g.decline {
+		return &blockchyp.AuthorizationResponse{Success: true, ResponseDescription: "Declined"}, nil
+	}
+
+	return &blockchyp.AuthorizationResponse{
+		Success:          true,
+		Approved:         true,
+		TransactionID:    "TX1",
+		AuthorizedAmount: request.Amount,
+	}, nil
+}
+
+// testCart holds 9.00 of untaxed items.
+func testCart(t *testing.T) *cart.Cart {
+	c, err := cart.New("")
+	require.NoError(t, err)
+	require.NoError(t, c.Add(cart.Item{ID: "A", Description: "Coffee beans", Price: money.MustParse("6.00"), Quantity: 1}))
+	require.NoError(t, c.Add(cart.Item{ID: "B", Description: "Muffin", Price: money.MustParse("3.00"), Quantity: 1}))
+
+	return c
+}
+
+func testProvider() *FakeProvider {
+	return NewFakeProvider(Member{
+		RewardsNumber: "1001",
+		Name:          "Ann",
+		Percent:       "10",
+		Points:        250,
+		Items:         map[string]money.Amount{"B": money.MustParse("1.00")},
+	})
+}
+
+func discounts(c *cart.Cart, id string) []money.Amount {
+	item, _ := c.Item(id)
+	amounts := make([]money.Amount, 0, len(item.Discounts))
+	for _, d := range item.Discounts {
+		amounts = append(amounts, d.Amount)
+	}
+
+	return amounts
+}
+
+func TestApplyAndRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	c := testCart(t)
+	r := &Reward{Discounts: []Discount{
+		{Amount: money.MustParse("1.00")},
+		{ItemID: "B", Description: "Member price", Amount: money.MustParse("1.00")},
+	}}
+	require.NoError(t, Apply(c, r))
+
+	// The item discount comes off first, then the order discount is
+	// spread over the 6.00 and 2.00 left.
+	assert.Equal("2.00", r.Applied.String())
+	assert.Equal([]money.Amount{75}, discounts(c, "A"))
+	assert.Equal([]money.Amount{100, 25}, discounts(c, "B"))
+	assert.Equal("7.00", c.Totals().Subtotal.String())
+
+	item, _ := c.Item("A")
+	assert.Equal(DefaultDescription, item.Discounts[0].Description)
+
+	Remove(c, r)
+	assert.Equal("9.00", c.Totals().Subtotal.String())
+	assert.Equal(money.Amount(0), r.Applied)
+}
+
+func TestApplyRejectsInvalidDiscounts(t *testing.T) {
+	c := testCart(t)
+
+	err := Apply(c, &Reward{Discounts: []Discount{
+		{Amount: money.MustParse("1.00")},
+		{ItemID: "Z", Amount: money.MustParse("1.00")},
+	}})
+	assert.True(t, errors.Is(err, cart.ErrUnknownItem))
+
+	err = Apply(c, &Reward{Discounts: []Discount{{Amount: -1}}})
+	assert.True(t, errors.Is(err, ErrInvalidDiscount))
+
+	assert.Equal(t, "9.00", c.Totals().Subtotal.String())
+}
+
+func TestSpreadAddsUpExactly(t *testing.T) {
+	lines := []cart.Line{{Item: cart.Item{ID: "A"}}, {Item: cart.Item{ID: "B"}}, {Item: cart.Item{ID: "C"}}}
+	net := map[string]money.Amount{"A": 100, "B": 100, "C": 100}
+
+	shares := spread(lines, net, 10)
+	require.Len(t, shares, 3)
+	assert.Equal(t, []share{{"A", 4}, {"B", 3}, {"C", 3}}, shares)
+
+	// Discounts are capped at what the items come to.
+	shares = spread(lines, net, 1000)
+	assert.Equal(t, []share{{"A", 100}, {"B", 100}, {"C", 100}}, shares)
+}
+
+func TestFakeProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	p := testProvider()
+	c := testCart(t)
+
+	r, err := p.Lookup(context.Background(), "1001", OrderFromCart(c))
+	require.NoError(t, err)
+	assert.Equal("Ann", r.Member)
+	assert.Equal(200, r.Points)
+	assert.Equal([]Discount{
+		{ItemID: "B", Description: "Member price", Amount: money.MustParse("1.00")},
+		{Description: "10% member discount", Amount: money.MustParse("0.80")},
+		{Description: "200 points", Amount: money.MustParse("2.00")},
+	}, r.Discounts)
+
+	require.NoError(t, p.Redeem(context.Background(), Redemption{Reward: r, TransactionID: "TX1"}))
+	m, _ := p.Member("1001")
+	assert.Equal(50, m.Points)
+	assert.Len(p.Redemptions(), 1)
+	assert.Error(p.Redeem(context.Background(), Redemption{Reward: r}))
+
+	_, err = p.Lookup(context.Background(), "9999", OrderFromCart(c))
+	assert.True(errors.Is(err, ErrUnknownMember))
+
+	p.Err = errors.New("service unavailable")
+	_, err = p.Lookup(context.Background(), "1001", OrderFromCart(c))
+	assert.EqualError(err, "service unavailable")
+	_, err = p.Lookup(context.Background(), "1001", OrderFromCart(c))
+	assert.NoError(err)
+}
+
+func TestCheckoutRun(t *testing.T) {
+	assert := assert.New(t)
+
+	p := testProvider()
+	g := &fakeGateway{rewardsNumber: " 1001 "}
+	c := testCart(t)
+
+	result, err := NewCheckout(p, g, Options{TerminalName: "Front"}).Run(context.Background(), c, blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.NoError(result.LoyaltyErr)
+	assert.Equal("1001", result.RewardsNumber)
+	require.NotNil(t, result.Reward)
+	assert.Equal("3.80", result.Reward.Applied.String())
+
+	require.Len(t, g.charges, 1)
+	assert.Equal("5.20", g.charges[0].Amount)
+	assert.Equal("Front", g.charges[0].TerminalName)
+
+	require.Len(t, p.Redemptions(), 1)
+	assert.Equal("5.20", p.Redemptions()[0].Amount.String())
+	assert.Equal("TX1", p.Redemptions()[0].TransactionID)
+}
+
+func TestCheckoutRunDeclined(t *testing.T) {
+	assert := assert.New(t)
+
+	p := testProvider()
+	g := &fakeGateway{rewardsNumber: "1001", decline: true}
+	c := testCart(t)
+
+	result, err := NewCheckout(p, g, Options{}).Run(context.Background(), c, blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.False(result.Response.Approved)
+	assert.Nil(result.Reward)
+	assert.Equal("9.00", c.Totals().Subtotal.String())
+	assert.Empty(p.Redemptions())
+
+	m, _ := p.Member("1001")
+	assert.Equal(250, m.Points)
+}
+
+func TestCheckoutLoyaltyFailuresDontStopSale(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{rewardsNumber: "9999"}
+	result, err := NewCheckout(testProvider(), g, Options{}).Run(context.Background(), testCart(t), blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.True(errors.Is(result.LoyaltyErr, ErrUnknownMember))
+	assert.Equal("9.00", g.charges[0].Amount)
+
+	g = &fakeGateway{promptErr: blockchyp.ResponseTimedOut}
+	result, err = NewCheckout(testProvider(), g, Options{}).Run(context.Background(), testCart(t), blockchyp.AuthorizationRequest{})
+	require.NoError(t, err)
+	assert.NoError(result.LoyaltyErr)
+	assert.Empty(result.RewardsNumber)
+	assert.True(result.Response.Approved)
+}
+
+func TestDiscountRemovedWhenDisplayFails(t *testing.T) {
+	g := &fakeGateway{displayErr: errors.New("terminal busy")}
+	c := testCart(t)
+
+	_, err := NewCheckout(testProvider(), g, Options{}).Discount(context.Background(), c, "1001")
+	assert.EqualError(t, err, "terminal busy")
+	assert.Equal(t, "9.00", c.Totals().Subtotal.String())
+}
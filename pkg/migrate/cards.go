@@ -0,0 +1,176 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Card is a stored card from the legacy vault. Its String method masks
+// the PAN, so a Card printed with %v or %+v never leaks it.
+type Card struct {
+	// LegacyID identifies the card in the old vault. Required and unique.
+	LegacyID string
+
+	PAN            string
+	ExpMonth       string
+	ExpYear        string
+	CardholderName string
+	Address        string
+	PostalCode     string
+
+	// CustomerRef links the card to a BlockChyp customer, creating the
+	// customer if no customer has the ref yet. The remaining customer
+	// fields are only used when the customer is created.
+	CustomerRef  string
+	FirstName    string
+	LastName     string
+	CompanyName  string
+	EmailAddress string
+	SmsNumber    string
+}
+
+// String describes the card without its PAN.
+func (c Card) String() string {
+	return fmt.Sprintf("card %s (%s, exp %s/%s)", c.LegacyID, MaskPAN(c.PAN), c.ExpMonth, c.ExpYear)
+}
+
+// GoString keeps %#v from printing the PAN.
+func (c Card) GoString() string {
+	return c.String()
+}
+
+// MaskPAN masks all but the last four digits of a card number.
+func MaskPAN(pan string) string {
+	pan = strings.TrimSpace(pan)
+	if len(pan) <= 4 {
+		return strings.Repeat("*", len(pan))
+	}
+
+	return strings.Repeat("*", len(pan)-4) + pan[len(pan)-4:]
+}
+
+// validate checks a card before it's sent to the gateway. Errors never
+// include the PAN.
+func (c Card) validate() error {
+	pan := c.PAN
+	switch {
+	case len(pan) < 12 || len(pan) > 19 || !allDigits(pan):
+		return fmt.Errorf("card number is not 12 to 19 digits")
+	case !luhn(pan):
+		return fmt.Errorf("card number fails check digit")
+	case c.ExpMonth == "" || c.ExpYear == "":
+		return fmt.Errorf("missing expiry date")
+	}
+
+	return nil
+}
+
+// ReadCards parses a decrypted card file. It's CSV with a header row;
+// legacyId, pan, expMonth and expYear are required, and cardholderName,
+// address, postalCode, customerRef, firstName, lastName, companyName,
+// emailAddress and smsNumber are recognized. Errors identify rows by line
+// and legacy ID, never by card number.
+func ReadCards(plaintext []byte) ([]Card, error) {
+	cr := csv.NewReader(bytes.NewReader(plaintext))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return []Card{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid card file header")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"legacyid", "pan", "expmonth", "expyear"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("card file has no %s column", name)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[strings.ToLower(name)]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	cards := make([]Card, 0)
+	seen := make(map[string]int)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if perr := (*csv.ParseError)(nil); errors.As(err, &perr) {
+			return nil, fmt.Errorf("card file line %d is malformed", perr.StartLine)
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		card := Card{
+			LegacyID:       field(record, "legacyId"),
+			PAN:            strings.ReplaceAll(field(record, "pan"), " ", ""),
+			ExpMonth:       field(record, "expMonth"),
+			ExpYear:        field(record, "expYear"),
+			CardholderName: field(record, "cardholderName"),
+			Address:        field(record, "address"),
+			PostalCode:     field(record, "postalCode"),
+			CustomerRef:    field(record, "customerRef"),
+			FirstName:      field(record, "firstName"),
+			LastName:       field(record, "lastName"),
+			CompanyName:    field(record, "companyName"),
+			EmailAddress:   field(record, "emailAddress"),
+			SmsNumber:      field(record, "smsNumber"),
+		}
+
+		if card.LegacyID == "" {
+			return nil, fmt.Errorf("card file line %d has no legacy ID", line)
+		}
+		if prev, ok := seen[card.LegacyID]; ok {
+			return nil, fmt.Errorf("card file line %d repeats legacy ID %s from line %d", line, card.LegacyID, prev)
+		}
+		seen[card.LegacyID] = line
+
+		cards = append(cards, card)
+	}
+
+	return cards, nil
+}
+
+func luhn(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// KeyEnv is the environment variable the CLI reads the file key from. Keys
+// are never accepted as flags, since those end up in shell history and
+// process listings.
+const KeyEnv = "BLOCKCHYP_MIGRATION_KEY"
+
+// magic prefixes encrypted migration files and versions the format: magic,
+// a 12 byte nonce, then the AES-256-GCM sealed CSV.
+var magic = []byte("BCMIG1")
+
+var (
+	// ErrInvalidKey is returned for keys that aren't 32 bytes of hex.
+	ErrInvalidKey = errors.New("migration key must be 64 hex characters")
+
+	// ErrNotEncrypted is returned for input that isn't an encrypted
+	// migration file.
+	ErrNotEncrypted = errors.New("not an encrypted migration file")
+
+	// ErrDecrypt is returned when a file can't be decrypted with the key,
+	// either because the key is wrong or the file was modified.
+	ErrDecrypt = errors.New("migration file could not be decrypted")
+)
+
+// ParseKey decodes a hex encoded 256 bit key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// NewKey returns a random key, hex encoded.
+func NewKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// Encrypt seals a plaintext card file with the key.
+func Encrypt(w io.Writer, plaintext []byte, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out := make([]byte, 0, len(magic)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, magic...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, plaintext, magic)
+
+	_, err = w.Write(out)
+
+	return err
+}
+
+// Decrypt opens an encrypted card file. The plaintext holds cardholder
+// data; keep it in memory and don't write it anywhere.
+func Decrypt(r io.Reader, key []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, magic) || len(content) < len(magic)+aead.NonceSize() {
+		return nil, ErrNotEncrypted
+	}
+	content = content[len(magic):]
+
+	plaintext, err := aead.Open(nil, content[:aead.NonceSize()], content[aead.NonceSize():], magic)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
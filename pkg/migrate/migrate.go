@@ -0,0 +1,388 @@
+// Package migrate moves stored cards from another processor's vault into
+// BlockChyp tokens. Cards are read from an encrypted file, enrolled with
+// bounded concurrency and linked to customers by customer ref, and the
+// resulting legacy ID to token mapping doubles as a checkpoint so an
+// interrupted migration can be rerun without enrolling cards twice.
+//
+// Card numbers are only ever held in memory. They are never logged, never
+// written to the mapping file and never included in errors.
+package migrate
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// DefaultConcurrency is the number of enrollments in flight at once when
+// none is configured.
+const DefaultConcurrency = 4
+
+// DefaultRefPrefix prefixes the transaction ref of each enrollment.
+const DefaultRefPrefix = "migrate-"
+
+// Gateway is the subset of *blockchyp.Client used for migration.
+type Gateway interface {
+	Enroll(request blockchyp.EnrollRequest) (*blockchyp.EnrollResponse, error)
+}
+
+// Options configures a migration.
+type Options struct {
+	Test bool
+
+	// Concurrency bounds the enrollments in flight. Defaults to
+	// DefaultConcurrency.
+	Concurrency int
+
+	// RefPrefix is prepended to each legacy ID to form the enrollment's
+	// transaction ref. Refs are stable across runs, so the gateway's
+	// duplicate detection catches a card enrolled just before a crash.
+	// Defaults to DefaultRefPrefix.
+	RefPrefix string
+
+	// Progress, if set, is called after each card with the running totals.
+	// It's called from one goroutine at a time.
+	Progress func(Result)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.RefPrefix == "" {
+		o.RefPrefix = DefaultRefPrefix
+	}
+
+	return o
+}
+
+// Status is the outcome of migrating a card.
+type Status string
+
+// Mapping statuses.
+const (
+	StatusEnrolled Status = "enrolled"
+	StatusFailed   Status = "failed"
+)
+
+// Mapping links a legacy card to its BlockChyp token.
+type Mapping struct {
+	LegacyID    string
+	Status      Status
+	Token       string
+	MaskedPAN   string
+	CustomerRef string
+	CustomerID  string
+	Error       string
+}
+
+var mappingHeader = []string{"legacyId", "status", "token", "maskedPan", "customerRef", "customerId", "error"}
+
+func (m Mapping) record() []string {
+	return []string{m.LegacyID, string(m.Status), m.Token, m.MaskedPAN, m.CustomerRef, m.CustomerID, m.Error}
+}
+
+// Result summarizes a migration run.
+type Result struct {
+	Total    int  `json:"total"`
+	Enrolled int  `json:"enrolled"`
+	Failed   int  `json:"failed"`
+	Skipped  int  `json:"skipped"`
+	Resumed  bool `json:"resumed"`
+}
+
+// ReadMappings reads a mapping file. When a legacy ID appears more than
+// once, as it does after a failed card is retried, the last row wins.
+func ReadMappings(r io.Reader) (map[string]Mapping, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	mappings := make(map[string]Mapping)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return mappings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ",") != strings.Join(mappingHeader, ",") {
+		return nil, errors.New("not a token migration mapping file")
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for len(record) < len(mappingHeader) {
+			record = append(record, "")
+		}
+
+		mappings[record[0]] = Mapping{
+			LegacyID:    record[0],
+			Status:      Status(record[1]),
+			Token:       record[2],
+			MaskedPAN:   record[3],
+			CustomerRef: record[4],
+			CustomerID:  record[5],
+			Error:       record[6],
+		}
+	}
+
+	return mappings, nil
+}
+
+// Run enrolls cards and appends a row per card to the mapping file at
+// path. The file is the checkpoint: if it exists, cards it already records
+// as enrolled are skipped and failed ones are retried. Each row is synced
+// to disk before the next is written, so a crash loses at most the cards
+// in flight, and those are caught by duplicate detection on the rerun. A
+// row torn by the crash is discarded when the file is next read.
+//
+// Cards that fail are recorded and don't stop the run. Canceling the
+// context stops new enrollments; the error returned is the context's.
+func Run(ctx context.Context, gateway Gateway, cards []Card, path string, opts Options) (Result, error) {
+	opts = opts.withDefaults()
+
+	result := Result{Total: len(cards)}
+
+	done, err := readMappingFile(path)
+	if err != nil {
+		return result, err
+	}
+	result.Resumed = done != nil
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	write := func(record []string) error {
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+
+		return f.Sync()
+	}
+
+	if !result.Resumed {
+		if err := write(mappingHeader); err != nil {
+			return result, err
+		}
+	}
+
+	pending := make([]Card, 0, len(cards))
+	for _, card := range cards {
+		if m, ok := done[card.LegacyID]; ok && m.Status == StatusEnrolled {
+			result.Skipped++
+			continue
+		}
+		pending = append(pending, card)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan Card)
+	results := make(chan Mapping)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for card := range jobs {
+				results <- enroll(gateway, card, opts)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, card := range pending {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- card:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var writeErr error
+	for m := range results {
+		if writeErr != nil {
+			// Drain so the workers can exit.
+			continue
+		}
+		if err := write(m.record()); err != nil {
+			writeErr = fmt.Errorf("writing mapping for %s: %w", m.LegacyID, err)
+			cancel()
+			continue
+		}
+
+		if m.Status == StatusEnrolled {
+			result.Enrolled++
+		} else {
+			result.Failed++
+		}
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+
+	if writeErr != nil {
+		return result, writeErr
+	}
+
+	return result, ctx.Err()
+}
+
+// enroll tokenizes a single card.
+func enroll(gateway Gateway, card Card, opts Options) Mapping {
+	m := Mapping{
+		LegacyID:    card.LegacyID,
+		Status:      StatusFailed,
+		MaskedPAN:   MaskPAN(card.PAN),
+		CustomerRef: card.CustomerRef,
+	}
+
+	if err := card.validate(); err != nil {
+		m.Error = err.Error()
+		return m
+	}
+
+	req := blockchyp.EnrollRequest{
+		Test:           opts.Test,
+		TransactionRef: opts.RefPrefix + card.LegacyID,
+		PAN:            card.PAN,
+		ExpMonth:       card.ExpMonth,
+		ExpYear:        card.ExpYear,
+		CardholderName: card.CardholderName,
+		Address:        card.Address,
+		PostalCode:     card.PostalCode,
+	}
+	if card.CustomerRef != "" {
+		req.Customer = &blockchyp.Customer{
+			CustomerRef:  card.CustomerRef,
+			FirstName:    card.FirstName,
+			LastName:     card.LastName,
+			CompanyName:  card.CompanyName,
+			EmailAddress: card.EmailAddress,
+			SmsNumber:    card.SmsNumber,
+		}
+	}
+
+	res, err := gateway.Enroll(req)
+	switch {
+	case err != nil:
+		m.Error = err.Error()
+		return m
+	case !res.Success || !res.Approved || res.Token == "":
+		m.Error = res.ResponseDescription
+		if m.Error == "" {
+			m.Error = "enrollment not approved"
+		}
+		return m
+	}
+
+	m.Status = StatusEnrolled
+	m.Token = res.Token
+	if res.MaskedPAN != "" {
+		m.MaskedPAN = res.MaskedPAN
+	}
+	if res.Customer != nil {
+		m.CustomerID = res.Customer.ID
+	}
+
+	return m
+}
+
+// readMappingFile returns nil if the file doesn't exist yet.
+func readMappingFile(path string) (map[string]Mapping, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+
+	size, err := truncateTornRow(f, path, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return ReadMappings(f)
+}
+
+// truncateTornRow cuts off a final row left half written by a crash, so the
+// file reads cleanly and new rows start on a fresh line. Every complete row
+// ends in a newline; a row that doesn't is torn. It returns the file's new
+// size. Damage earlier in the file is left for ReadMappings to report.
+func truncateTornRow(f *os.File, path string, size int64) (int64, error) {
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return size, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+
+	var offset int64
+	for {
+		_, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// A torn quoted field fails to parse. That's only expected of
+			// the last row.
+			if _, err := cr.Read(); err != io.EOF {
+				return size, nil
+			}
+			break
+		}
+		if cr.InputOffset() == size {
+			break
+		}
+		offset = cr.InputOffset()
+	}
+
+	return offset, os.Truncate(path, offset)
+}
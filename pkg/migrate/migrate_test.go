@@ -0,0 +1,227 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// fakeGateway enrolls every card except those with a declined PAN.
+type fakeGateway struct {
+	lock     sync.Mutex
+	declined map[string]bool
+	refs     []string
+}
+
+func (g *fakeGateway) Enroll(request blockchyp.EnrollRequest) (*blockchyp.EnrollResponse, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.refs = append(g.refs, request.TransactionRef)
+	if g.declined[request.PAN] {
+		return &blockchyp.EnrollResponse{Success: true, ResponseDescription: "Do Not Honor"}, nil
+	}
+
+	res := &blockchyp.EnrollResponse{
+		Success:   true,
+		Approved:  true,
+		Token:     "TOK-" + request.TransactionRef,
+		MaskedPAN: MaskPAN(request.PAN),
+	}
+	if request.Customer != nil {
+		res.Customer = &blockchyp.Customer{ID: "CUS-" + request.Customer.CustomerRef}
+	}
+
+	return res, nil
+}
+
+const cardFile = `legacyId,pan,expMonth,expYear,customerRef,firstName
+L1,4111 1111 1111 1111,12,28,R1,Ann
+L2,4111111111111112,12,28,,
+L3,5555555555554444,01,29,,
+`
+
+func TestEncryptRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	hexKey, err := NewKey()
+	require.NoError(t, err)
+	key, err := ParseKey(hexKey)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Encrypt(&buf, []byte(cardFile), key))
+	assert.NotContains(buf.String(), "5555555555554444")
+
+	plaintext, err := Decrypt(bytes.NewReader(buf.Bytes()), key)
+	require.NoError(t, err)
+	assert.Equal(cardFile, string(plaintext))
+
+	other, err := NewKey()
+	require.NoError(t, err)
+	otherKey, err := ParseKey(other)
+	require.NoError(t, err)
+	_, err = Decrypt(bytes.NewReader(buf.Bytes()), otherKey)
+	assert.True(errors.Is(err, ErrDecrypt))
+
+	_, err = Decrypt(bytes.NewReader([]byte(cardFile)), key)
+	assert.True(errors.Is(err, ErrNotEncrypted))
+
+	_, err = ParseKey("abcd")
+	assert.True(errors.Is(err, ErrInvalidKey))
+}
+
+func TestReadCards(t *testing.T) {
+	assert := assert.New(t)
+
+	cards, err := ReadCards([]byte(cardFile))
+	require.NoError(t, err)
+	require.Len(t, cards, 3)
+	assert.Equal("4111111111111111", cards[0].PAN)
+	assert.Equal("R1", cards[0].CustomerRef)
+	assert.Equal("Ann", cards[0].FirstName)
+
+	_, err = ReadCards([]byte("legacyId,pan,expMonth,expYear\nL1,4111111111111111,12,28\nL1,5555555555554444,01,29\n"))
+	assert.EqualError(err, "card file line 3 repeats legacy ID L1 from line 2")
+
+	_, err = ReadCards([]byte("legacyId,pan,expMonth\n"))
+	assert.EqualError(err, "card file has no expyear column")
+}
+
+func TestCardNeverPrintsPAN(t *testing.T) {
+	assert := assert.New(t)
+
+	card := Card{LegacyID: "L1", PAN: "4111111111111111", ExpMonth: "12", ExpYear: "28"}
+	for _, s := range []string{fmt.Sprint(card), fmt.Sprintf("%+v", card), fmt.Sprintf("%#v", card)} {
+		assert.NotContains(s, "4111111111111111")
+		assert.Contains(s, "************1111")
+	}
+	assert.Equal("***", MaskPAN("123"))
+
+	card.PAN = "4111111111111112"
+	err := card.validate()
+	require.Error(t, err)
+	assert.NotContains(err.Error(), card.PAN)
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	cards, err := ReadCards([]byte(cardFile))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "mapping.csv")
+	g := &fakeGateway{declined: map[string]bool{"5555555555554444": true}}
+
+	var progress []Result
+	result, err := Run(context.Background(), g, cards, path, Options{
+		Test:        true,
+		Concurrency: 2,
+		Progress:    func(r Result) { progress = append(progress, r) },
+	})
+	require.NoError(t, err)
+	assert.Equal(Result{Total: 3, Enrolled: 1, Failed: 2}, result)
+	assert.Len(progress, 3)
+
+	// The card failing its check digit never reaches the gateway.
+	assert.ElementsMatch([]string{"migrate-L1", "migrate-L3"}, g.refs)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(string(content), "4111111111111111")
+	assert.NotContains(string(content), "5555555555554444")
+
+	mappings, err := ReadMappings(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(Mapping{
+		LegacyID:    "L1",
+		Status:      StatusEnrolled,
+		Token:       "TOK-migrate-L1",
+		MaskedPAN:   "************1111",
+		CustomerRef: "R1",
+		CustomerID:  "CUS-R1",
+	}, mappings["L1"])
+	assert.Equal("card number fails check digit", mappings["L2"].Error)
+	assert.Equal("Do Not Honor", mappings["L3"].Error)
+
+	// A rerun skips the enrolled card and retries the failed ones.
+	g = &fakeGateway{}
+	result, err = Run(context.Background(), g, cards, path, Options{})
+	require.NoError(t, err)
+	assert.Equal(Result{Total: 3, Enrolled: 1, Failed: 1, Skipped: 1, Resumed: true}, result)
+	assert.Equal([]string{"migrate-L3"}, g.refs)
+
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	mappings, err = ReadMappings(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(StatusEnrolled, mappings["L3"].Status)
+}
+
+func TestRunCanceled(t *testing.T) {
+	cards, err := ReadCards([]byte(cardFile))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	g := &fakeGateway{}
+	_, err = Run(ctx, g, cards, filepath.Join(t.TempDir(), "mapping.csv"), Options{})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestReadMappingsRejectsOtherFiles(t *testing.T) {
+	_, err := ReadMappings(bytes.NewReader([]byte(cardFile)))
+	assert.Error(t, err)
+
+	mappings, err := ReadMappings(bytes.NewReader(nil))
+	require.NoError(t, err)
+	assert.Empty(t, mappings)
+}
+
+func TestRunTruncatesTornRow(t *testing.T) {
+	cards, err := ReadCards([]byte(cardFile))
+	require.NoError(t, err)
+
+	complete := "legacyId,status,token,maskedPan,customerRef,customerId,error\n" +
+		"L1,enrolled,TOK-migrate-L1,************1111,R1,CUS-R1,\n"
+
+	tests := []struct {
+		name    string
+		content string
+		refs    []string
+	}{
+		{"row", complete + "L3,enrolled,TOK-mig", []string{"migrate-L3"}},
+		{"quoted", complete + `L3,failed,,,,,"Do Not Honor, try`, []string{"migrate-L3"}},
+		{"header", "legacyId,status,to", []string{"migrate-L1", "migrate-L3"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			path := filepath.Join(t.TempDir(), "mapping.csv")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+
+			g := &fakeGateway{}
+			_, err := Run(context.Background(), g, cards, path, Options{})
+			require.NoError(t, err)
+			assert.ElementsMatch(tc.refs, g.refs)
+
+			written, err := os.ReadFile(path)
+			require.NoError(t, err)
+			mappings, err := ReadMappings(bytes.NewReader(written))
+			require.NoError(t, err)
+			assert.Equal(StatusEnrolled, mappings["L1"].Status)
+			assert.Equal(StatusEnrolled, mappings["L3"].Status)
+		})
+	}
+}
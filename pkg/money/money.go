@@ -0,0 +1,225 @@
+// Package money does exact arithmetic on the decimal amount strings used
+// throughout the BlockChyp API.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidAmount is returned when an amount string can't be parsed.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Amount is a monetary amount in cents. It only suits currencies with two
+// decimal places; see currency.RequireCents.
+type Amount int64
+
+// Parse parses a decimal amount such as "12.34" or "-5". A blank string
+// parses as zero, matching the way the gateway omits empty amounts.
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || len(frac) > 2 || !digits(whole) || !digits(frac) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	if negative {
+		cents = -cents
+	}
+
+	return Amount(cents), nil
+}
+
+// MustParse is like Parse but panics on invalid input. It is meant for
+// constants.
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return a
+}
+
+// FromFloat converts a floating point amount, as used by the statement and
+// invoice APIs, rounding to the nearest cent.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * 100))
+}
+
+// String formats the amount with two decimal places, the form the gateway
+// expects.
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, v/100, v%100)
+}
+
+// MarshalJSON encodes the amount as a decimal string.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.String())), nil
+}
+
+// UnmarshalJSON accepts a decimal string or a bare number.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "null" {
+		return nil
+	}
+
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+
+	return nil
+}
+
+// Cents returns the amount in cents.
+func (a Amount) Cents() int64 {
+	return int64(a)
+}
+
+// IsZero reports whether the amount is zero.
+func (a Amount) IsZero() bool {
+	return a == 0
+}
+
+// Abs returns the absolute value of the amount.
+func (a Amount) Abs() Amount {
+	if a < 0 {
+		return -a
+	}
+
+	return a
+}
+
+// Rounding selects how fractions of a cent are resolved.
+type Rounding int
+
+// Rounding modes.
+const (
+	// RoundNearest rounds half a cent away from zero.
+	RoundNearest Rounding = iota
+
+	// RoundUp rounds any fraction of a cent away from zero.
+	RoundUp
+
+	// RoundDown drops any fraction of a cent.
+	RoundDown
+)
+
+// Mul multiplies the amount by an exact decimal factor, such as a quantity
+// or a rate, and rounds the result to a whole cent.
+func (a Amount) Mul(factor string, mode Rounding) (Amount, error) {
+	f, ok := new(big.Rat).SetString(strings.TrimSpace(factor))
+	if !ok {
+		return 0, fmt.Errorf("%w: factor %q", ErrInvalidAmount, factor)
+	}
+
+	return a.MulRat(f, mode), nil
+}
+
+// Percent returns the given percentage of the amount, so a rate of "8.25"
+// yields 8.25% of it.
+func (a Amount) Percent(rate string, mode Rounding) (Amount, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+	if !ok {
+		return 0, fmt.Errorf("%w: rate %q", ErrInvalidAmount, rate)
+	}
+
+	return a.MulRat(r.Quo(r, big.NewRat(100, 1)), mode), nil
+}
+
+// MulRat multiplies the amount by an exact rational factor and rounds the
+// result to a whole cent.
+func (a Amount) MulRat(f *big.Rat, mode Rounding) Amount {
+	product := new(big.Rat).Mul(big.NewRat(int64(a), 1), f)
+
+	return Round(product, mode)
+}
+
+// Round rounds a rational number of cents to a whole cent.
+func Round(cents *big.Rat, mode Rounding) Amount {
+	return Amount(RoundInt(cents, mode).Int64())
+}
+
+// RoundInt rounds a rational number to an integer. It's Round for units
+// other than cents, whose totals may not fit in an int64.
+func RoundInt(x *big.Rat, mode Rounding) *big.Int {
+	num := new(big.Int).Abs(x.Num())
+	den := x.Denom()
+
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() != 0 {
+		switch mode {
+		case RoundUp:
+			q.Add(q, big.NewInt(1))
+		case RoundNearest:
+			if r.Lsh(r, 1).Cmp(den) >= 0 {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+
+	if x.Sign() < 0 {
+		q.Neg(q)
+	}
+
+	return q
+}
+
+// Sum adds up a list of amounts.
+func Sum(amounts ...Amount) Amount {
+	var total Amount
+	for _, a := range amounts {
+		total += a
+	}
+
+	return total
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
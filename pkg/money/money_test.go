@@ -0,0 +1,90 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[string]Amount{
+		"12.34": 1234,
+		"12.3":  1230,
+		"12":    1200,
+		".05":   5,
+		"-5":    -500,
+		"+1.01": 101,
+		" ":     0,
+	}
+	for s, want := range cases {
+		got, err := Parse(s)
+		require.NoError(t, err, s)
+		assert.Equal(want, got, s)
+	}
+
+	for _, s := range []string{"1.234", "abc", ".", "1,00", "1e3", "--1"} {
+		_, err := Parse(s)
+		assert.ErrorIs(err, ErrInvalidAmount, s)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("0.00", Amount(0).String())
+	assert.Equal("0.05", Amount(5).String())
+	assert.Equal("-0.05", Amount(-5).String())
+	assert.Equal("1234.50", Amount(123450).String())
+}
+
+func TestJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var v struct {
+		A Amount `json:"a"`
+		B Amount `json:"b"`
+		C Amount `json:"c"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"a":"1.50","b":2.25,"c":null}`), &v))
+	assert.Equal(Amount(150), v.A)
+	assert.Equal(Amount(225), v.B)
+	assert.Equal(Amount(0), v.C)
+
+	content, err := json.Marshal(v)
+	require.NoError(t, err)
+	assert.JSONEq(`{"a":"1.50","b":"2.25","c":"0.00"}`, string(content))
+}
+
+func TestRounding(t *testing.T) {
+	assert := assert.New(t)
+
+	// 3% of 10.50 is 31.5 cents.
+	a := MustParse("10.50")
+	for mode, want := range map[Rounding]Amount{RoundNearest: 32, RoundUp: 32, RoundDown: 31} {
+		got, err := a.Percent("3", mode)
+		require.NoError(t, err)
+		assert.Equal(want, got)
+	}
+
+	// Rounding is symmetric around zero.
+	assert.Equal(Amount(-32), Round(big.NewRat(-315, 10), RoundNearest))
+	assert.Equal(Amount(-31), Round(big.NewRat(-315, 10), RoundDown))
+
+	got, err := MustParse("1.99").Mul("3", RoundNearest)
+	require.NoError(t, err)
+	assert.Equal(MustParse("5.97"), got)
+
+	_, err = a.Mul("x", RoundNearest)
+	assert.ErrorIs(err, ErrInvalidAmount)
+}
+
+func TestFromFloat(t *testing.T) {
+	assert.Equal(t, Amount(1015), FromFloat(10.149999))
+	assert.Equal(t, Amount(-1), FromFloat(-0.005))
+	assert.Equal(t, MustParse("3.00"), Sum(100, 150, 50))
+}
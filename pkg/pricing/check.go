@@ -0,0 +1,139 @@
+package pricing
+
+import (
+	"fmt"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// Gateway runs the pricing APIs the calculator reproduces. It is satisfied
+// by *blockchyp.Client.
+type Gateway interface {
+	CashDiscount(request blockchyp.CashDiscountRequest) (*blockchyp.CashDiscountResponse, error)
+	SurchargeReview(request blockchyp.SurchargeReviewRequest) (*blockchyp.SurchargeReviewResponse, error)
+}
+
+// Mismatch is a calculation where the calculator and the gateway disagree.
+type Mismatch struct {
+	Request blockchyp.CashDiscountRequest
+	Local   blockchyp.CashDiscountResponse
+	Gateway blockchyp.CashDiscountResponse
+}
+
+// String describes the mismatch.
+func (m Mismatch) String() string {
+	mode := "default"
+	if m.Request.RoundingMode != nil {
+		mode = string(*m.Request.RoundingMode)
+	}
+
+	return fmt.Sprintf("amount %s surcharge=%t cashDiscount=%t rounding=%s: local %s/%s/%s, gateway %s/%s/%s",
+		m.Request.Amount, m.Request.Surcharge, m.Request.CashDiscount, mode,
+		m.Local.Amount, m.Local.Surcharge, m.Local.CashDiscount,
+		m.Gateway.Amount, m.Gateway.Surcharge, m.Gateway.CashDiscount)
+}
+
+// Check runs each amount through the calculator and the gateway's test
+// mode, for every combination of surcharge, cash discount and rounding
+// mode, and returns the calculations that differ. An empty result means
+// the cached policy reproduces the gateway exactly.
+func (c *Calculator) Check(g Gateway, amounts []string) ([]Mismatch, error) {
+	modes := []*blockchyp.RoundingMode{nil}
+	for _, m := range []blockchyp.RoundingMode{
+		blockchyp.RoundingModeUp,
+		blockchyp.RoundingModeNearest,
+		blockchyp.RoundingModeDown,
+	} {
+		modes = append(modes, &m)
+	}
+
+	mismatches := make([]Mismatch, 0)
+	for _, amount := range amounts {
+		for _, flags := range [][2]bool{{true, false}, {true, true}, {false, true}} {
+			for _, mode := range modes {
+				req := blockchyp.CashDiscountRequest{
+					Test:         true,
+					Amount:       amount,
+					Surcharge:    flags[0],
+					CashDiscount: flags[1],
+					RoundingMode: mode,
+				}
+
+				local, err := c.CashDiscount(req)
+				if err != nil {
+					return mismatches, err
+				}
+
+				remote, err := g.CashDiscount(req)
+				if err != nil {
+					return mismatches, err
+				}
+				if !remote.Success {
+					return mismatches, fmt.Errorf("gateway cash discount: %s", remote.ResponseDescription)
+				}
+
+				if !sameAmount(local.Amount, remote.Amount) ||
+					!sameAmount(local.Surcharge, remote.Surcharge) ||
+					!sameAmount(local.CashDiscount, remote.CashDiscount) {
+					mismatches = append(mismatches, Mismatch{
+						Request: req,
+						Local:   *local,
+						Gateway: *remote,
+					})
+				}
+			}
+		}
+	}
+
+	return mismatches, nil
+}
+
+// CheckSurchargeReview runs a surcharge review on the gateway's test mode,
+// repeats it locally for the card the gateway identified, and returns both
+// responses when the surcharge, total or exemption differ.
+func (c *Calculator) CheckSurchargeReview(g Gateway, req blockchyp.SurchargeReviewRequest) (local, remote *blockchyp.SurchargeReviewResponse, match bool, err error) {
+	req.Test = true
+
+	remote, err = g.SurchargeReview(req)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if !remote.Success {
+		return nil, remote, false, fmt.Errorf("gateway surcharge review: %s", remote.ResponseDescription)
+	}
+
+	attrs := remote.Data.Attributes
+	local, err = c.SurchargeReview(req, Card{
+		Type:        attrs.CardType,
+		Brand:       attrs.Brand,
+		Bin:         attrs.Bin,
+		CountryCode: attrs.CountryCode,
+		Commercial:  attrs.IsCommercial,
+		Regulated:   attrs.IsRegulated,
+	})
+	if err != nil {
+		return nil, remote, false, err
+	}
+
+	l := local.Data.Attributes
+	match = l.SurchargeExempt == attrs.SurchargeExempt &&
+		sameAmount(l.SurchargeAmount, attrs.SurchargeAmount) &&
+		sameAmount(l.TotalWithSurchargeAmount, attrs.TotalWithSurchargeAmount)
+
+	return local, remote, match, nil
+}
+
+// sameAmount compares amounts numerically, treating blank as zero.
+func sameAmount(a, b string) bool {
+	x, err := money.Parse(a)
+	if err != nil {
+		return a == b
+	}
+	y, err := money.Parse(b)
+	if err != nil {
+		return a == b
+	}
+
+	return x == y
+}
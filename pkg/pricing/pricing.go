@@ -0,0 +1,423 @@
+// Package pricing calculates surcharges and cash discounts locally from a
+// merchant's pricing policy, so prices can be shown on shelf tags and in
+// carts without a gateway round trip per amount. Results take the same
+// shape as the CashDiscount and SurchargeReview APIs, which remain the
+// source of truth when a transaction is run; Check compares the two.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// ErrNoSurchargeRate is returned when neither the pricing policy nor the
+// options supply a surcharge rate.
+var ErrNoSurchargeRate = errors.New("no surcharge rate")
+
+// DefaultExcludedStates are states that prohibit credit card surcharges.
+var DefaultExcludedStates = []string{"CT", "MA", "PR"}
+
+// Source fetches the merchant's pricing configuration. It is satisfied by
+// *blockchyp.Client.
+type Source interface {
+	PricingPolicy(request blockchyp.PricingPolicyRequest) (*blockchyp.PricingPolicyResponse, error)
+	MerchantProfile(request blockchyp.MerchantProfileRequest) (*blockchyp.MerchantProfileResponse, error)
+}
+
+// Options configures a Calculator.
+type Options struct {
+	// Test fetches the policy from the test gateway.
+	Test bool
+
+	// PolicyID selects a pricing policy. Defaults to the merchant's.
+	PolicyID string
+
+	// SurchargeRate overrides the policy's rate, as a percentage. Needed
+	// for interchange plus policies, where the policy only holds the
+	// markup.
+	SurchargeRate string
+
+	// MaxAge is how long the fetched policy is kept. Zero keeps it until
+	// Refresh is called.
+	MaxAge time.Duration
+}
+
+// Policy is the subset of a merchant's pricing configuration that affects
+// surcharges and cash discounts.
+type Policy struct {
+	// Enabled reports whether the merchant has cash discounting or
+	// surcharging turned on.
+	Enabled bool
+
+	// Rate is the surcharge rate as a percentage.
+	Rate string
+
+	// DebitRate and DebitFee are what debit transactions cost the
+	// merchant. Debit cards can't be surcharged, but the cost is reported
+	// by SurchargeReview.
+	DebitRate string
+	DebitFee  money.Amount
+}
+
+// Calculator computes prices from a cached policy. It is safe for
+// concurrent use.
+type Calculator struct {
+	source Source
+	opts   Options
+
+	lock    sync.Mutex
+	policy  *Policy
+	fetched time.Time
+}
+
+// New returns a calculator that fetches the policy from source when first
+// needed.
+func New(source Source, opts Options) *Calculator {
+	return &Calculator{source: source, opts: opts}
+}
+
+// NewWithPolicy returns a calculator for a fixed policy that never touches
+// the gateway.
+func NewWithPolicy(p Policy) *Calculator {
+	return &Calculator{policy: &p}
+}
+
+// Policy returns the cached policy, fetching it if needed.
+func (c *Calculator) Policy() (Policy, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stale := c.opts.MaxAge > 0 && time.Since(c.fetched) > c.opts.MaxAge
+	if c.policy != nil && (!stale || c.source == nil) {
+		return *c.policy, nil
+	}
+
+	p, err := c.fetch()
+	if err != nil {
+		return Policy{}, err
+	}
+	c.policy = p
+	c.fetched = time.Now()
+
+	return *p, nil
+}
+
+// Refresh discards the cached policy.
+func (c *Calculator) Refresh() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.source != nil {
+		c.policy = nil
+	}
+}
+
+func (c *Calculator) fetch() (*Policy, error) {
+	profile, err := c.source.MerchantProfile(blockchyp.MerchantProfileRequest{Test: c.opts.Test})
+	if err != nil {
+		return nil, fmt.Errorf("fetching merchant profile: %w", err)
+	}
+	if !profile.Success {
+		return nil, fmt.Errorf("fetching merchant profile: %s", profile.ResponseDescription)
+	}
+
+	pricing, err := c.source.PricingPolicy(blockchyp.PricingPolicyRequest{
+		Test: c.opts.Test,
+		ID:   c.opts.PolicyID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching pricing policy: %w", err)
+	}
+	if !pricing.Success {
+		return nil, fmt.Errorf("fetching pricing policy: %s", pricing.ResponseDescription)
+	}
+
+	p := &Policy{
+		Enabled:   profile.CashDiscountEnabled,
+		Rate:      percent(pricing.StandardFlatRate.Current),
+		DebitRate: percent(pricing.DebitFlatRate.Current),
+	}
+	if strings.EqualFold(pricing.PolicyType, "interchange") {
+		p.Rate = percent(pricing.StandardInterchangeMarkup.Current)
+		p.DebitRate = percent(pricing.DebitInterchangeMarkup.Current)
+	}
+	if c.opts.SurchargeRate != "" {
+		p.Rate = c.opts.SurchargeRate
+	}
+	if p.DebitFee, err = money.Parse(pricing.DebitTransactionFee.Current); err != nil {
+		return nil, fmt.Errorf("pricing policy debit fee: %w", err)
+	}
+
+	return p, nil
+}
+
+// Prices are what a customer pays by card and in cash.
+type Prices struct {
+	Card money.Amount
+	Cash money.Amount
+}
+
+// Prices returns the card and cash prices of a posted amount, as shown on
+// a shelf tag. Surcharges round up, matching the gateway's default.
+func (c *Calculator) Prices(amount money.Amount) (Prices, error) {
+	p, err := c.Policy()
+	if err != nil {
+		return Prices{}, err
+	}
+	if !p.Enabled {
+		return Prices{Card: amount, Cash: amount}, nil
+	}
+
+	s, err := surcharge(amount, p.Rate, money.RoundUp)
+	if err != nil {
+		return Prices{}, err
+	}
+
+	return Prices{Card: amount + s, Cash: amount}, nil
+}
+
+// CashDiscount computes locally what the CashDiscount API would return.
+//
+// With Surcharge set, the surcharge is added to the amount. With
+// CashDiscount also set, an offsetting discount of the same size brings
+// the total back to the amount, as for a cash sale under a cash discount
+// program. CashDiscount alone treats the amount as the card price and
+// discounts the surcharge out of it. Amounts are worked in cents, so
+// currencies without two decimal places are refused.
+func (c *Calculator) CashDiscount(req blockchyp.CashDiscountRequest) (*blockchyp.CashDiscountResponse, error) {
+	if err := currency.RequireCents(req.CurrencyCode); err != nil {
+		return nil, err
+	}
+
+	p, err := c.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := money.Parse(req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &blockchyp.CashDiscountResponse{
+		Success:             true,
+		ResponseDescription: "Approved",
+		CurrencyCode:        req.CurrencyCode,
+		TaxExempt:           req.TaxExempt,
+		Amount:              amount.String(),
+	}
+	if !p.Enabled {
+		return res, nil
+	}
+
+	mode := Rounding(req.RoundingMode)
+
+	switch {
+	case req.Surcharge:
+		s, err := surcharge(amount, p.Rate, mode)
+		if err != nil {
+			return nil, err
+		}
+		res.Surcharge = s.String()
+		if req.CashDiscount {
+			res.CashDiscount = s.String()
+		} else {
+			res.Amount = (amount + s).String()
+		}
+
+	case req.CashDiscount:
+		base, err := removeSurcharge(amount, p.Rate, mode)
+		if err != nil {
+			return nil, err
+		}
+		res.CashDiscount = (amount - base).String()
+		res.Amount = base.String()
+	}
+
+	return res, nil
+}
+
+// Card describes the card a SurchargeReview is for. The gateway looks this
+// up from the card number or token; locally it has to be supplied, for
+// instance from an earlier CardMetadata response.
+type Card struct {
+	// Type is "credit", "debit" or "prepaid".
+	Type        string
+	Brand       string
+	Bin         string
+	CountryCode string
+	Commercial  bool
+	Regulated   bool
+}
+
+// SurchargeReview computes locally what the SurchargeReview API would
+// return for a card. Rates in the request override the policy's.
+func (c *Calculator) SurchargeReview(req blockchyp.SurchargeReviewRequest, card Card) (*blockchyp.SurchargeReviewResponse, error) {
+	p, err := c.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := money.Parse(deref(req.Amount))
+	if err != nil {
+		return nil, err
+	}
+
+	rate := firstNonEmpty(deref(req.SurchargeRate), p.Rate)
+	debitRate := firstNonEmpty(deref(req.DebitDiscountRate), p.DebitRate)
+	debitFee := p.DebitFee
+	if fee := deref(req.DebitTransFee); fee != "" {
+		if debitFee, err = money.Parse(fee); err != nil {
+			return nil, err
+		}
+	}
+
+	attrs := blockchyp.SurchargeAttributeResponseData{
+		Success:                  true,
+		Type:                     "pricing",
+		CardType:                 card.Type,
+		Brand:                    card.Brand,
+		Bin:                      card.Bin,
+		CountryCode:              card.CountryCode,
+		IsCommercial:             card.Commercial,
+		IsRegulated:              card.Regulated,
+		CardToken:                req.Token,
+		State:                    strings.ToUpper(req.State),
+		SurchargePercent:         "0",
+		SurchargeAmount:          money.Amount(0).String(),
+		TotalWithSurchargeAmount: amount.String(),
+	}
+	if card.Commercial {
+		attrs.CommercialIndicator = "Y"
+	}
+
+	excluded := req.ExcludedMerchantStates
+	if excluded == nil {
+		excluded = DefaultExcludedStates
+	}
+
+	switch {
+	case !p.Enabled:
+		attrs.SurchargeExempt = true
+		attrs.ExemptionReason = "surcharging disabled"
+	case card.Type == "debit" || card.Type == "prepaid":
+		attrs.SurchargeExempt = true
+		attrs.ExemptionReason = card.Type
+		fee := debitFee
+		if debitRate != "" {
+			cost, err := amount.Percent(debitRate, money.RoundUp)
+			if err != nil {
+				return nil, err
+			}
+			fee += cost
+		}
+		attrs.DebitFeeAmount = fee.String()
+	case req.ExemptForeignCards && card.CountryCode != "" && !strings.EqualFold(card.CountryCode, "US"):
+		attrs.SurchargeExempt = true
+		attrs.ExemptionReason = "foreign card"
+	case slices.ContainsFunc(excluded, func(s string) bool { return strings.EqualFold(s, req.State) }):
+		attrs.SurchargeExempt = true
+		attrs.ExemptionReason = "state"
+	default:
+		s, err := surcharge(amount, rate, money.RoundUp)
+		if err != nil {
+			return nil, err
+		}
+		attrs.SurchargePercent = rate
+		attrs.SurchargeAmount = s.String()
+		attrs.TotalWithSurchargeAmount = (amount + s).String()
+	}
+
+	return &blockchyp.SurchargeReviewResponse{
+		Success:             true,
+		ResponseDescription: "Approved",
+		Data: blockchyp.SurchargeReviewResponseData{
+			Type:       "pricing",
+			Attributes: attrs,
+		},
+	}, nil
+}
+
+// Rounding maps a request's RoundingMode to a money.Rounding. Rounding up
+// is the default, as on the gateway.
+func Rounding(mode *blockchyp.RoundingMode) money.Rounding {
+	if mode == nil {
+		return money.RoundUp
+	}
+
+	switch *mode {
+	case blockchyp.RoundingModeNearest:
+		return money.RoundNearest
+	case blockchyp.RoundingModeDown:
+		return money.RoundDown
+	}
+
+	return money.RoundUp
+}
+
+func surcharge(amount money.Amount, rate string, mode money.Rounding) (money.Amount, error) {
+	if rate == "" {
+		return 0, ErrNoSurchargeRate
+	}
+
+	return amount.Percent(rate, mode)
+}
+
+// removeSurcharge finds the base price that, with a surcharge added, comes
+// to the given card price.
+func removeSurcharge(price money.Amount, rate string, mode money.Rounding) (money.Amount, error) {
+	if rate == "" {
+		return 0, ErrNoSurchargeRate
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return 0, fmt.Errorf("%w: rate %q", money.ErrInvalidAmount, rate)
+	}
+
+	// price / (1 + rate/100)
+	divisor := new(big.Rat).Add(big.NewRat(1, 1), r.Quo(r, big.NewRat(100, 1)))
+
+	// Rounding the base down keeps the discount, not the price, rounded
+	// the requested way.
+	switch mode {
+	case money.RoundUp:
+		mode = money.RoundDown
+	case money.RoundDown:
+		mode = money.RoundUp
+	}
+
+	return price.MulRat(new(big.Rat).Inv(divisor), mode), nil
+}
+
+// percent strips any percent sign from a policy rate.
+func percent(s string) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
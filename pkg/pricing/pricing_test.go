@@ -0,0 +1,261 @@
+package pricing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+type fakeSource struct {
+	policy  blockchyp.PricingPolicyResponse
+	enabled bool
+	calls   int
+}
+
+func (s *fakeSource) PricingPolicy(request blockchyp.PricingPolicyRequest) (*blockchyp.PricingPolicyResponse, error) {
+	s.calls++
+	res := s.policy
+	res.Success = true
+
+	return &res, nil
+}
+
+func (s *fakeSource) MerchantProfile(request blockchyp.MerchantProfileRequest) (*blockchyp.MerchantProfileResponse, error) {
+	return &blockchyp.MerchantProfileResponse{Success: true, CashDiscountEnabled: s.enabled}, nil
+}
+
+// fakeGateway answers with another calculator's results.
+type fakeGateway struct {
+	calc *Calculator
+}
+
+func (g *fakeGateway) CashDiscount(request blockchyp.CashDiscountRequest) (*blockchyp.CashDiscountResponse, error) {
+	return g.calc.CashDiscount(request)
+}
+
+func (g *fakeGateway) SurchargeReview(request blockchyp.SurchargeReviewRequest) (*blockchyp.SurchargeReviewResponse, error) {
+	res, err := g.calc.SurchargeReview(request, Card{Type: "credit", CountryCode: "US"})
+	if err != nil {
+		return nil, err
+	}
+	// Blank amounts, as the gateway sends them, compare as zero.
+	res.Data.Attributes.SurchargeAmount = ""
+
+	return res, nil
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func TestPrices(t *testing.T) {
+	assert := assert.New(t)
+
+	prices, err := NewWithPolicy(Policy{Enabled: true, Rate: "3.5"}).Prices(money.MustParse("9.99"))
+	require.NoError(t, err)
+	assert.Equal("10.34", prices.Card.String())
+	assert.Equal("9.99", prices.Cash.String())
+
+	prices, err = NewWithPolicy(Policy{Rate: "3.5"}).Prices(money.MustParse("9.99"))
+	require.NoError(t, err)
+	assert.Equal(prices.Cash, prices.Card)
+
+	_, err = NewWithPolicy(Policy{Enabled: true}).Prices(money.MustParse("9.99"))
+	assert.True(errors.Is(err, ErrNoSurchargeRate))
+}
+
+func TestCashDiscountModes(t *testing.T) {
+	assert := assert.New(t)
+
+	calc := NewWithPolicy(Policy{Enabled: true, Rate: "3.5"})
+
+	res, err := calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", Surcharge: true})
+	require.NoError(t, err)
+	assert.Equal("10.35", res.Amount)
+	assert.Equal("0.35", res.Surcharge)
+	assert.Empty(res.CashDiscount)
+
+	res, err = calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", Surcharge: true, CashDiscount: true})
+	require.NoError(t, err)
+	assert.Equal("10.00", res.Amount)
+	assert.Equal("0.35", res.Surcharge)
+	assert.Equal("0.35", res.CashDiscount)
+
+	// 10.00 / 1.035 = 9.6618..., so rounding the discount up rounds the
+	// base price down.
+	res, err = calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", CashDiscount: true})
+	require.NoError(t, err)
+	assert.Equal("9.66", res.Amount)
+	assert.Equal("0.34", res.CashDiscount)
+
+	down := blockchyp.RoundingMode(blockchyp.RoundingModeDown)
+	res, err = calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", CashDiscount: true, RoundingMode: &down})
+	require.NoError(t, err)
+	assert.Equal("9.67", res.Amount)
+	assert.Equal("0.33", res.CashDiscount)
+
+	res, err = NewWithPolicy(Policy{Rate: "3.5"}).CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", Surcharge: true})
+	require.NoError(t, err)
+	assert.Equal("10.00", res.Amount)
+	assert.Empty(res.Surcharge)
+}
+
+func TestCashDiscountRequiresCents(t *testing.T) {
+	calc := NewWithPolicy(Policy{Enabled: true, Rate: "3.5"})
+
+	_, err := calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "1000", CurrencyCode: "JPY", Surcharge: true})
+	assert.True(t, errors.Is(err, currency.ErrUnsupportedScale))
+
+	res, err := calc.CashDiscount(blockchyp.CashDiscountRequest{Amount: "10.00", CurrencyCode: "CAD", Surcharge: true})
+	require.NoError(t, err)
+	assert.Equal(t, "10.35", res.Amount)
+}
+
+func TestRounding(t *testing.T) {
+	assert := assert.New(t)
+
+	nearest := blockchyp.RoundingMode(blockchyp.RoundingModeNearest)
+	down := blockchyp.RoundingMode(blockchyp.RoundingModeDown)
+	assert.Equal(money.RoundUp, Rounding(nil))
+	assert.Equal(money.RoundNearest, Rounding(&nearest))
+	assert.Equal(money.RoundDown, Rounding(&down))
+}
+
+func TestSurchargeReview(t *testing.T) {
+	assert := assert.New(t)
+
+	calc := NewWithPolicy(Policy{Enabled: true, Rate: "3", DebitRate: "0.5", DebitFee: money.MustParse("0.10")})
+	req := blockchyp.SurchargeReviewRequest{Amount: str("100.00"), State: "tx"}
+
+	res, err := calc.SurchargeReview(req, Card{Type: "credit", CountryCode: "US", Commercial: true})
+	require.NoError(t, err)
+	attrs := res.Data.Attributes
+	assert.False(attrs.SurchargeExempt)
+	assert.Equal("3", attrs.SurchargePercent)
+	assert.Equal("3.00", attrs.SurchargeAmount)
+	assert.Equal("103.00", attrs.TotalWithSurchargeAmount)
+	assert.Equal("TX", attrs.State)
+	assert.Equal("Y", attrs.CommercialIndicator)
+
+	res, err = calc.SurchargeReview(req, Card{Type: "debit"})
+	require.NoError(t, err)
+	attrs = res.Data.Attributes
+	assert.True(attrs.SurchargeExempt)
+	assert.Equal("debit", attrs.ExemptionReason)
+	assert.Equal("0.60", attrs.DebitFeeAmount)
+	assert.Equal("100.00", attrs.TotalWithSurchargeAmount)
+
+	foreign := req
+	foreign.ExemptForeignCards = true
+	res, err = calc.SurchargeReview(foreign, Card{Type: "credit", CountryCode: "CA"})
+	require.NoError(t, err)
+	assert.Equal("foreign card", res.Data.Attributes.ExemptionReason)
+
+	excluded := req
+	excluded.State = "ma"
+	res, err = calc.SurchargeReview(excluded, Card{Type: "credit"})
+	require.NoError(t, err)
+	assert.Equal("state", res.Data.Attributes.ExemptionReason)
+
+	excluded.ExcludedMerchantStates = []string{}
+	excluded.SurchargeRate = str("2")
+	res, err = calc.SurchargeReview(excluded, Card{Type: "credit"})
+	require.NoError(t, err)
+	assert.False(res.Data.Attributes.SurchargeExempt)
+	assert.Equal("2.00", res.Data.Attributes.SurchargeAmount)
+
+	res, err = NewWithPolicy(Policy{Rate: "3"}).SurchargeReview(req, Card{Type: "credit"})
+	require.NoError(t, err)
+	assert.Equal("surcharging disabled", res.Data.Attributes.ExemptionReason)
+}
+
+func TestPolicyFetchedAndCached(t *testing.T) {
+	assert := assert.New(t)
+
+	source := &fakeSource{
+		enabled: true,
+		policy: blockchyp.PricingPolicyResponse{
+			StandardFlatRate:    blockchyp.PricePoint{Current: "3.5%"},
+			DebitFlatRate:       blockchyp.PricePoint{Current: "0.75"},
+			DebitTransactionFee: blockchyp.PricePoint{Current: "0.15"},
+		},
+	}
+	calc := New(source, Options{})
+
+	p, err := calc.Policy()
+	require.NoError(t, err)
+	assert.Equal(Policy{Enabled: true, Rate: "3.5", DebitRate: "0.75", DebitFee: money.MustParse("0.15")}, p)
+
+	_, err = calc.Prices(money.MustParse("1.00"))
+	require.NoError(t, err)
+	assert.Equal(1, source.calls)
+
+	calc.Refresh()
+	_, err = calc.Policy()
+	require.NoError(t, err)
+	assert.Equal(2, source.calls)
+}
+
+func TestPolicyInterchange(t *testing.T) {
+	assert := assert.New(t)
+
+	source := &fakeSource{
+		enabled: true,
+		policy: blockchyp.PricingPolicyResponse{
+			PolicyType:                "interchange",
+			StandardFlatRate:          blockchyp.PricePoint{Current: "3.5"},
+			StandardInterchangeMarkup: blockchyp.PricePoint{Current: "0.4"},
+			DebitInterchangeMarkup:    blockchyp.PricePoint{Current: "0.2"},
+			DebitTransactionFee:       blockchyp.PricePoint{Current: "0.10"},
+		},
+	}
+
+	p, err := New(source, Options{}).Policy()
+	require.NoError(t, err)
+	assert.Equal("0.4", p.Rate)
+	assert.Equal("0.2", p.DebitRate)
+
+	p, err = New(source, Options{SurchargeRate: "2.9"}).Policy()
+	require.NoError(t, err)
+	assert.Equal("2.9", p.Rate)
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	calc := NewWithPolicy(Policy{Enabled: true, Rate: "3.5"})
+
+	mismatches, err := calc.Check(&fakeGateway{calc: NewWithPolicy(Policy{Enabled: true, Rate: "3.5"})}, []string{"9.99", "10.00"})
+	require.NoError(t, err)
+	assert.Empty(mismatches)
+
+	mismatches, err = calc.Check(&fakeGateway{calc: NewWithPolicy(Policy{Enabled: true, Rate: "4"})}, []string{"10.00"})
+	require.NoError(t, err)
+	require.NotEmpty(t, mismatches)
+	assert.Equal("10.00", mismatches[0].Request.Amount)
+	assert.Contains(mismatches[0].String(), "gateway 10.40")
+}
+
+func TestCheckSurchargeReview(t *testing.T) {
+	assert := assert.New(t)
+
+	calc := NewWithPolicy(Policy{Enabled: true, Rate: "3"})
+	req := blockchyp.SurchargeReviewRequest{Amount: str("0.00"), State: "TX"}
+
+	_, _, match, err := calc.CheckSurchargeReview(&fakeGateway{calc: calc}, req)
+	require.NoError(t, err)
+	assert.True(match)
+
+	req.Amount = str("50.00")
+	local, remote, match, err := calc.CheckSurchargeReview(&fakeGateway{calc: NewWithPolicy(Policy{Enabled: true, Rate: "4"})}, req)
+	require.NoError(t, err)
+	assert.False(match)
+	assert.Equal("51.50", local.Data.Attributes.TotalWithSurchargeAmount)
+	assert.Equal("52.00", remote.Data.Attributes.TotalWithSurchargeAmount)
+}
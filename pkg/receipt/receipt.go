@@ -0,0 +1,356 @@
+// Package receipt renders card-brand compliant receipts as plain text, HTML
+// and ESC/POS printer commands.
+package receipt
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+)
+
+// Variant selects the layout of a receipt.
+type Variant string
+
+// Receipt variants.
+const (
+	Approved Variant = "approved"
+	Declined Variant = "declined"
+	Refund   Variant = "refund"
+	Void     Variant = "void"
+)
+
+// Copy labels a receipt as the customer's or the merchant's.
+type Copy string
+
+// Receipt copies.
+const (
+	CustomerCopy Copy = "CUSTOMER COPY"
+	MerchantCopy Copy = "MERCHANT COPY"
+)
+
+// Merchant is the business shown at the top of a receipt.
+type Merchant struct {
+	Name       string
+	Address    []string
+	Phone      string
+	MerchantID string
+}
+
+// Item is a line item.
+type Item struct {
+	Description string
+	Quantity    float64
+	Price       string
+	Extended    string
+	Discounts   []Discount
+}
+
+// Discount is a discount applied to a line item.
+type Discount struct {
+	Description string
+	Amount      string
+}
+
+// EMV holds the chip card fields card brands require on receipts.
+type EMV struct {
+	ApplicationLabel string
+	AID              string
+	ARQC             string
+	TC               string
+	TVR              string
+	TSI              string
+	IAD              string
+	ARC              string
+	CVM              string
+	TerminalID       string
+	MerchantKey      string
+	PINVerified      bool
+}
+
+// Present reports whether any EMV data is available.
+func (e EMV) Present() bool {
+	return e.AID != "" || e.ARQC != "" || e.TC != "" || e.TVR != "" || e.TSI != ""
+}
+
+// Receipt is the data rendered onto a receipt.
+type Receipt struct {
+	Variant  Variant
+	Copy     Copy
+	Merchant Merchant
+	Time     time.Time
+
+	TransactionType string
+	TransactionID   string
+	TransactionRef  string
+	AuthCode        string
+	BatchSequence   int
+	Response        string
+	Test            bool
+
+	Items    []Item
+	Subtotal string
+	Tax      string
+	Tip      string
+
+	Surcharge    string
+	CashDiscount string
+	CashBack     string
+
+	CurrencyCode     string
+	Locale           string
+	RequestedAmount  string
+	Total            string
+	RemainingBalance string
+	PartialAuth      bool
+
+	PaymentType string
+	MaskedPAN   string
+	EntryMethod string
+	CardHolder  string
+	Fallback    bool
+
+	EMV EMV
+
+	// SignatureLine asks for a line for the cardholder to sign.
+	SignatureLine bool
+
+	// Signature is a captured signature image and SignatureType its MIME
+	// type. HTML receipts show it in place of the signature line.
+	Signature     []byte
+	SignatureType string
+
+	// Header and Footer are branding lines printed above the merchant
+	// details and at the bottom of the receipt.
+	Header []string
+	Footer []string
+
+	// ascii is set while rendering for printers, so amounts use currency
+	// codes rather than symbols the printer can't print.
+	ascii bool
+}
+
+// Options supplies the context a transaction response doesn't carry.
+type Options struct {
+	Copy     Copy
+	Merchant *blockchyp.MerchantProfileResponse
+
+	// Display is the line item display shown during the transaction.
+	Display *blockchyp.TransactionDisplayTransaction
+
+	// Locale is a language tag, such as fr-CA, for how amounts are written.
+	// The default is en-US.
+	Locale string
+
+	Header []string
+	Footer []string
+}
+
+// New builds a receipt from a transaction response.
+func New(res blockchyp.AuthorizationResponse, opts Options) *Receipt {
+	s := res.ReceiptSuggestions
+
+	r := &Receipt{
+		Variant:          variantOf(res),
+		Copy:             opts.Copy,
+		TransactionType:  strings.ToUpper(firstNonEmpty(res.TransactionType, s.TransactionType)),
+		TransactionID:    res.TransactionID,
+		TransactionRef:   res.TransactionRef,
+		AuthCode:         res.AuthCode,
+		BatchSequence:    s.BatchSequence,
+		Response:         res.ResponseDescription,
+		Test:             res.Test,
+		Tip:              nonZero(res.TipAmount),
+		Tax:              nonZero(res.TaxAmount),
+		Surcharge:        nonZero(s.Surcharge),
+		CashDiscount:     nonZero(s.CashDiscount),
+		CashBack:         nonZero(firstNonEmpty(s.CashBackAmount, res.AuthorizedCashBackAmount)),
+		CurrencyCode:     res.CurrencyCode,
+		Locale:           opts.Locale,
+		RequestedAmount:  res.RequestedAmount,
+		Total:            firstNonEmpty(res.AuthorizedAmount, s.AuthorizedAmount, res.RequestedAmount),
+		RemainingBalance: nonZero(res.RemainingBalance),
+		PartialAuth:      res.PartialAuth,
+		PaymentType:      res.PaymentType,
+		MaskedPAN:        firstNonEmpty(s.MaskedPAN, res.MaskedPAN),
+		EntryMethod:      firstNonEmpty(s.EntryMethod, res.EntryMethod),
+		CardHolder:       res.CardHolder,
+		Fallback:         s.Fallback,
+		Header:           opts.Header,
+		Footer:           opts.Footer,
+		EMV: EMV{
+			ApplicationLabel: s.ApplicationLabel,
+			AID:              s.AID,
+			ARQC:             s.ARQC,
+			TC:               s.TC,
+			TVR:              s.TVR,
+			TSI:              s.TSI,
+			IAD:              s.IAD,
+			ARC:              s.ARC,
+			CVM:              string(s.CVMUsed),
+			TerminalID:       s.TerminalID,
+			MerchantKey:      s.MerchantKey,
+			PINVerified:      s.PINVerified,
+		},
+		Merchant: Merchant{
+			Name:       s.MerchantName,
+			MerchantID: s.MerchantID,
+		},
+	}
+
+	// A declined receipt shows what the customer tried to pay.
+	if r.Variant == Declined && res.RequestedAmount != "" {
+		r.Total = res.RequestedAmount
+	}
+
+	if t, err := time.Parse(time.RFC3339, res.Timestamp); err == nil {
+		r.Time = t
+	} else {
+		r.Time = time.Now()
+	}
+
+	if m := opts.Merchant; m != nil {
+		r.Merchant.Name = firstNonEmpty(m.DBAName, m.CompanyName, r.Merchant.Name)
+		r.Merchant.MerchantID = firstNonEmpty(r.Merchant.MerchantID, m.MerchantID)
+		r.Merchant.Phone = m.ContactNumber
+		r.Merchant.Address = addressLines(m.BillingAddress)
+	}
+
+	if d := opts.Display; d != nil {
+		for _, item := range d.Items {
+			if item == nil {
+				continue
+			}
+			ri := Item{
+				Description: item.Description,
+				Quantity:    item.Quantity,
+				Price:       item.Price,
+				Extended:    item.Extended,
+			}
+			for _, discount := range item.Discounts {
+				if discount != nil {
+					ri.Discounts = append(ri.Discounts, Discount{
+						Description: discount.Description,
+						Amount:      discount.Amount,
+					})
+				}
+			}
+			r.Items = append(r.Items, ri)
+		}
+		r.Subtotal = d.Subtotal
+		r.Tax = firstNonEmpty(r.Tax, nonZero(d.Tax))
+	}
+
+	// Card brands require a signature line when the terminal asks for one,
+	// and merchants keep a signed copy of refunds.
+	if r.Variant == Approved || r.Variant == Refund {
+		r.SignatureLine = s.RequestSignature || s.CVMUsed == blockchyp.CVMTypeSignature
+	}
+
+	if res.SigFile != "" {
+		if content, err := hex.DecodeString(res.SigFile); err == nil {
+			r.Signature = content
+			r.SignatureType = http.DetectContentType(content)
+		}
+	}
+
+	return r
+}
+
+// Title is the heading for the receipt's variant.
+func (r *Receipt) Title() string {
+	switch r.Variant {
+	case Declined:
+		return "DECLINED"
+	case Refund:
+		return "REFUND"
+	case Void:
+		return "VOID"
+	}
+
+	return "APPROVED"
+}
+
+// Agreement is the cardholder agreement printed over the signature line.
+func (r *Receipt) Agreement() string {
+	if r.Variant == Refund {
+		return "Merchant signature"
+	}
+
+	return "I agree to pay the above total amount according to the card issuer agreement."
+}
+
+// Amount formats an amount in the receipt's currency and locale.
+func (r *Receipt) Amount(amount string) string {
+	if amount == "" {
+		return ""
+	}
+
+	s := currency.Format(amount, r.CurrencyCode, r.Locale)
+	if r.ascii && strings.ContainsFunc(s, func(c rune) bool { return c > 0x7e }) {
+		return currency.FormatCode(amount, r.CurrencyCode, r.Locale)
+	}
+
+	return s
+}
+
+func variantOf(res blockchyp.AuthorizationResponse) Variant {
+	switch {
+	case !res.Approved:
+		return Declined
+	case strings.EqualFold(res.TransactionType, "refund"):
+		return Refund
+	case strings.EqualFold(res.TransactionType, "void"), strings.EqualFold(res.TransactionType, "reverse"):
+		return Void
+	}
+
+	return Approved
+}
+
+func addressLines(a blockchyp.Address) []string {
+	lines := make([]string, 0, 3)
+	if a.Address1 != "" {
+		lines = append(lines, a.Address1)
+	}
+	if a.Address2 != "" {
+		lines = append(lines, a.Address2)
+	}
+
+	city := a.City
+	if a.StateOrProvince != "" {
+		if city != "" {
+			city += ", "
+		}
+		city += a.StateOrProvince
+	}
+	if a.PostalCode != "" {
+		city = strings.TrimSpace(city + " " + a.PostalCode)
+	}
+	if city != "" {
+		lines = append(lines, city)
+	}
+
+	return lines
+}
+
+// nonZero drops amounts that are blank or zero so they aren't printed.
+func nonZero(amount string) string {
+	if strings.Trim(amount, "-0.") == "" {
+		return ""
+	}
+
+	return amount
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
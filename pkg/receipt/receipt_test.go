@@ -0,0 +1,162 @@
+package receipt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+func approvedChip() blockchyp.AuthorizationResponse {
+	return blockchyp.AuthorizationResponse{
+		Success:          true,
+		Approved:         true,
+		TransactionID:    "TX1",
+		TransactionRef:   "REF1",
+		TransactionType:  "charge",
+		AuthCode:         "123456",
+		AuthorizedAmount: "10.80",
+		TaxAmount:        "0.80",
+		PaymentType:      "VISA",
+		MaskedPAN:        "************1111",
+		EntryMethod:      "CHIP",
+		Timestamp:        "2024-03-01T15:04:05Z",
+		ReceiptSuggestions: blockchyp.ReceiptSuggestions{
+			AID:              "A0000000031010",
+			ApplicationLabel: "VISA CREDIT",
+			TVR:              "0000000000",
+			MerchantName:     "Pied Piper",
+			RequestSignature: true,
+		},
+	}
+}
+
+func TestNewApproved(t *testing.T) {
+	assert := assert.New(t)
+
+	r := New(approvedChip(), Options{
+		Copy: CustomerCopy,
+		Merchant: &blockchyp.MerchantProfileResponse{
+			DBAName:        "Pied Piper Coffee",
+			BillingAddress: blockchyp.Address{Address1: "5230 Newell Rd", City: "Palo Alto", StateOrProvince: "CA", PostalCode: "94303"},
+		},
+		Display: &blockchyp.TransactionDisplayTransaction{
+			Subtotal: "10.00",
+			Tax:      "0.80",
+			Items: []*blockchyp.TransactionDisplayItem{
+				{Description: "Latte", Quantity: 2, Price: "5.50", Extended: "11.00", Discounts: []*blockchyp.TransactionDisplayDiscount{{Description: "Member", Amount: "1.00"}}},
+				nil,
+			},
+		},
+	})
+
+	assert.Equal(Approved, r.Variant)
+	assert.Equal("CHARGE", r.TransactionType)
+	assert.Equal("Pied Piper Coffee", r.Merchant.Name)
+	assert.Equal([]string{"5230 Newell Rd", "Palo Alto, CA 94303"}, r.Merchant.Address)
+	assert.Len(r.Items, 1)
+	assert.True(r.SignatureLine)
+	assert.True(r.EMV.Present())
+
+	var buf bytes.Buffer
+	require.NoError(t, Renderer{}.WriteText(&buf, r))
+	text := buf.String()
+
+	assert.Contains(text, "APPROVED")
+	assert.Contains(text, columns("TOTAL", "$10.80", DefaultWidth))
+	assert.Contains(text, "  2 @ $5.50")
+	assert.Contains(text, "-$1.00")
+	assert.Contains(text, columns("AID", "A0000000031010", DefaultWidth))
+	assert.Contains(text, "X"+strings.Repeat("-", DefaultWidth-1))
+	assert.Contains(text, "CUSTOMER COPY")
+	for _, line := range strings.Split(text, "\n") {
+		assert.LessOrEqual(len([]rune(line)), DefaultWidth, line)
+	}
+}
+
+func TestNewDeclined(t *testing.T) {
+	assert := assert.New(t)
+
+	res := approvedChip()
+	res.Approved = false
+	res.AuthorizedAmount = "0.00"
+	res.RequestedAmount = "10.80"
+	res.ResponseDescription = "Insufficient Funds"
+
+	r := New(res, Options{})
+	assert.Equal(Declined, r.Variant)
+	assert.Equal("10.80", r.Total)
+	assert.False(r.SignatureLine)
+
+	var buf bytes.Buffer
+	require.NoError(t, Renderer{}.WriteText(&buf, r))
+	assert.Contains(buf.String(), "DECLINED")
+	assert.Contains(buf.String(), "Insufficient Funds")
+}
+
+func TestVariants(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(Refund, variantOf(blockchyp.AuthorizationResponse{Approved: true, TransactionType: "refund"}))
+	assert.Equal(Void, variantOf(blockchyp.AuthorizationResponse{Approved: true, TransactionType: "reverse"}))
+	assert.Equal("Merchant signature", (&Receipt{Variant: Refund}).Agreement())
+}
+
+func TestWriteESCPOS(t *testing.T) {
+	assert := assert.New(t)
+
+	res := approvedChip()
+	res.CurrencyCode = "EUR"
+	r := New(res, Options{Locale: "fr-FR"})
+
+	var buf bytes.Buffer
+	require.NoError(t, Renderer{}.WriteESCPOS(&buf, r))
+	out := buf.Bytes()
+
+	assert.True(bytes.HasPrefix(out, escInit))
+	assert.True(bytes.HasSuffix(out, escCut))
+	assert.True(bytes.Contains(out, escBoldOn))
+	assert.Contains(string(out), "EUR")
+	assert.NotContains(string(out), "€")
+	for _, b := range out {
+		assert.LessOrEqual(b, byte(0x7e))
+	}
+
+	// Rendering for a printer leaves the receipt itself unchanged.
+	assert.Contains(r.Amount("1.00"), "€")
+}
+
+func TestWriteHTML(t *testing.T) {
+	assert := assert.New(t)
+
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	res := approvedChip()
+	res.SigFile = hex.EncodeToString(png)
+	res.ReceiptSuggestions.MerchantName = "<script>"
+
+	r := New(res, Options{})
+	assert.Equal("image/png", r.SignatureType)
+
+	var buf bytes.Buffer
+	require.NoError(t, Renderer{}.WriteHTML(&buf, r))
+	assert.Contains(buf.String(), "&lt;script&gt;")
+	assert.Contains(buf.String(), `src="data:image/png;base64,`)
+}
+
+func TestCustomTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	rd := Renderer{Width: 10, TextTemplate: `{{ columns "A" "B" }}|{{ center "hi" }}|{{ wrap "one two three" }}`}
+	require.NoError(t, rd.WriteText(&buf, &Receipt{}))
+	assert.Equal(t, "A        B|    hi|one two\nthree", buf.String())
+
+	assert.Error(t, Renderer{TextTemplate: "{{ .Missing"}.WriteText(&buf, &Receipt{}))
+}
+
+func TestColumnsOverflow(t *testing.T) {
+	assert.Equal(t, "left side\n     right", columns("left side", "right", 10))
+}
@@ -0,0 +1,366 @@
+package receipt
+
+import (
+	"bytes"
+	"encoding/base64"
+	htmltemplate "html/template"
+	"io"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"unicode/utf8"
+)
+
+// DefaultWidth is the line width, in characters, of text and ESC/POS
+// receipts. It suits 80mm printers in their standard font.
+const DefaultWidth = 42
+
+// Renderer renders receipts. The zero value uses the built-in templates.
+//
+// Custom templates receive a *Receipt. Text templates can use the helpers
+// center, columns, rule, wrap, bold and qty; bold emphasizes text on ESC/POS
+// printers and is a no-op in plain text. HTML templates can use qty and
+// signature, which returns the captured signature as a data URL.
+type Renderer struct {
+	// Width is the text line width. Defaults to DefaultWidth.
+	Width int
+
+	// TextTemplate replaces the built-in plain text and ESC/POS layout.
+	TextTemplate string
+
+	// HTMLTemplate replaces the built-in HTML layout.
+	HTMLTemplate string
+}
+
+// WriteText renders a plain text receipt.
+func (rd Renderer) WriteText(w io.Writer, r *Receipt) error {
+	return rd.text(w, r, false)
+}
+
+// WriteHTML renders a standalone HTML receipt.
+func (rd Renderer) WriteHTML(w io.Writer, r *Receipt) error {
+	source := rd.HTMLTemplate
+	if source == "" {
+		source = defaultHTML
+	}
+
+	t, err := htmltemplate.New("receipt").Funcs(htmltemplate.FuncMap{
+		"qty": qty,
+		"signature": func(r *Receipt) htmltemplate.URL {
+			if len(r.Signature) == 0 {
+				return ""
+			}
+			return htmltemplate.URL("data:" + r.SignatureType + ";base64," + base64.StdEncoding.EncodeToString(r.Signature))
+		},
+	}).Parse(source)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, r)
+}
+
+// ESC/POS control sequences.
+var (
+	escInit      = []byte{0x1b, '@'}
+	escBoldOn    = []byte{0x1b, 'E', 1}
+	escBoldOff   = []byte{0x1b, 'E', 0}
+	escFeedLines = []byte{0x1b, 'd', 4}
+	escCut       = []byte{0x1d, 'V', 66, 0}
+)
+
+// WriteESCPOS renders the text layout as an ESC/POS byte stream, ending with
+// a paper cut. Characters outside ASCII are replaced, since printer code
+// pages vary.
+func (rd Renderer) WriteESCPOS(w io.Writer, r *Receipt) error {
+	printed := *r
+	printed.ascii = true
+
+	var buf bytes.Buffer
+	if err := rd.text(&buf, &printed, true); err != nil {
+		return err
+	}
+
+	out := make([]byte, 0, buf.Len()+32)
+	out = append(out, escInit...)
+	for _, c := range buf.String() {
+		switch {
+		case c == '\n':
+			out = append(out, '\r', '\n')
+		case c == boldOn:
+			out = append(out, escBoldOn...)
+		case c == boldOff:
+			out = append(out, escBoldOff...)
+		case c < 0x20 || c > 0x7e:
+			out = append(out, '?')
+		default:
+			out = append(out, byte(c))
+		}
+	}
+	out = append(out, escFeedLines...)
+	out = append(out, escCut...)
+
+	_, err := w.Write(out)
+
+	return err
+}
+
+// boldOn and boldOff mark emphasis in text output headed for an ESC/POS
+// printer. They're private use code points, so they can't collide with
+// receipt content.
+const (
+	boldOn  = '\uE000'
+	boldOff = '\uE001'
+)
+
+func (rd Renderer) text(w io.Writer, r *Receipt, escpos bool) error {
+	width := rd.Width
+	if width <= 0 {
+		width = DefaultWidth
+	}
+
+	source := rd.TextTemplate
+	if source == "" {
+		source = defaultText
+	}
+
+	t, err := texttemplate.New("receipt").Funcs(texttemplate.FuncMap{
+		"center": func(s string) string {
+			return center(s, width)
+		},
+		"columns": func(left, right string) string {
+			return columns(left, right, width)
+		},
+		"rule": func() string {
+			return strings.Repeat("-", width)
+		},
+		"wrap": func(s string) string {
+			return wrap(s, width)
+		},
+		"bold": func(s string) string {
+			if !escpos {
+				return s
+			}
+			return string(boldOn) + s + string(boldOff)
+		},
+		"qty": qty,
+	}).Parse(source)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, r)
+}
+
+func center(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
+	}
+
+	return strings.Repeat(" ", (width-n)/2) + s
+}
+
+// columns left aligns left and right aligns right on one line, wrapping
+// onto a second line if they don't fit.
+func columns(left, right string, width int) string {
+	gap := width - utf8.RuneCountInString(left) - utf8.RuneCountInString(right)
+	if gap < 1 {
+		return left + "\n" + strings.Repeat(" ", max(0, width-utf8.RuneCountInString(right))) + right
+	}
+
+	return left + strings.Repeat(" ", gap) + right
+}
+
+func wrap(s string, width int) string {
+	lines := make([]string, 0)
+	line := ""
+	for _, word := range strings.Fields(s) {
+		switch {
+		case line == "":
+			line = word
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > width:
+			lines = append(lines, line)
+			line = word
+		default:
+			line += " " + word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func qty(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+const defaultText = `{{ range .Header }}{{ center . }}
+{{ end -}}
+{{ with .Merchant }}{{ if .Name }}{{ bold (center .Name) }}
+{{ end }}{{ range .Address }}{{ center . }}
+{{ end }}{{ if .Phone }}{{ center .Phone }}
+{{ end }}{{ end }}
+{{ columns (.Time.Format "01/02/2006") (.Time.Format "3:04 PM") }}
+{{ if .Merchant.MerchantID }}{{ columns "MID" .Merchant.MerchantID }}
+{{ end }}{{ if .EMV.TerminalID }}{{ columns "TID" .EMV.TerminalID }}
+{{ end }}{{ if .TransactionRef }}{{ columns "REF" .TransactionRef }}
+{{ end }}{{ if .TransactionID }}{{ columns "TRANS ID" .TransactionID }}
+{{ end }}
+{{ bold (center .Title) }}
+{{ if .Test }}{{ center "*** TEST TRANSACTION ***" }}
+{{ end }}{{ if .TransactionType }}{{ center .TransactionType }}
+{{ end }}
+{{- if .Items }}
+{{ rule }}
+{{ range .Items }}{{ columns .Description ($.Amount .Extended) }}
+{{ if ne .Quantity 1.0 }}  {{ qty .Quantity }} @ {{ $.Amount .Price }}
+{{ end }}{{ range .Discounts }}{{ columns (printf "  %s" .Description) ($.Amount (printf "-%s" .Amount)) }}
+{{ end }}{{ end }}{{ rule }}
+{{ end }}
+{{- if .Subtotal }}{{ columns "SUBTOTAL" (.Amount .Subtotal) }}
+{{ end }}{{ if .Tax }}{{ columns "TAX" (.Amount .Tax) }}
+{{ end }}{{ if .Surcharge }}{{ columns "SURCHARGE" (.Amount .Surcharge) }}
+{{ end }}{{ if .CashDiscount }}{{ columns "CASH DISCOUNT" (.Amount .CashDiscount) }}
+{{ end }}{{ if .Tip }}{{ columns "TIP" (.Amount .Tip) }}
+{{ end }}{{ if .CashBack }}{{ columns "CASH BACK" (.Amount .CashBack) }}
+{{ end }}{{ bold (columns "TOTAL" (.Amount .Total)) }}
+{{ if .PartialAuth }}{{ columns "REQUESTED" (.Amount .RequestedAmount) }}
+{{ columns "BALANCE DUE" (.Amount .RemainingBalance) }}
+{{ else if .RemainingBalance }}{{ columns "CARD BALANCE" (.Amount .RemainingBalance) }}
+{{ end }}
+{{ if .MaskedPAN }}{{ columns .PaymentType .MaskedPAN }}
+{{ end }}{{ if .EntryMethod }}{{ columns "ENTRY" .EntryMethod }}{{ if .Fallback }} (FALLBACK){{ end }}
+{{ end }}{{ if .CardHolder }}{{ columns "NAME" .CardHolder }}
+{{ end }}{{ if .AuthCode }}{{ columns "AUTH CODE" .AuthCode }}
+{{ end }}{{ if .BatchSequence }}{{ columns "SEQ" (printf "%d" .BatchSequence) }}
+{{ end }}
+{{- with .EMV }}{{ if .Present }}
+{{ if .ApplicationLabel }}{{ columns "APP" .ApplicationLabel }}
+{{ end }}{{ if .AID }}{{ columns "AID" .AID }}
+{{ end }}{{ if .ARQC }}{{ columns "ARQC" .ARQC }}
+{{ end }}{{ if .TC }}{{ columns "TC" .TC }}
+{{ end }}{{ if .TVR }}{{ columns "TVR" .TVR }}
+{{ end }}{{ if .TSI }}{{ columns "TSI" .TSI }}
+{{ end }}{{ if .IAD }}{{ columns "IAD" .IAD }}
+{{ end }}{{ if .ARC }}{{ columns "ARC" .ARC }}
+{{ end }}{{ if .CVM }}{{ columns "CVM" .CVM }}
+{{ end }}{{ if .PINVerified }}{{ center "PIN VERIFIED" }}
+{{ end }}{{ if .MerchantKey }}{{ columns "MERCHANT KEY" .MerchantKey }}
+{{ end }}{{ end }}{{ end }}
+{{- if eq .Variant "declined" }}
+{{ bold (center .Response) }}
+{{ end }}
+{{- if .SignatureLine }}
+
+
+X{{ slice rule 1 }}
+{{ wrap .Agreement }}
+{{ end }}
+{{- if .Copy }}
+{{ center (printf "%s" .Copy) }}
+{{ end }}
+{{- range .Footer }}
+{{ center . }}{{ end }}
+`
+
+const defaultHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Merchant.Name }} Receipt</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; background: #f4f4f4; margin: 0; padding: 2em 0; color: #222; }
+.receipt { background: #fff; max-width: 26em; margin: 0 auto; padding: 1.5em 2em; box-shadow: 0 1px 4px rgba(0,0,0,0.15); }
+.center { text-align: center; }
+.merchant { font-size: 1.3em; font-weight: bold; }
+.muted { color: #666; font-size: 0.9em; }
+.title { font-size: 1.2em; font-weight: bold; letter-spacing: 0.1em; margin: 1em 0 0.2em; }
+.declined { color: #b00020; }
+table { width: 100%; border-collapse: collapse; margin: 0.8em 0; }
+td { padding: 0.15em 0; vertical-align: top; }
+td.amt { text-align: right; white-space: nowrap; }
+tr.total td { font-weight: bold; border-top: 1px solid #222; padding-top: 0.4em; }
+tr.discount td { color: #666; padding-left: 1em; }
+.items { border-top: 1px dashed #999; border-bottom: 1px dashed #999; }
+.emv td { font-family: monospace; font-size: 0.85em; }
+.signature { margin-top: 2.5em; }
+.signature .line { border-bottom: 1px solid #222; height: 3em; }
+.signature img { max-width: 100%; }
+</style>
+</head>
+<body>
+<div class="receipt">
+{{ range .Header }}<div class="center">{{ . }}</div>
+{{ end }}
+{{- with .Merchant }}
+<div class="center merchant">{{ .Name }}</div>
+{{ range .Address }}<div class="center muted">{{ . }}</div>
+{{ end }}{{ if .Phone }}<div class="center muted">{{ .Phone }}</div>{{ end }}
+{{- end }}
+<div class="center title{{ if eq .Variant "declined" }} declined{{ end }}">{{ .Title }}</div>
+{{ if .Test }}<div class="center muted">TEST TRANSACTION</div>{{ end }}
+<div class="center muted">{{ .TransactionType }} &middot; {{ .Time.Format "Jan 2, 2006 3:04 PM" }}</div>
+{{ if eq .Variant "declined" }}<div class="center declined">{{ .Response }}</div>{{ end }}
+{{- if .Items }}
+<table class="items">
+{{- range .Items }}
+<tr><td>{{ .Description }}{{ if ne .Quantity 1.0 }} <span class="muted">{{ qty .Quantity }} @ {{ $.Amount .Price }}</span>{{ end }}</td><td class="amt">{{ $.Amount .Extended }}</td></tr>
+{{- range .Discounts }}
+<tr class="discount"><td>{{ .Description }}</td><td class="amt">-{{ $.Amount .Amount }}</td></tr>
+{{- end }}
+{{- end }}
+</table>
+{{- end }}
+<table>
+{{ if .Subtotal }}<tr><td>Subtotal</td><td class="amt">{{ .Amount .Subtotal }}</td></tr>{{ end }}
+{{ if .Tax }}<tr><td>Tax</td><td class="amt">{{ .Amount .Tax }}</td></tr>{{ end }}
+{{ if .Surcharge }}<tr><td>Surcharge</td><td class="amt">{{ .Amount .Surcharge }}</td></tr>{{ end }}
+{{ if .CashDiscount }}<tr><td>Cash Discount</td><td class="amt">{{ .Amount .CashDiscount }}</td></tr>{{ end }}
+{{ if .Tip }}<tr><td>Tip</td><td class="amt">{{ .Amount .Tip }}</td></tr>{{ end }}
+{{ if .CashBack }}<tr><td>Cash Back</td><td class="amt">{{ .Amount .CashBack }}</td></tr>{{ end }}
+<tr class="total"><td>Total</td><td class="amt">{{ .Amount .Total }}</td></tr>
+{{ if .PartialAuth }}<tr><td>Requested</td><td class="amt">{{ .Amount .RequestedAmount }}</td></tr>
+<tr><td>Balance Due</td><td class="amt">{{ .Amount .RemainingBalance }}</td></tr>
+{{ else if .RemainingBalance }}<tr><td>Card Balance</td><td class="amt">{{ .Amount .RemainingBalance }}</td></tr>{{ end }}
+</table>
+<table>
+{{ if .MaskedPAN }}<tr><td>{{ .PaymentType }}</td><td class="amt">{{ .MaskedPAN }}</td></tr>{{ end }}
+{{ if .EntryMethod }}<tr><td>Entry</td><td class="amt">{{ .EntryMethod }}{{ if .Fallback }} (fallback){{ end }}</td></tr>{{ end }}
+{{ if .CardHolder }}<tr><td>Name</td><td class="amt">{{ .CardHolder }}</td></tr>{{ end }}
+{{ if .AuthCode }}<tr><td>Auth Code</td><td class="amt">{{ .AuthCode }}</td></tr>{{ end }}
+{{ if .TransactionRef }}<tr><td>Reference</td><td class="amt">{{ .TransactionRef }}</td></tr>{{ end }}
+{{ if .TransactionID }}<tr><td>Transaction</td><td class="amt">{{ .TransactionID }}</td></tr>{{ end }}
+{{ if .Merchant.MerchantID }}<tr><td>MID</td><td class="amt">{{ .Merchant.MerchantID }}</td></tr>{{ end }}
+</table>
+{{- with .EMV }}{{ if .Present }}
+<table class="emv">
+{{ if .ApplicationLabel }}<tr><td>APP</td><td class="amt">{{ .ApplicationLabel }}</td></tr>{{ end }}
+{{ if .AID }}<tr><td>AID</td><td class="amt">{{ .AID }}</td></tr>{{ end }}
+{{ if .ARQC }}<tr><td>ARQC</td><td class="amt">{{ .ARQC }}</td></tr>{{ end }}
+{{ if .TC }}<tr><td>TC</td><td class="amt">{{ .TC }}</td></tr>{{ end }}
+{{ if .TVR }}<tr><td>TVR</td><td class="amt">{{ .TVR }}</td></tr>{{ end }}
+{{ if .TSI }}<tr><td>TSI</td><td class="amt">{{ .TSI }}</td></tr>{{ end }}
+{{ if .IAD }}<tr><td>IAD</td><td class="amt">{{ .IAD }}</td></tr>{{ end }}
+{{ if .ARC }}<tr><td>ARC</td><td class="amt">{{ .ARC }}</td></tr>{{ end }}
+{{ if .CVM }}<tr><td>CVM</td><td class="amt">{{ .CVM }}</td></tr>{{ end }}
+{{ if .TerminalID }}<tr><td>TID</td><td class="amt">{{ .TerminalID }}</td></tr>{{ end }}
+{{ if .MerchantKey }}<tr><td>Merchant Key</td><td class="amt">{{ .MerchantKey }}</td></tr>{{ end }}
+</table>
+{{- end }}{{ end }}
+{{- if .SignatureLine }}
+<div class="signature">
+{{ if .Signature }}<img src="{{ signature . }}" alt="Signature">{{ else }}<div class="line"></div>{{ end }}
+<div class="muted">{{ .Agreement }}</div>
+</div>
+{{- end }}
+{{ if .Copy }}<div class="center muted">{{ .Copy }}</div>{{ end }}
+{{ range .Footer }}<div class="center">{{ . }}</div>
+{{ end -}}
+</div>
+</body>
+</html>
+`
@@ -0,0 +1,514 @@
+// Package reconcile matches a merchant's own order records against the
+// transactions and batches reported by the gateway.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"sort"
+	"strings"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// IssueKind classifies a reconciliation problem.
+type IssueKind string
+
+// Reconciliation issue kinds.
+const (
+	// IssueMissing means an order has no approved gateway transaction.
+	IssueMissing IssueKind = "missing"
+
+	// IssueDuplicate means an order was charged more than once, or appears
+	// more than once in the order records.
+	IssueDuplicate IssueKind = "duplicate"
+
+	// IssueAmountMismatch means the net settled amount differs from the
+	// order amount.
+	IssueAmountMismatch IssueKind = "amount_mismatch"
+
+	// IssueUnsettled means the transaction exists but is not yet in a closed
+	// batch, or was authorized and never captured.
+	IssueUnsettled IssueKind = "unsettled"
+
+	// IssueOrphaned means an approved gateway transaction has no matching
+	// order.
+	IssueOrphaned IssueKind = "orphaned"
+)
+
+// Order is a single order record from the merchant's system.
+type Order struct {
+	OrderRef       string `json:"orderRef"`
+	TransactionRef string `json:"transactionRef,omitempty"`
+
+	// TransactionID is optional and takes precedence over TransactionRef
+	// when both are known.
+	TransactionID string `json:"transactionId,omitempty"`
+
+	Amount       string `json:"amount"`
+	CurrencyCode string `json:"currencyCode,omitempty"`
+}
+
+// Gateway is the subset of the BlockChyp API used for reconciliation.
+// *blockchyp.Client satisfies it.
+type Gateway interface {
+	AllBatches(ctx context.Context, request blockchyp.BatchHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.BatchSummary, error]
+	BatchDetails(request blockchyp.BatchDetailsRequest) (*blockchyp.BatchDetailsResponse, error)
+	AllTransactions(ctx context.Context, request blockchyp.TransactionHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.AuthorizationResponse, error]
+}
+
+// Options configures a reconciliation run.
+type Options struct {
+	// StartDate and EndDate bound the gateway transactions considered.
+	StartDate time.Time
+	EndDate   time.Time
+
+	Test bool
+
+	// Ledger, if set, is used to find the transactions of orders that only
+	// carry an OrderRef.
+	Ledger *blockchyp.Ledger
+}
+
+// Issue is a single reconciliation finding.
+type Issue struct {
+	Kind           IssueKind `json:"kind"`
+	OrderRef       string    `json:"orderRef,omitempty"`
+	TransactionRef string    `json:"transactionRef,omitempty"`
+	TransactionIDs []string  `json:"transactionIds,omitempty"`
+	BatchID        string    `json:"batchId,omitempty"`
+	Expected       string    `json:"expected,omitempty"`
+	Actual         string    `json:"actual,omitempty"`
+	Detail         string    `json:"detail"`
+}
+
+// Report is the result of a reconciliation run.
+type Report struct {
+	GeneratedAt  time.Time         `json:"generatedAt"`
+	StartDate    time.Time         `json:"startDate"`
+	EndDate      time.Time         `json:"endDate"`
+	Orders       int               `json:"orders"`
+	Transactions int               `json:"transactions"`
+	Batches      int               `json:"batches"`
+	Matched      int               `json:"matched"`
+	Counts       map[IssueKind]int `json:"counts"`
+	Issues       []Issue           `json:"issues"`
+}
+
+// Clean reports whether the run found no issues.
+func (r *Report) Clean() bool {
+	return len(r.Issues) == 0
+}
+
+// Reconciler compares orders with gateway records.
+type Reconciler struct {
+	gateway Gateway
+	opts    Options
+}
+
+// New returns a reconciler.
+func New(gateway Gateway, opts Options) *Reconciler {
+	return &Reconciler{
+		gateway: gateway,
+		opts:    opts,
+	}
+}
+
+// batchState is what we need to know about a batch.
+type batchState struct {
+	open  bool
+	found bool
+}
+
+// Run reconciles orders against the gateway. Amounts are compared in
+// cents, so orders or transactions in currencies without two decimal
+// places fail the run rather than being mis-scaled.
+func (r *Reconciler) Run(ctx context.Context, orders []Order) (*Report, error) {
+	report := &Report{
+		GeneratedAt: time.Now(),
+		StartDate:   r.opts.StartDate,
+		EndDate:     r.opts.EndDate,
+		Orders:      len(orders),
+		Counts:      make(map[IssueKind]int),
+		Issues:      make([]Issue, 0),
+	}
+
+	batches := make(map[string]batchState)
+	for batch, err := range r.gateway.AllBatches(ctx, blockchyp.BatchHistoryRequest{
+		Test:      r.opts.Test,
+		StartDate: r.opts.StartDate,
+		EndDate:   r.opts.EndDate,
+	}) {
+		if err != nil {
+			return nil, fmt.Errorf("batch history: %w", err)
+		}
+		batches[batch.BatchID] = batchState{open: batch.Open, found: true}
+	}
+	report.Batches = len(batches)
+
+	idx := &index{
+		records: make(map[string]blockchyp.AuthorizationResponse),
+		byID:    make(map[string][]string),
+		byRef:   make(map[string][]string),
+		byOrder: make(map[string][]string),
+	}
+	for tx, err := range r.gateway.AllTransactions(ctx, blockchyp.TransactionHistoryRequest{
+		Test:      r.opts.Test,
+		StartDate: r.opts.StartDate,
+		EndDate:   r.opts.EndDate,
+	}) {
+		if err != nil {
+			return nil, fmt.Errorf("transaction history: %w", err)
+		}
+		report.Transactions++
+
+		idx.add(tx)
+	}
+
+	if r.opts.Ledger != nil {
+		// The ledger is read once rather than for every order.
+		for entry, err := range r.opts.Ledger.Entries() {
+			if err != nil {
+				return nil, fmt.Errorf("ledger: %w", err)
+			}
+			if entry.OrderRef != "" && entry.TransactionID != "" {
+				idx.byOrder[entry.OrderRef] = append(idx.byOrder[entry.OrderRef], entry.TransactionID)
+			}
+		}
+	}
+
+	claimed := make(map[string]bool)
+	seenOrders := make(map[string]bool)
+
+	for _, order := range orders {
+		key := order.key()
+		if key != "" && seenOrders[key] {
+			report.add(Issue{
+				Kind:           IssueDuplicate,
+				OrderRef:       order.OrderRef,
+				TransactionRef: order.TransactionRef,
+				Detail:         "order appears more than once in the order records",
+			})
+			continue
+		}
+		seenOrders[key] = true
+
+		txs := r.match(order, idx)
+		for _, tx := range txs {
+			claimed[txKey(tx)] = true
+		}
+
+		issues, err := r.check(order, txs, batches)
+		if err != nil {
+			return nil, err
+		}
+		if len(issues) == 0 {
+			report.Matched++
+		}
+		for _, issue := range issues {
+			report.add(issue)
+		}
+	}
+
+	for key, tx := range idx.records {
+		if claimed[key] || !tx.Approved || !isSale(tx) {
+			continue
+		}
+		// A captured preauth is reported once, as its capture.
+		if _, ok := idx.records[tx.TransactionID+"/capture"]; ok && tx.TransactionType == "preauth" {
+			continue
+		}
+		report.add(Issue{
+			Kind:           IssueOrphaned,
+			TransactionRef: tx.TransactionRef,
+			TransactionIDs: []string{tx.TransactionID},
+			BatchID:        tx.BatchID,
+			Actual:         tx.AuthorizedAmount,
+			Detail:         fmt.Sprintf("approved %s has no matching order", tx.TransactionType),
+		})
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.OrderRef != b.OrderRef {
+			return a.OrderRef < b.OrderRef
+		}
+		if a.TransactionRef != b.TransactionRef {
+			return a.TransactionRef < b.TransactionRef
+		}
+		return strings.Join(a.TransactionIDs, ",") < strings.Join(b.TransactionIDs, ",")
+	})
+
+	return report, nil
+}
+
+// index holds gateway records for lookup by transaction ID and reference.
+type index struct {
+	records map[string]blockchyp.AuthorizationResponse
+	byID    map[string][]string
+	byRef   map[string][]string
+
+	// byOrder maps order refs to transaction IDs recorded in the ledger.
+	byOrder map[string][]string
+}
+
+func (idx *index) add(tx blockchyp.AuthorizationResponse) {
+	key := txKey(tx)
+	if _, ok := idx.records[key]; !ok {
+		idx.byID[tx.TransactionID] = append(idx.byID[tx.TransactionID], key)
+		if tx.TransactionRef != "" {
+			idx.byRef[tx.TransactionRef] = append(idx.byRef[tx.TransactionRef], key)
+		}
+	}
+	idx.records[key] = tx
+}
+
+// match returns the gateway transactions that belong to an order.
+func (r *Reconciler) match(order Order, idx *index) []blockchyp.AuthorizationResponse {
+	keys := make([]string, 0)
+	switch {
+	case order.TransactionID != "":
+		keys = append(keys, idx.byID[order.TransactionID]...)
+	case order.TransactionRef != "":
+		keys = append(keys, idx.byRef[order.TransactionRef]...)
+	case order.OrderRef != "":
+		for _, id := range idx.byOrder[order.OrderRef] {
+			keys = append(keys, idx.byID[id]...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	txs := make([]blockchyp.AuthorizationResponse, 0)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			txs = append(txs, idx.records[key])
+		}
+	}
+
+	// Pull in follow-ups such as voids and refunds that share an ID or
+	// reference with a matched transaction.
+	for i := 0; i < len(txs); i++ {
+		related := make([]string, 0)
+		related = append(related, idx.byID[txs[i].TransactionID]...)
+		related = append(related, idx.byRef[txs[i].TransactionRef]...)
+		for _, key := range related {
+			if !seen[key] {
+				seen[key] = true
+				txs = append(txs, idx.records[key])
+			}
+		}
+	}
+
+	return txs
+}
+
+// check compares one order with its gateway transactions.
+func (r *Reconciler) check(order Order, txs []blockchyp.AuthorizationResponse, batches map[string]batchState) ([]Issue, error) {
+	if err := currency.RequireCents(order.CurrencyCode); err != nil {
+		return nil, fmt.Errorf("order %s: %w", order.OrderRef, err)
+	}
+
+	expected, err := money.Parse(order.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("order %s: %w", order.OrderRef, err)
+	}
+
+	base := Issue{
+		OrderRef:       order.OrderRef,
+		TransactionRef: order.TransactionRef,
+		Expected:       expected.String(),
+	}
+
+	var sales, refunds, voids, holds []blockchyp.AuthorizationResponse
+	for _, tx := range txs {
+		if !tx.Approved {
+			continue
+		}
+		switch tx.TransactionType {
+		case "charge", "capture":
+			sales = append(sales, tx)
+		case "preauth":
+			holds = append(holds, tx)
+		case "refund":
+			refunds = append(refunds, tx)
+		case "void", "reverse":
+			voids = append(voids, tx)
+		}
+	}
+
+	issues := make([]Issue, 0)
+
+	if len(sales) == 0 && len(holds) == 0 {
+		issue := base
+		issue.Kind = IssueMissing
+		issue.TransactionIDs = ids(txs)
+		issue.Detail = "no approved transaction found"
+		if len(txs) > 0 {
+			issue.Detail = fmt.Sprintf("no approved sale among %d transactions", len(txs))
+		}
+		return append(issues, issue), nil
+	}
+
+	if len(sales) == 0 {
+		issue := base
+		issue.Kind = IssueUnsettled
+		issue.TransactionIDs = ids(holds)
+		issue.Detail = "authorized but never captured"
+		return append(issues, issue), nil
+	}
+
+	if len(sales) > 1 {
+		issue := base
+		issue.Kind = IssueDuplicate
+		issue.TransactionIDs = ids(sales)
+		issue.Detail = fmt.Sprintf("%d approved sales for one order", len(sales))
+		issues = append(issues, issue)
+	}
+
+	var actual money.Amount
+	if len(voids) == 0 {
+		for _, tx := range sales {
+			a, err := txAmount(tx)
+			if err != nil {
+				return nil, err
+			}
+			actual += a
+		}
+		for _, tx := range refunds {
+			a, err := txAmount(tx)
+			if err != nil {
+				return nil, err
+			}
+			actual -= a.Abs()
+		}
+	}
+
+	if actual != expected {
+		issue := base
+		issue.Kind = IssueAmountMismatch
+		issue.TransactionIDs = ids(append(append(sales, refunds...), voids...))
+		issue.Actual = actual.String()
+		issue.Detail = fmt.Sprintf("settled %s, expected %s", actual, expected)
+		if len(voids) > 0 {
+			issue.Detail += " (voided)"
+		}
+		issues = append(issues, issue)
+	}
+
+	if order.CurrencyCode != "" {
+		for _, tx := range sales {
+			if tx.CurrencyCode != "" && tx.CurrencyCode != order.CurrencyCode {
+				issue := base
+				issue.Kind = IssueAmountMismatch
+				issue.TransactionIDs = []string{tx.TransactionID}
+				issue.Detail = fmt.Sprintf("settled in %s, expected %s", tx.CurrencyCode, order.CurrencyCode)
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	if len(voids) == 0 {
+		for _, tx := range sales {
+			open, err := r.batchOpen(tx.BatchID, batches)
+			if err != nil {
+				return nil, err
+			}
+			if open {
+				issue := base
+				issue.Kind = IssueUnsettled
+				issue.TransactionIDs = []string{tx.TransactionID}
+				issue.BatchID = tx.BatchID
+				issue.Detail = "batch not yet closed"
+				if tx.BatchID == "" {
+					issue.Detail = "not assigned to a batch"
+				}
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// txAmount parses a transaction's authorized amount, refusing currencies
+// that money.Amount can't hold.
+func txAmount(tx blockchyp.AuthorizationResponse) (money.Amount, error) {
+	if err := currency.RequireCents(tx.CurrencyCode); err != nil {
+		return 0, fmt.Errorf("transaction %s: %w", tx.TransactionID, err)
+	}
+
+	a, err := money.Parse(tx.AuthorizedAmount)
+	if err != nil {
+		return 0, fmt.Errorf("transaction %s: %w", tx.TransactionID, err)
+	}
+
+	return a, nil
+}
+
+// batchOpen reports whether a batch is still open, looking up batches that
+// fell outside the history window.
+func (r *Reconciler) batchOpen(batchID string, batches map[string]batchState) (bool, error) {
+	if batchID == "" {
+		return true, nil
+	}
+
+	state, ok := batches[batchID]
+	if !ok {
+		res, err := r.gateway.BatchDetails(blockchyp.BatchDetailsRequest{
+			Test:    r.opts.Test,
+			BatchID: batchID,
+		})
+		if err != nil {
+			return false, fmt.Errorf("batch details %s: %w", batchID, err)
+		}
+		state = batchState{open: res.Open, found: res.Success}
+		batches[batchID] = state
+	}
+
+	return state.open || !state.found, nil
+}
+
+func (r *Report) add(issue Issue) {
+	r.Issues = append(r.Issues, issue)
+	r.Counts[issue.Kind]++
+}
+
+func (o Order) key() string {
+	switch {
+	case o.TransactionID != "":
+		return "id:" + o.TransactionID
+	case o.TransactionRef != "":
+		return "ref:" + o.TransactionRef
+	case o.OrderRef != "":
+		return "order:" + o.OrderRef
+	}
+
+	return ""
+}
+
+// txKey identifies a gateway record. Follow-up records such as voids can
+// share a transaction ID with the original, so the type is part of the key.
+func txKey(tx blockchyp.AuthorizationResponse) string {
+	return tx.TransactionID + "/" + tx.TransactionType
+}
+
+func isSale(tx blockchyp.AuthorizationResponse) bool {
+	return tx.TransactionType == "charge" || tx.TransactionType == "capture" || tx.TransactionType == "preauth"
+}
+
+func ids(txs []blockchyp.AuthorizationResponse) []string {
+	result := make([]string, 0, len(txs))
+	for _, tx := range txs {
+		result = append(result, tx.TransactionID)
+	}
+
+	return result
+}
@@ -0,0 +1,191 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+)
+
+type fakeGateway struct {
+	batches      []blockchyp.BatchSummary
+	details      map[string]blockchyp.BatchDetailsResponse
+	txs          []blockchyp.AuthorizationResponse
+	detailLookup []string
+}
+
+func (g *fakeGateway) AllBatches(ctx context.Context, request blockchyp.BatchHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.BatchSummary, error] {
+	return func(yield func(blockchyp.BatchSummary, error) bool) {
+		for _, b := range g.batches {
+			if !yield(b, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (g *fakeGateway) BatchDetails(request blockchyp.BatchDetailsRequest) (*blockchyp.BatchDetailsResponse, error) {
+	g.detailLookup = append(g.detailLookup, request.BatchID)
+	res := g.details[request.BatchID]
+
+	return &res, nil
+}
+
+func (g *fakeGateway) AllTransactions(ctx context.Context, request blockchyp.TransactionHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.AuthorizationResponse, error] {
+	return func(yield func(blockchyp.AuthorizationResponse, error) bool) {
+		for _, tx := range g.txs {
+			if !yield(tx, nil) {
+				return
+			}
+		}
+	}
+}
+
+func tx(id, ref, txType, amount, batch string) blockchyp.AuthorizationResponse {
+	return blockchyp.AuthorizationResponse{
+		Approved:         true,
+		TransactionID:    id,
+		TransactionRef:   ref,
+		TransactionType:  txType,
+		AuthorizedAmount: amount,
+		BatchID:          batch,
+	}
+}
+
+func issuesFor(report *Report, orderRef string) []IssueKind {
+	kinds := make([]IssueKind, 0)
+	for _, issue := range report.Issues {
+		if issue.OrderRef == orderRef {
+			kinds = append(kinds, issue.Kind)
+		}
+	}
+
+	return kinds
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	gateway := &fakeGateway{
+		batches: []blockchyp.BatchSummary{
+			{BatchID: "B1"},
+			{BatchID: "B2", Open: true},
+		},
+		details: map[string]blockchyp.BatchDetailsResponse{
+			"B0": {Success: true},
+		},
+		txs: []blockchyp.AuthorizationResponse{
+			tx("TX1", "R1", "charge", "10.00", "B1"),
+			tx("TX3A", "R3", "charge", "10.00", "B1"),
+			tx("TX3B", "R3", "charge", "10.00", "B1"),
+			tx("TX4", "R4", "charge", "10.00", "B2"),
+			tx("TX5", "R5", "preauth", "10.00", "B1"),
+			tx("TX6", "R6", "charge", "10.00", "B1"),
+			tx("TX6", "R6", "void", "10.00", "B1"),
+			tx("TX7", "R7", "charge", "12.00", "B0"),
+			tx("TX7R", "R7", "refund", "-2.00", "B0"),
+			tx("TX9", "stray", "charge", "1.00", "B1"),
+		},
+	}
+
+	report, err := New(gateway, Options{}).Run(context.Background(), []Order{
+		{OrderRef: "O1", TransactionRef: "R1", Amount: "10.00"},
+		{OrderRef: "O2", TransactionRef: "R2", Amount: "10.00"},
+		{OrderRef: "O3", TransactionRef: "R3", Amount: "10.00"},
+		{OrderRef: "O4", TransactionRef: "R4", Amount: "10.00"},
+		{OrderRef: "O5", TransactionRef: "R5", Amount: "10.00"},
+		{OrderRef: "O6", TransactionRef: "R6", Amount: "10.00"},
+		{OrderRef: "O7", TransactionRef: "R7", Amount: "10.00"},
+		{OrderRef: "O1", TransactionRef: "R1", Amount: "10.00"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(2, report.Matched)
+	assert.Empty(issuesFor(report, "O7"))
+	assert.Equal([]IssueKind{IssueDuplicate}, issuesFor(report, "O1"))
+	assert.Equal([]IssueKind{IssueMissing}, issuesFor(report, "O2"))
+	assert.Equal([]IssueKind{IssueAmountMismatch, IssueDuplicate}, issuesFor(report, "O3"))
+	assert.Equal([]IssueKind{IssueUnsettled}, issuesFor(report, "O4"))
+	assert.Equal([]IssueKind{IssueUnsettled}, issuesFor(report, "O5"))
+	assert.Equal([]IssueKind{IssueAmountMismatch}, issuesFor(report, "O6"))
+
+	// Only the batch missing from the history is looked up.
+	assert.Equal([]string{"B0"}, gateway.detailLookup)
+
+	assert.Equal(1, report.Counts[IssueOrphaned])
+	for _, issue := range report.Issues {
+		if issue.Kind == IssueOrphaned {
+			assert.Equal([]string{"TX9"}, issue.TransactionIDs)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf))
+	assert.Contains(buf.String(), "Orphaned transactions")
+	assert.Contains(buf.String(), "settled 0.00, expected 10.00 (voided)")
+}
+
+func TestRunMatchesLedgerOrders(t *testing.T) {
+	ledger, err := blockchyp.OpenLedger(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	require.NoError(t, err)
+	defer ledger.Close()
+
+	_, err = ledger.Append(blockchyp.LedgerEntry{Operation: blockchyp.LedgerCharge, TransactionID: "TX1", OrderRef: "O1"})
+	require.NoError(t, err)
+
+	gateway := &fakeGateway{
+		batches: []blockchyp.BatchSummary{{BatchID: "B1"}},
+		txs:     []blockchyp.AuthorizationResponse{tx("TX1", "", "charge", "5.00", "B1")},
+	}
+
+	report, err := New(gateway, Options{Ledger: ledger}).Run(context.Background(), []Order{
+		{OrderRef: "O1", Amount: "5.00"},
+	})
+	require.NoError(t, err)
+	assert.True(t, report.Clean())
+	assert.Equal(t, 1, report.Matched)
+}
+
+func TestRunRejectsNonCentCurrencies(t *testing.T) {
+	gateway := &fakeGateway{}
+
+	_, err := New(gateway, Options{}).Run(context.Background(), []Order{
+		{OrderRef: "O1", Amount: "1000", CurrencyCode: "JPY"},
+	})
+	assert.ErrorIs(t, err, currency.ErrUnsupportedScale)
+
+	jpy := tx("TX1", "R1", "charge", "1000", "B1")
+	jpy.CurrencyCode = "JPY"
+	gateway.txs = []blockchyp.AuthorizationResponse{jpy}
+
+	_, err = New(gateway, Options{}).Run(context.Background(), []Order{
+		{OrderRef: "O1", TransactionRef: "R1", Amount: "10.00"},
+	})
+	assert.ErrorIs(t, err, currency.ErrUnsupportedScale)
+}
+
+func TestReadOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	orders, err := ReadOrders(strings.NewReader("OrderRef, Amount, notes, transactionId\nO1, 10.00, gift, TX1\nO2,5\n"))
+	require.NoError(t, err)
+	assert.Equal([]Order{
+		{OrderRef: "O1", TransactionID: "TX1", Amount: "10.00"},
+		{OrderRef: "O2", Amount: "5"},
+	}, orders)
+
+	_, err = ReadOrders(strings.NewReader("orderRef\nO1\n"))
+	assert.Error(err)
+
+	orders, err = ReadOrders(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Empty(orders)
+}
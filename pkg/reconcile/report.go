@@ -0,0 +1,154 @@
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// issueTitles gives each issue kind a heading for text reports, in the
+// order they're printed.
+var issueTitles = []struct {
+	kind  IssueKind
+	title string
+}{
+	{IssueMissing, "Missing transactions"},
+	{IssueDuplicate, "Duplicates"},
+	{IssueAmountMismatch, "Amount mismatches"},
+	{IssueUnsettled, "Unsettled transactions"},
+	{IssueOrphaned, "Orphaned transactions"},
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
+
+// WriteText writes a human readable summary followed by each issue, grouped
+// by kind.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Reconciliation report generated %s\n", r.GeneratedAt.Format("2006-01-02 15:04:05 MST"))
+	if !r.StartDate.IsZero() || !r.EndDate.IsZero() {
+		fmt.Fprintf(tw, "Period:\t%s to %s\n", formatStart(r), formatEnd(r))
+	}
+	fmt.Fprintf(tw, "Orders:\t%d\n", r.Orders)
+	fmt.Fprintf(tw, "Gateway transactions:\t%d\n", r.Transactions)
+	fmt.Fprintf(tw, "Batches:\t%d\n", r.Batches)
+	fmt.Fprintf(tw, "Matched cleanly:\t%d\n", r.Matched)
+	for _, t := range issueTitles {
+		fmt.Fprintf(tw, "%s:\t%d\n", t.title, r.Counts[t.kind])
+	}
+
+	if r.Clean() {
+		fmt.Fprintln(tw, "\nNo issues found.")
+		return tw.Flush()
+	}
+
+	for _, t := range issueTitles {
+		if r.Counts[t.kind] == 0 {
+			continue
+		}
+
+		fmt.Fprintf(tw, "\n%s\n%s\n", t.title, strings.Repeat("-", len(t.title)))
+		fmt.Fprintln(tw, "Order\tTransaction Ref\tTransaction IDs\tExpected\tActual\tDetail")
+		for _, issue := range r.Issues {
+			if issue.Kind != t.kind {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				dash(issue.OrderRef),
+				dash(issue.TransactionRef),
+				dash(strings.Join(issue.TransactionIDs, ", ")),
+				dash(issue.Expected),
+				dash(issue.Actual),
+				issue.Detail,
+			)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// ReadOrders reads order records from CSV. The first row is a header naming
+// the columns; orderRef, transactionRef, transactionId, amount and
+// currencyCode are recognized and anything else is ignored.
+func ReadOrders(r io.Reader) ([]Order, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return []Order{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, fmt.Errorf("order file has no amount column")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[strings.ToLower(name)]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	orders := make([]Order, 0)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, Order{
+			OrderRef:       field(record, "orderRef"),
+			TransactionRef: field(record, "transactionRef"),
+			TransactionID:  field(record, "transactionId"),
+			Amount:         field(record, "amount"),
+			CurrencyCode:   field(record, "currencyCode"),
+		})
+	}
+
+	return orders, nil
+}
+
+func formatStart(r *Report) string {
+	if r.StartDate.IsZero() {
+		return "beginning"
+	}
+
+	return r.StartDate.Format("2006-01-02")
+}
+
+func formatEnd(r *Report) string {
+	if r.EndDate.IsZero() {
+		return "now"
+	}
+
+	return r.EndDate.Format("2006-01-02")
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
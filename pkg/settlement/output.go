@@ -0,0 +1,217 @@
+package settlement
+
+import (
+	"encoding/csv"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var csvHeader = []string{
+	"type",
+	"period",
+	"currency",
+	"merchantId",
+	"merchantName",
+	"terminalName",
+	"batches",
+	"transactions",
+	"captured",
+	"expectedDeposit",
+	"fees",
+	"netDeposit",
+	"deposited",
+	"feesPaid",
+	"difference",
+	"unmatchedBatches",
+	"disbursed",
+}
+
+// WriteCSV writes merchant rows followed by terminal rows, then any
+// disbursements, with the type column telling them apart. Terminal rows
+// only carry captured volume and transaction counts; deposits and fees are
+// reported per batch, not per terminal. Disbursement rows carry the partner
+// in the merchant columns, the disbursement ID in batches and the amount
+// in disbursed.
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, row := range r.Merchants {
+		record := []string{
+			"merchant",
+			row.Period,
+			row.CurrencyCode,
+			row.MerchantID,
+			row.MerchantName,
+			"",
+			strings.Join(row.Batches, " "),
+			strconv.Itoa(row.Transactions),
+			row.Captured.String(),
+			row.ExpectedDeposit.String(),
+			row.Fees.String(),
+			row.NetDeposit.String(),
+			"",
+			"",
+			"",
+			"",
+			"",
+		}
+		if r.Statements {
+			record[12] = row.Deposited.String()
+			record[13] = row.FeesPaid.String()
+			record[14] = row.Difference.String()
+			record[15] = strconv.Itoa(row.Unmatched)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	for _, row := range r.Terminals {
+		record := []string{
+			"terminal",
+			row.Period,
+			row.CurrencyCode,
+			row.MerchantID,
+			row.MerchantName,
+			row.TerminalName,
+			strings.Join(row.Batches, " "),
+			strconv.Itoa(row.Transactions),
+			row.Captured.String(),
+			"", "", "", "", "", "", "", "",
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range r.Disbursements {
+		record := []string{
+			"disbursement",
+			d.Period,
+			"",
+			d.PartnerID,
+			d.PartnerName,
+			"",
+			d.ID,
+			"", "", "", "", "", "", "", "", "",
+			d.Amount.String(),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// WriteHTML writes the report as a standalone HTML page with no external
+// assets.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
+
+var htmlTemplate = template.Must(template.New("settlement").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Settlement Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.5em; margin-bottom: 0.2em; }
+h2 { font-size: 1.15em; margin-top: 2em; }
+p.meta { color: #666; margin-top: 0; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { padding: 0.4em 0.6em; border-bottom: 1px solid #ddd; text-align: left; }
+th { background: #f4f4f4; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+td.bad { color: #b00020; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Settlement Report</h1>
+<p class="meta">{{ .Period }} report
+{{- if not .StartDate.IsZero }} from {{ .StartDate.Format "2006-01-02" }}{{ end }}
+{{- if not .EndDate.IsZero }} to {{ .EndDate.Format "2006-01-02" }}{{ end }},
+generated {{ .GeneratedAt.Format "2006-01-02 15:04 MST" }}</p>
+
+<h2>Deposits by Merchant</h2>
+<table>
+<tr>
+<th>Period</th><th>Merchant</th><th>Currency</th><th class="num">Batches</th><th class="num">Transactions</th>
+<th class="num">Captured</th><th class="num">Expected Deposit</th><th class="num">Fees</th><th class="num">Net Deposit</th>
+{{- if .Statements }}<th class="num">Deposited</th><th class="num">Fees Paid</th><th class="num">Difference</th>{{ end }}
+</tr>
+{{- range .Merchants }}
+<tr>
+<td>{{ .Period }}</td><td>{{ .MerchantName }} <small>{{ .MerchantID }}</small></td><td>{{ .CurrencyCode }}</td>
+<td class="num">{{ len .Batches }}</td><td class="num">{{ .Transactions }}</td>
+<td class="num">{{ .Captured }}</td><td class="num">{{ .ExpectedDeposit }}</td>
+<td class="num">{{ .Fees }}</td><td class="num">{{ .NetDeposit }}</td>
+{{- if $.Statements }}
+<td class="num">{{ .Deposited }}{{ if .Unmatched }} <small>({{ .Unmatched }} unmatched)</small>{{ end }}</td>
+<td class="num">{{ .FeesPaid }}</td>
+<td class="num{{ if not .Difference.IsZero }} bad{{ end }}">{{ .Difference }}</td>
+{{- end }}
+</tr>
+{{- else }}
+<tr><td colspan="12">No closed batches in this period.</td></tr>
+{{- end }}
+</table>
+
+<h2>Volume by Terminal</h2>
+<table>
+<tr><th>Period</th><th>Merchant</th><th>Terminal</th><th>Currency</th><th class="num">Batches</th><th class="num">Transactions</th><th class="num">Captured</th></tr>
+{{- range .Terminals }}
+<tr>
+<td>{{ .Period }}</td><td>{{ .MerchantName }}</td><td>{{ .TerminalName }}</td><td>{{ .CurrencyCode }}</td>
+<td class="num">{{ len .Batches }}</td><td class="num">{{ .Transactions }}</td><td class="num">{{ .Captured }}</td>
+</tr>
+{{- else }}
+<tr><td colspan="7">No terminal volume in this period.</td></tr>
+{{- end }}
+</table>
+
+<h2>Batches</h2>
+<table>
+<tr>
+<th>Batch</th><th>Closed</th><th>Currency</th><th class="num">Transactions</th><th class="num">Captured</th>
+<th class="num">Expected Deposit</th><th class="num">Fees</th><th class="num">Net Deposit</th>
+{{- if .Statements }}<th class="num">Deposited</th>{{ end }}
+</tr>
+{{- range .Batches }}
+<tr>
+<td>{{ .BatchID }}</td><td>{{ .CloseDate.Format "2006-01-02 15:04" }}</td><td>{{ .CurrencyCode }}</td><td class="num">{{ .Transactions }}</td>
+<td class="num">{{ .Captured }}</td><td class="num">{{ .ExpectedDeposit }}</td>
+<td class="num">{{ .Fees }}</td><td class="num">{{ .NetDeposit }}</td>
+{{- if $.Statements }}<td class="num">{{ if .Deposited }}{{ .Deposited }}{{ else }}&ndash;{{ end }}</td>{{ end }}
+</tr>
+{{- end }}
+</table>
+{{- if .Disbursements }}
+
+<h2>Partner Disbursements</h2>
+<table>
+<tr><th>Period</th><th>Partner</th><th>Disbursement</th><th>Paid</th><th>Payment</th><th>Status</th><th class="num">Amount</th></tr>
+{{- range .Disbursements }}
+<tr>
+<td>{{ .Period }}</td><td>{{ .PartnerName }} <small>{{ .PartnerID }}</small></td><td>{{ .ID }}</td>
+<td>{{ .Timestamp.Format "2006-01-02 15:04" }}</td><td>{{ .PaymentType }} {{ .MaskedPAN }}</td>
+<td{{ if not (or .Approved .Pending) }} class="bad"{{ end }}>{{ if .Pending }}pending{{ else if .Approved }}approved{{ else }}failed{{ with .ResponseDescription }} <small>{{ . }}</small>{{ end }}{{ end }}</td>
+<td class="num">{{ .Amount }}</td>
+</tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .OpenBatches }}
+<p class="meta">Open batches not included: {{ range $i, $b := .OpenBatches }}{{ if $i }}, {{ end }}{{ $b }}{{ end }}</p>
+{{- end }}
+</body>
+</html>
+`))
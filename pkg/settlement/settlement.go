@@ -0,0 +1,543 @@
+// Package settlement builds daily and monthly deposit reports from batch
+// details, merchant statements and partner statement disbursements.
+package settlement
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// Period is the reporting interval.
+type Period string
+
+// Reporting periods.
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// Gateway is the subset of the BlockChyp API used for settlement
+// reporting. *blockchyp.Client satisfies it.
+type Gateway interface {
+	MerchantProfile(request blockchyp.MerchantProfileRequest) (*blockchyp.MerchantProfileResponse, error)
+	AllBatches(ctx context.Context, request blockchyp.BatchHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.BatchSummary, error]
+	BatchDetails(request blockchyp.BatchDetailsRequest) (*blockchyp.BatchDetailsResponse, error)
+	AllMerchantInvoices(ctx context.Context, request blockchyp.MerchantInvoiceListRequest) iter.Seq2[blockchyp.MerchantInvoiceSummary, error]
+	MerchantInvoiceDetail(request blockchyp.MerchantInvoiceDetailRequest) (*blockchyp.MerchantInvoiceDetailResponse, error)
+	AllPartnerStatements(ctx context.Context, request blockchyp.PartnerStatementListRequest) iter.Seq2[blockchyp.PartnerStatementSummary, error]
+	PartnerStatementDetail(request blockchyp.PartnerStatementDetailRequest) (*blockchyp.PartnerStatementDetailResponse, error)
+}
+
+// Options configures a report.
+type Options struct {
+	Period    Period
+	StartDate time.Time
+	EndDate   time.Time
+	Test      bool
+
+	// Location sets the time zone used to assign batches to days. Defaults
+	// to the merchant's configured time zone, then local time.
+	Location *time.Location
+
+	// Statements ties batches to the deposits recorded on merchant
+	// statements. Without it, reports show expected deposits only.
+	Statements bool
+
+	// Disbursements lists the payouts on partner statements over the
+	// period. It needs partner credentials.
+	Disbursements bool
+}
+
+// Batch is a closed batch with its settlement figures.
+type Batch struct {
+	BatchID      string    `json:"batchId"`
+	MerchantID   string    `json:"merchantId"`
+	CloseDate    time.Time `json:"closeDate"`
+	Period       string    `json:"period"`
+	CurrencyCode string    `json:"currencyCode"`
+	Transactions int       `json:"transactions"`
+
+	Captured        money.Amount `json:"captured"`
+	ExpectedDeposit money.Amount `json:"expectedDeposit"`
+	Fees            money.Amount `json:"fees"`
+	NetDeposit      money.Amount `json:"netDeposit"`
+
+	// Deposited and FeesPaid come from merchant statements and are only
+	// set when a matching statement deposit was found.
+	Deposited *money.Amount `json:"deposited,omitempty"`
+	FeesPaid  *money.Amount `json:"feesPaid,omitempty"`
+
+	Terminals []blockchyp.TerminalVolume `json:"terminals"`
+}
+
+// Row is one line of a report: totals for a merchant, or for one of its
+// terminals, over a single period in a single currency.
+type Row struct {
+	Period       string `json:"period"`
+	CurrencyCode string `json:"currencyCode"`
+	MerchantID   string `json:"merchantId"`
+	MerchantName string `json:"merchantName"`
+
+	// TerminalName is empty on merchant rows.
+	TerminalName string `json:"terminalName,omitempty"`
+
+	Batches      []string `json:"batches"`
+	Transactions int      `json:"transactions"`
+
+	Captured        money.Amount `json:"captured"`
+	ExpectedDeposit money.Amount `json:"expectedDeposit"`
+	Fees            money.Amount `json:"fees"`
+	NetDeposit      money.Amount `json:"netDeposit"`
+	Deposited       money.Amount `json:"deposited"`
+	FeesPaid        money.Amount `json:"feesPaid"`
+
+	// Difference is the statement deposit less the net deposit expected
+	// from batch details, over batches with a statement deposit.
+	Difference money.Amount `json:"difference"`
+
+	// Unmatched counts batches with no statement deposit.
+	Unmatched int `json:"unmatched"`
+}
+
+// Disbursement is a payout recorded on a partner statement. Partner
+// statements don't carry a currency.
+type Disbursement struct {
+	ID          string    `json:"id"`
+	StatementID string    `json:"statementId"`
+	PartnerID   string    `json:"partnerId"`
+	PartnerName string    `json:"partnerName"`
+	Timestamp   time.Time `json:"timestamp"`
+	Period      string    `json:"period"`
+
+	TransactionType string `json:"transactionType"`
+	PaymentType     string `json:"paymentType"`
+	MaskedPAN       string `json:"maskedPan"`
+
+	Pending             bool   `json:"pending"`
+	Approved            bool   `json:"approved"`
+	ResponseDescription string `json:"responseDescription,omitempty"`
+
+	Amount money.Amount `json:"amount"`
+}
+
+// Report is a settlement report.
+type Report struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	Period      Period    `json:"period"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	Statements  bool      `json:"statements"`
+
+	Merchants []Row   `json:"merchants"`
+	Terminals []Row   `json:"terminals"`
+	Batches   []Batch `json:"batches"`
+
+	// Disbursements is only set when requested in the options.
+	Disbursements []Disbursement `json:"disbursements,omitempty"`
+
+	// OpenBatches lists batches in range that have not closed yet and are
+	// left out of the totals.
+	OpenBatches []string `json:"openBatches"`
+}
+
+// Build builds a settlement report for the merchant behind gateway.
+// Batches in currencies without two decimal places fail the report.
+func Build(ctx context.Context, gateway Gateway, opts Options) (*Report, error) {
+	if opts.Period == "" {
+		opts.Period = Daily
+	}
+	if opts.Period != Daily && opts.Period != Monthly {
+		return nil, fmt.Errorf("unsupported period: %s", opts.Period)
+	}
+
+	profile, err := gateway.MerchantProfile(blockchyp.MerchantProfileRequest{Test: opts.Test})
+	if err != nil {
+		return nil, fmt.Errorf("merchant profile: %w", err)
+	}
+
+	loc := opts.Location
+	if loc == nil && profile.TimeZone != "" {
+		if l, err := time.LoadLocation(profile.TimeZone); err == nil {
+			loc = l
+		} else {
+			log.Printf("Unknown merchant time zone %q, using local time", profile.TimeZone)
+		}
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	report := &Report{
+		GeneratedAt: time.Now(),
+		Period:      opts.Period,
+		StartDate:   opts.StartDate,
+		EndDate:     opts.EndDate,
+		Statements:  opts.Statements,
+		Merchants:   make([]Row, 0),
+		Terminals:   make([]Row, 0),
+		Batches:     make([]Batch, 0),
+		OpenBatches: make([]string, 0),
+	}
+
+	for summary, err := range gateway.AllBatches(ctx, blockchyp.BatchHistoryRequest{
+		Test:      opts.Test,
+		StartDate: opts.StartDate,
+		EndDate:   opts.EndDate,
+	}) {
+		if err != nil {
+			return nil, fmt.Errorf("batch history: %w", err)
+		}
+		if summary.Open {
+			report.OpenBatches = append(report.OpenBatches, summary.BatchID)
+			continue
+		}
+
+		details, err := gateway.BatchDetails(blockchyp.BatchDetailsRequest{
+			Test:    opts.Test,
+			BatchID: summary.BatchID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("batch details %s: %w", summary.BatchID, err)
+		}
+
+		batch, err := newBatch(profile.MerchantID, summary, details, opts.Period, loc)
+		if err != nil {
+			return nil, err
+		}
+		report.Batches = append(report.Batches, batch)
+	}
+
+	if opts.Statements {
+		deposits, err := statementDeposits(ctx, gateway, profile.MerchantID, opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range report.Batches {
+			if d, ok := deposits[report.Batches[i].BatchID]; ok {
+				deposited := money.FromFloat(d.NetDeposit)
+				feesPaid := money.FromFloat(d.FeesPaid)
+				report.Batches[i].Deposited = &deposited
+				report.Batches[i].FeesPaid = &feesPaid
+			}
+		}
+	}
+
+	if opts.Disbursements {
+		report.Disbursements, err = disbursements(ctx, gateway, opts, loc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(report.Batches, func(i, j int) bool {
+		return report.Batches[i].CloseDate.Before(report.Batches[j].CloseDate)
+	})
+
+	name := profile.DBAName
+	if name == "" {
+		name = profile.CompanyName
+	}
+	report.Merchants, report.Terminals = summarize(report.Batches, name)
+
+	return report, nil
+}
+
+// Combine merges reports built for several merchants into one. Rows stay
+// per merchant and currency. Disbursements seen on more than one report,
+// as happens for merchants under the same partner, are listed once.
+func Combine(reports ...*Report) *Report {
+	combined := &Report{
+		GeneratedAt: time.Now(),
+		Merchants:   make([]Row, 0),
+		Terminals:   make([]Row, 0),
+		Batches:     make([]Batch, 0),
+		OpenBatches: make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range reports {
+		if i == 0 {
+			combined.Period = r.Period
+			combined.StartDate = r.StartDate
+			combined.EndDate = r.EndDate
+			combined.Statements = r.Statements
+		}
+		combined.Statements = combined.Statements && r.Statements
+		combined.Merchants = append(combined.Merchants, r.Merchants...)
+		combined.Terminals = append(combined.Terminals, r.Terminals...)
+		combined.Batches = append(combined.Batches, r.Batches...)
+		combined.OpenBatches = append(combined.OpenBatches, r.OpenBatches...)
+
+		for _, d := range r.Disbursements {
+			if !seen[d.ID] {
+				seen[d.ID] = true
+				combined.Disbursements = append(combined.Disbursements, d)
+			}
+		}
+	}
+
+	sortRows(combined.Merchants)
+	sortRows(combined.Terminals)
+	sort.SliceStable(combined.Batches, func(i, j int) bool {
+		return combined.Batches[i].CloseDate.Before(combined.Batches[j].CloseDate)
+	})
+	sortDisbursements(combined.Disbursements)
+
+	return combined
+}
+
+func newBatch(merchantID string, summary blockchyp.BatchSummary, details *blockchyp.BatchDetailsResponse, period Period, loc *time.Location) (Batch, error) {
+	// Figures are kept in cents.
+	if err := currency.RequireCents(summary.CurrencyCode); err != nil {
+		return Batch{}, fmt.Errorf("batch %s: %w", summary.BatchID, err)
+	}
+	code := strings.ToUpper(strings.TrimSpace(summary.CurrencyCode))
+	if code == "" {
+		code = currency.Default
+	}
+
+	closed := details.CloseDate
+	if closed.IsZero() {
+		closed = summary.CloseDate
+	}
+
+	batch := Batch{
+		BatchID:      summary.BatchID,
+		MerchantID:   merchantID,
+		CloseDate:    closed,
+		Period:       periodKey(closed, period, loc),
+		CurrencyCode: code,
+		Transactions: details.TransactionCount,
+		Terminals:    details.VolumeByTerminal,
+	}
+
+	fields := []struct {
+		dst   *money.Amount
+		value string
+	}{
+		{&batch.Captured, details.CapturedAmount},
+		{&batch.ExpectedDeposit, details.ExpectedDeposit},
+		{&batch.Fees, details.DailyFees},
+		{&batch.NetDeposit, details.NetDeposit},
+	}
+	for _, f := range fields {
+		a, err := money.Parse(f.value)
+		if err != nil {
+			return batch, fmt.Errorf("batch %s: %w", summary.BatchID, err)
+		}
+		*f.dst = a
+	}
+
+	return batch, nil
+}
+
+// statementDeposits collects the deposits listed on the merchant's
+// statements, keyed by batch ID.
+func statementDeposits(ctx context.Context, gateway Gateway, merchantID string, opts Options) (map[string]blockchyp.StatementDeposit, error) {
+	request := blockchyp.MerchantInvoiceListRequest{Test: opts.Test}
+	if merchantID != "" {
+		request.MerchantID = &merchantID
+	}
+	if !opts.StartDate.IsZero() {
+		start := opts.StartDate
+		request.StartDate = &start
+	}
+	if !opts.EndDate.IsZero() {
+		// Deposits for the last batches land on a later statement.
+		end := opts.EndDate.AddDate(0, 1, 0)
+		request.EndDate = &end
+	}
+
+	deposits := make(map[string]blockchyp.StatementDeposit)
+	for invoice, err := range gateway.AllMerchantInvoices(ctx, request) {
+		if err != nil {
+			return nil, fmt.Errorf("merchant invoices: %w", err)
+		}
+
+		details, err := gateway.MerchantInvoiceDetail(blockchyp.MerchantInvoiceDetailRequest{
+			Test: opts.Test,
+			ID:   invoice.ID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("merchant invoice %s: %w", invoice.ID, err)
+		}
+
+		for _, d := range details.Deposits {
+			if d.BatchID != "" {
+				deposits[d.BatchID] = d
+			}
+		}
+	}
+
+	return deposits, nil
+}
+
+// disbursements collects the payouts on partner statements over the
+// period.
+func disbursements(ctx context.Context, gateway Gateway, opts Options, loc *time.Location) ([]Disbursement, error) {
+	request := blockchyp.PartnerStatementListRequest{Test: opts.Test}
+	if !opts.StartDate.IsZero() {
+		start := opts.StartDate
+		request.StartDate = &start
+	}
+	if !opts.EndDate.IsZero() {
+		// Payouts for the end of the period land on a later statement.
+		end := opts.EndDate.AddDate(0, 1, 0)
+		request.EndDate = &end
+	}
+
+	result := make([]Disbursement, 0)
+	for statement, err := range gateway.AllPartnerStatements(ctx, request) {
+		if err != nil {
+			return nil, fmt.Errorf("partner statements: %w", err)
+		}
+
+		details, err := gateway.PartnerStatementDetail(blockchyp.PartnerStatementDetailRequest{
+			Test: opts.Test,
+			ID:   statement.ID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("partner statement %s: %w", statement.ID, err)
+		}
+
+		for _, d := range details.Disbursements {
+			if !opts.StartDate.IsZero() && d.Timestamp.Before(opts.StartDate) {
+				continue
+			}
+			if !opts.EndDate.IsZero() && !d.Timestamp.Before(opts.EndDate) {
+				continue
+			}
+
+			result = append(result, Disbursement{
+				ID:                  d.ID,
+				StatementID:         statement.ID,
+				PartnerID:           details.PartnerID,
+				PartnerName:         details.PartnerName,
+				Timestamp:           d.Timestamp,
+				Period:              periodKey(d.Timestamp, opts.Period, loc),
+				TransactionType:     d.TransactionType,
+				PaymentType:         d.PaymentType,
+				MaskedPAN:           d.MaskedPAN,
+				Pending:             d.Pending,
+				Approved:            d.Approved,
+				ResponseDescription: d.ResponseDescription,
+				Amount:              money.FromFloat(d.Amount),
+			})
+		}
+	}
+	sortDisbursements(result)
+
+	return result, nil
+}
+
+// summarize rolls batches up into merchant and terminal rows per period
+// and currency.
+func summarize(batches []Batch, merchantName string) ([]Row, []Row) {
+	merchants := make(map[string]*Row)
+	terminals := make(map[string]*Row)
+
+	for _, b := range batches {
+		group := b.Period + "\x00" + b.CurrencyCode
+		m, ok := merchants[group]
+		if !ok {
+			m = &Row{
+				Period:       b.Period,
+				CurrencyCode: b.CurrencyCode,
+				MerchantID:   b.MerchantID,
+				MerchantName: merchantName,
+				Batches:      make([]string, 0),
+			}
+			merchants[group] = m
+		}
+
+		m.Batches = append(m.Batches, b.BatchID)
+		m.Transactions += b.Transactions
+		m.Captured += b.Captured
+		m.ExpectedDeposit += b.ExpectedDeposit
+		m.Fees += b.Fees
+		m.NetDeposit += b.NetDeposit
+		if b.Deposited != nil {
+			m.Deposited += *b.Deposited
+			m.FeesPaid += *b.FeesPaid
+			m.Difference += *b.Deposited - b.NetDeposit
+		} else {
+			m.Unmatched++
+		}
+
+		for _, tv := range b.Terminals {
+			key := group + "\x00" + tv.TerminalName
+			t, ok := terminals[key]
+			if !ok {
+				t = &Row{
+					Period:       b.Period,
+					CurrencyCode: b.CurrencyCode,
+					MerchantID:   b.MerchantID,
+					MerchantName: merchantName,
+					TerminalName: tv.TerminalName,
+					Batches:      make([]string, 0),
+				}
+				terminals[key] = t
+			}
+
+			captured, err := money.Parse(tv.CapturedAmount)
+			if err != nil {
+				log.Printf("Ignoring invalid terminal volume for %s in batch %s: %+v", tv.TerminalName, b.BatchID, err)
+				continue
+			}
+			t.Batches = append(t.Batches, b.BatchID)
+			t.Transactions += tv.TransactionCount
+			t.Captured += captured
+		}
+	}
+
+	return rows(merchants), rows(terminals)
+}
+
+func rows(m map[string]*Row) []Row {
+	result := make([]Row, 0, len(m))
+	for _, r := range m {
+		result = append(result, *r)
+	}
+	sortRows(result)
+
+	return result
+}
+
+func sortRows(r []Row) {
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Period != r[j].Period {
+			return r[i].Period < r[j].Period
+		}
+		if r[i].MerchantID != r[j].MerchantID {
+			return r[i].MerchantID < r[j].MerchantID
+		}
+		if r[i].CurrencyCode != r[j].CurrencyCode {
+			return r[i].CurrencyCode < r[j].CurrencyCode
+		}
+		return r[i].TerminalName < r[j].TerminalName
+	})
+}
+
+func sortDisbursements(d []Disbursement) {
+	sort.SliceStable(d, func(i, j int) bool {
+		return d[i].Timestamp.Before(d[j].Timestamp)
+	})
+}
+
+func periodKey(t time.Time, period Period, loc *time.Location) string {
+	t = t.In(loc)
+	if period == Monthly {
+		return t.Format("2006-01")
+	}
+
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,234 @@
+package settlement
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"iter"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+type fakeGateway struct {
+	merchantID string
+	batches    []blockchyp.BatchSummary
+	details    map[string]*blockchyp.BatchDetailsResponse
+	deposits   []blockchyp.StatementDeposit
+	partner    *blockchyp.PartnerStatementDetailResponse
+}
+
+func (g *fakeGateway) MerchantProfile(blockchyp.MerchantProfileRequest) (*blockchyp.MerchantProfileResponse, error) {
+	return &blockchyp.MerchantProfileResponse{
+		MerchantID: g.merchantID,
+		DBAName:    "Shop " + g.merchantID,
+		TimeZone:   "UTC",
+	}, nil
+}
+
+func (g *fakeGateway) AllBatches(ctx context.Context, request blockchyp.BatchHistoryRequest, opts ...blockchyp.PageOptions) iter.Seq2[blockchyp.BatchSummary, error] {
+	return func(yield func(blockchyp.BatchSummary, error) bool) {
+		for _, b := range g.batches {
+			if !yield(b, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (g *fakeGateway) BatchDetails(request blockchyp.BatchDetailsRequest) (*blockchyp.BatchDetailsResponse, error) {
+	d, ok := g.details[request.BatchID]
+	if !ok {
+		return nil, errors.New("batch not found")
+	}
+
+	return d, nil
+}
+
+func (g *fakeGateway) AllMerchantInvoices(ctx context.Context, request blockchyp.MerchantInvoiceListRequest) iter.Seq2[blockchyp.MerchantInvoiceSummary, error] {
+	return func(yield func(blockchyp.MerchantInvoiceSummary, error) bool) {
+		yield(blockchyp.MerchantInvoiceSummary{ID: "INV1"}, nil)
+	}
+}
+
+func (g *fakeGateway) MerchantInvoiceDetail(request blockchyp.MerchantInvoiceDetailRequest) (*blockchyp.MerchantInvoiceDetailResponse, error) {
+	return &blockchyp.MerchantInvoiceDetailResponse{Deposits: g.deposits}, nil
+}
+
+func (g *fakeGateway) AllPartnerStatements(ctx context.Context, request blockchyp.PartnerStatementListRequest) iter.Seq2[blockchyp.PartnerStatementSummary, error] {
+	return func(yield func(blockchyp.PartnerStatementSummary, error) bool) {
+		if g.partner != nil {
+			yield(blockchyp.PartnerStatementSummary{ID: g.partner.ID}, nil)
+		}
+	}
+}
+
+func (g *fakeGateway) PartnerStatementDetail(request blockchyp.PartnerStatementDetailRequest) (*blockchyp.PartnerStatementDetailResponse, error) {
+	return g.partner, nil
+}
+
+func (g *fakeGateway) addBatch(id, code string, closed time.Time, captured, net string) {
+	g.batches = append(g.batches, blockchyp.BatchSummary{
+		BatchID:      id,
+		CurrencyCode: code,
+		CloseDate:    closed,
+	})
+	if g.details == nil {
+		g.details = make(map[string]*blockchyp.BatchDetailsResponse)
+	}
+	g.details[id] = &blockchyp.BatchDetailsResponse{
+		CloseDate:        closed,
+		TransactionCount: 2,
+		CapturedAmount:   captured,
+		ExpectedDeposit:  captured,
+		DailyFees:        "1.00",
+		NetDeposit:       net,
+		VolumeByTerminal: []blockchyp.TerminalVolume{
+			{TerminalName: "Front", CapturedAmount: captured, TransactionCount: 2},
+		},
+	}
+}
+
+var (
+	start = time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end   = time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func partnerStatement() *blockchyp.PartnerStatementDetailResponse {
+	return &blockchyp.PartnerStatementDetailResponse{
+		ID:          "PS1",
+		PartnerID:   "P1",
+		PartnerName: "Partner",
+		Disbursements: []blockchyp.PartnerStatementDisbursement{
+			{ID: "D1", Timestamp: start.AddDate(0, 0, 4), Approved: true, Amount: 12.5},
+			{ID: "D2", Timestamp: end.AddDate(0, 0, 4), Approved: true, Amount: 99},
+		},
+	}
+}
+
+func TestRowsGroupedByCurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{merchantID: "M1"}
+	g.addBatch("B1", "usd", start.Add(10*time.Hour), "100.00", "99.00")
+	g.addBatch("B2", "EUR", start.Add(11*time.Hour), "50.00", "49.00")
+	g.addBatch("B3", "", start.Add(12*time.Hour), "10.00", "9.00")
+
+	report, err := Build(context.Background(), g, Options{Period: Monthly, StartDate: start, EndDate: end})
+	require.NoError(t, err)
+
+	require.Len(t, report.Merchants, 2)
+	assert.Equal("EUR", report.Merchants[0].CurrencyCode)
+	assert.Equal(money.MustParse("50.00"), report.Merchants[0].Captured)
+	assert.Equal(currency.Default, report.Merchants[1].CurrencyCode)
+	assert.Equal(money.MustParse("110.00"), report.Merchants[1].Captured)
+	assert.Equal([]string{"B1", "B3"}, report.Merchants[1].Batches)
+
+	require.Len(t, report.Terminals, 2)
+	assert.Equal("EUR", report.Terminals[0].CurrencyCode)
+	assert.Equal(money.MustParse("110.00"), report.Terminals[1].Captured)
+}
+
+func TestStatementDeposits(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{merchantID: "M1"}
+	g.addBatch("B1", "USD", start.Add(10*time.Hour), "100.00", "99.00")
+	g.addBatch("B2", "USD", start.Add(34*time.Hour), "20.00", "19.00")
+	g.deposits = []blockchyp.StatementDeposit{{BatchID: "B1", NetDeposit: 98.5, FeesPaid: 1.5}}
+
+	report, err := Build(context.Background(), g, Options{Period: Monthly, Statements: true})
+	require.NoError(t, err)
+
+	require.Len(t, report.Merchants, 1)
+	row := report.Merchants[0]
+	assert.Equal(money.MustParse("98.50"), row.Deposited)
+	assert.Equal(money.MustParse("-0.50"), row.Difference)
+	assert.Equal(1, row.Unmatched)
+}
+
+func TestDisbursements(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{merchantID: "M1", partner: partnerStatement()}
+
+	report, err := Build(context.Background(), g, Options{StartDate: start, EndDate: end, Disbursements: true})
+	require.NoError(t, err)
+
+	require.Len(t, report.Disbursements, 1)
+	d := report.Disbursements[0]
+	assert.Equal("D1", d.ID)
+	assert.Equal("PS1", d.StatementID)
+	assert.Equal("P1", d.PartnerID)
+	assert.Equal("2024-03-05", d.Period)
+	assert.Equal(money.MustParse("12.50"), d.Amount)
+
+	report, err = Build(context.Background(), g, Options{StartDate: start, EndDate: end})
+	require.NoError(t, err)
+	assert.Empty(report.Disbursements)
+}
+
+func TestCombine(t *testing.T) {
+	assert := assert.New(t)
+
+	a := &fakeGateway{merchantID: "M1", partner: partnerStatement()}
+	a.addBatch("B1", "USD", start.Add(10*time.Hour), "100.00", "99.00")
+	b := &fakeGateway{merchantID: "M2", partner: partnerStatement()}
+	b.addBatch("B2", "USD", start.Add(9*time.Hour), "20.00", "19.00")
+
+	opts := Options{Period: Monthly, StartDate: start, EndDate: end, Disbursements: true}
+	ra, err := Build(context.Background(), a, opts)
+	require.NoError(t, err)
+	rb, err := Build(context.Background(), b, opts)
+	require.NoError(t, err)
+
+	combined := Combine(ra, rb)
+	require.Len(t, combined.Merchants, 2)
+	assert.Equal("M1", combined.Merchants[0].MerchantID)
+	assert.Equal("M2", combined.Merchants[1].MerchantID)
+	assert.Equal("B2", combined.Batches[0].BatchID)
+	assert.Len(combined.Disbursements, 1)
+}
+
+func TestUnsupportedCurrency(t *testing.T) {
+	g := &fakeGateway{merchantID: "M1"}
+	g.addBatch("B1", "JPY", start, "1000", "990")
+
+	_, err := Build(context.Background(), g, Options{})
+	assert.True(t, errors.Is(err, currency.ErrUnsupportedScale))
+}
+
+func TestWriteCSV(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{merchantID: "M1", partner: partnerStatement()}
+	g.addBatch("B1", "EUR", start.Add(10*time.Hour), "100.00", "99.00")
+
+	report, err := Build(context.Background(), g, Options{Period: Monthly, StartDate: start, EndDate: end, Disbursements: true})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteCSV(&buf))
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+
+	assert.Equal(csvHeader, records[0])
+	assert.Equal([]string{"merchant", "2024-03", "EUR", "M1"}, records[1][:4])
+	assert.Equal([]string{"terminal", "2024-03", "EUR", "M1"}, records[2][:4])
+	assert.Equal("disbursement", records[3][0])
+	assert.Equal("D1", records[3][6])
+	assert.Equal("12.50", records[3][len(csvHeader)-1])
+
+	buf.Reset()
+	require.NoError(t, report.WriteHTML(&buf))
+	assert.Contains(buf.String(), "Partner Disbursements")
+}
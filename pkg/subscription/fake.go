@@ -0,0 +1,141 @@
+package subscription
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// FakeClock is a clock that only moves when told to. Pass its Now method
+// as Manager.Now.
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewFakeClock returns a clock stopped at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// AdvanceDays moves the clock forward by calendar days.
+func (c *FakeClock) AdvanceDays(days int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.AddDate(0, 0, days)
+}
+
+// Set moves the clock to a given time.
+func (c *FakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = now
+}
+
+// FakeGateway stands in for the gateway. It approves every charge unless
+// Decline says otherwise, and records every request it sees. Like the real
+// gateway, a charge that repeats an earlier TransactionRef gets the
+// earlier response rather than being charged again.
+type FakeGateway struct {
+	// Decline returns a decline reason for a charge, or "" to approve it.
+	Decline func(request blockchyp.AuthorizationRequest) string
+
+	// Err, when set, is returned by the next charge instead of a response,
+	// as if the gateway couldn't be reached.
+	Err error
+
+	// Lost, when set, is returned by the next charge after it has been
+	// processed, as if the connection dropped before the response came
+	// back.
+	Lost error
+
+	lock    sync.Mutex
+	charges []blockchyp.AuthorizationRequest
+	seen    map[string]*blockchyp.AuthorizationResponse
+	seq     int
+}
+
+// Charge implements Gateway.
+func (g *FakeGateway) Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if err := g.Err; err != nil {
+		g.Err = nil
+		return &blockchyp.AuthorizationResponse{ResponseDescription: err.Error()}, err
+	}
+
+	if res, ok := g.seen[request.TransactionRef]; ok {
+		cp := *res
+		return &cp, nil
+	}
+
+	g.charges = append(g.charges, request)
+
+	g.seq++
+	res := &blockchyp.AuthorizationResponse{
+		Success:             true,
+		Approved:            true,
+		Test:                true,
+		TransactionID:       "FAKE" + strconv.Itoa(g.seq),
+		TransactionRef:      request.TransactionRef,
+		TransactionType:     "charge",
+		Token:               request.Token,
+		ResponseDescription: "Approved",
+		RequestedAmount:     request.Amount,
+		AuthorizedAmount:    request.Amount,
+	}
+
+	if g.Decline != nil {
+		if reason := g.Decline(request); reason != "" {
+			res.Approved = false
+			res.ResponseDescription = reason
+			res.AuthorizedAmount = "0.00"
+		}
+	}
+
+	if request.TransactionRef != "" {
+		if g.seen == nil {
+			g.seen = make(map[string]*blockchyp.AuthorizationResponse)
+		}
+		g.seen[request.TransactionRef] = res
+	}
+
+	if err := g.Lost; err != nil {
+		g.Lost = nil
+		return &blockchyp.AuthorizationResponse{ResponseDescription: err.Error()}, err
+	}
+
+	cp := *res
+
+	return &cp, nil
+}
+
+// Charges returns every charge the gateway processed, oldest first.
+// Repeats of an earlier TransactionRef aren't included.
+func (g *FakeGateway) Charges() []blockchyp.AuthorizationRequest {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return append([]blockchyp.AuthorizationRequest(nil), g.charges...)
+}
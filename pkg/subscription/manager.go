@@ -0,0 +1,471 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/internal/netutil"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// DefaultRetries is the dunning schedule used when none is configured:
+// retry a declined charge after one, three and seven days.
+var DefaultRetries = []time.Duration{
+	24 * time.Hour,
+	3 * 24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// Gateway is the subset of *blockchyp.Client used for billing.
+type Gateway interface {
+	Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+}
+
+// EventType identifies a billing event.
+type EventType string
+
+// Billing events.
+const (
+	EventCreated        EventType = "created"
+	EventChargeApproved EventType = "charge_approved"
+	EventChargeDeclined EventType = "charge_declined"
+	EventChargeFailed   EventType = "charge_failed"
+	EventRetryScheduled EventType = "retry_scheduled"
+	EventRenewed        EventType = "renewed"
+	EventPlanChanged    EventType = "plan_changed"
+	EventUnpaid         EventType = "unpaid"
+	EventReactivated    EventType = "reactivated"
+	EventCanceled       EventType = "canceled"
+)
+
+// Event reports something that happened to a subscription.
+type Event struct {
+	Type           EventType
+	SubscriptionID string
+	At             time.Time
+
+	// Charge is set for charge events.
+	Charge *Charge
+
+	// Subscription is the subscription after the event.
+	Subscription *Subscription
+}
+
+// Manager schedules and bills subscriptions.
+type Manager struct {
+	Gateway Gateway
+	Store   Store
+
+	// Now returns the current time. It defaults to time.Now; use a
+	// FakeClock to control it.
+	Now func() time.Time
+
+	// Retries is the dunning schedule: how long to wait before each retry
+	// of a declined charge. Once it's exhausted the subscription becomes
+	// unpaid. Defaults to DefaultRetries.
+	Retries []time.Duration
+
+	// CancelWhenUnpaid cancels subscriptions that run out of retries
+	// instead of leaving them unpaid.
+	CancelWhenUnpaid bool
+
+	// OnEvent is called after each event has been saved.
+	OnEvent func(Event)
+
+	// Test sends charges to the test gateway.
+	Test bool
+
+	lock sync.Mutex
+}
+
+// NewManager returns a Manager backed by the given gateway and store.
+func NewManager(gateway Gateway, store Store) *Manager {
+	return &Manager{
+		Gateway: gateway,
+		Store:   store,
+		Now:     time.Now,
+		Retries: DefaultRetries,
+	}
+}
+
+// Subscribe starts a subscription. The first charge is due at once, or
+// when the plan's trial ends.
+func (m *Manager) Subscribe(id, customerID, token string, plan Plan) (*Subscription, error) {
+	if id == "" {
+		return nil, errors.New("subscription id required")
+	}
+	if token == "" {
+		return nil, errors.New("payment token required")
+	}
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.Store.Load(id); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, id)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	now := m.now()
+	start := now.AddDate(0, 0, plan.TrialDays)
+
+	s := &Subscription{
+		ID:            id,
+		CustomerID:    customerID,
+		Token:         token,
+		Plan:          plan,
+		Status:        StatusActive,
+		Anchor:        start,
+		NextBillingAt: start,
+		Charges:       make([]Charge, 0),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if plan.TrialDays > 0 {
+		s.Status = StatusTrialing
+		s.CurrentPeriodStart = now
+		s.CurrentPeriodEnd = start
+	}
+
+	if err := m.save(s, EventCreated, nil); err != nil {
+		return nil, err
+	}
+
+	return clone(s), nil
+}
+
+// Get returns a subscription.
+func (m *Manager) Get(id string) (*Subscription, error) {
+	return m.Store.Load(id)
+}
+
+// RunDue bills every subscription whose charge or retry is due, and
+// returns the subscriptions it touched. Each call bills at most one period
+// per subscription, so a scheduler that was down for several periods
+// catches up one period per run rather than charging all at once.
+// Gateway declines are recorded and don't stop the run; store errors do.
+func (m *Manager) RunDue() ([]*Subscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	subs, err := m.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	due := make([]*Subscription, 0)
+	for _, s := range subs {
+		if s.due(now) {
+			due = append(due, s)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextBillingAt.Equal(due[j].NextBillingAt) {
+			return due[i].NextBillingAt.Before(due[j].NextBillingAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+
+	touched := make([]*Subscription, 0, len(due))
+	for _, s := range due {
+		if err := m.bill(s, now); err != nil {
+			return touched, err
+		}
+		touched = append(touched, clone(s))
+	}
+
+	return touched, nil
+}
+
+// Run calls RunDue every interval until the context is canceled. Errors
+// are logged and the loop carries on.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.RunDue(); err != nil {
+			log.Printf("subscription billing run failed: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// bill charges a due subscription and moves it along its schedule.
+func (m *Manager) bill(s *Subscription, now time.Time) error {
+	if s.CancelAtPeriodEnd {
+		s.Status = StatusCanceled
+		s.CanceledAt = &now
+		return m.save(s, EventCanceled, nil)
+	}
+
+	amount := s.Plan.Amount + s.Balance
+	if amount <= 0 {
+		// Credit covers the whole period.
+		s.Balance = amount
+		s.Status = StatusActive
+		s.advance()
+		return m.save(s, EventRenewed, nil)
+	}
+
+	charge := Charge{
+		At:      now,
+		Period:  s.Period + 1,
+		Attempt: s.attempts(s.Period+1) + 1,
+		Amount:  amount,
+	}
+	charge.TransactionRef = transactionRef(s.ID, charge.Period, charge.Attempt)
+
+	res, err := m.Gateway.Charge(blockchyp.AuthorizationRequest{
+		Test:           m.Test,
+		Token:          s.Token,
+		Amount:         amount.String(),
+		CurrencyCode:   s.Plan.CurrencyCode,
+		TransactionRef: charge.TransactionRef,
+		OrderRef:       s.ID,
+		Description:    s.Plan.Name,
+		Recurring:      true,
+		Subscription:   true,
+		Mit:            true,
+	})
+
+	switch {
+	case netutil.IsNetworkError(err):
+		// The charge may have gone through. It's retried on the next run
+		// with the same TransactionRef, so the gateway returns the
+		// original result instead of charging again, and it doesn't
+		// count against the dunning schedule.
+		charge.Response = err.Error()
+		charge.Unresolved = true
+		s.Charges = append(s.Charges, charge)
+		return m.save(s, EventChargeFailed, &charge)
+	case err != nil:
+		charge.Response = err.Error()
+	default:
+		charge.TransactionID = res.TransactionID
+		charge.Response = res.ResponseDescription
+		charge.Approved = res.Approved
+	}
+
+	s.Charges = append(s.Charges, charge)
+
+	if !charge.Approved {
+		return m.decline(s, now, &charge)
+	}
+
+	s.Balance = 0
+	s.FailedAttempts = 0
+	s.Status = StatusActive
+	s.advance()
+
+	if err := m.save(s, EventChargeApproved, &charge); err != nil {
+		return err
+	}
+
+	m.emit(s, EventRenewed, nil)
+
+	return nil
+}
+
+// decline applies the dunning schedule after a failed charge.
+func (m *Manager) decline(s *Subscription, now time.Time, charge *Charge) error {
+	s.FailedAttempts++
+
+	if err := m.save(s, EventChargeDeclined, charge); err != nil {
+		return err
+	}
+
+	if s.FailedAttempts <= len(m.Retries) {
+		s.Status = StatusPastDue
+		s.NextBillingAt = now.Add(m.Retries[s.FailedAttempts-1])
+		return m.save(s, EventRetryScheduled, nil)
+	}
+
+	if m.CancelWhenUnpaid {
+		s.Status = StatusCanceled
+		s.CanceledAt = &now
+		return m.save(s, EventCanceled, nil)
+	}
+
+	s.Status = StatusUnpaid
+
+	return m.save(s, EventUnpaid, nil)
+}
+
+// Reactivate retries an unpaid subscription's outstanding charge on the
+// next run, typically after the customer updates their payment token. A
+// blank token keeps the current one.
+func (m *Manager) Reactivate(id, token string) (*Subscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == StatusCanceled {
+		return nil, fmt.Errorf("%w: %s", ErrCanceled, id)
+	}
+
+	if token != "" {
+		s.Token = token
+	}
+	s.Status = StatusActive
+	s.FailedAttempts = 0
+	s.NextBillingAt = m.now()
+
+	if err := m.save(s, EventReactivated, nil); err != nil {
+		return nil, err
+	}
+
+	return clone(s), nil
+}
+
+// Cancel stops a subscription, either now or when the current period
+// ends. Cancelling now doesn't refund the current period.
+func (m *Manager) Cancel(id string, atPeriodEnd bool) (*Subscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == StatusCanceled {
+		return clone(s), nil
+	}
+
+	if atPeriodEnd && s.Status != StatusUnpaid {
+		s.CancelAtPeriodEnd = true
+		s.UpdatedAt = m.now()
+		if err := m.Store.Save(s); err != nil {
+			return nil, err
+		}
+		return clone(s), nil
+	}
+
+	now := m.now()
+	s.Status = StatusCanceled
+	s.CanceledAt = &now
+
+	if err := m.save(s, EventCanceled, nil); err != nil {
+		return nil, err
+	}
+
+	return clone(s), nil
+}
+
+// ChangePlan moves a subscription to another plan.
+//
+// With prorate set, the unused part of the current period is credited at
+// the old price and charged at the new one; the difference is added to the
+// next charge. Plans on the same cycle keep the billing date. Plans on a
+// different cycle restart the billing period now, and the new plan is
+// billed on the next run less the credit for the old one.
+func (m *Manager) ChangePlan(id string, plan Plan, prorate bool) (*Subscription, error) {
+	if err := plan.validate(); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, err := m.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == StatusCanceled {
+		return nil, fmt.Errorf("%w: %s", ErrCanceled, id)
+	}
+
+	now := m.now()
+	billed := s.Period > 0 && s.Status != StatusTrialing
+	unused := s.unused(now)
+
+	if prorate && billed {
+		credit := s.Plan.Amount.MulRat(unused, money.RoundDown)
+		s.Balance -= credit
+		if s.Plan.sameSchedule(plan) {
+			s.Balance += plan.Amount.MulRat(unused, money.RoundUp)
+		}
+	}
+
+	if !s.Plan.sameSchedule(plan) && billed {
+		// Start a fresh cycle on the new plan, billed on the next run.
+		s.Anchor = now
+		s.Period = 0
+		s.CurrentPeriodStart = time.Time{}
+		s.CurrentPeriodEnd = time.Time{}
+		s.NextBillingAt = now
+	}
+
+	s.Plan = plan
+
+	if err := m.save(s, EventPlanChanged, nil); err != nil {
+		return nil, err
+	}
+
+	return clone(s), nil
+}
+
+// save persists a subscription and emits an event for it.
+func (m *Manager) save(s *Subscription, event EventType, charge *Charge) error {
+	s.UpdatedAt = m.now()
+
+	if err := m.Store.Save(s); err != nil {
+		return err
+	}
+	m.emit(s, event, charge)
+
+	return nil
+}
+
+func (m *Manager) emit(s *Subscription, event EventType, charge *Charge) {
+	if m.OnEvent == nil {
+		return
+	}
+
+	e := Event{
+		Type:           event,
+		SubscriptionID: s.ID,
+		At:             s.UpdatedAt,
+		Subscription:   clone(s),
+	}
+	if charge != nil {
+		c := *charge
+		e.Charge = &c
+	}
+	m.OnEvent(e)
+}
+
+func (m *Manager) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+
+	return m.Now()
+}
+
+// transactionRef is unique per period and attempt, so gateway duplicate
+// detection can't mistake a retry for a repeat of the declined charge.
+// Unresolved attempts don't count, so their retry reuses the ref.
+func transactionRef(id string, period, attempt int) string {
+	return id + "-" + strconv.Itoa(period) + "-" + strconv.Itoa(attempt)
+}
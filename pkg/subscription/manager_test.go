@@ -0,0 +1,296 @@
+package subscription
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+var monthly = Plan{
+	ID:       "basic",
+	Name:     "Basic",
+	Amount:   money.MustParse("10.00"),
+	Interval: Month,
+}
+
+func newTestManager(start time.Time) (*Manager, *FakeClock, *FakeGateway) {
+	clock := NewFakeClock(start)
+	gateway := &FakeGateway{}
+
+	m := NewManager(gateway, NewMemoryStore())
+	m.Now = clock.Now
+
+	return m, clock, gateway
+}
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 9, 0, 0, 0, time.UTC)
+}
+
+func TestTrialThenFirstCharge(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, gateway := newTestManager(date(2024, time.March, 1))
+
+	plan := monthly
+	plan.TrialDays = 14
+	s, err := m.Subscribe("sub1", "cust1", "tok1", plan)
+	require.NoError(t, err)
+	assert.Equal(StatusTrialing, s.Status)
+	assert.Equal(date(2024, time.March, 15), s.NextBillingAt)
+
+	clock.AdvanceDays(13)
+	touched, err := m.RunDue()
+	require.NoError(t, err)
+	assert.Empty(touched)
+	assert.Empty(gateway.Charges())
+
+	clock.AdvanceDays(1)
+	touched, err = m.RunDue()
+	require.NoError(t, err)
+	require.Len(t, touched, 1)
+
+	charges := gateway.Charges()
+	require.Len(t, charges, 1)
+	assert.Equal("10.00", charges[0].Amount)
+	assert.Equal("tok1", charges[0].Token)
+	assert.True(charges[0].Recurring)
+	assert.True(charges[0].Mit)
+	assert.Equal("sub1-1-1", charges[0].TransactionRef)
+
+	s, err = m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(StatusActive, s.Status)
+	assert.Equal(1, s.Period)
+	assert.Equal(date(2024, time.April, 15), s.NextBillingAt)
+}
+
+func TestPlanRequiresCents(t *testing.T) {
+	m, _, _ := newTestManager(date(2024, time.March, 1))
+
+	plan := monthly
+	plan.CurrencyCode = "JPY"
+	_, err := m.Subscribe("sub1", "cust1", "tok1", plan)
+	assert.True(t, errors.Is(err, ErrInvalidPlan))
+	assert.True(t, errors.Is(err, currency.ErrUnsupportedScale))
+
+	plan.CurrencyCode = "EUR"
+	_, err = m.Subscribe("sub1", "cust1", "tok1", plan)
+	assert.NoError(t, err)
+}
+
+func TestEndOfMonthAnchor(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, _ := newTestManager(date(2024, time.January, 31))
+
+	_, err := m.Subscribe("sub1", "", "tok1", monthly)
+	require.NoError(t, err)
+
+	want := []time.Time{
+		date(2024, time.February, 29),
+		date(2024, time.March, 31),
+		date(2024, time.April, 30),
+		date(2024, time.May, 31),
+	}
+	for _, next := range want {
+		_, err := m.RunDue()
+		require.NoError(t, err)
+
+		s, err := m.Get("sub1")
+		require.NoError(t, err)
+		assert.Equal(next, s.NextBillingAt)
+
+		clock.Set(next)
+	}
+}
+
+func TestDunningToUnpaid(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, gateway := newTestManager(date(2024, time.March, 1))
+	gateway.Decline = func(blockchyp.AuthorizationRequest) string { return "Insufficient Funds" }
+
+	var events []EventType
+	m.OnEvent = func(e Event) { events = append(events, e.Type) }
+
+	_, err := m.Subscribe("sub1", "", "tok1", monthly)
+	require.NoError(t, err)
+
+	for i, wait := range DefaultRetries {
+		_, err := m.RunDue()
+		require.NoError(t, err)
+
+		s, err := m.Get("sub1")
+		require.NoError(t, err)
+		assert.Equal(StatusPastDue, s.Status)
+		assert.Equal(i+1, s.FailedAttempts)
+		assert.Equal(clock.Now().Add(wait), s.NextBillingAt)
+
+		clock.Advance(wait)
+	}
+
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	s, err := m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(StatusUnpaid, s.Status)
+	assert.Equal(0, s.Period)
+
+	refs := make([]string, 0)
+	for _, c := range gateway.Charges() {
+		refs = append(refs, c.TransactionRef)
+	}
+	assert.Equal([]string{"sub1-1-1", "sub1-1-2", "sub1-1-3", "sub1-1-4"}, refs)
+	assert.Equal(EventUnpaid, events[len(events)-1])
+
+	clock.AdvanceDays(30)
+	touched, err := m.RunDue()
+	require.NoError(t, err)
+	assert.Empty(touched)
+
+	gateway.Decline = nil
+	_, err = m.Reactivate("sub1", "tok2")
+	require.NoError(t, err)
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	s, err = m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(StatusActive, s.Status)
+	assert.Equal(1, s.Period)
+
+	charges := gateway.Charges()
+	assert.Equal("tok2", charges[len(charges)-1].Token)
+	assert.Equal("sub1-1-5", charges[len(charges)-1].TransactionRef)
+}
+
+func TestDunningToCanceled(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, gateway := newTestManager(date(2024, time.March, 1))
+	gateway.Decline = func(blockchyp.AuthorizationRequest) string { return "Declined" }
+	m.Retries = []time.Duration{24 * time.Hour}
+	m.CancelWhenUnpaid = true
+
+	_, err := m.Subscribe("sub1", "", "tok1", monthly)
+	require.NoError(t, err)
+
+	_, err = m.RunDue()
+	require.NoError(t, err)
+	clock.AdvanceDays(1)
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	s, err := m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(StatusCanceled, s.Status)
+	assert.NotNil(s.CanceledAt)
+
+	_, err = m.Reactivate("sub1", "")
+	assert.True(errors.Is(err, ErrCanceled))
+}
+
+func TestNetworkFailureReusesRef(t *testing.T) {
+	assert := assert.New(t)
+	m, _, gateway := newTestManager(date(2024, time.March, 1))
+
+	_, err := m.Subscribe("sub1", "", "tok1", monthly)
+	require.NoError(t, err)
+
+	// The gateway approves the charge but the response is lost.
+	gateway.Lost = &net.OpError{Op: "read", Err: errors.New("connection reset")}
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	s, err := m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(StatusActive, s.Status)
+	assert.Equal(0, s.FailedAttempts)
+	assert.Equal(0, s.Period)
+	require.Len(t, s.Charges, 1)
+	assert.True(s.Charges[0].Unresolved)
+
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	s, err = m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(1, s.Period)
+	require.Len(t, s.Charges, 2)
+	assert.Equal(s.Charges[0].TransactionRef, s.Charges[1].TransactionRef)
+	assert.True(s.Charges[1].Approved)
+
+	// Only one charge reached the gateway.
+	assert.Len(gateway.Charges(), 1)
+}
+
+func TestChangePlanProrates(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, gateway := newTestManager(date(2024, time.April, 1))
+
+	_, err := m.Subscribe("sub1", "", "tok1", monthly)
+	require.NoError(t, err)
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	// Halfway through a 30 day April, move to a plan twice the price.
+	clock.AdvanceDays(15)
+	premium := monthly
+	premium.ID = "premium"
+	premium.Amount = money.MustParse("20.00")
+
+	s, err := m.ChangePlan("sub1", premium, true)
+	require.NoError(t, err)
+	assert.Equal(money.MustParse("5.00"), s.Balance)
+	assert.Equal(date(2024, time.May, 1), s.NextBillingAt)
+
+	clock.Set(date(2024, time.May, 1))
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	charges := gateway.Charges()
+	assert.Equal("25.00", charges[len(charges)-1].Amount)
+
+	s, err = m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(money.Amount(0), s.Balance)
+}
+
+func TestChangePlanCreditCoversPeriod(t *testing.T) {
+	assert := assert.New(t)
+	m, clock, gateway := newTestManager(date(2024, time.April, 1))
+
+	plan := monthly
+	plan.Amount = money.MustParse("100.00")
+	_, err := m.Subscribe("sub1", "", "tok1", plan)
+	require.NoError(t, err)
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	// A day in, drop to a plan that costs less than the credit.
+	clock.AdvanceDays(1)
+	cheap := monthly
+	cheap.ID = "cheap"
+	cheap.Amount = money.MustParse("1.00")
+
+	s, err := m.ChangePlan("sub1", cheap, true)
+	require.NoError(t, err)
+	assert.True(s.Balance < 0)
+
+	clock.Set(date(2024, time.May, 1))
+	_, err = m.RunDue()
+	require.NoError(t, err)
+
+	assert.Len(gateway.Charges(), 1)
+
+	s, err = m.Get("sub1")
+	require.NoError(t, err)
+	assert.Equal(2, s.Period)
+	assert.Equal(StatusActive, s.Status)
+}
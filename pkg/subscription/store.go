@@ -0,0 +1,159 @@
+package subscription
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blockchyp/blockchyp-go/v2/internal/atomicfile"
+)
+
+// Store persists subscriptions. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Load returns the subscription with the given id or ErrNotFound.
+	Load(id string) (*Subscription, error)
+
+	// Save creates or replaces a subscription.
+	Save(sub *Subscription) error
+
+	// List returns every stored subscription.
+	List() ([]*Subscription, error)
+}
+
+// MemoryStore is a Store that keeps subscriptions in memory. It is mostly
+// useful for testing.
+type MemoryStore struct {
+	lock          sync.Mutex
+	subscriptions map[string]Subscription
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		subscriptions: make(map[string]Subscription),
+	}
+}
+
+// Load implements Store.
+func (s *MemoryStore) Load(id string) (*Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return clone(&sub), nil
+}
+
+// Save implements Store.
+func (s *MemoryStore) Save(sub *Subscription) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.subscriptions[sub.ID] = *clone(sub)
+
+	return nil
+}
+
+// List implements Store.
+func (s *MemoryStore) List() ([]*Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	subscriptions := make([]*Subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		sub := sub
+		subscriptions = append(subscriptions, clone(&sub))
+	}
+
+	return subscriptions, nil
+}
+
+// FileStore is a Store that keeps each subscription in its own JSON file.
+type FileStore struct {
+	Dir string
+
+	lock sync.Mutex
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{Dir: dir}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.Dir, filepath.Base(id)+".json")
+}
+
+// Load implements Store.
+func (s *FileStore) Load(id string) (*Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.read(s.path(id))
+}
+
+// Save implements Store.
+func (s *FileStore) Save(sub *Subscription) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := json.MarshalIndent(sub, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(s.path(sub.ID), content, 0600)
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]*Subscription, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]*Subscription, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		sub, err := s.read(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, nil
+}
+
+func (s *FileStore) read(path string) (*Subscription, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{}
+	if err := json.Unmarshal(content, sub); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
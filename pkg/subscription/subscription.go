@@ -0,0 +1,264 @@
+// Package subscription bills saved payment tokens on a recurring schedule.
+// Scheduled charges are flagged as merchant initiated recurring
+// transactions, declines are retried on a configurable dunning schedule,
+// and plan changes are prorated. Time comes from a clock function and the
+// gateway is an interface, so billing runs can be driven deterministically
+// with FakeClock and FakeGateway.
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+var (
+	// ErrNotFound is returned by a Store when a subscription does not
+	// exist.
+	ErrNotFound = errors.New("subscription not found")
+
+	// ErrExists is returned when subscribing with an ID already in use.
+	ErrExists = errors.New("subscription already exists")
+
+	// ErrCanceled is returned when changing a canceled subscription.
+	ErrCanceled = errors.New("subscription canceled")
+
+	// ErrInvalidPlan is returned for plans that can't be billed.
+	ErrInvalidPlan = errors.New("invalid plan")
+)
+
+// Unit is the unit of a billing interval.
+type Unit string
+
+// Interval units.
+const (
+	Day   Unit = "day"
+	Week  Unit = "week"
+	Month Unit = "month"
+	Year  Unit = "year"
+)
+
+// Plan is what a subscriber pays and how often.
+type Plan struct {
+	ID           string       `json:"id"`
+	Name         string       `json:"name,omitempty"`
+	Amount       money.Amount `json:"amount"`
+	CurrencyCode string       `json:"currencyCode,omitempty"`
+
+	// Interval and IntervalCount set the billing period, such as every 3
+	// months. IntervalCount defaults to 1.
+	Interval      Unit `json:"interval"`
+	IntervalCount int  `json:"intervalCount,omitempty"`
+
+	// TrialDays delays the first charge.
+	TrialDays int `json:"trialDays,omitempty"`
+}
+
+func (p Plan) validate() error {
+	switch {
+	case p.ID == "":
+		return fmt.Errorf("%w: missing ID", ErrInvalidPlan)
+	case p.Amount < 0:
+		return fmt.Errorf("%w: negative amount", ErrInvalidPlan)
+	case p.IntervalCount < 0 || p.TrialDays < 0:
+		return fmt.Errorf("%w: negative interval", ErrInvalidPlan)
+	}
+
+	switch p.Interval {
+	case Day, Week, Month, Year:
+	default:
+		return fmt.Errorf("%w: unknown interval %q", ErrInvalidPlan, p.Interval)
+	}
+
+	// Plan amounts are kept in cents.
+	if err := currency.RequireCents(p.CurrencyCode); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPlan, err)
+	}
+
+	return nil
+}
+
+// sameSchedule reports whether two plans bill on the same cycle.
+func (p Plan) sameSchedule(other Plan) bool {
+	return p.Interval == other.Interval && p.count() == other.count()
+}
+
+func (p Plan) count() int {
+	if p.IntervalCount <= 0 {
+		return 1
+	}
+
+	return p.IntervalCount
+}
+
+// periodStart returns the start of the nth billing period after anchor.
+// Months and years are counted from the anchor rather than from the
+// previous period, so a subscription anchored on the 31st bills on the
+// last day of shorter months and returns to the 31st afterwards.
+func (p Plan) periodStart(anchor time.Time, n int) time.Time {
+	steps := n * p.count()
+
+	switch p.Interval {
+	case Day:
+		return anchor.AddDate(0, 0, steps)
+	case Week:
+		return anchor.AddDate(0, 0, 7*steps)
+	case Year:
+		return addMonths(anchor, 12*steps)
+	}
+
+	return addMonths(anchor, steps)
+}
+
+// addMonths adds months to t, clamping to the end of shorter months.
+func addMonths(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+
+	last := first.AddDate(0, 1, -1).Day()
+	if d > last {
+		d = last
+	}
+
+	return first.AddDate(0, 0, d-1)
+}
+
+// Status is the billing state of a subscription.
+type Status string
+
+// Subscription statuses.
+const (
+	// StatusTrialing subscriptions haven't been charged yet.
+	StatusTrialing Status = "trialing"
+
+	// StatusActive subscriptions are paid up.
+	StatusActive Status = "active"
+
+	// StatusPastDue subscriptions have a declined charge being retried.
+	StatusPastDue Status = "past_due"
+
+	// StatusUnpaid subscriptions ran out of retries. They aren't charged
+	// again until Reactivate is called.
+	StatusUnpaid Status = "unpaid"
+
+	// StatusCanceled subscriptions are never charged again.
+	StatusCanceled Status = "canceled"
+)
+
+// Charge is a single billing attempt.
+type Charge struct {
+	At             time.Time    `json:"at"`
+	Period         int          `json:"period"`
+	Attempt        int          `json:"attempt"`
+	Amount         money.Amount `json:"amount"`
+	TransactionRef string       `json:"transactionRef"`
+	TransactionID  string       `json:"transactionId,omitempty"`
+	Approved       bool         `json:"approved"`
+	Response       string       `json:"response,omitempty"`
+
+	// Unresolved is set when the gateway couldn't be reached, so it isn't
+	// known whether the charge went through. The next attempt reuses its
+	// TransactionRef.
+	Unresolved bool `json:"unresolved,omitempty"`
+}
+
+// Subscription is a customer's recurring payment.
+type Subscription struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customerId,omitempty"`
+
+	// Token is the saved payment method. It should come from a customer
+	// initiated transaction that established the recurring agreement.
+	Token string `json:"token"`
+
+	Plan   Plan   `json:"plan"`
+	Status Status `json:"status"`
+
+	// Anchor is the start of the first billing period. Period counts the
+	// periods billed so far.
+	Anchor time.Time `json:"anchor"`
+	Period int       `json:"period"`
+
+	CurrentPeriodStart time.Time `json:"currentPeriodStart"`
+	CurrentPeriodEnd   time.Time `json:"currentPeriodEnd"`
+
+	// NextBillingAt is when the next charge is due. During dunning it's
+	// the next retry.
+	NextBillingAt time.Time `json:"nextBillingAt"`
+
+	// Balance is added to the next charge. Proration credits make it
+	// negative.
+	Balance money.Amount `json:"balance"`
+
+	// FailedAttempts counts consecutive declines of the current charge.
+	FailedAttempts int `json:"failedAttempts"`
+
+	CancelAtPeriodEnd bool       `json:"cancelAtPeriodEnd,omitempty"`
+	CanceledAt        *time.Time `json:"canceledAt,omitempty"`
+
+	Charges []Charge `json:"charges"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// due reports whether the subscription needs attention at the given time.
+func (s *Subscription) due(now time.Time) bool {
+	switch s.Status {
+	case StatusTrialing, StatusActive, StatusPastDue:
+		return !s.NextBillingAt.After(now)
+	}
+
+	return false
+}
+
+// advance moves the subscription into its next billing period.
+func (s *Subscription) advance() {
+	s.Period++
+	s.CurrentPeriodStart = s.Plan.periodStart(s.Anchor, s.Period-1)
+	s.CurrentPeriodEnd = s.Plan.periodStart(s.Anchor, s.Period)
+	s.NextBillingAt = s.CurrentPeriodEnd
+}
+
+// attempts counts the charges the gateway answered for a period, including
+// those made before the subscription was reactivated.
+func (s *Subscription) attempts(period int) int {
+	n := 0
+	for _, c := range s.Charges {
+		if c.Period == period && !c.Unresolved {
+			n++
+		}
+	}
+
+	return n
+}
+
+// unused returns the fraction of the current period left at now.
+func (s *Subscription) unused(now time.Time) *big.Rat {
+	total := s.CurrentPeriodEnd.Sub(s.CurrentPeriodStart)
+	left := s.CurrentPeriodEnd.Sub(now)
+
+	switch {
+	case s.Period == 0 || total <= 0 || left <= 0:
+		return new(big.Rat)
+	case left >= total:
+		return big.NewRat(1, 1)
+	}
+
+	return big.NewRat(int64(left), int64(total))
+}
+
+func clone(s *Subscription) *Subscription {
+	cp := *s
+	cp.Charges = append([]Charge(nil), s.Charges...)
+	if s.CanceledAt != nil {
+		t := *s.CanceledAt
+		cp.CanceledAt = &t
+	}
+
+	return &cp
+}
@@ -0,0 +1,556 @@
+// Package tender collects payment for a single order across several
+// tenders, such as a gift card, an EBT card, a credit card and cash,
+// carrying partial approvals forward until the total is covered and
+// backing every completed leg out if the customer walks away.
+package tender
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/internal/netutil"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/cart"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/currency"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+var (
+	// ErrComplete is returned when a tender is run against an order that is
+	// already paid for.
+	ErrComplete = errors.New("order already paid")
+
+	// ErrAbandoned is returned when a tender is run after Abandon, or by a
+	// leg that was still running when the order was abandoned.
+	ErrAbandoned = errors.New("order abandoned")
+
+	// ErrRunning is returned when a tender is run while another is still
+	// waiting on the gateway.
+	ErrRunning = errors.New("another tender is running")
+)
+
+// Kind is a type of tender.
+type Kind string
+
+// Tender kinds.
+const (
+	Gift   Kind = "gift"
+	EBT    Kind = "ebt"
+	Credit Kind = "credit"
+	Cash   Kind = "cash"
+)
+
+// Gateway is the subset of *blockchyp.Client used to run tenders.
+type Gateway interface {
+	Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+	Void(request blockchyp.VoidRequest) (*blockchyp.VoidResponse, error)
+	Reverse(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error)
+}
+
+// Tender is one payment to attempt.
+type Tender struct {
+	Kind Kind
+
+	// Amount is the most to take from this tender. Zero takes whatever
+	// remains. For cash, it's the cash handed over, and any excess is
+	// returned as change.
+	Amount money.Amount
+
+	// Request carries any other fields for card tenders, such as a token
+	// or manual entry flag. Amount, TransactionRef and OrderRef are set
+	// for each leg.
+	Request blockchyp.AuthorizationRequest
+}
+
+// Status is the outcome of a leg.
+type Status string
+
+// Leg statuses. A leg is running while it waits on the gateway.
+const (
+	Running  Status = "running"
+	Approved Status = "approved"
+	Declined Status = "declined"
+	Failed   Status = "failed"
+	Voided   Status = "voided"
+)
+
+// Leg is a tender that was run against the order.
+type Leg struct {
+	Kind           Kind
+	Status         Status
+	TransactionID  string
+	TransactionRef string
+
+	// Requested is what was asked of the tender and Paid what it covered.
+	// For cash, Change is what was handed back.
+	Requested money.Amount
+	Paid      money.Amount
+	Change    money.Amount
+
+	// PartialAuth and RemainingBalance are reported by gift and EBT cards
+	// that couldn't cover the whole request.
+	PartialAuth      bool
+	RemainingBalance string
+
+	Response *blockchyp.AuthorizationResponse
+	Error    string
+
+	// Unresolved is set on failed legs the gateway may have approved but
+	// that couldn't be backed out. Abandon tries again.
+	Unresolved bool
+}
+
+// Options configures a Session.
+type Options struct {
+	// OrderRef identifies the order. Leg transaction refs are derived from
+	// it. Required.
+	OrderRef string
+
+	TerminalName string
+	Test         bool
+
+	// Cart is shown on the terminal before each card leg, so every leg
+	// displays the same items and totals.
+	Cart *cart.Cart
+
+	// Display drives the terminal's line item display. Required with Cart.
+	Display cart.Display
+}
+
+// Session collects payment for one order. It is safe for concurrent use,
+// though tenders run one at a time.
+type Session struct {
+	gateway Gateway
+	opts    Options
+	total   money.Amount
+
+	lock      sync.Mutex
+	legs      []*Leg
+	abandoned bool
+
+	// abandonLock serializes Abandon, which releases lock while it voids.
+	abandonLock sync.Mutex
+
+	// running is set while a leg waits on the gateway, which can take
+	// minutes at the terminal. The lock isn't held meanwhile, so the order
+	// can still be checked on or abandoned.
+	running bool
+}
+
+// New starts collecting payment for an order total.
+func New(gateway Gateway, total money.Amount, opts Options) (*Session, error) {
+	if opts.OrderRef == "" {
+		return nil, errors.New("order ref required")
+	}
+	if opts.Cart != nil && opts.Display == nil {
+		return nil, errors.New("display required to show cart")
+	}
+
+	return &Session{gateway: gateway, opts: opts, total: total}, nil
+}
+
+// Total is the order total.
+func (s *Session) Total() money.Amount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.total
+}
+
+// SetTotal changes the order total, as when a tender makes part of the
+// order tax exempt. The total can't drop below what's already been paid.
+func (s *Session) SetTotal(total money.Amount) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.abandoned {
+		return ErrAbandoned
+	}
+	if paid := s.paid(); total < paid {
+		return fmt.Errorf("total %s is less than the %s already paid", total, paid)
+	}
+	s.total = total
+
+	return nil
+}
+
+// Paid is the sum of approved legs.
+func (s *Session) Paid() money.Amount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.paid()
+}
+
+// Remaining is what's left to collect.
+func (s *Session) Remaining() money.Amount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.total - s.paid()
+}
+
+// Complete reports whether the order is paid in full.
+func (s *Session) Complete() bool {
+	return s.Remaining() <= 0
+}
+
+// Legs returns a copy of every leg run so far, in order.
+func (s *Session) Legs() []Leg {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	legs := make([]Leg, 0, len(s.legs))
+	for _, leg := range s.legs {
+		legs = append(legs, *leg)
+	}
+
+	return legs
+}
+
+// Run applies a tender to the remaining balance. Declines aren't errors:
+// the leg is returned with a declined status and the balance is unchanged,
+// so the cashier can try another tender. A network failure reverses the
+// leg, since the gateway may have approved it. Only one tender runs at a
+// time; if the order is abandoned while it runs, an approval is voided
+// and ErrAbandoned returned. Card tenders must be in a currency with two
+// decimal places.
+func (s *Session) Run(t Tender) (*Leg, error) {
+	if err := currency.RequireCents(t.Request.CurrencyCode); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+
+	if s.abandoned {
+		s.lock.Unlock()
+		return nil, ErrAbandoned
+	}
+	if s.running {
+		s.lock.Unlock()
+		return nil, ErrRunning
+	}
+
+	remaining := s.total - s.paid()
+	if remaining <= 0 {
+		s.lock.Unlock()
+		return nil, ErrComplete
+	}
+
+	if t.Kind == Cash {
+		leg := s.cash(t, remaining)
+		s.lock.Unlock()
+		return leg, nil
+	}
+
+	amount := remaining
+	if t.Amount > 0 && t.Amount < amount {
+		amount = t.Amount
+	}
+
+	leg := &Leg{
+		Kind:           t.Kind,
+		Status:         Running,
+		TransactionRef: s.opts.OrderRef + "-" + strconv.Itoa(len(s.legs)+1),
+		Requested:      amount,
+	}
+	s.legs = append(s.legs, leg)
+
+	req := t.Request
+	req.Amount = amount.String()
+	req.TransactionRef = leg.TransactionRef
+	req.AutogeneratedRef = false
+	req.OrderRef = s.opts.OrderRef
+	req.Test = s.opts.Test
+	if req.TerminalName == "" {
+		req.TerminalName = s.opts.TerminalName
+	}
+
+	switch t.Kind {
+	case Gift:
+		req.CardType = blockchyp.CardTypeBlockchainGift
+	case EBT:
+		req.CardType = blockchyp.CardTypeEBT
+		if req.EBTTotal == "" {
+			req.EBTTotal = req.Amount
+		}
+	}
+
+	s.running = true
+	s.lock.Unlock()
+
+	// Only this tender touches the leg and the cart while it's running, so
+	// the outcome is worked out on a copy, without the lock, and recorded
+	// once it's known. Backing a leg out is another network call.
+	settled := *leg
+	if err := s.showCart(req.TerminalName); err != nil {
+		// The display is a courtesy; a stale one shouldn't stop payment.
+		settled.Error = err.Error()
+	}
+
+	res, err := s.gateway.Charge(req)
+	settled.Response = res
+	err = s.settle(&settled, res, err)
+
+	s.lock.Lock()
+	if !s.abandoned {
+		s.finish(leg, settled)
+		s.lock.Unlock()
+		return leg, err
+	}
+	s.lock.Unlock()
+
+	// Abandon leaves running legs alone, so an approval has to be voided
+	// here. The leg stays running until it is, so nothing else backs it
+	// out too.
+	if settled.Status == Approved {
+		if verr := s.void(settled); verr != nil {
+			settled.Status = Failed
+			settled.Unresolved = true
+			settled.Error = verr.Error()
+			err = errors.Join(err, fmt.Errorf("leg %s: %w", settled.TransactionRef, verr))
+		} else {
+			settled.Status = Voided
+		}
+	}
+
+	s.lock.Lock()
+	s.finish(leg, settled)
+	s.lock.Unlock()
+
+	return leg, errors.Join(ErrAbandoned, err)
+}
+
+// finish records a leg's outcome and ends the running tender. The lock
+// must be held.
+func (s *Session) finish(leg *Leg, settled Leg) {
+	*leg = settled
+	s.running = false
+
+	// The terminal clears its display after a transaction, so the next
+	// leg has to send the whole cart again.
+	if s.opts.Cart != nil {
+		s.opts.Cart.Reset()
+	}
+}
+
+// settle records the gateway's answer to a leg, backing it out if the
+// outcome is uncertain. It's called without the lock, on a copy of the leg.
+func (s *Session) settle(leg *Leg, res *blockchyp.AuthorizationResponse, err error) error {
+	switch {
+	case netutil.IsNetworkError(err):
+		leg.Status = Failed
+		leg.Error = err.Error()
+		if rerr := s.reverse(*leg); rerr != nil {
+			leg.Unresolved = true
+			return fmt.Errorf("%w; reversal also failed: %v", err, rerr)
+		}
+		leg.Status = Voided
+		return err
+	case err != nil:
+		leg.Status = Failed
+		leg.Error = err.Error()
+		return err
+	case !res.Approved:
+		leg.Status = Declined
+		leg.TransactionID = res.TransactionID
+		leg.Error = res.ResponseDescription
+		return nil
+	}
+
+	paid, err := money.Parse(res.AuthorizedAmount)
+	if err != nil {
+		// The gateway approved something; without knowing how much, the
+		// only safe thing is to back it out.
+		leg.Status = Failed
+		leg.TransactionID = res.TransactionID
+		leg.Error = err.Error()
+		if verr := s.void(*leg); verr != nil {
+			leg.Unresolved = true
+			return fmt.Errorf("invalid authorized amount %q; void also failed: %v", res.AuthorizedAmount, verr)
+		}
+		leg.Status = Voided
+		return fmt.Errorf("invalid authorized amount %q", res.AuthorizedAmount)
+	}
+
+	leg.Status = Approved
+	leg.TransactionID = res.TransactionID
+	leg.Paid = paid
+	leg.PartialAuth = res.PartialAuth || paid < leg.Requested
+	leg.RemainingBalance = res.RemainingBalance
+
+	return nil
+}
+
+func (s *Session) cash(t Tender, remaining money.Amount) *Leg {
+	tendered := t.Amount
+	if tendered <= 0 {
+		tendered = remaining
+	}
+
+	leg := &Leg{
+		Kind:      Cash,
+		Status:    Approved,
+		Requested: remaining,
+		Paid:      min(tendered, remaining),
+		Change:    max(tendered-remaining, 0),
+	}
+	s.legs = append(s.legs, leg)
+
+	return leg
+}
+
+// Abandoned is the result of backing out an order.
+type Abandoned struct {
+	// Voided lists the card legs that were voided or reversed.
+	Voided []Leg
+
+	// Failed lists card legs that couldn't be backed out and need
+	// attention, such as a refund once the batch closes.
+	Failed []Leg
+
+	// Running lists legs still waiting on the gateway. Run voids them if
+	// they're approved.
+	Running []Leg
+
+	// CashToReturn is cash taken for the order that should go back to the
+	// customer.
+	CashToReturn money.Amount
+}
+
+// Abandon voids every approved card leg, newest first, and reports the
+// cash to hand back. Voids that fail fall back to a reversal by
+// transaction ref, and failed legs that may have been approved are backed
+// out again. A leg still running is left to Run. Nothing more can be run
+// on the session afterwards.
+func (s *Session) Abandon() (*Abandoned, error) {
+	// Calls to Abandon take turns, so a leg is only backed out once. The
+	// session lock isn't held while voiding, so the order can still be
+	// checked on.
+	s.abandonLock.Lock()
+	defer s.abandonLock.Unlock()
+
+	s.lock.Lock()
+	s.abandoned = true
+
+	result := &Abandoned{
+		Voided:  make([]Leg, 0),
+		Failed:  make([]Leg, 0),
+		Running: make([]Leg, 0),
+	}
+
+	// Settle the cash and running legs now, and pick out the card legs
+	// to back out once the lock is released.
+	backOut := make([]*Leg, 0)
+	for i := len(s.legs) - 1; i >= 0; i-- {
+		leg := s.legs[i]
+		switch {
+		case leg.Status == Running:
+			result.Running = append(result.Running, *leg)
+		case leg.Status == Failed && leg.Unresolved:
+			backOut = append(backOut, leg)
+		case leg.Status != Approved:
+			// Declined and voided legs have nothing to back out.
+		case leg.Kind == Cash:
+			result.CashToReturn += leg.Paid
+			leg.Status = Voided
+		default:
+			backOut = append(backOut, leg)
+		}
+	}
+
+	snapshot := make([]Leg, len(backOut))
+	for i, leg := range backOut {
+		snapshot[i] = *leg
+	}
+	s.lock.Unlock()
+
+	failures := make([]error, len(snapshot))
+	for i, leg := range snapshot {
+		failures[i] = s.void(leg)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var errs []error
+	for i, leg := range backOut {
+		if err := failures[i]; err != nil {
+			errs = append(errs, fmt.Errorf("leg %s: %w", leg.TransactionRef, err))
+			result.Failed = append(result.Failed, *leg)
+			continue
+		}
+		leg.Status = Voided
+		leg.Unresolved = false
+		result.Voided = append(result.Voided, *leg)
+	}
+
+	if s.opts.Cart != nil && !s.running {
+		s.opts.Cart.Reset()
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// void backs out a leg, falling back to a reversal. It makes network calls
+// and is called without the lock.
+func (s *Session) void(leg Leg) error {
+	res, err := s.gateway.Void(blockchyp.VoidRequest{
+		Test:           s.opts.Test,
+		TransactionRef: leg.TransactionRef + "-void",
+		TransactionID:  leg.TransactionID,
+	})
+	if err == nil && res.Success && res.Approved {
+		return nil
+	}
+
+	if rerr := s.reverse(leg); rerr != nil {
+		if err == nil {
+			err = errors.New(res.ResponseDescription)
+		}
+		return fmt.Errorf("void: %v; reverse: %w", err, rerr)
+	}
+
+	return nil
+}
+
+// reverse reverses a leg by its transaction ref, which works even when the
+// leg's outcome is unknown.
+func (s *Session) reverse(leg Leg) error {
+	res, err := s.gateway.Reverse(blockchyp.AuthorizationRequest{
+		Test:           s.opts.Test,
+		TransactionRef: leg.TransactionRef,
+	})
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return errors.New(res.ResponseDescription)
+	}
+
+	return nil
+}
+
+func (s *Session) showCart(terminal string) error {
+	if s.opts.Cart == nil || terminal == "" {
+		return nil
+	}
+
+	return s.opts.Cart.Publish(s.opts.Display, blockchyp.TransactionDisplayRequest{
+		Test:         s.opts.Test,
+		TerminalName: terminal,
+	})
+}
+
+func (s *Session) paid() money.Amount {
+	var paid money.Amount
+	for _, leg := range s.legs {
+		if leg.Status == Approved {
+			paid += leg.Paid
+		}
+	}
+
+	return paid
+}
@@ -0,0 +1,310 @@
+package tender
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+	"github.com/blockchyp/blockchyp-go/v2/pkg/money"
+)
+
+// fakeGateway approves charges up to a per-card-type limit and records
+// what was voided and reversed.
+type fakeGateway struct {
+	lock sync.Mutex
+
+	// limits caps what each card type authorizes. Missing types approve
+	// in full; negative limits decline.
+	limits map[blockchyp.CardType]money.Amount
+
+	chargeErr  error
+	voidFails  bool
+	charges    []blockchyp.AuthorizationRequest
+	voids      []string
+	reversals  []string
+	chargeHook func()
+	voidHook   func()
+}
+
+func (g *fakeGateway) Charge(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	if g.chargeHook != nil {
+		g.chargeHook()
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.charges = append(g.charges, request)
+	if g.chargeErr != nil {
+		return nil, g.chargeErr
+	}
+
+	amount := money.MustParse(request.Amount)
+	limit, ok := g.limits[request.CardType]
+	if ok && limit < 0 {
+		return &blockchyp.AuthorizationResponse{
+			TransactionID:       "TX-" + request.TransactionRef,
+			ResponseDescription: "Declined",
+		}, nil
+	}
+
+	res := &blockchyp.AuthorizationResponse{
+		Approved:         true,
+		TransactionID:    "TX-" + request.TransactionRef,
+		AuthorizedAmount: amount.String(),
+	}
+	if ok && limit < amount {
+		res.AuthorizedAmount = limit.String()
+		res.PartialAuth = true
+		res.RemainingBalance = "0.00"
+	}
+
+	return res, nil
+}
+
+func (g *fakeGateway) Void(request blockchyp.VoidRequest) (*blockchyp.VoidResponse, error) {
+	if g.voidHook != nil {
+		g.voidHook()
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.voidFails {
+		return &blockchyp.VoidResponse{ResponseDescription: "Void window closed"}, nil
+	}
+	g.voids = append(g.voids, request.TransactionID)
+
+	return &blockchyp.VoidResponse{Success: true, Approved: true}, nil
+}
+
+func (g *fakeGateway) Reverse(request blockchyp.AuthorizationRequest) (*blockchyp.AuthorizationResponse, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.reversals = append(g.reversals, request.TransactionRef)
+
+	return &blockchyp.AuthorizationResponse{Success: true}, nil
+}
+
+func newSession(t *testing.T, g *fakeGateway, total string) *Session {
+	s, err := New(g, money.MustParse(total), Options{OrderRef: "ORD1", TerminalName: "Front", Test: true})
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestSplitTender(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{limits: map[blockchyp.CardType]money.Amount{
+		blockchyp.CardTypeBlockchainGift: money.MustParse("20.00"),
+	}}
+	s := newSession(t, g, "50.00")
+
+	leg, err := s.Run(Tender{Kind: Gift})
+	require.NoError(t, err)
+	assert.Equal(Approved, leg.Status)
+	assert.True(leg.PartialAuth)
+	assert.Equal("20.00", leg.Paid.String())
+	assert.Equal("30.00", s.Remaining().String())
+
+	leg, err = s.Run(Tender{Kind: Credit, Amount: money.MustParse("10.00")})
+	require.NoError(t, err)
+	assert.Equal("10.00", leg.Requested.String())
+	assert.False(leg.PartialAuth)
+
+	leg, err = s.Run(Tender{Kind: Cash, Amount: money.MustParse("40.00")})
+	require.NoError(t, err)
+	assert.Equal("20.00", leg.Paid.String())
+	assert.Equal("20.00", leg.Change.String())
+	assert.True(s.Complete())
+
+	_, err = s.Run(Tender{Kind: Credit})
+	assert.True(errors.Is(err, ErrComplete))
+
+	require.Len(t, g.charges, 2)
+	assert.Equal("ORD1-1", g.charges[0].TransactionRef)
+	assert.Equal(blockchyp.CardTypeBlockchainGift, g.charges[0].CardType)
+	assert.Equal("ORD1-2", g.charges[1].TransactionRef)
+	assert.Equal("ORD1", g.charges[1].OrderRef)
+	assert.Equal("Front", g.charges[1].TerminalName)
+	assert.True(g.charges[1].Test)
+}
+
+func TestEBTTotalDefaultsToAmount(t *testing.T) {
+	g := &fakeGateway{}
+	s := newSession(t, g, "12.34")
+
+	_, err := s.Run(Tender{Kind: EBT})
+	require.NoError(t, err)
+
+	require.Len(t, g.charges, 1)
+	assert.Equal(t, blockchyp.CardTypeEBT, g.charges[0].CardType)
+	assert.Equal(t, "12.34", g.charges[0].EBTTotal)
+}
+
+func TestDeclineLeavesBalance(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{limits: map[blockchyp.CardType]money.Amount{
+		blockchyp.CardTypeBlockchainGift: -1,
+	}}
+	s := newSession(t, g, "25.00")
+
+	leg, err := s.Run(Tender{Kind: Gift})
+	require.NoError(t, err)
+	assert.Equal(Declined, leg.Status)
+	assert.Equal("Declined", leg.Error)
+	assert.Equal("25.00", s.Remaining().String())
+
+	leg, err = s.Run(Tender{Kind: Credit})
+	require.NoError(t, err)
+	assert.Equal(Approved, leg.Status)
+	assert.True(s.Complete())
+}
+
+func TestNetworkErrorReversesLeg(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{chargeErr: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	s := newSession(t, g, "25.00")
+
+	leg, err := s.Run(Tender{Kind: Credit})
+	require.Error(t, err)
+	assert.Equal(Voided, leg.Status)
+	assert.False(leg.Unresolved)
+	assert.Equal([]string{"ORD1-1"}, g.reversals)
+	assert.Equal("25.00", s.Remaining().String())
+}
+
+func TestSetTotal(t *testing.T) {
+	s := newSession(t, &fakeGateway{}, "25.00")
+
+	_, err := s.Run(Tender{Kind: Cash, Amount: money.MustParse("10.00")})
+	require.NoError(t, err)
+
+	assert.Error(t, s.SetTotal(money.MustParse("5.00")))
+	require.NoError(t, s.SetTotal(money.MustParse("20.00")))
+	assert.Equal(t, "10.00", s.Remaining().String())
+}
+
+func TestAbandon(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{limits: map[blockchyp.CardType]money.Amount{
+		blockchyp.CardTypeBlockchainGift: money.MustParse("5.00"),
+	}}
+	s := newSession(t, g, "50.00")
+
+	_, err := s.Run(Tender{Kind: Gift})
+	require.NoError(t, err)
+	_, err = s.Run(Tender{Kind: Cash, Amount: money.MustParse("15.00")})
+	require.NoError(t, err)
+	_, err = s.Run(Tender{Kind: Credit, Amount: money.MustParse("10.00")})
+	require.NoError(t, err)
+
+	result, err := s.Abandon()
+	require.NoError(t, err)
+	assert.Equal("15.00", result.CashToReturn.String())
+	assert.Empty(result.Failed)
+	require.Len(t, result.Voided, 2)
+	assert.Equal("ORD1-3", result.Voided[0].TransactionRef)
+	assert.Equal("ORD1-1", result.Voided[1].TransactionRef)
+	assert.Equal([]string{"TX-ORD1-3", "TX-ORD1-1"}, g.voids)
+	assert.Equal(money.Amount(0), s.Paid())
+
+	_, err = s.Run(Tender{Kind: Credit})
+	assert.True(errors.Is(err, ErrAbandoned))
+}
+
+func TestAbandonFallsBackToReversal(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{}
+	s := newSession(t, g, "50.00")
+
+	_, err := s.Run(Tender{Kind: Credit})
+	require.NoError(t, err)
+
+	g.voidFails = true
+	result, err := s.Abandon()
+	require.NoError(t, err)
+	require.Len(t, result.Voided, 1)
+	assert.Equal([]string{"ORD1-1"}, g.reversals)
+	assert.Equal(Voided, s.Legs()[0].Status)
+}
+
+func TestAbandonWhileRunning(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g := &fakeGateway{chargeHook: func() {
+		close(started)
+		<-release
+	}}
+	s := newSession(t, g, "50.00")
+
+	type result struct {
+		leg *Leg
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		leg, err := s.Run(Tender{Kind: Credit})
+		done <- result{leg, err}
+	}()
+	<-started
+
+	_, err := s.Run(Tender{Kind: Credit})
+	assert.True(errors.Is(err, ErrRunning))
+
+	abandoned, err := s.Abandon()
+	require.NoError(t, err)
+	require.Len(t, abandoned.Running, 1)
+	assert.Empty(abandoned.Voided)
+
+	close(release)
+	r := <-done
+	assert.True(errors.Is(r.err, ErrAbandoned))
+	assert.Equal(Voided, r.leg.Status)
+	assert.Equal([]string{"TX-ORD1-1"}, g.voids)
+}
+
+func TestAbandonDoesNotBlockWhileVoiding(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g := &fakeGateway{}
+	s := newSession(t, g, "50.00")
+
+	_, err := s.Run(Tender{Kind: Credit, Amount: money.MustParse("20.00")})
+	require.NoError(t, err)
+
+	g.voidHook = func() {
+		close(started)
+		<-release
+	}
+	done := make(chan error)
+	go func() {
+		_, err := s.Abandon()
+		done <- err
+	}()
+	<-started
+
+	// The order can be checked on while the void waits on the gateway.
+	assert.Equal("20.00", s.Paid().String())
+	assert.Equal(Approved, s.Legs()[0].Status)
+
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(Voided, s.Legs()[0].Status)
+	assert.Equal(money.Amount(0), s.Paid())
+}
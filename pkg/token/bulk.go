@@ -0,0 +1,181 @@
+package token
+
+import (
+	"context"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// Action is a change made to a token.
+type Action string
+
+// Bulk actions.
+const (
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Result is the outcome of a bulk action on one token.
+type Result string
+
+// Bulk action results.
+const (
+	ResultDone    Result = "done"
+	ResultFailed  Result = "failed"
+	ResultDryRun  Result = "dry_run"
+	ResultSkipped Result = "skipped"
+)
+
+// Entry is one line of an audit trail.
+type Entry struct {
+	At     time.Time `json:"at"`
+	Action Action    `json:"action"`
+	Token  string    `json:"token"`
+	Result Result    `json:"result"`
+
+	// Changes lists the fields an update set, by name. Values aren't
+	// recorded, since they can include cardholder data.
+	Changes []string `json:"changes,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Audit is the record of a bulk run.
+type Audit struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	DryRun     bool           `json:"dryRun"`
+	Counts     map[Result]int `json:"counts"`
+	Entries    []Entry        `json:"entries"`
+}
+
+func (m *Manager) newAudit() *Audit {
+	return &Audit{
+		StartedAt: m.opts.Now(),
+		DryRun:    m.opts.DryRun,
+		Counts:    make(map[Result]int),
+		Entries:   make([]Entry, 0),
+	}
+}
+
+func (a *Audit) add(e Entry) {
+	a.Counts[e.Result]++
+	a.Entries = append(a.Entries, e)
+}
+
+// Delete deletes tokens. Failures are recorded and don't stop the run;
+// if the context is canceled, the remaining tokens are recorded as
+// skipped and the context's error is returned with the audit.
+func (m *Manager) Delete(ctx context.Context, tokens []string) (*Audit, error) {
+	audit := m.newAudit()
+
+	var stopped error
+	for _, value := range tokens {
+		e := Entry{Action: ActionDelete, Token: value}
+
+		switch {
+		case stopped != nil:
+			e.Result = ResultSkipped
+		case m.opts.DryRun:
+			e.Result = ResultDryRun
+		default:
+			if err := m.limiter.wait(ctx); err != nil {
+				stopped = err
+				e.Result = ResultSkipped
+				break
+			}
+			res, err := m.gateway.DeleteToken(blockchyp.DeleteTokenRequest{
+				Test:  m.opts.Test,
+				Token: value,
+			})
+			if err != nil {
+				e.Result, e.Error = ResultFailed, err.Error()
+				break
+			}
+			e.Result, e.Error = outcome(res.Success, res.ResponseDescription)
+		}
+
+		e.At = m.opts.Now()
+		audit.add(e)
+	}
+	audit.FinishedAt = m.opts.Now()
+
+	return audit, stopped
+}
+
+// Update applies token updates, such as new expiry dates or billing
+// addresses. Each request's Token names the token to change; Test is set
+// from the Manager's options. Failures and cancellation are handled as in
+// Delete.
+func (m *Manager) Update(ctx context.Context, updates []blockchyp.UpdateTokenRequest) (*Audit, error) {
+	audit := m.newAudit()
+
+	var stopped error
+	for _, req := range updates {
+		e := Entry{Action: ActionUpdate, Token: req.Token, Changes: changes(req)}
+
+		switch {
+		case stopped != nil:
+			e.Result = ResultSkipped
+		case m.opts.DryRun:
+			e.Result = ResultDryRun
+		default:
+			if err := m.limiter.wait(ctx); err != nil {
+				stopped = err
+				e.Result = ResultSkipped
+				break
+			}
+			req.Test = m.opts.Test
+			res, err := m.gateway.UpdateToken(req)
+			if err != nil {
+				e.Result, e.Error = ResultFailed, err.Error()
+				break
+			}
+			e.Result, e.Error = outcome(res.Success, res.ResponseDescription)
+		}
+
+		e.At = m.opts.Now()
+		audit.add(e)
+	}
+	audit.FinishedAt = m.opts.Now()
+
+	return audit, stopped
+}
+
+// outcome turns a gateway response into an audit result.
+func outcome(success bool, description string) (Result, string) {
+	if success {
+		return ResultDone, ""
+	}
+	if description == "" {
+		description = "request failed"
+	}
+
+	return ResultFailed, description
+}
+
+func changes(req blockchyp.UpdateTokenRequest) []string {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"accountHolderType", req.AccountHolderType},
+		{"accountType", req.AccountType},
+		{"bankName", req.BankName},
+		{"cardHolderName", req.CardHolderName},
+		{"expiryMonth", req.ExpiryMonth},
+		{"expiryYear", req.ExpiryYear},
+		{"address", req.Address},
+		{"postalCode", req.PostalCode},
+	}
+
+	names := make([]string, 0)
+	for _, f := range fields {
+		if f.value != "" {
+			names = append(names, f.name)
+		}
+	}
+
+	return names
+}
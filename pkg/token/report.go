@@ -0,0 +1,166 @@
+package token
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statusTitles gives each status a heading for text reports, in the order
+// they're printed.
+var statusTitles = []struct {
+	status Status
+	title  string
+}{
+	{StatusExpired, "Expired"},
+	{StatusExpiring, "Expiring"},
+	{StatusOrphaned, "Orphaned"},
+	{StatusUnknown, "Unknown"},
+	{StatusOK, "OK"},
+}
+
+// WriteJSON writes the inventory as indented JSON.
+func (inv *Inventory) WriteJSON(w io.Writer) error {
+	return writeJSON(w, inv)
+}
+
+// WriteText writes a summary of the inventory followed by every token that
+// needs attention, grouped by status.
+func (inv *Inventory) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Token inventory generated %s\n", inv.GeneratedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(tw, "Customers:\t%d\n", inv.Customers)
+	fmt.Fprintf(tw, "Tokens:\t%d\n", len(inv.Tokens))
+	for _, t := range statusTitles {
+		fmt.Fprintf(tw, "%s:\t%d\n", t.title, inv.Counts[t.status])
+	}
+
+	for _, t := range statusTitles {
+		if t.status == StatusOK || inv.Counts[t.status] == 0 {
+			continue
+		}
+
+		fmt.Fprintf(tw, "\n%s\n%s\n", t.title, strings.Repeat("-", len(t.title)))
+		fmt.Fprintln(tw, "Token\tMasked PAN\tExpiry\tCustomers\tError")
+		for _, tok := range inv.Tokens {
+			if tok.Status != t.status {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				tok.Token,
+				dash(tok.MaskedPAN),
+				dash(expiry(tok)),
+				dash(strings.Join(tok.Customers, ", ")),
+				dash(tok.Error),
+			)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// WriteCSV writes one row per token.
+func (inv *Inventory) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"token", "status", "maskedPan", "paymentType", "expiryMonth", "expiryYear", "customers", "error"})
+	for _, t := range inv.Tokens {
+		cw.Write([]string{
+			t.Token,
+			string(t.Status),
+			t.MaskedPAN,
+			t.PaymentType,
+			t.ExpiryMonth,
+			t.ExpiryYear,
+			strings.Join(t.Customers, " "),
+			t.Error,
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// WriteJSON writes the audit as indented JSON.
+func (a *Audit) WriteJSON(w io.Writer) error {
+	return writeJSON(w, a)
+}
+
+// WriteText writes a summary of the run followed by every entry.
+func (a *Audit) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	title := "Token maintenance"
+	if a.DryRun {
+		title += " (dry run)"
+	}
+	fmt.Fprintf(tw, "%s started %s\n", title, a.StartedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(tw, "Finished:\t%s\n", a.FinishedAt.Format("2006-01-02 15:04:05 MST"))
+	for _, r := range []Result{ResultDone, ResultDryRun, ResultFailed, ResultSkipped} {
+		if a.Counts[r] > 0 {
+			fmt.Fprintf(tw, "%s:\t%d\n", r, a.Counts[r])
+		}
+	}
+
+	if len(a.Entries) > 0 {
+		fmt.Fprintln(tw, "\nTime\tAction\tToken\tResult\tChanges\tError")
+		for _, e := range a.Entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.At.Format(time.RFC3339),
+				e.Action,
+				e.Token,
+				e.Result,
+				dash(strings.Join(e.Changes, ", ")),
+				dash(e.Error),
+			)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// WriteCSV writes one row per entry.
+func (a *Audit) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"at", "action", "token", "result", "changes", "error"})
+	for _, e := range a.Entries {
+		cw.Write([]string{
+			e.At.Format(time.RFC3339),
+			string(e.Action),
+			e.Token,
+			string(e.Result),
+			strings.Join(e.Changes, " "),
+			e.Error,
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func expiry(t Token) string {
+	if t.ExpiryMonth == "" && t.ExpiryYear == "" {
+		return ""
+	}
+
+	return t.ExpiryMonth + "/" + t.ExpiryYear
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
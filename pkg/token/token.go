@@ -0,0 +1,339 @@
+// Package token inventories the payment tokens saved with the gateway,
+// flags cards that have expired or are about to, finds tokens no longer
+// linked to any customer, and updates or deletes tokens in bulk with a
+// dry-run mode, rate limiting and an audit trail.
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+// DefaultExpiryWindow is how far ahead cards are flagged as expiring.
+const DefaultExpiryWindow = 60 * 24 * time.Hour
+
+// DefaultInterval is the default minimum time between gateway requests.
+const DefaultInterval = 100 * time.Millisecond
+
+// Gateway is the subset of *blockchyp.Client used to manage tokens.
+type Gateway interface {
+	Customer(request blockchyp.CustomerRequest) (*blockchyp.CustomerResponse, error)
+	CustomerSearch(request blockchyp.CustomerSearchRequest) (*blockchyp.CustomerSearchResponse, error)
+	TokenMetadata(request blockchyp.TokenMetadataRequest) (*blockchyp.TokenMetadataResponse, error)
+	UpdateToken(request blockchyp.UpdateTokenRequest) (*blockchyp.UpdateTokenResponse, error)
+	DeleteToken(request blockchyp.DeleteTokenRequest) (*blockchyp.DeleteTokenResponse, error)
+}
+
+// Options configures a Manager.
+type Options struct {
+	Test bool
+
+	// DryRun records what bulk updates and deletes would do without
+	// sending them.
+	DryRun bool
+
+	// Interval is the minimum time between gateway requests. Defaults to
+	// DefaultInterval; negative disables rate limiting.
+	Interval time.Duration
+
+	// ExpiryWindow is how far ahead cards are flagged as expiring.
+	// Defaults to DefaultExpiryWindow.
+	ExpiryWindow time.Duration
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Status classifies a token.
+type Status string
+
+// Token statuses.
+const (
+	// StatusOK tokens are linked to a customer and not near expiry.
+	StatusOK Status = "ok"
+
+	// StatusExpiring cards expire within the expiry window.
+	StatusExpiring Status = "expiring"
+
+	// StatusExpired cards are past their expiry date.
+	StatusExpired Status = "expired"
+
+	// StatusOrphaned tokens aren't linked to any customer.
+	StatusOrphaned Status = "orphaned"
+
+	// StatusUnknown tokens couldn't be looked up.
+	StatusUnknown Status = "unknown"
+)
+
+// Token is an inventoried payment token. It never carries a full account
+// number.
+type Token struct {
+	Token       string `json:"token"`
+	MaskedPAN   string `json:"maskedPan,omitempty"`
+	PaymentType string `json:"paymentType,omitempty"`
+	ExpiryMonth string `json:"expiryMonth,omitempty"`
+	ExpiryYear  string `json:"expiryYear,omitempty"`
+
+	// Expires is the first moment the card is no longer valid: the start
+	// of the month after its expiry month. It's zero for tokens without
+	// an expiry date, such as bank accounts.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// Customers lists the IDs of linked customers.
+	Customers []string `json:"customers"`
+
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Inventory is the result of a token inventory.
+type Inventory struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Customers   int            `json:"customers"`
+	Counts      map[Status]int `json:"counts"`
+	Tokens      []Token        `json:"tokens"`
+}
+
+// WithStatus returns the tokens with the given status.
+func (inv *Inventory) WithStatus(status Status) []Token {
+	tokens := make([]Token, 0)
+	for _, t := range inv.Tokens {
+		if t.Status == status {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens
+}
+
+// Manager inventories and maintains tokens.
+type Manager struct {
+	gateway Gateway
+	opts    Options
+	limiter *limiter
+}
+
+// New returns a Manager.
+func New(gateway Gateway, opts Options) *Manager {
+	if opts.Interval == 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.ExpiryWindow <= 0 {
+		opts.ExpiryWindow = DefaultExpiryWindow
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	return &Manager{
+		gateway: gateway,
+		opts:    opts,
+		limiter: &limiter{interval: opts.Interval},
+	}
+}
+
+// Inventory collects tokens from the customers matching each search query
+// and from a list of known tokens, such as those saved in the merchant's
+// own database. The gateway can't list tokens that aren't linked to a
+// customer, so known tokens are the only way orphans are found.
+func (m *Manager) Inventory(ctx context.Context, queries []string, known []string) (*Inventory, error) {
+	inv := &Inventory{
+		GeneratedAt: m.opts.Now(),
+		Counts:      make(map[Status]int),
+		Tokens:      make([]Token, 0),
+	}
+
+	tokens := make(map[string]*Token)
+	customers := make(map[string]bool)
+
+	for _, query := range queries {
+		if err := m.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		res, err := m.gateway.CustomerSearch(blockchyp.CustomerSearchRequest{
+			Test:  m.opts.Test,
+			Query: query,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("customer search %q: %w", query, err)
+		}
+		if !res.Success {
+			return nil, fmt.Errorf("customer search %q: %s", query, res.ResponseDescription)
+		}
+
+		for _, c := range res.Customers {
+			if customers[c.ID] {
+				continue
+			}
+			customers[c.ID] = true
+
+			// Search results don't reliably carry payment methods.
+			if err := m.limiter.wait(ctx); err != nil {
+				return nil, err
+			}
+			cres, err := m.gateway.Customer(blockchyp.CustomerRequest{
+				Test:       m.opts.Test,
+				CustomerID: c.ID,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("customer %s: %w", c.ID, err)
+			}
+			if !cres.Success || cres.Customer == nil {
+				return nil, fmt.Errorf("customer %s: %s", c.ID, cres.ResponseDescription)
+			}
+
+			for _, pm := range cres.Customer.PaymentMethods {
+				t, ok := tokens[pm.Token]
+				if !ok {
+					t = fromCustomerToken(pm)
+					tokens[pm.Token] = t
+				}
+				t.Customers = append(t.Customers, c.ID)
+			}
+		}
+	}
+	inv.Customers = len(customers)
+
+	for _, value := range known {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if _, ok := tokens[value]; ok {
+			continue
+		}
+
+		if err := m.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		t, err := m.metadata(value)
+		if err != nil {
+			t = &Token{Token: value, Customers: make([]string, 0), Status: StatusUnknown, Error: err.Error()}
+		}
+		tokens[value] = t
+	}
+
+	now := m.opts.Now()
+	for _, t := range tokens {
+		if t.Status == "" {
+			t.Status = m.classify(t, now)
+		}
+		inv.Counts[t.Status]++
+		inv.Tokens = append(inv.Tokens, *t)
+	}
+	sort.Slice(inv.Tokens, func(i, j int) bool {
+		return inv.Tokens[i].Token < inv.Tokens[j].Token
+	})
+
+	return inv, nil
+}
+
+func (m *Manager) metadata(value string) (*Token, error) {
+	res, err := m.gateway.TokenMetadata(blockchyp.TokenMetadataRequest{
+		Test:  m.opts.Test,
+		Token: value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success {
+		return nil, errors.New(res.ResponseDescription)
+	}
+
+	t := fromCustomerToken(res.Token)
+	t.Token = value
+	for _, c := range res.Token.Customers {
+		t.Customers = append(t.Customers, c.ID)
+	}
+
+	return t, nil
+}
+
+// classify works out a token's status. Orphans are reported ahead of
+// expiry, since an orphaned token can't be billed either way.
+func (m *Manager) classify(t *Token, now time.Time) Status {
+	switch {
+	case len(t.Customers) == 0:
+		return StatusOrphaned
+	case t.Expires.IsZero():
+		return StatusOK
+	case !now.Before(t.Expires):
+		return StatusExpired
+	case t.Expires.Sub(now) <= m.opts.ExpiryWindow:
+		return StatusExpiring
+	}
+
+	return StatusOK
+}
+
+func fromCustomerToken(ct blockchyp.CustomerToken) *Token {
+	return &Token{
+		Token:       ct.Token,
+		MaskedPAN:   ct.MaskedPAN,
+		PaymentType: ct.PaymentType,
+		ExpiryMonth: ct.ExpiryMonth,
+		ExpiryYear:  ct.ExpiryYear,
+		Expires:     expires(ct.ExpiryMonth, ct.ExpiryYear),
+		Customers:   make([]string, 0),
+	}
+}
+
+// expires returns the start of the month after a card's expiry month, or
+// zero if the expiry date is missing or invalid. Two digit years are taken
+// to be in this century.
+func expires(month, year string) time.Time {
+	mm, err := strconv.Atoi(strings.TrimSpace(month))
+	if err != nil || mm < 1 || mm > 12 {
+		return time.Time{}
+	}
+	yy, err := strconv.Atoi(strings.TrimSpace(year))
+	if err != nil || yy < 0 {
+		return time.Time{}
+	}
+	if yy < 100 {
+		yy += 2000
+	}
+
+	return time.Date(yy, time.Month(mm)+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// limiter spaces out gateway requests.
+type limiter struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval <= 0 {
+		return ctx.Err()
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
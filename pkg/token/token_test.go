@@ -0,0 +1,273 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	blockchyp "github.com/blockchyp/blockchyp-go/v2"
+)
+
+var now = time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+type fakeGateway struct {
+	customers map[string]blockchyp.Customer
+	searches  map[string][]string
+	metadata  map[string]blockchyp.CustomerToken
+
+	lookups []string
+	deleted []string
+	updated []blockchyp.UpdateTokenRequest
+}
+
+func (g *fakeGateway) CustomerSearch(request blockchyp.CustomerSearchRequest) (*blockchyp.CustomerSearchResponse, error) {
+	res := &blockchyp.CustomerSearchResponse{Success: true}
+	for _, id := range g.searches[request.Query] {
+		// Search results don't carry payment methods.
+		res.Customers = append(res.Customers, blockchyp.Customer{ID: id})
+	}
+
+	return res, nil
+}
+
+func (g *fakeGateway) Customer(request blockchyp.CustomerRequest) (*blockchyp.CustomerResponse, error) {
+	g.lookups = append(g.lookups, request.CustomerID)
+	c, ok := g.customers[request.CustomerID]
+	if !ok {
+		return &blockchyp.CustomerResponse{ResponseDescription: "Not Found"}, nil
+	}
+
+	return &blockchyp.CustomerResponse{Success: true, Customer: &c}, nil
+}
+
+func (g *fakeGateway) TokenMetadata(request blockchyp.TokenMetadataRequest) (*blockchyp.TokenMetadataResponse, error) {
+	t, ok := g.metadata[request.Token]
+	if !ok {
+		return &blockchyp.TokenMetadataResponse{ResponseDescription: "Invalid Token"}, nil
+	}
+
+	return &blockchyp.TokenMetadataResponse{Success: true, Token: t}, nil
+}
+
+func (g *fakeGateway) UpdateToken(request blockchyp.UpdateTokenRequest) (*blockchyp.UpdateTokenResponse, error) {
+	g.updated = append(g.updated, request)
+
+	return &blockchyp.UpdateTokenResponse{Success: true}, nil
+}
+
+func (g *fakeGateway) DeleteToken(request blockchyp.DeleteTokenRequest) (*blockchyp.DeleteTokenResponse, error) {
+	if request.Token == "BAD" {
+		return nil, errors.New("connection reset")
+	}
+	if request.Token == "GONE" {
+		return &blockchyp.DeleteTokenResponse{}, nil
+	}
+	g.deleted = append(g.deleted, request.Token)
+
+	return &blockchyp.DeleteTokenResponse{Success: true}, nil
+}
+
+func card(token, month, year string) blockchyp.CustomerToken {
+	return blockchyp.CustomerToken{
+		Token:       token,
+		MaskedPAN:   "************" + token,
+		PaymentType: "VISA",
+		ExpiryMonth: month,
+		ExpiryYear:  year,
+	}
+}
+
+func newManager(g Gateway, dryRun bool) *Manager {
+	return New(g, Options{
+		DryRun:   dryRun,
+		Interval: -1,
+		Now:      func() time.Time { return now },
+	})
+}
+
+func TestInventory(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{
+		searches: map[string][]string{
+			"smith": {"C1", "C2"},
+			"jones": {"C1"},
+		},
+		customers: map[string]blockchyp.Customer{
+			"C1": {ID: "C1", PaymentMethods: []blockchyp.CustomerToken{card("T1", "12", "2026"), card("T2", "06", "24")}},
+			"C2": {ID: "C2", PaymentMethods: []blockchyp.CustomerToken{card("T1", "12", "2026"), card("T3", "05", "2024")}},
+		},
+		metadata: map[string]blockchyp.CustomerToken{
+			"T4": card("T4", "01", "2030"),
+		},
+	}
+
+	inv, err := newManager(g, false).Inventory(context.Background(), []string{"smith", "jones"}, []string{"T1", " T4 ", "T5", ""})
+	require.NoError(t, err)
+
+	assert.Equal([]string{"C1", "C2"}, g.lookups)
+	assert.Equal(2, inv.Customers)
+	require.Len(t, inv.Tokens, 5)
+
+	byToken := make(map[string]Token)
+	for _, tok := range inv.Tokens {
+		byToken[tok.Token] = tok
+	}
+	assert.Equal(StatusOK, byToken["T1"].Status)
+	assert.Equal([]string{"C1", "C2"}, byToken["T1"].Customers)
+	assert.Equal(StatusExpiring, byToken["T2"].Status)
+	assert.Equal(time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC), byToken["T2"].Expires)
+	assert.Equal(StatusExpired, byToken["T3"].Status)
+	assert.Equal(StatusOrphaned, byToken["T4"].Status)
+	assert.Equal(StatusUnknown, byToken["T5"].Status)
+	assert.Equal("Invalid Token", byToken["T5"].Error)
+
+	assert.Equal(map[Status]int{
+		StatusOK:       1,
+		StatusExpiring: 1,
+		StatusExpired:  1,
+		StatusOrphaned: 1,
+		StatusUnknown:  1,
+	}, inv.Counts)
+	assert.Len(inv.WithStatus(StatusExpired), 1)
+}
+
+func TestInventoryCustomerError(t *testing.T) {
+	g := &fakeGateway{searches: map[string][]string{"smith": {"C9"}}}
+
+	_, err := newManager(g, false).Inventory(context.Background(), []string{"smith"}, nil)
+	assert.EqualError(t, err, "customer C9: Not Found")
+}
+
+func TestExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC), expires("12", "24"))
+	assert.Equal(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), expires(" 2", "2024"))
+	assert.True(expires("13", "24").IsZero())
+	assert.True(expires("", "").IsZero())
+}
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{}
+	audit, err := newManager(g, false).Delete(context.Background(), []string{"T1", "BAD", "GONE", "T2"})
+	require.NoError(t, err)
+
+	assert.Equal([]string{"T1", "T2"}, g.deleted)
+	assert.Equal(2, audit.Counts[ResultDone])
+	assert.Equal(2, audit.Counts[ResultFailed])
+	assert.Equal("connection reset", audit.Entries[1].Error)
+	assert.Equal("request failed", audit.Entries[2].Error)
+	assert.Equal(now, audit.Entries[0].At)
+}
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{}
+	m := newManager(g, true)
+
+	audit, err := m.Delete(context.Background(), []string{"T1"})
+	require.NoError(t, err)
+	assert.True(audit.DryRun)
+	assert.Equal(ResultDryRun, audit.Entries[0].Result)
+
+	audit, err = m.Update(context.Background(), []blockchyp.UpdateTokenRequest{{Token: "T1", ExpiryMonth: "01"}})
+	require.NoError(t, err)
+	assert.Equal(ResultDryRun, audit.Entries[0].Result)
+
+	assert.Empty(g.deleted)
+	assert.Empty(g.updated)
+}
+
+func TestUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &fakeGateway{}
+	m := New(g, Options{Test: true, Interval: -1, Now: func() time.Time { return now }})
+
+	audit, err := m.Update(context.Background(), []blockchyp.UpdateTokenRequest{{
+		Token:       "T1",
+		ExpiryMonth: "01",
+		ExpiryYear:  "2028",
+		PostalCode:  "12345",
+	}})
+	require.NoError(t, err)
+
+	require.Len(t, g.updated, 1)
+	assert.True(g.updated[0].Test)
+	assert.Equal([]string{"expiryMonth", "expiryYear", "postalCode"}, audit.Entries[0].Changes)
+	assert.Equal(ResultDone, audit.Entries[0].Result)
+}
+
+func TestCanceledRunSkipsRemaining(t *testing.T) {
+	g := &fakeGateway{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	audit, err := newManager(g, false).Delete(ctx, []string{"T1", "T2"})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 2, audit.Counts[ResultSkipped])
+	assert.Empty(t, g.deleted)
+}
+
+func TestLimiterSpacesRequests(t *testing.T) {
+	l := &limiter{interval: 20 * time.Millisecond}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.wait(context.Background()))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestReports(t *testing.T) {
+	assert := assert.New(t)
+
+	inv := &Inventory{
+		GeneratedAt: now,
+		Customers:   1,
+		Counts:      map[Status]int{StatusExpired: 1, StatusOK: 1},
+		Tokens: []Token{
+			{Token: "T1", MaskedPAN: "****1111", ExpiryMonth: "05", ExpiryYear: "2024", Customers: []string{"C1"}, Status: StatusExpired},
+			{Token: "T2", Customers: []string{"C1"}, Status: StatusOK},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, inv.WriteText(&buf))
+	text := buf.String()
+	assert.Contains(text, "Expired\n-------")
+	assert.Contains(text, "05/2024")
+	assert.NotContains(text, "T2")
+
+	buf.Reset()
+	require.NoError(t, inv.WriteCSV(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal("T1,expired,****1111,,05,2024,C1,", lines[1])
+
+	audit := &Audit{
+		StartedAt:  now,
+		FinishedAt: now,
+		DryRun:     true,
+		Counts:     map[Result]int{ResultDryRun: 1},
+		Entries:    []Entry{{At: now, Action: ActionDelete, Token: "T1", Result: ResultDryRun}},
+	}
+	buf.Reset()
+	require.NoError(t, audit.WriteText(&buf))
+	assert.Contains(buf.String(), "Token maintenance (dry run)")
+	assert.Regexp(`dry_run:\s+1\n`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, audit.WriteJSON(&buf))
+	assert.Contains(buf.String(), `"dryRun": true`)
+}
@@ -0,0 +1,656 @@
+package blockchyp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/blockchyp/blockchyp-go/v2/internal/atomicfile"
+	"github.com/blockchyp/blockchyp-go/v2/internal/netutil"
+)
+
+// ResponseQueuedOffline is the response description for operations stored
+// in the offline queue because the gateway could not be reached.
+const ResponseQueuedOffline = "Queued Offline"
+
+// DefaultQueueReplayInterval is how often the offline queue retries pending
+// operations.
+const DefaultQueueReplayInterval = 30 * time.Second
+
+// DefaultQueueRetention is how long sent items are kept in the offline
+// queue.
+const DefaultQueueRetention = 7 * 24 * time.Hour
+
+// ErrQueuedOffline is returned when an operation could not reach the gateway
+// and was stored in the offline queue for later replay.
+var ErrQueuedOffline = errors.New("queued offline")
+
+// ErrQueueItemNotFound is returned when a queued item does not exist.
+var ErrQueueItemNotFound = errors.New("queue item not found")
+
+// QueuedOperation identifies the gateway operation a queued item replays.
+type QueuedOperation string
+
+// Operations supported by the offline queue.
+const (
+	QueuedCapture         QueuedOperation = "capture"
+	QueuedVoid            QueuedOperation = "void"
+	QueuedCloseBatch      QueuedOperation = "close-batch"
+	QueuedUpdateCustomer  QueuedOperation = "update-customer"
+	QueuedSendPaymentLink QueuedOperation = "send-payment-link"
+)
+
+// QueueStatus is the replay status of a queued item.
+type QueueStatus string
+
+// Queued item statuses.
+const (
+	QueueStatusPending QueueStatus = "pending"
+	QueueStatusSent    QueueStatus = "sent"
+	QueueStatusFailed  QueueStatus = "failed"
+)
+
+// QueuedItem is a single operation stored in the offline queue.
+type QueuedItem struct {
+	// ID is the operation and idempotency key, such as capture:ref1.
+	ID             string          `json:"id"`
+	Sequence       int64           `json:"sequence"`
+	Operation      QueuedOperation `json:"operation"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+	Status         QueueStatus     `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"lastError,omitempty"`
+	Request        json.RawMessage `json:"request"`
+	Response       json.RawMessage `json:"response,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+}
+
+// OfflineQueueConfig contains options for an offline queue.
+type OfflineQueueConfig struct {
+	// Dir is the directory queued items are stored in. It is created if it
+	// does not exist.
+	Dir string
+
+	// ReplayInterval is how often pending items are retried in the
+	// background. Set to a negative value to disable background replay and
+	// call Replay manually.
+	ReplayInterval time.Duration
+
+	// Retention is how long sent items are kept, so resubmitting one
+	// returns its stored outcome rather than calling the gateway again.
+	// Older sent items are deleted when the queue is opened and on each
+	// background replay. Defaults to DefaultQueueRetention; a negative
+	// value keeps them forever, and the directory then grows without
+	// bound. Failed items are kept until removed.
+	Retention time.Duration
+}
+
+// OfflineQueue is a durable, file backed store-and-forward queue for gateway
+// operations that can safely be deferred. Each item is stored in its own
+// JSON file and replayed in the order it was accepted, using the request's
+// TransactionRef as an idempotency key. Items are identified by operation
+// and key, so a capture and a void can share a TransactionRef.
+type OfflineQueue struct {
+	client *Client
+	config OfflineQueueConfig
+
+	lock     sync.Mutex
+	replay   sync.Mutex
+	items    []*QueuedItem
+	sequence int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// OpenOfflineQueue opens or creates an offline queue and starts background
+// replay of any pending items.
+func OpenOfflineQueue(client *Client, config OfflineQueueConfig) (*OfflineQueue, error) {
+	if config.Dir == "" {
+		return nil, errors.New("offline queue directory required")
+	}
+	if config.ReplayInterval == 0 {
+		config.ReplayInterval = DefaultQueueReplayInterval
+	}
+	if config.Retention == 0 {
+		config.Retention = DefaultQueueRetention
+	}
+
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &OfflineQueue{
+		client: client,
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.prune(time.Now()); err != nil {
+		return nil, err
+	}
+
+	if config.ReplayInterval > 0 {
+		q.wg.Add(1)
+		go q.run()
+	}
+
+	return q, nil
+}
+
+// Close stops background replay.
+func (q *OfflineQueue) Close() error {
+	q.once.Do(func() {
+		close(q.done)
+		q.wg.Wait()
+	})
+
+	return nil
+}
+
+// Capture captures a preauthorization, queueing it if the gateway is
+// unreachable.
+func (q *OfflineQueue) Capture(request CaptureRequest) (*CaptureResponse, error) {
+	var response CaptureResponse
+	assignIdempotencyKey(&request.TransactionRef, &request.AutogeneratedRef)
+
+	err := q.submit(QueuedCapture, request.TransactionRef, request, &response, func() error {
+		res, err := q.client.Capture(request)
+		if res != nil {
+			response = *res
+		}
+		return err
+	})
+	if errors.Is(err, ErrQueuedOffline) {
+		response.TransactionRef = request.TransactionRef
+		response.ResponseDescription = ResponseQueuedOffline
+	}
+
+	return &response, err
+}
+
+// Void discards a previous transaction, queueing it if the gateway is
+// unreachable.
+func (q *OfflineQueue) Void(request VoidRequest) (*VoidResponse, error) {
+	var response VoidResponse
+	assignIdempotencyKey(&request.TransactionRef, &request.AutogeneratedRef)
+
+	err := q.submit(QueuedVoid, request.TransactionRef, request, &response, func() error {
+		res, err := q.client.Void(request)
+		if res != nil {
+			response = *res
+		}
+		return err
+	})
+	if errors.Is(err, ErrQueuedOffline) {
+		response.TransactionRef = request.TransactionRef
+		response.ResponseDescription = ResponseQueuedOffline
+	}
+
+	return &response, err
+}
+
+// CloseBatch closes the current credit card batch, queueing it if the
+// gateway is unreachable.
+func (q *OfflineQueue) CloseBatch(request CloseBatchRequest) (*CloseBatchResponse, error) {
+	var response CloseBatchResponse
+	assignIdempotencyKey(&request.TransactionRef, &request.AutogeneratedRef)
+
+	err := q.submit(QueuedCloseBatch, request.TransactionRef, request, &response, func() error {
+		res, err := q.client.CloseBatch(request)
+		if res != nil {
+			response = *res
+		}
+		return err
+	})
+	if errors.Is(err, ErrQueuedOffline) {
+		response.ResponseDescription = ResponseQueuedOffline
+	}
+
+	return &response, err
+}
+
+// UpdateCustomer updates or creates a customer record, queueing it if the
+// gateway is unreachable.
+func (q *OfflineQueue) UpdateCustomer(request UpdateCustomerRequest) (*CustomerResponse, error) {
+	var response CustomerResponse
+	assignIdempotencyKey(&request.TransactionRef, &request.AutogeneratedRef)
+
+	err := q.submit(QueuedUpdateCustomer, request.TransactionRef, request, &response, func() error {
+		res, err := q.client.UpdateCustomer(request)
+		if res != nil {
+			response = *res
+		}
+		return err
+	})
+	if errors.Is(err, ErrQueuedOffline) {
+		response.ResponseDescription = ResponseQueuedOffline
+	}
+
+	return &response, err
+}
+
+// SendPaymentLink creates and sends a payment link, queueing it if the
+// gateway is unreachable.
+func (q *OfflineQueue) SendPaymentLink(request PaymentLinkRequest) (*PaymentLinkResponse, error) {
+	var response PaymentLinkResponse
+	assignIdempotencyKey(&request.TransactionRef, &request.AutogeneratedRef)
+
+	err := q.submit(QueuedSendPaymentLink, request.TransactionRef, request, &response, func() error {
+		res, err := q.client.SendPaymentLink(request)
+		if res != nil {
+			response = *res
+		}
+		return err
+	})
+	if errors.Is(err, ErrQueuedOffline) {
+		response.ResponseDescription = ResponseQueuedOffline
+	}
+
+	return &response, err
+}
+
+// Items returns a snapshot of every item in the queue in replay order.
+func (q *OfflineQueue) Items() []QueuedItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := make([]QueuedItem, len(q.items))
+	for i, item := range q.items {
+		items[i] = *item
+	}
+
+	return items
+}
+
+// Item returns the queued item with the given id or, failing that, the
+// first item with the given idempotency key.
+func (q *OfflineQueue) Item(id string) (*QueuedItem, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, item := range q.items {
+		if item.ID == id {
+			cp := *item
+			return &cp, nil
+		}
+	}
+	for _, item := range q.items {
+		if item.IdempotencyKey == id {
+			cp := *item
+			return &cp, nil
+		}
+	}
+
+	return nil, ErrQueueItemNotFound
+}
+
+// Pending returns the number of items waiting to be replayed.
+func (q *OfflineQueue) Pending() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.pendingLocked()
+}
+
+// Remove deletes an item from the queue. Pending items are removed too, so
+// callers can discard operations they no longer want replayed.
+func (q *OfflineQueue) Remove(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, item := range q.items {
+		if item.ID == id {
+			if err := os.Remove(q.itemPath(item)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrQueueItemNotFound
+}
+
+// Replay sends pending items to the gateway in the order they were queued.
+// Replay stops at the first item that still cannot reach the gateway so
+// ordering is preserved. Items rejected by the gateway are marked failed and
+// skipped. It returns the number of items sent.
+func (q *OfflineQueue) Replay() (int, error) {
+	q.replay.Lock()
+	defer q.replay.Unlock()
+
+	sent := 0
+	for {
+		item := q.nextPending()
+		if item == nil {
+			return sent, nil
+		}
+
+		res, err := q.dispatch(item)
+
+		q.lock.Lock()
+		item.Attempts++
+		item.UpdatedAt = time.Now()
+		if err != nil {
+			item.LastError = err.Error()
+		} else {
+			item.LastError = ""
+		}
+
+		switch {
+		case netutil.IsOffline(err):
+			saveErr := q.save(item)
+			q.lock.Unlock()
+			if saveErr != nil {
+				return sent, saveErr
+			}
+			return sent, err
+		case err != nil:
+			item.Status = QueueStatusFailed
+			item.Response = res
+		default:
+			item.Status = QueueStatusSent
+			item.Response = res
+			sent++
+		}
+
+		saveErr := q.save(item)
+		q.lock.Unlock()
+		if saveErr != nil {
+			return sent, saveErr
+		}
+	}
+}
+
+// submit runs an operation directly unless the gateway is unreachable or
+// earlier operations are still waiting, in which case it is queued. If the
+// operation is already in the queue, its stored outcome is returned without
+// calling the gateway again.
+func (q *OfflineQueue) submit(op QueuedOperation, key string, request, response interface{}, call func() error) error {
+	q.lock.Lock()
+	queued := q.findLocked(op, key)
+	pending := q.pendingLocked()
+	q.lock.Unlock()
+
+	if queued != nil {
+		return queued.outcome(response)
+	}
+
+	if pending == 0 {
+		err := call()
+		if !netutil.IsOffline(err) {
+			return err
+		}
+	}
+
+	item, err := q.enqueue(op, key, request)
+	if err != nil {
+		return err
+	}
+
+	return item.outcome(response)
+}
+
+// outcome decodes a replayed item's stored response, returning the error it
+// failed with, or ErrQueuedOffline if the item is still pending.
+func (item *QueuedItem) outcome(response interface{}) error {
+	if item.Status == QueueStatusPending {
+		return ErrQueuedOffline
+	}
+
+	if len(item.Response) > 0 {
+		if err := json.Unmarshal(item.Response, response); err != nil {
+			return err
+		}
+	}
+	if item.Status == QueueStatusFailed {
+		return errors.New(item.LastError)
+	}
+
+	return nil
+}
+
+func (q *OfflineQueue) enqueue(op QueuedOperation, key string, request interface{}) (*QueuedItem, error) {
+	content, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if item := q.findLocked(op, key); item != nil {
+		return item, nil
+	}
+
+	q.sequence++
+	now := time.Now()
+	item := &QueuedItem{
+		ID:             queueItemID(op, key),
+		Sequence:       q.sequence,
+		Operation:      op,
+		IdempotencyKey: key,
+		Status:         QueueStatusPending,
+		Request:        content,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	if err := q.save(item); err != nil {
+		q.sequence--
+		return nil, err
+	}
+
+	q.items = append(q.items, item)
+	cp := *item
+
+	return &cp, nil
+}
+
+func (q *OfflineQueue) dispatch(item *QueuedItem) (json.RawMessage, error) {
+	var response interface{}
+	var err error
+
+	switch item.Operation {
+	case QueuedCapture:
+		var request CaptureRequest
+		if err := json.Unmarshal(item.Request, &request); err != nil {
+			return nil, err
+		}
+		response, err = q.client.Capture(request)
+	case QueuedVoid:
+		var request VoidRequest
+		if err := json.Unmarshal(item.Request, &request); err != nil {
+			return nil, err
+		}
+		response, err = q.client.Void(request)
+	case QueuedCloseBatch:
+		var request CloseBatchRequest
+		if err := json.Unmarshal(item.Request, &request); err != nil {
+			return nil, err
+		}
+		response, err = q.client.CloseBatch(request)
+	case QueuedUpdateCustomer:
+		var request UpdateCustomerRequest
+		if err := json.Unmarshal(item.Request, &request); err != nil {
+			return nil, err
+		}
+		response, err = q.client.UpdateCustomer(request)
+	case QueuedSendPaymentLink:
+		var request PaymentLinkRequest
+		if err := json.Unmarshal(item.Request, &request); err != nil {
+			return nil, err
+		}
+		response, err = q.client.SendPaymentLink(request)
+	default:
+		return nil, fmt.Errorf("unsupported queued operation: %s", item.Operation)
+	}
+
+	content, mErr := json.Marshal(response)
+	if mErr != nil {
+		return nil, mErr
+	}
+
+	return content, err
+}
+
+func (q *OfflineQueue) nextPending() *QueuedItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, item := range q.items {
+		if item.Status == QueueStatusPending {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// findLocked returns a copy of the item queued for an operation and
+// idempotency key, or nil if there isn't one.
+func (q *OfflineQueue) findLocked(op QueuedOperation, key string) *QueuedItem {
+	for _, item := range q.items {
+		if item.IdempotencyKey == key && item.Operation == op {
+			cp := *item
+			return &cp
+		}
+	}
+
+	return nil
+}
+
+func (q *OfflineQueue) pendingLocked() int {
+	pending := 0
+	for _, item := range q.items {
+		if item.Status == QueueStatusPending {
+			pending++
+		}
+	}
+
+	return pending
+}
+
+func (q *OfflineQueue) run() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.config.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			if q.Pending() > 0 {
+				q.Replay()
+			}
+			if err := q.prune(time.Now()); err != nil {
+				log.Printf("Failed to prune offline queue: %+v", err)
+			}
+		}
+	}
+}
+
+// prune deletes sent items older than the retention period.
+func (q *OfflineQueue) prune(now time.Time) error {
+	if q.config.Retention < 0 {
+		return nil
+	}
+	cutoff := now.Add(-q.config.Retention)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	kept := make([]*QueuedItem, 0, len(q.items))
+	for i, item := range q.items {
+		if item.Status == QueueStatusSent && item.UpdatedAt.Before(cutoff) {
+			if err := os.Remove(q.itemPath(item)); err != nil && !os.IsNotExist(err) {
+				q.items = append(kept, q.items[i:]...)
+				return err
+			}
+			continue
+		}
+		kept = append(kept, item)
+	}
+	q.items = kept
+
+	return nil
+}
+
+func queueItemID(op QueuedOperation, key string) string {
+	return string(op) + ":" + key
+}
+
+func (q *OfflineQueue) itemPath(item *QueuedItem) string {
+	return filepath.Join(q.config.Dir, fmt.Sprintf("%020d.json", item.Sequence))
+}
+
+// save atomically writes an item to disk.
+func (q *OfflineQueue) save(item *QueuedItem) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(q.itemPath(item), content, 0600)
+}
+
+func (q *OfflineQueue) load() error {
+	files, err := ioutil.ReadDir(q.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(q.config.Dir, f.Name()))
+		if err != nil {
+			return err
+		}
+
+		item := &QueuedItem{}
+		if err := json.Unmarshal(content, item); err != nil {
+			return fmt.Errorf("corrupt queue item %s: %w", f.Name(), err)
+		}
+
+		q.items = append(q.items, item)
+		if item.Sequence > q.sequence {
+			q.sequence = item.Sequence
+		}
+	}
+
+	sort.Slice(q.items, func(i, j int) bool {
+		return q.items[i].Sequence < q.items[j].Sequence
+	})
+
+	return nil
+}
+
+// assignIdempotencyKey ensures a request carries a caller-visible
+// TransactionRef the gateway can use to detect replays.
+func assignIdempotencyKey(ref *string, autogenerated *bool) {
+	if *ref == "" {
+		*ref = uuid.Must(uuid.NewV4()).String()
+	}
+	*autogenerated = false
+}
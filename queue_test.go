@@ -0,0 +1,213 @@
+package blockchyp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGateway records the paths it is sent and answers with a fixed status
+// and body.
+type fakeGateway struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	paths  []string
+	status int
+	body   string
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	g := &fakeGateway{status: http.StatusOK, body: `{"success":true,"approved":true,"transactionId":"TX1"}`}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.paths = append(g.paths, r.URL.Path)
+		w.WriteHeader(g.status)
+		w.Write([]byte(g.body))
+	}))
+	t.Cleanup(g.Close)
+
+	return g
+}
+
+func (g *fakeGateway) requests() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return append([]string(nil), g.paths...)
+}
+
+// unreachableHost returns the address of a server that has already shut
+// down, so dialing it fails.
+func unreachableHost() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	return srv.URL
+}
+
+func newQueueClient(host string) *Client {
+	client := NewClient(APICredentials{
+		APIKey:      "KEY",
+		BearerToken: "TOKEN",
+		SigningKey:  "9c6a5e8e763df1c9256e3d72bd7f53dfbd07312938131c75b3bfd254da787947",
+	})
+	client.GatewayHost = host
+
+	return &client
+}
+
+func openTestQueue(t *testing.T, client *Client, dir string) *OfflineQueue {
+	q, err := OpenOfflineQueue(client, OfflineQueueConfig{Dir: dir, ReplayInterval: -1})
+	require.NoError(t, err)
+	t.Cleanup(func() { q.Close() })
+
+	return q
+}
+
+func TestOfflineQueueReplaysInOrder(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	client := newQueueClient(unreachableHost())
+	q := openTestQueue(t, client, dir)
+
+	capture, err := q.Capture(CaptureRequest{TransactionID: "AUTH1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+	assert.Equal(ResponseQueuedOffline, capture.ResponseDescription)
+	assert.NotEmpty(capture.TransactionRef)
+
+	// Later operations queue behind pending ones even if the gateway is
+	// back, so they replay in order.
+	gateway := newFakeGateway(t)
+	client.GatewayHost = gateway.URL
+	_, err = q.Void(VoidRequest{TransactionID: "AUTH2", TransactionRef: "void-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+	assert.Empty(gateway.requests())
+
+	// Items survive a restart.
+	require.NoError(t, q.Close())
+	q = openTestQueue(t, client, dir)
+	assert.Equal(2, q.Pending())
+
+	sent, err := q.Replay()
+	require.NoError(t, err)
+	assert.Equal(2, sent)
+	assert.Equal([]string{"/api/capture", "/api/void"}, gateway.requests())
+
+	// Resubmitting a replayed operation returns its stored outcome.
+	void, err := q.Void(VoidRequest{TransactionID: "AUTH2", TransactionRef: "void-1"})
+	require.NoError(t, err)
+	assert.Equal("TX1", void.TransactionID)
+	assert.Len(gateway.requests(), 2)
+
+	item, err := q.Item(capture.TransactionRef)
+	require.NoError(t, err)
+	assert.Equal(QueueStatusSent, item.Status)
+	assert.Equal(1, item.Attempts)
+}
+
+func TestOfflineQueueRejectedItemsFail(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newQueueClient(unreachableHost())
+	q := openTestQueue(t, client, t.TempDir())
+
+	_, err := q.CloseBatch(CloseBatchRequest{TransactionRef: "close-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+
+	gateway := newFakeGateway(t)
+	gateway.status = http.StatusBadRequest
+	gateway.body = `{"success":false,"error":"batch already closed"}`
+	client.GatewayHost = gateway.URL
+
+	sent, err := q.Replay()
+	require.NoError(t, err)
+	assert.Equal(0, sent)
+	assert.Equal(0, q.Pending())
+
+	_, err = q.CloseBatch(CloseBatchRequest{TransactionRef: "close-1"})
+	assert.EqualError(err, "batch already closed")
+	assert.Len(gateway.requests(), 1)
+}
+
+func TestOfflineQueueReplayStopsWhileOffline(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newQueueClient(unreachableHost())
+	q := openTestQueue(t, client, t.TempDir())
+
+	_, err := q.Capture(CaptureRequest{TransactionRef: "capture-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+
+	sent, err := q.Replay()
+	assert.Error(err)
+	assert.Equal(0, sent)
+
+	item, err := q.Item("capture-1")
+	require.NoError(t, err)
+	assert.Equal(QueueStatusPending, item.Status)
+	assert.Equal(1, item.Attempts)
+	assert.NotEmpty(item.LastError)
+
+	require.NoError(t, q.Remove("capture:capture-1"))
+	assert.Empty(q.Items())
+	assert.ErrorIs(q.Remove("capture:capture-1"), ErrQueueItemNotFound)
+}
+
+func TestOfflineQueueKeysByOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newQueueClient(unreachableHost())
+	q := openTestQueue(t, client, t.TempDir())
+
+	_, err := q.Capture(CaptureRequest{TransactionRef: "ref-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+	_, err = q.Void(VoidRequest{TransactionRef: "ref-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+	require.Len(t, q.Items(), 2)
+
+	require.NoError(t, q.Remove("void:ref-1"))
+	items := q.Items()
+	require.Len(t, items, 1)
+	assert.Equal(QueuedCapture, items[0].Operation)
+
+	item, err := q.Item("ref-1")
+	require.NoError(t, err)
+	assert.Equal("capture:ref-1", item.ID)
+}
+
+func TestOfflineQueuePrunesSentItems(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	client := newQueueClient(unreachableHost())
+	q := openTestQueue(t, client, dir)
+
+	_, err := q.Capture(CaptureRequest{TransactionRef: "capture-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+	_, err = q.Void(VoidRequest{TransactionRef: "void-1"})
+	require.ErrorIs(t, err, ErrQueuedOffline)
+
+	client.GatewayHost = newFakeGateway(t).URL
+	_, err = q.Replay()
+	require.NoError(t, err)
+
+	// Sent items are kept for the retention period only.
+	require.NoError(t, q.prune(time.Now()))
+	assert.Len(q.Items(), 2)
+
+	require.NoError(t, q.prune(time.Now().Add(DefaultQueueRetention+time.Minute)))
+	assert.Empty(q.Items())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(files)
+}
@@ -0,0 +1,210 @@
+package blockchyp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default route refresher configuration.
+const (
+	DefaultRouteRefreshInterval = 10 * time.Minute
+	DefaultRouteIdleTimeout     = DefaultRouteCacheTTL
+	DefaultRouteEventBuffer     = 16
+)
+
+// RouteRefresherConfig contains options for the background route refresher.
+type RouteRefresherConfig struct {
+	// Interval is how often recently used routes are re-resolved. It should
+	// be shorter than the route cache TTL so routes are renewed before they
+	// expire.
+	Interval time.Duration
+
+	// IdleTimeout is how long after its last use a terminal is still
+	// considered recently used.
+	IdleTimeout time.Duration
+
+	// EventBuffer is the capacity of the route change channel. Events are
+	// dropped rather than stalling the refresher if the buffer is full.
+	EventBuffer int
+}
+
+// RouteChange describes a terminal route that changed during a background
+// refresh.
+type RouteChange struct {
+	TerminalName string
+	Previous     *TerminalRoute
+	Current      TerminalRoute
+	IPChanged    bool
+	KeyChanged   bool
+	Timestamp    time.Time
+}
+
+// RouteRefresher renews cached terminal routes in the background so payment
+// requests rarely pay for a synchronous route lookup.
+type RouteRefresher struct {
+	client *Client
+	config RouteRefresherConfig
+
+	lock     sync.Mutex
+	lastUsed map[string]time.Time
+
+	changes chan RouteChange
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// StartRouteRefresher starts a background route refresher for the client.
+// Any refresher already running on the client is stopped. The refresher
+// belongs to this *Client, not to copies of it. ExpireRouteCache doesn't
+// lock the route cache, so don't call it while a refresher is running.
+func (client *Client) StartRouteRefresher(config RouteRefresherConfig) *RouteRefresher {
+	if config.Interval <= 0 {
+		config.Interval = DefaultRouteRefreshInterval
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultRouteIdleTimeout
+	}
+	if config.EventBuffer <= 0 {
+		config.EventBuffer = DefaultRouteEventBuffer
+	}
+
+	r := &RouteRefresher{
+		client:   client,
+		config:   config,
+		lastUsed: make(map[string]time.Time),
+		changes:  make(chan RouteChange, config.EventBuffer),
+		done:     make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.run()
+
+	if previous := client.swapRefresher(r); previous != nil {
+		previous.Close()
+	}
+
+	return r
+}
+
+// refresher returns the client's running route refresher, if any.
+func (client *Client) refresher() *RouteRefresher {
+	return client.state().refresher
+}
+
+// swapRefresher replaces the client's route refresher, returning the old
+// one. The old refresher is closed by the caller once the state lock is
+// released.
+func (client *Client) swapRefresher(r *RouteRefresher) *RouteRefresher {
+	return client.updateState(func(s *clientState) {
+		s.refresher = r
+	}).refresher
+}
+
+// Changes returns a channel of route change events. The channel is closed
+// when the refresher stops.
+func (r *RouteRefresher) Changes() <-chan RouteChange {
+	return r.changes
+}
+
+// Close stops the refresher and waits for any in-flight refresh to finish.
+func (r *RouteRefresher) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+		close(r.changes)
+	})
+
+	return nil
+}
+
+// touch records that a terminal was just used.
+func (r *RouteRefresher) touch(terminalName string) {
+	// IP address routes are never cached, so there is nothing to refresh.
+	if strings.Count(terminalName, ".") == 3 {
+		return
+	}
+
+	r.lock.Lock()
+	r.lastUsed[terminalName] = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *RouteRefresher) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			for _, terminalName := range r.recentTerminals() {
+				select {
+				case <-r.done:
+					return
+				default:
+				}
+				r.refresh(terminalName)
+			}
+		}
+	}
+}
+
+// recentTerminals returns terminals used within the idle timeout and forgets
+// the rest.
+func (r *RouteRefresher) recentTerminals() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cutoff := time.Now().Add(-r.config.IdleTimeout)
+
+	terminals := make([]string, 0, len(r.lastUsed))
+	for name, used := range r.lastUsed {
+		if used.Before(cutoff) {
+			delete(r.lastUsed, name)
+			continue
+		}
+		terminals = append(terminals, name)
+	}
+
+	return terminals
+}
+
+func (r *RouteRefresher) refresh(terminalName string) {
+	previous := r.client.routeCacheGet(terminalName, true)
+
+	route, err := r.client.requestRouteFromGateway(terminalName)
+	if err != nil {
+		// Leave the cached route alone; the next payment call will fall back
+		// to the usual synchronous lookup.
+		return
+	}
+
+	r.client.routeCachePut(*route)
+
+	if previous == nil {
+		return
+	}
+
+	change := RouteChange{
+		TerminalName: terminalName,
+		Previous:     previous,
+		Current:      *route,
+		IPChanged:    previous.IPAddress != route.IPAddress,
+		KeyChanged:   !previous.sameKey(*route),
+		Timestamp:    time.Now(),
+	}
+
+	if !change.IPChanged && !change.KeyChanged {
+		return
+	}
+
+	select {
+	case r.changes <- change:
+	default:
+	}
+}
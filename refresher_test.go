@@ -0,0 +1,159 @@
+package blockchyp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachedClient(t *testing.T, apiKey string) *Client {
+	client := NewClient(APICredentials{APIKey: apiKey})
+	client.RouteCache = filepath.Join(t.TempDir(), "routes")
+
+	return &client
+}
+
+func TestRouteCacheScopedToCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newCachedClient(t, "KEY-A")
+	b := newCachedClient(t, "KEY-B")
+	a.routeCachePut(TerminalRoute{TerminalName: "Front", IPAddress: "10.0.0.5", Exists: true})
+
+	route := a.routeCacheGet("Front", false)
+	require.NotNil(t, route)
+	assert.Equal("10.0.0.5", route.IPAddress)
+
+	assert.Nil(b.routeCacheGet("Front", false))
+}
+
+func TestRouteRefresherConcurrentUse(t *testing.T) {
+	client := newCachedClient(t, "KEY-RACE")
+	client.routeCachePut(TerminalRoute{TerminalName: "Front", IPAddress: "10.0.0.6", Exists: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := client.resolveTerminalRoute("Front")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		client.StartRouteRefresher(RouteRefresherConfig{Interval: time.Hour})
+	}
+	wg.Wait()
+
+	r := client.refresher()
+	require.NotNil(t, r)
+	require.NoError(t, client.Close())
+	assert.Nil(t, client.refresher())
+
+	// The last refresher was closed with the client.
+	_, open := <-r.Changes()
+	assert.False(t, open)
+}
+
+// routeGateway serves every terminal route at ip and returns a client that
+// resolves routes through it.
+func routeGateway(t *testing.T, apiKey, ip string) *Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TerminalRouteResponse{
+			TerminalRoute: TerminalRoute{
+				TerminalName: r.URL.Query().Get("terminal"),
+				IPAddress:    ip,
+			},
+			Success: true,
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newCachedClient(t, apiKey)
+	client.GatewayHost = srv.URL
+
+	return client
+}
+
+func newTestRefresher(client *Client, buffer int) *RouteRefresher {
+	return &RouteRefresher{
+		client:   client,
+		lastUsed: make(map[string]time.Time),
+		changes:  make(chan RouteChange, buffer),
+		done:     make(chan struct{}),
+	}
+}
+
+func TestRouteRefresherReportsIPChange(t *testing.T) {
+	assert := assert.New(t)
+
+	ip := "10.0.0.7"
+	client := routeGateway(t, "KEY-CHANGE", ip)
+	client.routeCachePut(TerminalRoute{TerminalName: "Front", IPAddress: "10.0.0.6", Exists: true})
+
+	r := newTestRefresher(client, 1)
+	r.refresh("Front")
+
+	select {
+	case change := <-r.Changes():
+		assert.Equal("Front", change.TerminalName)
+		assert.True(change.IPChanged)
+		assert.False(change.KeyChanged)
+		assert.Equal("10.0.0.6", change.Previous.IPAddress)
+		assert.Equal("10.0.0.7", change.Current.IPAddress)
+	default:
+		t.Fatal("no route change reported")
+	}
+
+	route := client.routeCacheGet("Front", false)
+	require.NotNil(t, route)
+	assert.Equal("10.0.0.7", route.IPAddress)
+}
+
+func TestRouteRefresherQuietWhenUnchanged(t *testing.T) {
+	ip := "10.0.0.8"
+	client := routeGateway(t, "KEY-SAME", ip)
+	client.routeCachePut(TerminalRoute{TerminalName: "Front", IPAddress: ip, Exists: true})
+
+	r := newTestRefresher(client, 1)
+	r.refresh("Front")
+
+	assert.Empty(t, r.changes)
+}
+
+func TestRouteRefresherFullChannelDoesNotBlock(t *testing.T) {
+	ip := "10.0.0.9"
+	client := routeGateway(t, "KEY-FULL", ip)
+	client.routeCachePut(TerminalRoute{TerminalName: "Front", IPAddress: "10.0.0.1", Exists: true})
+	client.routeCachePut(TerminalRoute{TerminalName: "Back", IPAddress: "10.0.0.2", Exists: true})
+
+	r := newTestRefresher(client, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.refresh("Front")
+		r.refresh("Back")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh blocked on a full change channel")
+	}
+
+	// The second change was dropped, but its route was still cached.
+	require.Len(t, r.changes, 1)
+	assert.Equal(t, "Front", (<-r.changes).TerminalName)
+	assert.Equal(t, ip, client.routeCacheGet("Back", false).IPAddress)
+}
@@ -0,0 +1,401 @@
+package blockchyp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SignatureFormatSVG requests a vector signature. Terminals only return
+// raster images, so SVG signatures are traced locally from a PNG.
+const SignatureFormatSVG = "svg"
+
+// Signature is a customer signature captured by a terminal.
+type Signature struct {
+	Format SignatureFormat
+	Data   []byte
+
+	// TransactionID and TransactionRef identify the transaction the
+	// signature belongs to, when there is one.
+	TransactionID  string
+	TransactionRef string
+}
+
+// SignatureSink receives customer signatures as they arrive in responses.
+type SignatureSink interface {
+	WriteSignature(sig Signature) error
+}
+
+// SignatureSinkFunc adapts a function to a SignatureSink.
+type SignatureSinkFunc func(sig Signature) error
+
+// WriteSignature calls f.
+func (f SignatureSinkFunc) WriteSignature(sig Signature) error {
+	return f(sig)
+}
+
+// WriterSignatureSink writes raw signature images to an io.Writer.
+type WriterSignatureSink struct {
+	W io.Writer
+}
+
+// WriteSignature writes the image data to the writer.
+func (s WriterSignatureSink) WriteSignature(sig Signature) error {
+	_, err := s.W.Write(sig.Data)
+	return err
+}
+
+// MemorySignatureSink keeps signatures in memory.
+type MemorySignatureSink struct {
+	lock       sync.Mutex
+	signatures []Signature
+}
+
+// WriteSignature stores the signature.
+func (s *MemorySignatureSink) WriteSignature(sig Signature) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.signatures = append(s.signatures, sig)
+
+	return nil
+}
+
+// Signatures returns every stored signature, oldest first.
+func (s *MemorySignatureSink) Signatures() []Signature {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Signature(nil), s.signatures...)
+}
+
+// Last returns the most recent signature.
+func (s *MemorySignatureSink) Last() (Signature, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.signatures) == 0 {
+		return Signature{}, false
+	}
+
+	return s.signatures[len(s.signatures)-1], true
+}
+
+// DocumentStore is a place signatures can be filed, such as a document
+// management system or object store.
+type DocumentStore interface {
+	Put(name, contentType string, data []byte) error
+}
+
+// DocumentStoreSignatureSink files signatures in a DocumentStore.
+type DocumentStoreSignatureSink struct {
+	Store DocumentStore
+
+	// Name picks the document name. Defaults to the transaction ID, or
+	// reference, plus the format's extension.
+	Name func(sig Signature) string
+}
+
+// WriteSignature files the signature.
+func (s DocumentStoreSignatureSink) WriteSignature(sig Signature) error {
+	var name string
+	if s.Name != nil {
+		name = s.Name(sig)
+	} else {
+		name = firstNonEmpty(sig.TransactionID, sig.TransactionRef, "signature") + "." + string(sig.Format)
+	}
+
+	return s.Store.Put(name, signatureContentType(sig.Format), sig.Data)
+}
+
+// ConvertingSignatureSink converts signatures to another format, and
+// optionally width, before passing them on.
+type ConvertingSignatureSink struct {
+	Sink   SignatureSink
+	Format SignatureFormat
+	Width  int
+}
+
+// WriteSignature converts the signature and writes it to the wrapped sink.
+func (s ConvertingSignatureSink) WriteSignature(sig Signature) error {
+	converted, err := sig.Convert(s.Format, s.Width)
+	if err != nil {
+		return err
+	}
+
+	return s.Sink.WriteSignature(converted)
+}
+
+// Convert returns the signature in another format. A width greater than
+// zero scales the image down to that width, preserving the aspect ratio;
+// images are never scaled up.
+func (sig Signature) Convert(format SignatureFormat, width int) (Signature, error) {
+	format = normalizeSignatureFormat(format)
+	if format == SignatureFormatNone {
+		format = sig.Format
+	}
+	if format == sig.Format && width <= 0 {
+		return sig, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(sig.Data))
+	if err != nil {
+		return sig, fmt.Errorf("decoding signature: %w", err)
+	}
+
+	if width > 0 && img.Bounds().Dx() > width {
+		img = scaleImage(img, width)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case SignatureFormatPNG:
+		err = png.Encode(&buf, img)
+	case SignatureFormatJPG:
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: 90})
+	case SignatureFormatGIF:
+		err = gif.Encode(&buf, img, nil)
+	case SignatureFormatSVG:
+		err = traceSVG(&buf, img)
+	default:
+		err = fmt.Errorf("invalid signature format: %s", format)
+	}
+	if err != nil {
+		return sig, err
+	}
+
+	sig.Format = format
+	sig.Data = buf.Bytes()
+
+	return sig, nil
+}
+
+// SetSignatureSink sends every customer signature returned to the client
+// to sink. A nil sink stops delivery. The sink belongs to this *Client, not
+// to copies of it, and is forgotten when the client is closed.
+//
+// Terminals only return raster images; wrap the sink in a
+// ConvertingSignatureSink for SVG or another format.
+func (client *Client) SetSignatureSink(sink SignatureSink) {
+	client.updateState(func(s *clientState) {
+		s.signatureSink = sink
+	})
+}
+
+// deliverSignature scales any signature in a response down to the
+// requested width and passes it to the client's signature sink. It runs
+// before the generated client methods write signatures to files, so files
+// get the scaled image too.
+func (client *Client) deliverSignature(request, response interface{}) error {
+	if !isStruct(request) || !isStruct(response) {
+		return nil
+	}
+
+	requestOpts, ok := (SignatureRequest{}).From(request)
+	if !ok {
+		return nil
+	}
+
+	responseOpts, ok := (SignatureResponse{}).From(response)
+	if !ok || responseOpts.SigFile == "" {
+		return nil
+	}
+
+	sink := client.state().signatureSink
+	if sink == nil && requestOpts.SigWidth <= 0 {
+		return nil
+	}
+
+	content, err := hex.DecodeString(responseOpts.SigFile)
+	if err != nil {
+		return err
+	}
+
+	var ids struct {
+		TransactionID  string
+		TransactionRef string
+	}
+	copyTo(response, &ids)
+
+	sig := Signature{
+		Format:         detectSignatureFormat(content, requestOpts.SigFormat),
+		Data:           content,
+		TransactionID:  ids.TransactionID,
+		TransactionRef: ids.TransactionRef,
+	}
+
+	// Terminals normally scale signatures themselves, but not always, so
+	// make sure the requested width is honored.
+	if requestOpts.SigWidth > 0 {
+		config, _, err := image.DecodeConfig(bytes.NewReader(content))
+		if err == nil && config.Width > requestOpts.SigWidth {
+			sig, err = sig.Convert(sig.Format, requestOpts.SigWidth)
+			if err != nil {
+				return err
+			}
+			setSigFile(response, hex.EncodeToString(sig.Data))
+		}
+	}
+
+	if sink != nil {
+		return sink.WriteSignature(sig)
+	}
+
+	return nil
+}
+
+// setSigFile replaces the hex encoded signature in a response.
+func setSigFile(response interface{}, sigFile string) {
+	v := reflect.ValueOf(response)
+	if v.Kind() != reflect.Ptr {
+		return
+	}
+
+	if f := v.Elem().FieldByName("SigFile"); f.CanSet() && f.Kind() == reflect.String {
+		f.SetString(sigFile)
+	}
+}
+
+func normalizeSignatureFormat(format SignatureFormat) SignatureFormat {
+	format = SignatureFormat(strings.ToLower(string(format)))
+	if format == "jpeg" {
+		return SignatureFormatJPG
+	}
+
+	return format
+}
+
+func detectSignatureFormat(content []byte, requested SignatureFormat) SignatureFormat {
+	switch {
+	case bytes.HasPrefix(content, []byte("\x89PNG")):
+		return SignatureFormatPNG
+	case bytes.HasPrefix(content, []byte("GIF8")):
+		return SignatureFormatGIF
+	case bytes.HasPrefix(content, []byte("\xff\xd8")):
+		return SignatureFormatJPG
+	}
+
+	return normalizeSignatureFormat(requested)
+}
+
+func signatureContentType(format SignatureFormat) string {
+	switch format {
+	case SignatureFormatPNG:
+		return "image/png"
+	case SignatureFormatJPG:
+		return "image/jpeg"
+	case SignatureFormatGIF:
+		return "image/gif"
+	case SignatureFormatSVG:
+		return "image/svg+xml"
+	}
+
+	return "application/octet-stream"
+}
+
+// scaleImage shrinks an image to the given width with a box filter, which
+// keeps thin signature strokes visible.
+func scaleImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+// flatten draws an image over white, since JPEG has no transparency.
+func flatten(src image.Image) image.Image {
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+
+	return dst
+}
+
+// traceSVG writes an SVG with one path covering the image's ink. Each run
+// of dark pixels on a row becomes a rectangle, so the result scales cleanly
+// without needing the original pen strokes.
+func traceSVG(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+
+	var path strings.Builder
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		start := -1
+		for x := b.Min.X; x <= b.Max.X; x++ {
+			ink := x < b.Max.X && isInk(img.At(x, y))
+			switch {
+			case ink && start < 0:
+				start = x
+			case !ink && start >= 0:
+				fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start-b.Min.X, y-b.Min.Y, x-start, x-start)
+				start = -1
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges"><path fill="#000" d="%s"/></svg>`,
+		b.Dx(), b.Dy(), b.Dx(), b.Dy(), path.String())
+
+	return err
+}
+
+// isInk reports whether a pixel is part of the signature rather than the
+// background.
+func isInk(c color.Color) bool {
+	r, g, b, a := c.RGBA()
+	if a < 0x8000 {
+		return false
+	}
+
+	// Luma on a 16 bit scale, un-premultiplied against a white background.
+	luma := (299*r + 587*g + 114*b) / 1000
+	luma += 0xffff - a
+
+	return luma < 0x8000
+}
@@ -0,0 +1,155 @@
+package blockchyp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSignature is a white 100x40 PNG with a black stroke across the middle.
+func testSignature(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 100; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	for x := 10; x < 90; x++ {
+		img.Set(x, 20, color.Black)
+		img.Set(x, 21, color.Black)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	return buf.Bytes()
+}
+
+type fakeDocumentStore map[string]string
+
+func (s fakeDocumentStore) Put(name, contentType string, data []byte) error {
+	s[name] = contentType
+
+	return nil
+}
+
+func TestSignatureConvert(t *testing.T) {
+	assert := assert.New(t)
+	sig := Signature{Format: SignatureFormatPNG, Data: testSignature(t)}
+
+	same, err := sig.Convert("", 0)
+	require.NoError(t, err)
+	assert.Equal(sig, same)
+
+	jpg, err := sig.Convert("JPEG", 50)
+	require.NoError(t, err)
+	assert.Equal(SignatureFormat(SignatureFormatJPG), jpg.Format)
+	img, format, err := image.Decode(bytes.NewReader(jpg.Data))
+	require.NoError(t, err)
+	assert.Equal("jpeg", format)
+	assert.Equal(50, img.Bounds().Dx())
+	assert.Equal(20, img.Bounds().Dy())
+
+	// Signatures are never scaled up.
+	gif, err := sig.Convert(SignatureFormatGIF, 500)
+	require.NoError(t, err)
+	img, _, err = image.Decode(bytes.NewReader(gif.Data))
+	require.NoError(t, err)
+	assert.Equal(100, img.Bounds().Dx())
+
+	svg, err := sig.Convert(SignatureFormatSVG, 0)
+	require.NoError(t, err)
+	assert.Contains(string(svg.Data), `viewBox="0 0 100 40"`)
+	assert.Contains(string(svg.Data), "M10 20h80v1h-80z")
+
+	_, err = sig.Convert("bmp", 0)
+	assert.Error(err)
+
+	_, err = Signature{Format: SignatureFormatPNG, Data: []byte("junk")}.Convert(SignatureFormatGIF, 0)
+	assert.Error(err)
+}
+
+func TestDeliverSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &MemorySignatureSink{}
+	client := NewClient(APICredentials{})
+	client.SetSignatureSink(sink)
+	defer client.Close()
+
+	path := filepath.Join(t.TempDir(), "sig.png")
+	request := AuthorizationRequest{SigFile: path, SigWidth: 50}
+	response := AuthorizationResponse{
+		TransactionID: "TX1",
+		SigFile:       hex.EncodeToString(testSignature(t)),
+	}
+
+	// The generated client methods write the file once the request returns.
+	client.afterRequest("/api/charge", TerminalAuthorizationRequest{Request: request}, &response, nil)
+	require.NoError(t, handleSignature(request, &response))
+	assert.Empty(response.SigFile)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	img, _, err := image.Decode(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(50, img.Bounds().Dx())
+
+	sig, ok := sink.Last()
+	require.True(t, ok)
+	assert.Equal(SignatureFormat(SignatureFormatPNG), sig.Format)
+	assert.Equal("TX1", sig.TransactionID)
+	assert.Equal(content, sig.Data)
+}
+
+func TestDeliverSignatureWithoutSink(t *testing.T) {
+	client := NewClient(APICredentials{})
+	response := AuthorizationResponse{SigFile: "zz"}
+
+	require.NoError(t, client.deliverSignature(AuthorizationRequest{}, &response))
+	assert.Equal(t, "zz", response.SigFile)
+
+	// Signatures already narrow enough are passed through untouched.
+	original := hex.EncodeToString(testSignature(t))
+	response.SigFile = original
+	require.NoError(t, client.deliverSignature(AuthorizationRequest{SigWidth: 200}, &response))
+	assert.Equal(t, original, response.SigFile)
+}
+
+func TestSignatureSinks(t *testing.T) {
+	assert := assert.New(t)
+	sig := Signature{Format: SignatureFormatPNG, Data: testSignature(t), TransactionRef: "REF1"}
+
+	store := fakeDocumentStore{}
+	sink := ConvertingSignatureSink{
+		Sink:   DocumentStoreSignatureSink{Store: store},
+		Format: SignatureFormatSVG,
+	}
+	require.NoError(t, sink.WriteSignature(sig))
+	assert.Equal(fakeDocumentStore{"REF1.svg": "image/svg+xml"}, store)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriterSignatureSink{W: &buf}.WriteSignature(sig))
+	assert.Equal(sig.Data, buf.Bytes())
+
+	var calls int
+	require.NoError(t, SignatureSinkFunc(func(Signature) error { calls++; return nil }).WriteSignature(sig))
+	assert.Equal(1, calls)
+}
+
+func TestDetectSignatureFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(SignatureFormat(SignatureFormatPNG), detectSignatureFormat([]byte("\x89PNG...."), SignatureFormatJPG))
+	assert.Equal(SignatureFormat(SignatureFormatGIF), detectSignatureFormat([]byte("GIF89a"), ""))
+	assert.Equal(SignatureFormat(SignatureFormatJPG), detectSignatureFormat([]byte("\xff\xd8\xff"), ""))
+	assert.Equal(SignatureFormat(SignatureFormatJPG), detectSignatureFormat(nil, "JPEG"))
+}
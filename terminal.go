@@ -3,23 +3,31 @@ package blockchyp
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	routeCache map[string]routeCacheEntry
+	routeCache     map[string]routeCacheEntry
+	routeCacheLock sync.RWMutex
 )
 
 const (
@@ -37,6 +45,28 @@ var ErrUnknownTerminal = errors.New("unknown terminal")
 // ErrNoChange is returned when a route refresh does not produce a new route.
 var ErrNoChange = errors.New("route unchanged")
 
+// ErrTerminalKeyMismatch is returned when a terminal presents a TLS key that
+// does not match the public key registered on its route.
+var ErrTerminalKeyMismatch = errors.New("terminal key mismatch")
+
+// TerminalKeyMismatchError describes a terminal that presented a certificate
+// whose key does not match the key on its route. It matches
+// ErrTerminalKeyMismatch with errors.Is.
+type TerminalKeyMismatchError struct {
+	TerminalName string
+	IPAddress    string
+	Reason       string
+}
+
+func (e *TerminalKeyMismatchError) Error() string {
+	return fmt.Sprintf("%s: terminal %q at %s: %s", ErrTerminalKeyMismatch, e.TerminalName, e.IPAddress, e.Reason)
+}
+
+// Is reports whether target is ErrTerminalKeyMismatch.
+func (e *TerminalKeyMismatchError) Is(target error) bool {
+	return target == ErrTerminalKeyMismatch
+}
+
 /*
 TerminalRoute models route information for a payment terminal.
 */
@@ -77,7 +107,7 @@ func (client *Client) readFromOfflineCache(terminalName string) *routeCacheEntry
 		return nil
 	}
 
-	route, ok := cache.Routes[client.Credentials.APIKey+terminalName]
+	route, ok := cache.Routes[client.routeCacheKey(terminalName)]
 	if ok {
 		return &route
 	}
@@ -117,6 +147,10 @@ transient credentials mapped to the given API credentials.
 */
 func (client *Client) resolveTerminalRoute(terminalName string) (TerminalRoute, error) {
 
+	if r := client.refresher(); r != nil {
+		r.touch(terminalName)
+	}
+
 	route := client.routeCacheGet(terminalName, false)
 	if route == nil {
 		var err error
@@ -167,8 +201,14 @@ func (client *Client) requestRouteFromGateway(terminalName string) (*TerminalRou
 	return nil, ErrUnknownTerminal
 }
 
+// routeCacheKey scopes a cached route to the client's credentials.
+func (client *Client) routeCacheKey(terminalName string) string {
+	return client.Credentials.APIKey + terminalName
+}
+
 func (client *Client) routeCachePut(terminalRoute TerminalRoute) {
 
+	routeCacheLock.Lock()
 	if routeCache == nil {
 		routeCache = make(map[string]routeCacheEntry)
 	}
@@ -178,7 +218,8 @@ func (client *Client) routeCachePut(terminalRoute TerminalRoute) {
 		TTL:   time.Now().Add(client.routeCacheTTL),
 	}
 
-	routeCache[client.Credentials.APIKey+terminalRoute.TerminalName] = cacheEntry
+	routeCache[client.routeCacheKey(terminalRoute.TerminalName)] = cacheEntry
+	routeCacheLock.Unlock()
 
 	go client.updateOfflineCache(&cacheEntry)
 
@@ -233,7 +274,7 @@ func (client *Client) updateOfflineCache(cacheEntry *routeCacheEntry) {
 	cacheEntry.Route.TransientCredentials.BearerToken = client.encrypt(cacheEntry.Route.TransientCredentials.BearerToken)
 	cacheEntry.Route.TransientCredentials.SigningKey = client.encrypt(cacheEntry.Route.TransientCredentials.SigningKey)
 
-	cache.Routes[client.Credentials.APIKey+cacheEntry.Route.TerminalName] = *cacheEntry
+	cache.Routes[client.routeCacheKey(cacheEntry.Route.TerminalName)] = *cacheEntry
 
 	content, err := json.Marshal(cache)
 
@@ -252,14 +293,15 @@ func (client *Client) updateOfflineCache(cacheEntry *routeCacheEntry) {
 
 func (client *Client) routeCacheGet(terminalName string, stale bool) *TerminalRoute {
 
-	if routeCache != nil {
-		route, ok := routeCache[terminalName]
-		if ok {
-			if time.Now().After(route.TTL) {
-				return nil
-			}
-			return &route.Route
+	routeCacheLock.RLock()
+	route, ok := routeCache[client.routeCacheKey(terminalName)]
+	routeCacheLock.RUnlock()
+
+	if ok {
+		if !stale && time.Now().After(route.TTL) {
+			return nil
 		}
+		return &route.Route
 	}
 
 	cacheEntry := client.readFromOfflineCache(terminalName)
@@ -306,6 +348,15 @@ func (client *Client) terminalPost(route TerminalRoute, path string, requestEnti
 
 // terminalRequest sends an HTTP request to a terminal.
 func (client *Client) terminalRequest(route TerminalRoute, path, method string, requestEntity, responseEntity, requestTimeout interface{}) error {
+	err := client.sendTerminalRequest(route, path, method, requestEntity, responseEntity, requestTimeout)
+	client.afterRequest(path, requestEntity, responseEntity, err)
+
+	return err
+}
+
+// sendTerminalRequest sends a request to a terminal, retrying once if the
+// terminal's route has changed.
+func (client *Client) sendTerminalRequest(route TerminalRoute, path, method string, requestEntity, responseEntity, requestTimeout interface{}) error {
 	content, err := json.Marshal(requestEntity)
 	if err != nil {
 		return err
@@ -336,14 +387,24 @@ func (client *Client) terminalRequest(route TerminalRoute, path, method string,
 		fmt.Fprintln(os.Stderr, string(b))
 	}
 
-	res, err := client.terminalHTTPClient.Do(req)
-	if err != nil {
+	res, err := terminalHTTPClients.get(client.routeCacheKey(route.TerminalName), route).Do(req)
+	if errors.Is(err, ErrTerminalKeyMismatch) {
+		// The terminal may have been re-keyed since the route was cached.
+		// Only retry if the gateway now reports a different key.
+		rRoute, rErr := client.requestRouteFromGateway(route.TerminalName)
+		if rErr == nil && !rRoute.sameKey(route) {
+			client.routeCachePut(*rRoute)
+			return client.sendTerminalRequest(*rRoute, path, method, requestEntity, responseEntity, requestTimeout)
+		}
+
+		return err
+	} else if err != nil {
 		// Try to resolve the route again.
 		// If the route has changed, retry the request.
 		rRoute, rErr := client.refreshRoute(route)
 		if rErr == nil {
 			client.routeCachePut(*rRoute)
-			return client.terminalRequest(*rRoute, path, method, requestEntity, responseEntity, requestTimeout)
+			return client.sendTerminalRequest(*rRoute, path, method, requestEntity, responseEntity, requestTimeout)
 		}
 
 		return err
@@ -369,6 +430,199 @@ func (client *Client) refreshRoute(route TerminalRoute) (*TerminalRoute, error)
 	return nil, ErrNoChange
 }
 
+// sameKey reports whether two routes carry the same terminal public key.
+func (route TerminalRoute) sameKey(other TerminalRoute) bool {
+	return route.PublicKey == other.PublicKey && route.RawKey == other.RawKey
+}
+
+// pinnedKey returns the terminal public key carried by the route, or nil if
+// the route has no key to pin against.
+func (route TerminalRoute) pinnedKey() (*ecdsa.PublicKey, error) {
+	if route.RawKey.X != "" && route.RawKey.Y != "" {
+		return route.RawKey.publicKey()
+	}
+
+	if route.PublicKey == "" {
+		return nil, nil
+	}
+
+	der := []byte(route.PublicKey)
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	} else if b, err := hex.DecodeString(route.PublicKey); err == nil {
+		der = b
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported terminal key type %T", key)
+	}
+
+	return ecKey, nil
+}
+
+// publicKey converts the hex encoded curve point into an ECDSA public key.
+func (raw RawPublicKey) publicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch strings.ToUpper(strings.ReplaceAll(raw.Curve, "-", "")) {
+	case "P256", "SECP256R1", "PRIME256V1", "":
+		curve = elliptic.P256()
+	case "P384", "SECP384R1":
+		curve = elliptic.P384()
+	case "P521", "SECP521R1":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported terminal key curve: %s", raw.Curve)
+	}
+
+	x, ok := new(big.Int).SetString(raw.X, 16)
+	if !ok {
+		return nil, fmt.Errorf("malformed terminal key x coordinate")
+	}
+	y, ok := new(big.Int).SetString(raw.Y, 16)
+	if !ok {
+		return nil, fmt.Errorf("malformed terminal key y coordinate")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// verifyTerminalKey checks that the leaf certificate presented by a terminal
+// carries the key registered on the route. Routes without a key, such as
+// routes built from raw IP addresses, are not pinned.
+func verifyTerminalKey(route TerminalRoute, state tls.ConnectionState) error {
+	expected, err := route.pinnedKey()
+	if err != nil {
+		return &TerminalKeyMismatchError{
+			TerminalName: route.TerminalName,
+			IPAddress:    route.IPAddress,
+			Reason:       "invalid route key: " + err.Error(),
+		}
+	}
+
+	if expected == nil {
+		return nil
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return &TerminalKeyMismatchError{
+			TerminalName: route.TerminalName,
+			IPAddress:    route.IPAddress,
+			Reason:       "no certificate presented",
+		}
+	}
+
+	presented, ok := state.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || !expected.Equal(presented) {
+		return &TerminalKeyMismatchError{
+			TerminalName: route.TerminalName,
+			IPAddress:    route.IPAddress,
+			Reason:       "presented key does not match route",
+		}
+	}
+
+	return nil
+}
+
+// terminalHTTPClients is shared by every Client, like the route cache, and
+// keyed the same way. It takes the place of the client's single terminal
+// HTTP client.
+var terminalHTTPClients = newTerminalClients()
+
+// terminalClients holds an HTTP client for each terminal. Connections are
+// pinned to the key on the route they were opened for, and http.Transport
+// pools connections by address alone, so a shared transport could hand a
+// connection verified for one terminal to a request for another terminal
+// at the same address. Each terminal gets its own transport instead, which
+// is replaced when its address or key changes.
+type terminalClients struct {
+	lock    sync.Mutex
+	clients map[string]*terminalClient
+}
+
+type terminalClient struct {
+	route     TerminalRoute
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newTerminalClients() *terminalClients {
+	return &terminalClients{
+		clients: make(map[string]*terminalClient),
+	}
+}
+
+// get returns the HTTP client for a route, cached under key.
+func (t *terminalClients) get(key string, route TerminalRoute) *http.Client {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if c, ok := t.clients[key]; ok {
+		if c.route.IPAddress == route.IPAddress && c.route.sameKey(route) {
+			return c.client
+		}
+		c.transport.CloseIdleConnections()
+	}
+
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).Dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTerminalTLS(ctx, network, addr, route)
+		},
+	}
+	c := &terminalClient{
+		route:     route,
+		transport: transport,
+		client: &http.Client{
+			Transport: AddUserAgent(transport, BuildUserAgent()),
+		},
+	}
+	t.clients[key] = c
+
+	return c.client
+}
+
+// dialTerminalTLS opens a TLS connection to a terminal, verifying the chain
+// against the terminal root CA and the leaf key against the route.
+func dialTerminalTLS(ctx context.Context, network, addr string, route TerminalRoute) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:    terminalRoots,
+		ServerName: terminalCN,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyTerminalKey(route, state)
+		},
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+var terminalRoots = terminalCertPool()
+
 func terminalCertPool() *x509.CertPool {
 	pool := x509.NewCertPool()
 
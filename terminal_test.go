@@ -0,0 +1,119 @@
+package blockchyp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTerminal starts a TLS server posing as a terminal, with a leaf
+// certificate issued by a throwaway root that replaces the terminal root CA
+// for the length of the test.
+func testTerminal(t *testing.T) (*httptest.Server, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Terminal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: terminalCN},
+		DNSNames:     []string{terminalCN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	roots := terminalRoots
+	terminalRoots = x509.NewCertPool()
+	terminalRoots.AddCert(ca)
+	t.Cleanup(func() { terminalRoots = roots })
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"success":true}`)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, leafKey
+}
+
+func pemKey(t *testing.T, key *ecdsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestTerminalKeyPinning(t *testing.T) {
+	srv, key := testTerminal(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	clients := newTerminalClients()
+
+	res, err := clients.get("Front", TerminalRoute{TerminalName: "Front", PublicKey: pemKey(t, &key.PublicKey)}).Get(srv.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	// A second terminal at the same address with a different key must not
+	// be handed the connection that was verified for the first.
+	_, err = clients.get("Back", TerminalRoute{TerminalName: "Back", PublicKey: pemKey(t, &other.PublicKey)}).Get(srv.URL)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrTerminalKeyMismatch))
+}
+
+func TestTerminalClientReplacedOnKeyChange(t *testing.T) {
+	srv, key := testTerminal(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	clients := newTerminalClients()
+	good := TerminalRoute{TerminalName: "Front", PublicKey: pemKey(t, &key.PublicKey)}
+
+	first := clients.get("Front", good)
+	res, err := first.Get(srv.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Same(t, first, clients.get("Front", good))
+
+	rekeyed := good
+	rekeyed.PublicKey = pemKey(t, &other.PublicKey)
+	_, err = clients.get("Front", rekeyed).Get(srv.URL)
+	assert.True(t, errors.Is(err, ErrTerminalKeyMismatch))
+
+	assert.NotSame(t, first, clients.get("Front", good))
+}